@@ -0,0 +1,417 @@
+package certdepot
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cdr/grip"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+	"github.com/square/certstrap/pkix"
+)
+
+// DefaultPendingRequestExpiration is how long a submitted certificate request
+// waits for approval if SubmitOptions does not set an expiration.
+const DefaultPendingRequestExpiration = 7 * 24 * time.Hour
+
+// PendingRequestStatus is the state of a certificate request submitted for
+// approval.
+type PendingRequestStatus string
+
+const (
+	// PendingRequestPending is the status of a request that is waiting for
+	// approval.
+	PendingRequestPending PendingRequestStatus = "pending"
+	// PendingRequestApproved is the status of a request that was approved
+	// and signed.
+	PendingRequestApproved PendingRequestStatus = "approved"
+	// PendingRequestDenied is the status of a request that was denied.
+	PendingRequestDenied PendingRequestStatus = "denied"
+	// PendingRequestExpired is the status of a request that was neither
+	// approved nor denied before it expired.
+	PendingRequestExpired PendingRequestStatus = "expired"
+)
+
+// Validate checks that the status is one of the known statuses.
+func (s PendingRequestStatus) Validate() error {
+	switch s {
+	case PendingRequestPending, PendingRequestApproved, PendingRequestDenied, PendingRequestExpired:
+		return nil
+	default:
+		return errors.Errorf("unrecognized pending request status '%s'", s)
+	}
+}
+
+// Requester describes who submitted a certificate request for approval.
+type Requester struct {
+	// Name identifies the requester, such as a user or service name.
+	Name string `bson:"name,omitempty" json:"name,omitempty" yaml:"name,omitempty"`
+	// Email is the email address of the requester.
+	Email string `bson:"email,omitempty" json:"email,omitempty" yaml:"email,omitempty"`
+	// Address is the network address that the request was submitted from.
+	Address string `bson:"address,omitempty" json:"address,omitempty" yaml:"address,omitempty"`
+	// Metadata holds any other information about the request, such as a
+	// ticket number or justification.
+	Metadata map[string]string `bson:"metadata,omitempty" json:"metadata,omitempty" yaml:"metadata,omitempty"`
+}
+
+// PendingRequest is a certificate request that was submitted to a CA for
+// approval, along with the options that it is signed with once approved.
+type PendingRequest struct {
+	ID string `bson:"_id" json:"id" yaml:"id"`
+	// CertificateRequest is the PEM-encoded certificate request.
+	CertificateRequest string `bson:"csr" json:"csr" yaml:"csr"`
+	// Options are the options that the request is signed with. CA is the
+	// name of the CA that the request was submitted to and Host is the name
+	// that the certificate is stored under. Passphrases are never stored.
+	Options   CertificateOptions   `bson:"options" json:"options" yaml:"options"`
+	Requester Requester            `bson:"requester" json:"requester" yaml:"requester"`
+	Status    PendingRequestStatus `bson:"status" json:"status" yaml:"status"`
+	// SubmittedAt is when the request was submitted.
+	SubmittedAt time.Time `bson:"submitted_at" json:"submitted_at" yaml:"submitted_at"`
+	// ExpiresAt is when the request expires if it is still pending.
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at" yaml:"expires_at"`
+	// DecidedAt is when the request was approved or denied.
+	DecidedAt time.Time `bson:"decided_at,omitempty" json:"decided_at,omitempty" yaml:"decided_at,omitempty"`
+	// DecidedBy identifies who approved or denied the request.
+	DecidedBy string `bson:"decided_by,omitempty" json:"decided_by,omitempty" yaml:"decided_by,omitempty"`
+	// Reason is the reason that the request was denied.
+	Reason string `bson:"reason,omitempty" json:"reason,omitempty" yaml:"reason,omitempty"`
+	// Certificate is the PEM-encoded certificate signed when the request
+	// was approved.
+	Certificate string `bson:"certificate,omitempty" json:"certificate,omitempty" yaml:"certificate,omitempty"`
+}
+
+// expire marks the request as expired if it is still pending after its
+// expiration, and returns whether it changed.
+func (r *PendingRequest) expire(now time.Time) bool {
+	if r.Status != PendingRequestPending || now.Before(r.ExpiresAt) {
+		return false
+	}
+	r.Status = PendingRequestExpired
+	return true
+}
+
+// SubmitOptions configure how a certificate request is submitted for approval.
+type SubmitOptions struct {
+	Requester Requester `bson:"requester" json:"requester" yaml:"requester"`
+	// How long the request waits for approval before it expires. Defaults
+	// to DefaultPendingRequestExpiration.
+	Expires time.Duration `bson:"expires,omitempty" json:"expires,omitempty" yaml:"expires,omitempty"`
+}
+
+// Validate checks that the options are valid.
+func (opts *SubmitOptions) Validate() error {
+	if opts.Expires < 0 {
+		return errors.New("expiration cannot be negative")
+	}
+	return nil
+}
+
+// ApproveOptions configure how a pending certificate request is approved.
+type ApproveOptions struct {
+	// Approver identifies who approved the request.
+	Approver string `bson:"approver" json:"approver" yaml:"approver"`
+	// Passphrase to decrypt the CA's private-key PEM block.
+	CAPassphrase string `bson:"ca_passphrase,omitempty" json:"ca_passphrase,omitempty" yaml:"ca_passphrase,omitempty"`
+}
+
+// DenyOptions configure how a pending certificate request is denied.
+type DenyOptions struct {
+	// Denier identifies who denied the request.
+	Denier string `bson:"denier" json:"denier" yaml:"denier"`
+	// Reason explains to the requester why the request was denied.
+	Reason string `bson:"reason" json:"reason" yaml:"reason"`
+}
+
+// Validate checks that a reason is given.
+func (opts *DenyOptions) Validate() error {
+	if opts.Reason == "" {
+		return errors.New("must specify a reason for denying the request")
+	}
+	return nil
+}
+
+// SubmitCertificateRequest submits the certificate request to the CA for
+// approval instead of signing it, so that it can be listed with
+// ListPendingRequests and then signed with ApprovePendingRequest or refused
+// with DenyPendingRequest. If csr is nil, the certificate request in memory is
+// submitted. CA and Host must be set, and the request is checked against the
+// policy of the CA when it is submitted and again when it is approved. The
+// depot must implement PendingRequestManager.
+func (opts *CertificateOptions) SubmitCertificateRequest(wd depot.Depot, csr *pkix.CertificateSigningRequest, submit SubmitOptions) (*PendingRequest, error) {
+	prm, ok := wd.(PendingRequestManager)
+	if !ok {
+		return nil, errors.New("depot does not support pending requests")
+	}
+	if err := submit.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid submit options")
+	}
+	if csr == nil {
+		if !opts.certRequestedInMemory() {
+			return nil, errors.New("must provide a certificate request or make one in memory")
+		}
+		csr = opts.csr
+	}
+	if err := opts.ApplyProfile(wd); err != nil {
+		return nil, errors.Wrap(err, "problem applying profile")
+	}
+	if opts.CA == "" {
+		return nil, errors.New("must provide name of CA")
+	}
+	if opts.Host == "" {
+		return nil, errors.New("must provide name of host")
+	}
+	formattedCAName := strings.Replace(opts.CA, " ", "_", -1)
+	if !depot.CheckCertificate(wd, formattedCAName) {
+		return nil, errors.Errorf("could not find CA %s in the depot", opts.CA)
+	}
+
+	rawCsr, err := csr.GetRawCertificateSigningRequest()
+	if err != nil {
+		return nil, errors.Wrap(err, "problem getting raw certificate request")
+	}
+	if err = rawCsr.CheckSignature(); err != nil {
+		return nil, errors.Wrap(err, "invalid certificate request signature")
+	}
+	if err = opts.checkPolicy(wd, formattedCAName, rawCsr); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pemCsr, err := csr.Export()
+	if err != nil {
+		return nil, errors.Wrap(err, "problem exporting certificate request")
+	}
+
+	id, err := newPendingRequestID()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	stored := *opts
+	stored.Passphrase = ""
+	stored.CAPassphrase = ""
+	stored.Key = ""
+	stored.Profile = ""
+	stored.Reset()
+	expires := submit.Expires
+	if expires == 0 {
+		expires = DefaultPendingRequestExpiration
+	}
+	now := time.Now().UTC()
+
+	req := &PendingRequest{
+		ID:                 id,
+		CertificateRequest: string(pemCsr),
+		Options:            stored,
+		Requester:          submit.Requester,
+		Status:             PendingRequestPending,
+		SubmittedAt:        now,
+		ExpiresAt:          now.Add(expires),
+	}
+	if err = prm.PutPendingRequest(req); err != nil {
+		return nil, errors.Wrap(err, "problem putting pending request")
+	}
+
+	return req, nil
+}
+
+// GetPendingRequest returns the certificate request with the given ID that was
+// submitted for approval, marking it as expired if it is still pending after
+// its expiration.
+func GetPendingRequest(d depot.Depot, id string) (*PendingRequest, error) {
+	prm, ok := d.(PendingRequestManager)
+	if !ok {
+		return nil, errors.New("depot does not support pending requests")
+	}
+	if id == "" || strings.ContainsAny(id, `/\`) {
+		return nil, errors.Errorf("invalid pending request ID '%s'", id)
+	}
+
+	req, err := prm.GetPendingRequest(id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "problem getting pending request %s", id)
+	}
+	if req == nil {
+		return nil, errors.Errorf("could not find pending request %s", id)
+	}
+	if req.expire(time.Now()) {
+		swapped, err := prm.SwapPendingRequest(req, PendingRequestPending)
+		if err != nil {
+			return nil, errors.Wrapf(err, "problem expiring pending request %s", id)
+		}
+		if !swapped {
+			// The request was decided concurrently.
+			if req, err = prm.GetPendingRequest(id); err != nil {
+				return nil, errors.Wrapf(err, "problem getting pending request %s", id)
+			}
+			if req == nil {
+				return nil, errors.Errorf("could not find pending request %s", id)
+			}
+		}
+	}
+
+	return req, nil
+}
+
+// ListPendingRequests returns the certificate requests submitted for approval
+// with the given status, or all of them if the status is empty, ordered by
+// when they were submitted. Requests that are still pending after their
+// expiration are marked as expired.
+func ListPendingRequests(d depot.Depot, status PendingRequestStatus) ([]PendingRequest, error) {
+	if status != "" {
+		if err := status.Validate(); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if err := ExpirePendingRequests(d); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	reqs, err := d.(PendingRequestManager).ListPendingRequests()
+	if err != nil {
+		return nil, errors.Wrap(err, "problem listing pending requests")
+	}
+
+	filtered := []PendingRequest{}
+	for _, req := range reqs {
+		if status == "" || req.Status == status {
+			filtered = append(filtered, req)
+		}
+	}
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return filtered[i].SubmittedAt.Before(filtered[j].SubmittedAt)
+	})
+
+	return filtered, nil
+}
+
+// ExpirePendingRequests marks every certificate request that is still pending
+// after its expiration as expired.
+func ExpirePendingRequests(d depot.Depot) error {
+	prm, ok := d.(PendingRequestManager)
+	if !ok {
+		return errors.New("depot does not support pending requests")
+	}
+
+	reqs, err := prm.ListPendingRequests()
+	if err != nil {
+		return errors.Wrap(err, "problem listing pending requests")
+	}
+
+	now := time.Now()
+	catcher := grip.NewBasicCatcher()
+	for i := range reqs {
+		if reqs[i].expire(now) {
+			_, err = prm.SwapPendingRequest(&reqs[i], PendingRequestPending)
+			catcher.Wrapf(err, "problem expiring pending request %s", reqs[i].ID)
+		}
+	}
+
+	return catcher.Resolve()
+}
+
+// ApprovePendingRequest signs the pending certificate request with the given
+// ID using the options it was submitted with and puts the certificate in the
+// depot under the requested host name. The signed certificate is also kept in
+// the returned request. If the request cannot be signed, such as because it
+// violates the policy of the CA, it remains pending. Fails if the request is
+// approved, denied or expired concurrently.
+func ApprovePendingRequest(d depot.Depot, id string, opts ApproveOptions) (*PendingRequest, error) {
+	req, err := getDecidablePendingRequest(d, id)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	csr, err := pkix.NewCertificateSigningRequestFromPEM([]byte(req.CertificateRequest))
+	if err != nil {
+		return nil, errors.Wrap(err, "problem parsing certificate request")
+	}
+	signOpts := req.Options
+	signOpts.CAPassphrase = opts.CAPassphrase
+	crt, err := signOpts.SignCertificateRequestInMemory(d, csr)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem signing certificate request")
+	}
+	pemCrt, err := crt.Export()
+	if err != nil {
+		return nil, errors.Wrap(err, "problem exporting certificate")
+	}
+
+	pending := *req
+	req.Status = PendingRequestApproved
+	req.DecidedAt = time.Now().UTC()
+	req.DecidedBy = opts.Approver
+	req.Certificate = string(pemCrt)
+	if err = decidePendingRequest(d, req); err != nil {
+		return nil, errors.Wrapf(err, "problem recording approval of pending request %s", id)
+	}
+
+	if err = signOpts.PutCertFromMemory(d); err != nil {
+		catcher := grip.NewBasicCatcher()
+		catcher.Wrap(err, "problem putting certificate in the depot")
+		swapped, err := d.(PendingRequestManager).SwapPendingRequest(&pending, PendingRequestApproved)
+		catcher.Wrapf(err, "problem restoring pending request %s", id)
+		catcher.ErrorfWhen(err == nil && !swapped, "could not restore pending request %s", id)
+		return nil, catcher.Resolve()
+	}
+
+	return req, nil
+}
+
+// DenyPendingRequest refuses the pending certificate request with the given ID
+// and records the reason, so that it can no longer be approved.
+func DenyPendingRequest(d depot.Depot, id string, opts DenyOptions) (*PendingRequest, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid deny options")
+	}
+	req, err := getDecidablePendingRequest(d, id)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	req.Status = PendingRequestDenied
+	req.DecidedAt = time.Now().UTC()
+	req.DecidedBy = opts.Denier
+	req.Reason = opts.Reason
+	if err = decidePendingRequest(d, req); err != nil {
+		return nil, errors.Wrapf(err, "problem recording denial of pending request %s", id)
+	}
+
+	return req, nil
+}
+
+// getDecidablePendingRequest returns the request with the given ID if it is
+// still pending.
+func getDecidablePendingRequest(d depot.Depot, id string) (*PendingRequest, error) {
+	req, err := GetPendingRequest(d, id)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if req.Status != PendingRequestPending {
+		return nil, errors.Errorf("pending request %s is %s", id, req.Status)
+	}
+	return req, nil
+}
+
+// decidePendingRequest records the decision on the request, which must still
+// be pending in the depot.
+func decidePendingRequest(d depot.Depot, req *PendingRequest) error {
+	swapped, err := d.(PendingRequestManager).SwapPendingRequest(req, PendingRequestPending)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !swapped {
+		return errors.Errorf("pending request %s is no longer pending", req.ID)
+	}
+	return nil
+}
+
+func newPendingRequestID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "problem generating random identifier")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,329 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/pkix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApproval(t *testing.T) {
+	const caName = "ca"
+
+	newCSR := func(t *testing.T, host string) *pkix.CertificateSigningRequest {
+		opts := &CertificateOptions{CommonName: host, Host: host}
+		csr, _, err := opts.CertRequestInMemory()
+		require.NoError(t, err)
+		return csr
+	}
+	submit := func(t *testing.T, d Depot, host string) *PendingRequest {
+		req, err := (&CertificateOptions{CA: caName, Host: host, Expires: time.Hour}).SubmitCertificateRequest(d, newCSR(t, host), SubmitOptions{
+			Requester: Requester{Name: "alice", Metadata: map[string]string{"ticket": "123"}},
+		})
+		require.NoError(t, err)
+		return req
+	}
+
+	for testName, testCase := range map[string]func(t *testing.T, d Depot){
+		"SubmitStoresPendingRequest": func(t *testing.T, d Depot) {
+			req := submit(t, d, "server")
+			assert.NotEmpty(t, req.ID)
+			assert.Equal(t, PendingRequestPending, req.Status)
+			assert.WithinDuration(t, time.Now().Add(DefaultPendingRequestExpiration), req.ExpiresAt, time.Minute)
+			assert.False(t, d.Check(CsrTag("server")))
+			assert.False(t, d.Check(CrtTag("server")))
+
+			stored, err := GetPendingRequest(d, req.ID)
+			require.NoError(t, err)
+			assert.Equal(t, req.ID, stored.ID)
+			assert.Equal(t, req.CertificateRequest, stored.CertificateRequest)
+			assert.Equal(t, "alice", stored.Requester.Name)
+			assert.Equal(t, map[string]string{"ticket": "123"}, stored.Requester.Metadata)
+			assert.Equal(t, caName, stored.Options.CA)
+			assert.Equal(t, "server", stored.Options.Host)
+			assert.Equal(t, time.Hour, stored.Options.Expires)
+		},
+		"SubmitDoesNotStorePassphrases": func(t *testing.T, d Depot) {
+			req, err := (&CertificateOptions{
+				CA:           caName,
+				Host:         "server",
+				Passphrase:   "secret",
+				CAPassphrase: "secret",
+			}).SubmitCertificateRequest(d, newCSR(t, "server"), SubmitOptions{})
+			require.NoError(t, err)
+
+			stored, err := GetPendingRequest(d, req.ID)
+			require.NoError(t, err)
+			assert.Empty(t, stored.Options.Passphrase)
+			assert.Empty(t, stored.Options.CAPassphrase)
+		},
+		"SubmitUsesCertificateRequestInMemory": func(t *testing.T, d Depot) {
+			opts := &CertificateOptions{CommonName: "server", CA: caName, Host: "server"}
+			_, _, err := opts.CertRequestInMemory()
+			require.NoError(t, err)
+
+			req, err := opts.SubmitCertificateRequest(d, nil, SubmitOptions{})
+			require.NoError(t, err)
+			assert.NotEmpty(t, req.CertificateRequest)
+		},
+		"SubmitFailsWithoutCertificateRequest": func(t *testing.T, d Depot) {
+			_, err := (&CertificateOptions{CA: caName, Host: "server"}).SubmitCertificateRequest(d, nil, SubmitOptions{})
+			assert.Error(t, err)
+		},
+		"SubmitFailsWithNonexistentCA": func(t *testing.T, d Depot) {
+			_, err := (&CertificateOptions{CA: "nonexistent", Host: "server"}).SubmitCertificateRequest(d, newCSR(t, "server"), SubmitOptions{})
+			assert.Error(t, err)
+		},
+		"SubmitFailsWithoutHost": func(t *testing.T, d Depot) {
+			_, err := (&CertificateOptions{CA: caName}).SubmitCertificateRequest(d, newCSR(t, "server"), SubmitOptions{})
+			assert.Error(t, err)
+		},
+		"SubmitFailsWithPolicyViolation": func(t *testing.T, d Depot) {
+			require.NoError(t, PutPolicy(d, caName, &Policy{MaxLifetime: time.Minute}))
+			_, err := (&CertificateOptions{CA: caName, Host: "server", Expires: time.Hour}).SubmitCertificateRequest(d, newCSR(t, "server"), SubmitOptions{})
+			assert.Error(t, err)
+
+			reqs, err := ListPendingRequests(d, "")
+			require.NoError(t, err)
+			assert.Empty(t, reqs)
+		},
+		"ApproveSignsCertificate": func(t *testing.T, d Depot) {
+			req := submit(t, d, "server")
+
+			approved, err := ApprovePendingRequest(d, req.ID, ApproveOptions{Approver: "bob"})
+			require.NoError(t, err)
+			assert.Equal(t, PendingRequestApproved, approved.Status)
+			assert.Equal(t, "bob", approved.DecidedBy)
+			assert.NotEmpty(t, approved.Certificate)
+
+			require.True(t, d.Check(CrtTag("server")))
+			rawCrt, err := getRawCertificate(d, "server")
+			require.NoError(t, err)
+			assert.Equal(t, "server", rawCrt.Subject.CommonName)
+			assert.WithinDuration(t, time.Now().Add(time.Hour), rawCrt.NotAfter, time.Minute)
+			parent, err := GetParent(d, "server")
+			require.NoError(t, err)
+			assert.Equal(t, caName, parent)
+
+			stored, err := GetPendingRequest(d, req.ID)
+			require.NoError(t, err)
+			assert.Equal(t, PendingRequestApproved, stored.Status)
+			assert.Equal(t, approved.Certificate, stored.Certificate)
+
+			_, err = ApprovePendingRequest(d, req.ID, ApproveOptions{})
+			assert.Error(t, err)
+		},
+		"ApproveFailsWithPolicyViolation": func(t *testing.T, d Depot) {
+			req := submit(t, d, "server")
+			require.NoError(t, PutPolicy(d, caName, &Policy{MaxLifetime: time.Minute}))
+
+			_, err := ApprovePendingRequest(d, req.ID, ApproveOptions{})
+			assert.Error(t, err)
+			assert.False(t, d.Check(CrtTag("server")))
+
+			stored, err := GetPendingRequest(d, req.ID)
+			require.NoError(t, err)
+			assert.Equal(t, PendingRequestPending, stored.Status)
+		},
+		"DenyRecordsReason": func(t *testing.T, d Depot) {
+			req := submit(t, d, "server")
+
+			_, err := DenyPendingRequest(d, req.ID, DenyOptions{Denier: "bob"})
+			assert.Error(t, err)
+
+			denied, err := DenyPendingRequest(d, req.ID, DenyOptions{Denier: "bob", Reason: "unknown host"})
+			require.NoError(t, err)
+			assert.Equal(t, PendingRequestDenied, denied.Status)
+
+			stored, err := GetPendingRequest(d, req.ID)
+			require.NoError(t, err)
+			assert.Equal(t, PendingRequestDenied, stored.Status)
+			assert.Equal(t, "bob", stored.DecidedBy)
+			assert.Equal(t, "unknown host", stored.Reason)
+
+			_, err = ApprovePendingRequest(d, req.ID, ApproveOptions{})
+			assert.Error(t, err)
+			assert.False(t, d.Check(CrtTag("server")))
+		},
+		"ExpiredRequestCannotBeApproved": func(t *testing.T, d Depot) {
+			req, err := (&CertificateOptions{CA: caName, Host: "server"}).SubmitCertificateRequest(d, newCSR(t, "server"), SubmitOptions{Expires: time.Nanosecond})
+			require.NoError(t, err)
+			time.Sleep(time.Millisecond)
+
+			stored, err := GetPendingRequest(d, req.ID)
+			require.NoError(t, err)
+			assert.Equal(t, PendingRequestExpired, stored.Status)
+
+			_, err = ApprovePendingRequest(d, req.ID, ApproveOptions{})
+			assert.Error(t, err)
+			_, err = DenyPendingRequest(d, req.ID, DenyOptions{Reason: "too late"})
+			assert.Error(t, err)
+		},
+		"ConcurrentDecisionsRecordOne": func(t *testing.T, d Depot) {
+			req := submit(t, d, "server")
+
+			const workers = 8
+			var wg sync.WaitGroup
+			errs := make(chan error, workers)
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					var err error
+					if i%2 == 0 {
+						_, err = ApprovePendingRequest(d, req.ID, ApproveOptions{Approver: "bob"})
+					} else {
+						_, err = DenyPendingRequest(d, req.ID, DenyOptions{Denier: "bob", Reason: "duplicate"})
+					}
+					errs <- err
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+
+			var succeeded int
+			for err := range errs {
+				if err == nil {
+					succeeded++
+				}
+			}
+			assert.Equal(t, 1, succeeded)
+
+			stored, err := GetPendingRequest(d, req.ID)
+			require.NoError(t, err)
+			switch stored.Status {
+			case PendingRequestApproved:
+				assert.NotEmpty(t, stored.Certificate)
+				assert.True(t, d.Check(CrtTag("server")))
+			case PendingRequestDenied:
+				assert.Empty(t, stored.Certificate)
+				assert.False(t, d.Check(CrtTag("server")))
+			default:
+				assert.Fail(t, "request was not decided", "status is %s", stored.Status)
+			}
+		},
+		"SwapRequiresStatus": func(t *testing.T, d Depot) {
+			req := submit(t, d, "server")
+			prm := d.(PendingRequestManager)
+
+			denied := *req
+			denied.Status = PendingRequestDenied
+			swapped, err := prm.SwapPendingRequest(&denied, PendingRequestApproved)
+			require.NoError(t, err)
+			assert.False(t, swapped)
+
+			swapped, err = prm.SwapPendingRequest(&denied, PendingRequestPending)
+			require.NoError(t, err)
+			assert.True(t, swapped)
+
+			swapped, err = prm.SwapPendingRequest(req, PendingRequestPending)
+			require.NoError(t, err)
+			assert.False(t, swapped)
+
+			stored, err := prm.GetPendingRequest(req.ID)
+			require.NoError(t, err)
+			assert.Equal(t, PendingRequestDenied, stored.Status)
+
+			missing := *req
+			missing.ID = "missing"
+			swapped, err = prm.SwapPendingRequest(&missing, PendingRequestPending)
+			require.NoError(t, err)
+			assert.False(t, swapped)
+			stored, err = prm.GetPendingRequest(missing.ID)
+			require.NoError(t, err)
+			assert.Nil(t, stored)
+		},
+		"ListFiltersByStatus": func(t *testing.T, d Depot) {
+			first := submit(t, d, "first")
+			second := submit(t, d, "second")
+			third := submit(t, d, "third")
+			expired, err := (&CertificateOptions{CA: caName, Host: "fourth"}).SubmitCertificateRequest(d, newCSR(t, "fourth"), SubmitOptions{Expires: time.Nanosecond})
+			require.NoError(t, err)
+			time.Sleep(time.Millisecond)
+
+			_, err = ApprovePendingRequest(d, first.ID, ApproveOptions{})
+			require.NoError(t, err)
+			_, err = DenyPendingRequest(d, second.ID, DenyOptions{Reason: "unknown host"})
+			require.NoError(t, err)
+
+			for status, expected := range map[PendingRequestStatus][]string{
+				"":                     {first.ID, second.ID, third.ID, expired.ID},
+				PendingRequestPending:  {third.ID},
+				PendingRequestApproved: {first.ID},
+				PendingRequestDenied:   {second.ID},
+				PendingRequestExpired:  {expired.ID},
+			} {
+				reqs, err := ListPendingRequests(d, status)
+				require.NoError(t, err)
+				ids := []string{}
+				for _, req := range reqs {
+					ids = append(ids, req.ID)
+				}
+				assert.ElementsMatch(t, expected, ids, "status '%s'", status)
+			}
+
+			_, err = ListPendingRequests(d, "unknown")
+			assert.Error(t, err)
+		},
+		"GetFailsWithNonexistentRequest": func(t *testing.T, d Depot) {
+			_, err := GetPendingRequest(d, "nonexistent")
+			assert.Error(t, err)
+			_, err = GetPendingRequest(d, "../nonexistent")
+			assert.Error(t, err)
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			tempDir, err := ioutil.TempDir(".", "approval-test")
+			require.NoError(t, err)
+			defer func() {
+				assert.NoError(t, os.RemoveAll(tempDir))
+			}()
+
+			for depotName, makeDepot := range map[string]func(t *testing.T) Depot{
+				"Memory": func(t *testing.T) Depot {
+					return NewMemoryDepot(DepotOptions{})
+				},
+				"File": func(t *testing.T) Depot {
+					d, err := NewFileDepot(filepath.Join(tempDir, "file"))
+					require.NoError(t, err)
+					return d
+				},
+				"Bolt": func(t *testing.T) Depot {
+					d, err := NewBoltDBCertDepot(&BoltDBOptions{Path: filepath.Join(tempDir, "bolt.db")})
+					require.NoError(t, err)
+					return d
+				},
+				"SQL": func(t *testing.T) Depot {
+					d, err := NewSQLCertDepot(context.Background(), &SQLDepotOptions{DriverName: "sqlite", DataSourceName: filepath.Join(tempDir, "sql.db") + "?_pragma=busy_timeout(10000)"})
+					require.NoError(t, err)
+					return d
+				},
+			} {
+				t.Run(depotName, func(t *testing.T) {
+					d := makeDepot(t)
+					require.NoError(t, (&CertificateOptions{CommonName: caName, Expires: 24 * time.Hour}).Init(d))
+
+					testCase(t, d)
+				})
+			}
+		})
+	}
+	t.Run("UnsupportedDepot", func(t *testing.T) {
+		d := struct{ Depot }{NewMemoryDepot(DepotOptions{})}
+		require.NoError(t, (&CertificateOptions{CommonName: caName, Expires: 24 * time.Hour}).Init(d))
+
+		_, err := (&CertificateOptions{CA: caName, Host: "server"}).SubmitCertificateRequest(d, newCSR(t, "server"), SubmitOptions{})
+		assert.Error(t, err)
+		_, err = ListPendingRequests(d, "")
+		assert.Error(t, err)
+		_, err = ApprovePendingRequest(d, "id", ApproveOptions{})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,436 @@
+package certdepot
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// backupVersion is the version of the archive format written by Backup.
+// Version 2 added profile and pending request entries; Restore still reads
+// version 1 archives.
+const backupVersion = 2
+
+const (
+	// backupProfileType is the type of archive entries that hold a
+	// profile.
+	backupProfileType = "profile"
+	// backupRequestType is the type of archive entries that hold a pending
+	// request, which are named by the ID of the request.
+	backupRequestType = "request"
+)
+
+const (
+	backupKDF    = "scrypt"
+	backupCipher = "aes-256-gcm"
+	// backupCheck is encrypted into the archive header so that Restore can
+	// detect an incorrect passphrase before modifying the depot.
+	backupCheck = "certdepot"
+	// The scrypt parameters that Backup uses, which are also the largest
+	// that Restore accepts so that an archive cannot make it allocate an
+	// unbounded amount of memory.
+	backupScryptN = 1 << 15
+	backupScryptR = 8
+	backupScryptP = 1
+)
+
+// BackupOptions contains options for BackupWithOptions.
+type BackupOptions struct {
+	// Passphrase to encrypt the private keys in the archive. If empty, the
+	// private keys are stored as they are in the depot.
+	Passphrase string `bson:"passphrase,omitempty" json:"passphrase,omitempty" yaml:"passphrase,omitempty"`
+}
+
+// RestoreOptions contains options for RestoreWithOptions.
+type RestoreOptions struct {
+	// Passphrase to decrypt the private keys in the archive. Required if
+	// the archive was created with a passphrase.
+	Passphrase string `bson:"passphrase,omitempty" json:"passphrase,omitempty" yaml:"passphrase,omitempty"`
+	// How to handle names that already exist in the depot (defaults to
+	// CopySkipExisting).
+	Policy CopyPolicy `bson:"policy,omitempty" json:"policy,omitempty" yaml:"policy,omitempty"`
+}
+
+// backupHeader is the first line of an archive.
+type backupHeader struct {
+	Version    int               `json:"version"`
+	CreatedAt  time.Time         `json:"created_at"`
+	Encryption *backupEncryption `json:"encryption,omitempty"`
+}
+
+// backupEncryption describes how the private keys in an archive are
+// encrypted.
+type backupEncryption struct {
+	KDF    string `json:"kdf"`
+	Salt   []byte `json:"salt"`
+	N      int    `json:"n"`
+	R      int    `json:"r"`
+	P      int    `json:"p"`
+	Cipher string `json:"cipher"`
+	Check  []byte `json:"check"`
+}
+
+// backupEntry holds all entries of a single name in an archive, or a profile
+// or pending request if its type is backupProfileType or backupRequestType.
+type backupEntry struct {
+	Type string `json:"type,omitempty"`
+	Name string `json:"name"`
+	// Data holds the PEM-encoded entries of each kind. If the archive is
+	// encrypted, the private key is base64-encoded ciphertext.
+	Data map[TagKind]string `json:"data"`
+	TTL  *time.Time         `json:"ttl,omitempty"`
+	// Parent is the name of the CA that issued the certificate, if the
+	// depot records it.
+	Parent string `json:"parent,omitempty"`
+	// Policy is the issuance policy of the CA, if it has one.
+	Policy *Policy `json:"policy,omitempty"`
+	// Profile is set for profile entries.
+	Profile *Profile `json:"profile,omitempty"`
+	// Request is set for pending request entries.
+	Request *PendingRequest `json:"request,omitempty"`
+}
+
+// Backup writes every certificate, key, certificate request and CRL in the
+// depot, along with their expirations, and every profile and pending request
+// to an archive that can be restored into any kind of depot with Restore. The
+// depot must implement Lister.
+//
+// The archive is in the JSON lines format: the first line is a header that
+// contains the format version, followed by one line for each name, profile
+// and pending request.
+func Backup(d Depot, w io.Writer) error {
+	return BackupWithOptions(d, w, BackupOptions{})
+}
+
+// BackupWithOptions is the same as Backup but allows the private keys in the
+// archive to be encrypted with a passphrase.
+func BackupWithOptions(d Depot, w io.Writer, opts BackupOptions) error {
+	if d == nil {
+		return errors.New("must specify a non-nil depot")
+	}
+
+	names, err := listAllNames(d)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	header := backupHeader{
+		Version:   backupVersion,
+		CreatedAt: time.Now().UTC(),
+	}
+	var aead cipher.AEAD
+	if opts.Passphrase != "" {
+		header.Encryption, aead, err = newBackupEncryption(opts.Passphrase)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(header); err != nil {
+		return errors.Wrap(err, "problem writing archive header")
+	}
+
+	for _, name := range names {
+		entry := backupEntry{
+			Name: name,
+			Data: map[TagKind]string{},
+		}
+		for _, kind := range copyKinds {
+			tag := KindTag(kind, name)
+			if !d.Check(tag) {
+				continue
+			}
+			data, err := d.Get(tag)
+			if err != nil {
+				return errors.Wrapf(err, "problem getting %s entry for %s", kind, name)
+			}
+			if kind == PrivKeyKind && aead != nil {
+				data, err = sealBackupData(aead, name, data)
+				if err != nil {
+					return errors.Wrapf(err, "problem encrypting key for %s", name)
+				}
+				entry.Data[kind] = base64.StdEncoding.EncodeToString(data)
+				continue
+			}
+			entry.Data[kind] = string(data)
+		}
+
+		if _, ok := entry.Data[CrtKind]; ok {
+			ttl, err := copyTTL(d, name)
+			if err != nil {
+				return errors.Wrapf(err, "problem getting TTL for %s", name)
+			}
+			entry.TTL = &ttl
+			if entry.Parent, err = getParent(d, name); err != nil {
+				return errors.Wrapf(err, "problem getting parent for %s", name)
+			}
+			if entry.Policy, err = GetPolicy(d, name); err != nil {
+				return errors.Wrapf(err, "problem getting policy for %s", name)
+			}
+		}
+
+		if err = enc.Encode(entry); err != nil {
+			return errors.Wrapf(err, "problem writing archive entry for %s", name)
+		}
+	}
+
+	profiles, err := listProfiles(d)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, name := range sortedProfileNames(profiles) {
+		entry := backupEntry{
+			Type:    backupProfileType,
+			Name:    name,
+			Profile: profiles[name],
+		}
+		if err = enc.Encode(entry); err != nil {
+			return errors.Wrapf(err, "problem writing archive entry for profile %s", name)
+		}
+	}
+
+	reqs, err := listPendingRequests(d)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for i := range reqs {
+		entry := backupEntry{
+			Type:    backupRequestType,
+			Name:    reqs[i].ID,
+			Request: &reqs[i],
+		}
+		if err = enc.Encode(entry); err != nil {
+			return errors.Wrapf(err, "problem writing archive entry for pending request %s", reqs[i].ID)
+		}
+	}
+
+	return nil
+}
+
+// Restore reads an archive written by Backup into the depot. Names, profiles
+// and pending requests that already exist in the depot are skipped. Profiles
+// and pending requests are also skipped if the depot does not implement
+// ProfileManager or PendingRequestManager. The whole archive is read and
+// validated before the depot is modified.
+func Restore(d Depot, r io.Reader) error {
+	return RestoreWithOptions(d, r, RestoreOptions{})
+}
+
+// RestoreWithOptions is the same as Restore but allows the passphrase of an
+// encrypted archive and the handling of existing names to be configured.
+func RestoreWithOptions(d Depot, r io.Reader, opts RestoreOptions) error {
+	if d == nil {
+		return errors.New("must specify a non-nil depot")
+	}
+	if err := opts.Policy.Validate(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	dec := json.NewDecoder(r)
+	header := backupHeader{}
+	if err := dec.Decode(&header); err != nil {
+		return errors.Wrap(err, "problem reading archive header")
+	}
+	if header.Version < 1 || header.Version > backupVersion {
+		return errors.Errorf("unsupported archive version %d", header.Version)
+	}
+
+	var aead cipher.AEAD
+	if header.Encryption != nil {
+		if opts.Passphrase == "" {
+			return errors.New("must specify a passphrase to restore an encrypted archive")
+		}
+		var err error
+		aead, err = header.Encryption.open(opts.Passphrase)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	type restoreEntry struct {
+		name   string
+		data   map[TagKind][]byte
+		ttl    *time.Time
+		parent string
+		policy *Policy
+	}
+	entries := []restoreEntry{}
+	profiles := map[string]*Profile{}
+	reqs := []PendingRequest{}
+	for {
+		entry := backupEntry{}
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "problem reading archive entry")
+		}
+		if entry.Name == "" {
+			return errors.New("archive entry is missing a name")
+		}
+		switch entry.Type {
+		case "":
+		case backupProfileType:
+			if entry.Profile == nil {
+				return errors.Errorf("archive entry for profile %s is missing the profile", entry.Name)
+			}
+			if err = entry.Profile.Validate(); err != nil {
+				return errors.Wrapf(err, "invalid archive entry for profile %s", entry.Name)
+			}
+			profiles[entry.Name] = entry.Profile
+			continue
+		case backupRequestType:
+			if entry.Request == nil || entry.Request.ID != entry.Name {
+				return errors.Errorf("archive entry for pending request %s is missing the request", entry.Name)
+			}
+			if err = entry.Request.Status.Validate(); err != nil {
+				return errors.Wrapf(err, "invalid archive entry for pending request %s", entry.Name)
+			}
+			reqs = append(reqs, *entry.Request)
+			continue
+		default:
+			return errors.Errorf("unrecognized archive entry type '%s'", entry.Type)
+		}
+		data := map[TagKind][]byte{}
+		for kind, value := range entry.Data {
+			if err = kind.Validate(); err != nil {
+				return errors.Wrapf(err, "invalid archive entry for %s", entry.Name)
+			}
+			data[kind] = []byte(value)
+		}
+		if key, ok := entry.Data[PrivKeyKind]; ok && aead != nil {
+			ciphertext, err := base64.StdEncoding.DecodeString(key)
+			if err != nil {
+				return errors.Wrapf(err, "problem decoding key for %s", entry.Name)
+			}
+			data[PrivKeyKind], err = openBackupData(aead, entry.Name, ciphertext)
+			if err != nil {
+				return errors.Wrapf(err, "problem decrypting key for %s", entry.Name)
+			}
+		}
+		entries = append(entries, restoreEntry{name: entry.Name, data: data, ttl: entry.TTL, parent: entry.Parent, policy: entry.Policy})
+	}
+
+	_, isExpirationManager := d.(ExpirationManager)
+	for _, entry := range entries {
+		if opts.Policy != CopyOverwrite && nameExists(d, entry.name) {
+			continue
+		}
+
+		var ttl time.Time
+		if entry.ttl != nil && isExpirationManager {
+			ttl = *entry.ttl
+		}
+		if err := putName(d, entry.name, entry.data, ttl, entry.parent, entry.policy); err != nil {
+			return errors.Wrapf(err, "problem restoring %s", entry.name)
+		}
+	}
+
+	if _, ok := d.(ProfileManager); ok {
+		for _, name := range sortedProfileNames(profiles) {
+			if err := copyProfile(d, name, profiles[name], opts.Policy); err != nil {
+				return errors.Wrapf(err, "problem restoring profile %s", name)
+			}
+		}
+	}
+	if _, ok := d.(PendingRequestManager); ok {
+		for i := range reqs {
+			if err := copyPendingRequest(d, &reqs[i], opts.Policy); err != nil {
+				return errors.Wrapf(err, "problem restoring pending request %s", reqs[i].ID)
+			}
+		}
+	}
+
+	return nil
+}
+
+// newBackupEncryption derives a key from the passphrase with a random salt and
+// returns the parameters to store in the archive header along with the cipher.
+func newBackupEncryption(passphrase string) (*backupEncryption, cipher.AEAD, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, errors.Wrap(err, "problem generating salt")
+	}
+
+	e := &backupEncryption{
+		KDF:    backupKDF,
+		Salt:   salt,
+		N:      backupScryptN,
+		R:      backupScryptR,
+		P:      backupScryptP,
+		Cipher: backupCipher,
+	}
+	aead, err := e.cipher(passphrase)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	e.Check, err = sealBackupData(aead, "", []byte(backupCheck))
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	return e, aead, nil
+}
+
+// open returns the cipher for the passphrase after checking that the
+// passphrase is the one the archive was encrypted with.
+func (e *backupEncryption) open(passphrase string) (cipher.AEAD, error) {
+	if e.KDF != backupKDF || e.Cipher != backupCipher {
+		return nil, errors.Errorf("unsupported archive encryption %s/%s", e.KDF, e.Cipher)
+	}
+	if e.N <= 1 || e.N > backupScryptN || e.R <= 0 || e.R > backupScryptR || e.P <= 0 || e.P > backupScryptP {
+		return nil, errors.Errorf("unsupported archive key derivation parameters N=%d, r=%d, p=%d", e.N, e.R, e.P)
+	}
+
+	aead, err := e.cipher(passphrase)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	check, err := openBackupData(aead, "", e.Check)
+	if err != nil || string(check) != backupCheck {
+		return nil, errors.New("incorrect passphrase for archive")
+	}
+
+	return aead, nil
+}
+
+func (e *backupEncryption) cipher(passphrase string) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), e.Salt, e.N, e.R, e.P, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem deriving key from passphrase")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem creating cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, errors.Wrap(err, "problem creating cipher")
+}
+
+// sealBackupData encrypts the data with a random nonce, which is prepended to
+// the ciphertext. The name is authenticated so that encrypted data cannot be
+// moved to another name.
+func sealBackupData(aead cipher.AEAD, name string, data []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "problem generating nonce")
+	}
+	return aead.Seal(nonce, nonce, data, []byte(name)), nil
+}
+
+func openBackupData(aead cipher.AEAD, name string, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+	out, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(name))
+	return out, errors.Wrap(err, "problem decrypting data")
+}
@@ -0,0 +1,286 @@
+package certdepot
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackup(t *testing.T) {
+	const (
+		caName     = "ca"
+		passphrase = "passphrase"
+	)
+
+	populate := func(t *testing.T, d Depot) {
+		caOpts := &CertificateOptions{
+			CommonName: caName,
+			Expires:    24 * time.Hour,
+		}
+		require.NoError(t, caOpts.Init(d))
+		for _, name := range []string{"alice", "bob"} {
+			opts := &CertificateOptions{
+				CA:         caName,
+				CommonName: name,
+				Host:       name,
+				Expires:    time.Hour,
+			}
+			require.NoError(t, opts.CreateCertificate(d))
+		}
+	}
+	submit := func(t *testing.T, d Depot, host string) *PendingRequest {
+		csr, _, err := (&CertificateOptions{CommonName: host, Host: host}).CertRequestInMemory()
+		require.NoError(t, err)
+		req, err := (&CertificateOptions{CA: caName, Host: host, Expires: time.Hour}).SubmitCertificateRequest(d, csr, SubmitOptions{})
+		require.NoError(t, err)
+		return req
+	}
+	assertRestored := func(t *testing.T, src, dst Depot) {
+		names, err := listAllNames(src)
+		require.NoError(t, err)
+		restoredNames, err := listAllNames(dst)
+		require.NoError(t, err)
+		assert.Equal(t, names, restoredNames)
+
+		for _, name := range names {
+			for _, kind := range copyKinds {
+				tag := KindTag(kind, name)
+				require.Equal(t, src.Check(tag), dst.Check(tag), "%s/%s", name, kind)
+				if !src.Check(tag) {
+					continue
+				}
+				srcData, err := src.Get(tag)
+				require.NoError(t, err)
+				dstData, err := dst.Get(tag)
+				require.NoError(t, err)
+				assert.Equal(t, srcData, dstData, "%s/%s", name, kind)
+			}
+		}
+	}
+
+	for testName, testCase := range map[string]func(t *testing.T, src, dst Depot){
+		"RoundTrip": func(t *testing.T, src, dst Depot) {
+			buf := &bytes.Buffer{}
+			require.NoError(t, Backup(src, buf))
+			assert.Len(t, strings.Split(strings.TrimSpace(buf.String()), "\n"), 4)
+			assert.Contains(t, buf.String(), "PRIVATE KEY")
+
+			require.NoError(t, Restore(dst, buf))
+			assertRestored(t, src, dst)
+
+			creds, err := depotFind(dst, "alice", DepotOptions{CA: caName})
+			require.NoError(t, err)
+			_, err = creds.Resolve()
+			assert.NoError(t, err)
+		},
+		"RoundTripPreservesTTL": func(t *testing.T, src, dst Depot) {
+			_, notAfter, err := ValidityBounds(src, "alice")
+			require.NoError(t, err)
+			ttl := notAfter.Add(-time.Minute).UTC().Truncate(time.Second)
+			require.NoError(t, src.(ExpirationManager).PutTTL("alice", ttl))
+
+			buf := &bytes.Buffer{}
+			require.NoError(t, Backup(src, buf))
+			require.NoError(t, Restore(dst, buf))
+
+			restoredTTL, err := dst.(ExpirationManager).GetTTL("alice")
+			require.NoError(t, err)
+			assert.True(t, ttl.Equal(restoredTTL))
+		},
+		"EncryptedRoundTrip": func(t *testing.T, src, dst Depot) {
+			buf := &bytes.Buffer{}
+			require.NoError(t, BackupWithOptions(src, buf, BackupOptions{Passphrase: passphrase}))
+
+			assert.Contains(t, buf.String(), "BEGIN CERTIFICATE")
+			assert.NotContains(t, buf.String(), "PRIVATE KEY")
+
+			require.NoError(t, RestoreWithOptions(dst, buf, RestoreOptions{Passphrase: passphrase}))
+			assertRestored(t, src, dst)
+		},
+		"EncryptedRestoreFailsWithoutCorrectPassphrase": func(t *testing.T, src, dst Depot) {
+			buf := &bytes.Buffer{}
+			require.NoError(t, BackupWithOptions(src, buf, BackupOptions{Passphrase: passphrase}))
+			archive := buf.Bytes()
+
+			assert.Error(t, Restore(dst, bytes.NewReader(archive)))
+			assert.Error(t, RestoreWithOptions(dst, bytes.NewReader(archive), RestoreOptions{Passphrase: "wrong"}))
+			names, err := listAllNames(dst)
+			require.NoError(t, err)
+			assert.Empty(t, names)
+		},
+		"RoundTripPreservesProfiles": func(t *testing.T, src, dst Depot) {
+			profile := &Profile{CA: caName, Organization: "Example", Expires: time.Hour}
+			require.NoError(t, PutProfile(src, "client device", profile))
+
+			buf := &bytes.Buffer{}
+			require.NoError(t, Backup(src, buf))
+			require.NoError(t, Restore(dst, buf))
+
+			restored, err := GetProfile(dst, "client device")
+			require.NoError(t, err)
+			assert.Equal(t, profile, restored)
+
+			opts := &CertificateOptions{CommonName: "carol", Host: "carol", Profile: "client device"}
+			require.NoError(t, opts.CreateCertificate(dst))
+			rawCrt, err := getRawCertificate(dst, "carol")
+			require.NoError(t, err)
+			assert.Equal(t, []string{"Example"}, rawCrt.Subject.Organization)
+		},
+		"RestoreReadsVersion1Archive": func(t *testing.T, src, dst Depot) {
+			buf := &bytes.Buffer{}
+			require.NoError(t, Backup(src, buf))
+			lines := strings.SplitN(buf.String(), "\n", 2)
+			header := strings.Replace(lines[0], `"version":2`, `"version":1`, 1)
+			require.NotEqual(t, lines[0], header)
+
+			require.NoError(t, Restore(dst, strings.NewReader(header+"\n"+lines[1])))
+			assertRestored(t, src, dst)
+		},
+		"RestoreSkipsExistingProfiles": func(t *testing.T, src, dst Depot) {
+			require.NoError(t, PutProfile(src, "client", &Profile{CA: caName}))
+			existing := &Profile{Organization: "Existing"}
+			require.NoError(t, PutProfile(dst, "client", existing))
+
+			buf := &bytes.Buffer{}
+			require.NoError(t, Backup(src, buf))
+			archive := buf.Bytes()
+
+			require.NoError(t, Restore(dst, bytes.NewReader(archive)))
+			restored, err := GetProfile(dst, "client")
+			require.NoError(t, err)
+			assert.Equal(t, existing, restored)
+
+			require.NoError(t, RestoreWithOptions(dst, bytes.NewReader(archive), RestoreOptions{Policy: CopyOverwrite}))
+			restored, err = GetProfile(dst, "client")
+			require.NoError(t, err)
+			assert.Equal(t, &Profile{CA: caName}, restored)
+		},
+		"RoundTripPreservesPendingRequests": func(t *testing.T, src, dst Depot) {
+			req := submit(t, src, "carol")
+			denied := submit(t, src, "dave")
+			_, err := DenyPendingRequest(src, denied.ID, DenyOptions{Denier: "admin", Reason: "unknown host"})
+			require.NoError(t, err)
+
+			buf := &bytes.Buffer{}
+			require.NoError(t, Backup(src, buf))
+			require.NoError(t, Restore(dst, buf))
+
+			restored, err := GetPendingRequest(dst, denied.ID)
+			require.NoError(t, err)
+			require.NotNil(t, restored)
+			assert.Equal(t, PendingRequestDenied, restored.Status)
+			assert.Equal(t, "unknown host", restored.Reason)
+
+			approved, err := ApprovePendingRequest(dst, req.ID, ApproveOptions{Approver: "admin"})
+			require.NoError(t, err)
+			assert.Equal(t, req.CertificateRequest, approved.CertificateRequest)
+			assert.True(t, CheckCertificate(dst, "carol"))
+		},
+		"RestoreSkipsExistingPendingRequests": func(t *testing.T, src, dst Depot) {
+			req := submit(t, src, "carol")
+			existing := *req
+			existing.Status = PendingRequestDenied
+			require.NoError(t, dst.(PendingRequestManager).PutPendingRequest(&existing))
+
+			buf := &bytes.Buffer{}
+			require.NoError(t, Backup(src, buf))
+			archive := buf.Bytes()
+
+			require.NoError(t, Restore(dst, bytes.NewReader(archive)))
+			restored, err := GetPendingRequest(dst, req.ID)
+			require.NoError(t, err)
+			assert.Equal(t, PendingRequestDenied, restored.Status)
+
+			require.NoError(t, RestoreWithOptions(dst, bytes.NewReader(archive), RestoreOptions{Policy: CopyOverwrite}))
+			restored, err = GetPendingRequest(dst, req.ID)
+			require.NoError(t, err)
+			assert.Equal(t, PendingRequestPending, restored.Status)
+		},
+		"EncryptedRestoreFailsWithExcessiveKeyDerivationParameters": func(t *testing.T, src, dst Depot) {
+			buf := &bytes.Buffer{}
+			require.NoError(t, BackupWithOptions(src, buf, BackupOptions{Passphrase: passphrase}))
+			lines := strings.SplitN(buf.String(), "\n", 2)
+
+			for paramName, replacement := range map[string][2]string{
+				"N":    {`"n":32768`, `"n":1073741824`},
+				"R":    {`"r":8`, `"r":1024`},
+				"P":    {`"p":1`, `"p":64`},
+				"Zero": {`"n":32768`, `"n":0`},
+			} {
+				header := strings.Replace(lines[0], replacement[0], replacement[1], 1)
+				require.NotEqual(t, lines[0], header, paramName)
+				err := RestoreWithOptions(dst, strings.NewReader(header+"\n"+lines[1]), RestoreOptions{Passphrase: passphrase})
+				require.Error(t, err, paramName)
+				assert.Contains(t, err.Error(), "key derivation parameters", paramName)
+			}
+			names, err := listAllNames(dst)
+			require.NoError(t, err)
+			assert.Empty(t, names)
+		},
+		"RestoreSkipsExistingNames": func(t *testing.T, src, dst Depot) {
+			require.NoError(t, dst.Put(CrtTag("alice"), []byte("existing")))
+
+			buf := &bytes.Buffer{}
+			require.NoError(t, Backup(src, buf))
+			require.NoError(t, Restore(dst, buf))
+
+			data, err := dst.Get(CrtTag("alice"))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("existing"), data)
+			assert.False(t, dst.Check(PrivKeyTag("alice")))
+			assert.True(t, dst.Check(CrtTag("bob")))
+		},
+		"RestoreOverwritesExistingNames": func(t *testing.T, src, dst Depot) {
+			require.NoError(t, dst.Put(CrtTag("alice"), []byte("existing")))
+
+			buf := &bytes.Buffer{}
+			require.NoError(t, Backup(src, buf))
+			require.NoError(t, RestoreWithOptions(dst, buf, RestoreOptions{Policy: CopyOverwrite}))
+			assertRestored(t, src, dst)
+		},
+		"RestoreFailsForInvalidArchive": func(t *testing.T, src, dst Depot) {
+			buf := &bytes.Buffer{}
+			require.NoError(t, Backup(src, buf))
+			lines := strings.SplitN(buf.String(), "\n", 2)
+
+			for archiveName, archive := range map[string]string{
+				"Empty":              "",
+				"UnsupportedVersion": `{"version":3}` + "\n" + lines[1],
+				"InvalidType":        lines[0] + "\n" + `{"type":"invalid","name":"alice"}` + "\n",
+				"MissingProfile":     lines[0] + "\n" + `{"type":"profile","name":"client"}` + "\n",
+				"InvalidProfile":     lines[0] + "\n" + `{"type":"profile","name":"client","profile":{"expires":-1}}` + "\n",
+				"MissingRequest":     lines[0] + "\n" + `{"type":"request","name":"id"}` + "\n",
+				"MismatchedRequest":  lines[0] + "\n" + `{"type":"request","name":"id","request":{"id":"other","status":"pending"}}` + "\n",
+				"InvalidRequest":     lines[0] + "\n" + `{"type":"request","name":"id","request":{"id":"id","status":"invalid"}}` + "\n",
+				"Truncated":          buf.String()[:buf.Len()-10],
+				"InvalidKind":        lines[0] + "\n" + `{"name":"alice","data":{"invalid":""}}` + "\n",
+			} {
+				assert.Error(t, Restore(dst, strings.NewReader(archive)), archiveName)
+			}
+			names, err := listAllNames(dst)
+			require.NoError(t, err)
+			assert.Empty(t, names)
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			tempDir, err := ioutil.TempDir(".", "backup-test")
+			require.NoError(t, err)
+			defer func() {
+				assert.NoError(t, os.RemoveAll(tempDir))
+			}()
+
+			src := NewMemoryDepot(DepotOptions{})
+			dst, err := NewFileDepot(tempDir)
+			require.NoError(t, err)
+			populate(t, src)
+
+			testCase(t, src, dst)
+		})
+	}
+}
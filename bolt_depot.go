@@ -0,0 +1,677 @@
+package certdepot
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cdr/grip"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// BoltDBOptions contains options for NewBoltDBCertDepot and
+// NewBoltDBCertDepotWithDB.
+type BoltDBOptions struct {
+	Path         string        `bson:"path" json:"path" yaml:"path"`
+	BucketName   string        `bson:"bucket_name" json:"bucket_name" yaml:"bucket_name"`
+	Timeout      time.Duration `bson:"timeout,omitempty" json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	DepotOptions DepotOptions  `bson:"depot_options" json:"depot_options" yaml:"depot_options"`
+}
+
+// IsZero returns whether the given BoltDBOptions struct holds the "zero"
+// value of the struct.
+func (opts *BoltDBOptions) IsZero() bool {
+	return opts.Path == ""
+}
+
+func (opts *BoltDBOptions) validate() error {
+	if opts.BucketName == "" {
+		opts.BucketName = "certs"
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 2 * time.Second
+	}
+
+	return nil
+}
+
+type boltDepot struct {
+	db                *bolt.DB
+	bucketName        []byte
+	profileBucketName []byte
+	requestBucketName []byte
+	opts              DepotOptions
+	// ownsDB is whether the depot opened the database and closes it in
+	// Close.
+	ownsDB bool
+}
+
+// NewBoltDBCertDepot returns a new cert depot backed by an embedded bbolt
+// database stored in the file at the given path. The file is created if it
+// does not exist. The database file stays locked until the depot is closed
+// with its Close method, which the depot implements as io.Closer.
+func NewBoltDBCertDepot(opts *BoltDBOptions) (Depot, error) {
+	if opts.Path == "" {
+		return nil, errors.New("must specify a path to the database file")
+	}
+	if err := opts.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+
+	db, err := bolt.Open(opts.Path, 0600, &bolt.Options{Timeout: opts.Timeout})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open database %s", opts.Path)
+	}
+
+	d, err := NewBoltDBCertDepotWithDB(db, opts)
+	if err != nil {
+		catcher := grip.NewBasicCatcher()
+		catcher.Add(err)
+		catcher.Wrapf(db.Close(), "problem closing database %s", opts.Path)
+		return nil, catcher.Resolve()
+	}
+	d.(*boltDepot).ownsDB = true
+
+	return d, nil
+}
+
+// NewBoltDBCertDepotWithDB returns a new cert depot backed by the provided
+// bbolt database. The caller owns the database: closing the depot does not
+// close it, and the caller must close it once the depot is no longer used.
+func NewBoltDBCertDepotWithDB(db *bolt.DB, opts *BoltDBOptions) (Depot, error) {
+	if db == nil {
+		return nil, errors.New("must specify a non-nil database")
+	}
+
+	if err := opts.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+
+	bucketName := []byte(opts.BucketName)
+	profileBucketName := []byte(opts.BucketName + "_profiles")
+	requestBucketName := []byte(opts.BucketName + "_requests")
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketName, profileBucketName, requestBucketName} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return errors.Wrapf(err, "problem creating bucket %s", name)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &boltDepot{
+		db:                db,
+		bucketName:        bucketName,
+		profileBucketName: profileBucketName,
+		requestBucketName: requestBucketName,
+		opts:              opts.DepotOptions,
+	}, nil
+}
+
+// Close closes the database if the depot opened it, which releases the lock on
+// the database file. The depot cannot be used after it is closed.
+func (b *boltDepot) Close() error {
+	if !b.ownsDB {
+		return nil
+	}
+	return errors.Wrap(b.db.Close(), "problem closing database")
+}
+
+func (b *boltDepot) getUser(tx *bolt.Tx, name string) (*User, error) {
+	data := tx.Bucket(b.bucketName).Get([]byte(name))
+	if data == nil {
+		return nil, nil
+	}
+
+	u := &User{}
+	if err := bson.Unmarshal(data, u); err != nil {
+		return nil, errors.Wrapf(err, "problem decoding %s", name)
+	}
+
+	return u, nil
+}
+
+func (b *boltDepot) putUser(tx *bolt.Tx, u *User) error {
+	data, err := bson.Marshal(u)
+	if err != nil {
+		return errors.Wrapf(err, "problem encoding %s", u.ID)
+	}
+
+	return errors.Wrapf(tx.Bucket(b.bucketName).Put([]byte(u.ID), data), "problem writing %s", u.ID)
+}
+
+// Put inserts the data into the user specified by the tag, creating the user
+// if it does not exist.
+func (b *boltDepot) Put(tag *depot.Tag, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+
+	name, key, err := getNameAndKey(tag)
+	if err != nil {
+		return errors.Wrapf(err, "could not format name %s", name)
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		u, err := b.getUser(tx, name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if u == nil {
+			u = &User{ID: name}
+		}
+
+		switch key {
+		case userCertKey:
+			u.Cert = string(data)
+		case userPrivateKeyKey:
+			u.PrivateKey = string(data)
+		case userCertReqKey:
+			u.CertReq = string(data)
+		case userCertRevocListKey:
+			u.CertRevocList = string(data)
+		default:
+			return errors.Errorf("unrecognized tag for %s", name)
+		}
+
+		return errors.Wrap(b.putUser(tx, u), "problem adding data to the database")
+	})
+}
+
+// Check returns whether the user and data specified by the tag exists.
+func (b *boltDepot) Check(tag *depot.Tag) bool {
+	name, key, err := getNameAndKey(tag)
+	if err != nil {
+		return false
+	}
+
+	var u *User
+	if err = b.db.View(func(tx *bolt.Tx) error {
+		u, err = b.getUser(tx, name)
+		return err
+	}); err != nil || u == nil {
+		return false
+	}
+
+	switch key {
+	case userCertKey:
+		return u.Cert != ""
+	case userPrivateKeyKey:
+		return u.PrivateKey != ""
+	case userCertReqKey:
+		return u.CertReq != ""
+	case userCertRevocListKey:
+		return u.CertRevocList != ""
+	default:
+		return false
+	}
+}
+
+// Get reads the data for the user specified by tag. Returns an error if the
+// user does not exist or if the data is empty.
+func (b *boltDepot) Get(tag *depot.Tag) ([]byte, error) {
+	name, key, err := getNameAndKey(tag)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not format name %s", name)
+	}
+
+	var u *User
+	if err = b.db.View(func(tx *bolt.Tx) error {
+		u, err = b.getUser(tx, name)
+		return err
+	}); err != nil {
+		return nil, errors.Wrapf(err, "problem looking up %s in the database", name)
+	}
+	if u == nil {
+		return nil, errors.Errorf("could not find %s in the database", name)
+	}
+
+	var data []byte
+	switch key {
+	case userCertKey:
+		data = []byte(u.Cert)
+	case userPrivateKeyKey:
+		data = []byte(u.PrivateKey)
+	case userCertReqKey:
+		data = []byte(u.CertReq)
+	case userCertRevocListKey:
+		data = []byte(u.CertRevocList)
+	}
+
+	if len(data) == 0 {
+		return nil, errors.New("no data available")
+	}
+	return data, nil
+}
+
+// Delete removes the data from a user specified by the tag.
+func (b *boltDepot) Delete(tag *depot.Tag) error {
+	name, key, err := getNameAndKey(tag)
+	if err != nil {
+		return errors.Wrapf(err, "could not format name %s", name)
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		u, err := b.getUser(tx, name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if u == nil {
+			return nil
+		}
+
+		switch key {
+		case userCertKey:
+			u.Cert = ""
+		case userPrivateKeyKey:
+			u.PrivateKey = ""
+		case userCertReqKey:
+			u.CertReq = ""
+		case userCertRevocListKey:
+			u.CertRevocList = ""
+		}
+
+		return errors.Wrapf(b.putUser(tx, u), "problem deleting %s.%s from the database", name, key)
+	})
+}
+
+func (b *boltDepot) Save(name string, creds *Credentials) error { return depotSave(b, name, creds) }
+func (b *boltDepot) Find(name string) (*Credentials, error)     { return depotFind(b, name, b.opts) }
+func (b *boltDepot) Generate(name string) (*Credentials, error) {
+	return depotGenerate(b, name, b.opts)
+}
+
+// List returns the names of all users that hold data of the given kind.
+func (b *boltDepot) List(kind TagKind) ([]string, error) {
+	key, err := kind.userKey()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	names := []string{}
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucketName).ForEach(func(k, v []byte) error {
+			u := User{}
+			if err := bson.Unmarshal(v, &u); err != nil {
+				return errors.Wrapf(err, "problem decoding %s", k)
+			}
+			if userHasKind(&u, key) {
+				names = append(names, u.ID)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "problem listing %s entries", kind)
+	}
+
+	return names, nil
+}
+
+// PutTTL sets the TTL to the given expiration time for the name. If the name is
+// not found in the database, this will error. The expiration must be within
+// the validity bounds of the certificate for the given name.
+func (b *boltDepot) PutTTL(name string, expiration time.Time) error {
+	expiration = expiration.UTC()
+
+	minExpiration, maxExpiration, err := ValidityBounds(b, name)
+	if err != nil {
+		return errors.Wrap(err, "could not get certificate validity bounds")
+	}
+	if expiration.Before(minExpiration) || expiration.After(maxExpiration) {
+		return errors.Errorf("cannot set expiration to %s because it must be between %s and %s", expiration, minExpiration, maxExpiration)
+	}
+
+	formattedName := strings.Replace(name, " ", "_", -1)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		u, err := b.getUser(tx, formattedName)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if u == nil {
+			return errors.Errorf("could not find %s in the database", name)
+		}
+		u.TTL = expiration
+
+		return errors.Wrap(b.putUser(tx, u), "problem updating TTL in the database")
+	})
+}
+
+// GetTTL returns the TTL for the given name.
+func (b *boltDepot) GetTTL(name string) (time.Time, error) {
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	var u *User
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		u, err = b.getUser(tx, formattedName)
+		return err
+	}); err != nil {
+		return time.Time{}, errors.Wrap(err, "could not get TTL from database")
+	}
+	if u == nil {
+		return time.Time{}, errors.Errorf("could not find %s in the database", name)
+	}
+
+	return u.TTL, nil
+}
+
+// PutParent records the name of the CA that issued the certificate with the
+// given name. If the name is not found in the database, this will error.
+func (b *boltDepot) PutParent(name, parent string) error {
+	formattedName := strings.Replace(name, " ", "_", -1)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		u, err := b.getUser(tx, formattedName)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if u == nil {
+			return errors.Errorf("could not find %s in the database", name)
+		}
+		u.Parent = strings.Replace(parent, " ", "_", -1)
+
+		return errors.Wrap(b.putUser(tx, u), "problem updating parent in the database")
+	})
+}
+
+// GetParent returns the name of the CA that issued the certificate with the
+// given name.
+func (b *boltDepot) GetParent(name string) (string, error) {
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	var u *User
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		u, err = b.getUser(tx, formattedName)
+		return err
+	}); err != nil {
+		return "", errors.Wrap(err, "could not get parent from database")
+	}
+	if u == nil {
+		return "", errors.Errorf("could not find %s in the database", name)
+	}
+
+	return u.Parent, nil
+}
+
+// errFoundChild stops iterating over the bucket once a child is found.
+var errFoundChild = errors.New("found child")
+
+// HasChildren returns whether any certificate records the CA with the given
+// name as its parent.
+func (b *boltDepot) HasChildren(name string) (bool, error) {
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucketName).ForEach(func(k, v []byte) error {
+			u := User{}
+			if err := bson.Unmarshal(v, &u); err != nil {
+				return errors.Wrapf(err, "problem decoding %s", k)
+			}
+			if u.Parent == formattedName {
+				return errFoundChild
+			}
+			return nil
+		})
+	})
+	if err == errFoundChild {
+		return true, nil
+	}
+
+	return false, errors.Wrap(err, "could not find children in database")
+}
+
+// SwapRevocationList replaces the CRL of the CA with the given name if the
+// stored CRL is equal to prev.
+func (b *boltDepot) SwapRevocationList(name string, prev, next []byte) (bool, error) {
+	if next == nil {
+		return false, errors.New("data is nil")
+	}
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	var swapped bool
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		u, err := b.getUser(tx, formattedName)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if u == nil {
+			return errors.Errorf("could not find %s in the database", name)
+		}
+		if u.CertRevocList != string(prev) {
+			return nil
+		}
+		u.CertRevocList = string(next)
+		swapped = true
+
+		return errors.Wrap(b.putUser(tx, u), "problem updating certificate revocation list in the database")
+	})
+
+	return swapped, errors.WithStack(err)
+}
+
+// PutPolicy attaches the policy to the CA with the given name. If the name is
+// not found in the database, this will error.
+func (b *boltDepot) PutPolicy(name string, policy *Policy) error {
+	formattedName := strings.Replace(name, " ", "_", -1)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		u, err := b.getUser(tx, formattedName)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if u == nil {
+			return errors.Errorf("could not find %s in the database", name)
+		}
+		u.Policy = policy
+
+		return errors.Wrap(b.putUser(tx, u), "problem updating policy in the database")
+	})
+}
+
+// GetPolicy returns the policy of the CA with the given name.
+func (b *boltDepot) GetPolicy(name string) (*Policy, error) {
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	var u *User
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		u, err = b.getUser(tx, formattedName)
+		return err
+	}); err != nil {
+		return nil, errors.Wrap(err, "could not get policy from database")
+	}
+	if u == nil {
+		return nil, errors.Errorf("could not find %s in the database", name)
+	}
+
+	return u.Policy, nil
+}
+
+// PutProfile stores the profile under the given name in a separate bucket.
+func (b *boltDepot) PutProfile(name string, profile *Profile) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.profileBucketName)
+		if profile == nil {
+			return errors.Wrapf(bucket.Delete([]byte(name)), "problem deleting profile %s", name)
+		}
+
+		data, err := bson.Marshal(profile)
+		if err != nil {
+			return errors.Wrapf(err, "problem encoding profile %s", name)
+		}
+		return errors.Wrapf(bucket.Put([]byte(name), data), "problem writing profile %s", name)
+	})
+}
+
+// GetProfile returns the profile with the given name.
+func (b *boltDepot) GetProfile(name string) (*Profile, error) {
+	var profile *Profile
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(b.profileBucketName).Get([]byte(name))
+		if data == nil {
+			return nil
+		}
+		profile = &Profile{}
+		return errors.Wrapf(bson.Unmarshal(data, profile), "problem decoding profile %s", name)
+	}); err != nil {
+		return nil, errors.Wrap(err, "could not get profile from database")
+	}
+
+	return profile, nil
+}
+
+// ListProfiles returns all profiles by name.
+func (b *boltDepot) ListProfiles() (map[string]*Profile, error) {
+	profiles := map[string]*Profile{}
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.profileBucketName).ForEach(func(k, v []byte) error {
+			profile := &Profile{}
+			if err := bson.Unmarshal(v, profile); err != nil {
+				return errors.Wrapf(err, "problem decoding profile %s", k)
+			}
+			profiles[string(k)] = profile
+			return nil
+		})
+	}); err != nil {
+		return nil, errors.Wrap(err, "could not list profiles from database")
+	}
+
+	return profiles, nil
+}
+
+// PutPendingRequest inserts or replaces the pending request in a separate
+// bucket.
+func (b *boltDepot) PutPendingRequest(req *PendingRequest) error {
+	data, err := bson.Marshal(req)
+	if err != nil {
+		return errors.Wrapf(err, "problem encoding pending request %s", req.ID)
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return errors.Wrapf(tx.Bucket(b.requestBucketName).Put([]byte(req.ID), data), "problem writing pending request %s", req.ID)
+	})
+}
+
+// SwapPendingRequest replaces the pending request if the stored request has
+// the given status.
+func (b *boltDepot) SwapPendingRequest(req *PendingRequest, prev PendingRequestStatus) (bool, error) {
+	data, err := bson.Marshal(req)
+	if err != nil {
+		return false, errors.Wrapf(err, "problem encoding pending request %s", req.ID)
+	}
+
+	var swapped bool
+	if err = b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.requestBucketName)
+		currentData := bucket.Get([]byte(req.ID))
+		if currentData == nil {
+			return nil
+		}
+		current := PendingRequest{}
+		if err := bson.Unmarshal(currentData, &current); err != nil {
+			return errors.Wrapf(err, "problem decoding pending request %s", req.ID)
+		}
+		if current.Status != prev {
+			return nil
+		}
+		swapped = true
+		return errors.Wrapf(bucket.Put([]byte(req.ID), data), "problem writing pending request %s", req.ID)
+	}); err != nil {
+		return false, errors.Wrap(err, "could not update pending request in database")
+	}
+
+	return swapped, nil
+}
+
+// GetPendingRequest returns the pending request with the given ID.
+func (b *boltDepot) GetPendingRequest(id string) (*PendingRequest, error) {
+	var req *PendingRequest
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(b.requestBucketName).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		req = &PendingRequest{}
+		return errors.Wrapf(bson.Unmarshal(data, req), "problem decoding pending request %s", id)
+	}); err != nil {
+		return nil, errors.Wrap(err, "could not get pending request from database")
+	}
+
+	return req, nil
+}
+
+// ListPendingRequests returns all pending requests.
+func (b *boltDepot) ListPendingRequests() ([]PendingRequest, error) {
+	reqs := []PendingRequest{}
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.requestBucketName).ForEach(func(k, v []byte) error {
+			req := PendingRequest{}
+			if err := bson.Unmarshal(v, &req); err != nil {
+				return errors.Wrapf(err, "problem decoding pending request %s", k)
+			}
+			reqs = append(reqs, req)
+			return nil
+		})
+	}); err != nil {
+		return nil, errors.Wrap(err, "could not list pending requests from database")
+	}
+
+	return reqs, nil
+}
+
+// FindExpiresBefore finds all Users that expire before the given cutoff time.
+func (b *boltDepot) FindExpiresBefore(cutoff time.Time) ([]User, error) {
+	users := []User{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucketName).ForEach(func(k, v []byte) error {
+			u := User{}
+			if err := bson.Unmarshal(v, &u); err != nil {
+				return errors.Wrapf(err, "problem decoding %s", k)
+			}
+			if expiresBefore(&u, cutoff) {
+				users = append(users, u)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "problem finding expired users")
+	}
+
+	return users, nil
+}
+
+// DeleteExpiresBefore removes all Users that expire before the given cutoff
+// time.
+func (b *boltDepot) DeleteExpiresBefore(cutoff time.Time) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.bucketName)
+
+		var expired [][]byte
+		if err := bucket.ForEach(func(k, v []byte) error {
+			u := User{}
+			if err := bson.Unmarshal(v, &u); err != nil {
+				return errors.Wrapf(err, "problem decoding %s", k)
+			}
+			if expiresBefore(&u, cutoff) {
+				expired = append(expired, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return errors.Wrap(err, "problem removing expired users")
+}
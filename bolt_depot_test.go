@@ -0,0 +1,209 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/depot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltDepot(t *testing.T) {
+	const (
+		caName      = "ca"
+		serviceName = "localhost"
+	)
+
+	insertUser := func(t *testing.T, bd *boltDepot, u *User) {
+		require.NoError(t, bd.db.Update(func(tx *bolt.Tx) error {
+			return bd.putUser(tx, u)
+		}))
+	}
+
+	for testName, testCase := range map[string]func(t *testing.T, path string, bd *boltDepot){
+		"PutTTLSetsValueOnExistingUser": func(t *testing.T, _ string, bd *boltDepot) {
+			const name = "foo"
+			opts := &CertificateOptions{
+				CA:         caName,
+				CommonName: name,
+				Host:       name,
+				Expires:    24 * time.Hour,
+			}
+			require.NoError(t, opts.CreateCertificate(bd))
+
+			ttl, err := bd.GetTTL(name)
+			require.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(opts.Expires), ttl, time.Minute)
+		},
+		"PutTTLDoesNotInsert": func(t *testing.T, _ string, bd *boltDepot) {
+			const name = "user"
+			require.Error(t, bd.PutTTL(name, time.Now()))
+			_, err := bd.GetTTL(name)
+			assert.Error(t, err)
+		},
+		"PutParentSetsValueOnExistingUser": func(t *testing.T, _ string, bd *boltDepot) {
+			const name = "foo"
+			require.NoError(t, (&CertificateOptions{
+				CA:         caName,
+				CommonName: name,
+				Host:       name,
+				Expires:    24 * time.Hour,
+			}).CreateCertificate(bd))
+
+			parent, err := bd.GetParent(name)
+			require.NoError(t, err)
+			assert.Equal(t, caName, parent)
+
+			require.NoError(t, bd.PutParent(name, ""))
+			parent, err = bd.GetParent(name)
+			require.NoError(t, err)
+			assert.Empty(t, parent)
+		},
+		"HasChildrenFindsRecordedParent": func(t *testing.T, _ string, bd *boltDepot) {
+			hasChildren, err := bd.HasChildren(caName)
+			require.NoError(t, err)
+			assert.True(t, hasChildren)
+			hasChildren, err = bd.HasChildren(serviceName)
+			require.NoError(t, err)
+			assert.False(t, hasChildren)
+
+			require.NoError(t, bd.PutParent(serviceName, ""))
+			hasChildren, err = bd.HasChildren(caName)
+			require.NoError(t, err)
+			assert.False(t, hasChildren)
+		},
+		"PutParentDoesNotInsert": func(t *testing.T, _ string, bd *boltDepot) {
+			const name = "user"
+			require.Error(t, bd.PutParent(name, caName))
+			_, err := bd.GetParent(name)
+			assert.Error(t, err)
+		},
+		"PutPolicySetsValueOnExistingUser": func(t *testing.T, _ string, bd *boltDepot) {
+			policy, err := bd.GetPolicy(caName)
+			require.NoError(t, err)
+			assert.Nil(t, policy)
+
+			expected := &Policy{AllowedNames: []string{"*.example.com"}, MaxLifetime: time.Hour}
+			require.NoError(t, bd.PutPolicy(caName, expected))
+			policy, err = bd.GetPolicy(caName)
+			require.NoError(t, err)
+			assert.Equal(t, expected, policy)
+
+			require.NoError(t, bd.PutPolicy(caName, nil))
+			policy, err = bd.GetPolicy(caName)
+			require.NoError(t, err)
+			assert.Nil(t, policy)
+		},
+		"PutPolicyDoesNotInsert": func(t *testing.T, _ string, bd *boltDepot) {
+			const name = "user"
+			require.Error(t, bd.PutPolicy(name, &Policy{}))
+			_, err := bd.GetPolicy(name)
+			assert.Error(t, err)
+		},
+		"GetTTLFailsForNonexistentUser": func(t *testing.T, _ string, bd *boltDepot) {
+			_, err := bd.GetTTL("nonexistent")
+			assert.Error(t, err)
+		},
+		"FindExpiresBeforeMatchesExpired": func(t *testing.T, _ string, bd *boltDepot) {
+			ttl := time.Now()
+			expiration := ttl.Add(time.Hour)
+			insertUser(t, bd, &User{ID: "user1", TTL: ttl})
+			insertUser(t, bd, &User{ID: "user2", TTL: expiration.Add(time.Hour)})
+			insertUser(t, bd, &User{ID: "user3", Cert: "cert"})
+
+			users, err := bd.FindExpiresBefore(expiration)
+			require.NoError(t, err)
+			require.Len(t, users, 1)
+			assert.Equal(t, "user1", users[0].ID)
+		},
+		"DeleteExpiresBeforeRemovesExpired": func(t *testing.T, _ string, bd *boltDepot) {
+			ttl := time.Now()
+			expiration := ttl.Add(time.Hour)
+			insertUser(t, bd, &User{ID: "user1", Cert: "cert", TTL: ttl})
+			insertUser(t, bd, &User{ID: "user2", Cert: "cert", TTL: expiration.Add(time.Hour)})
+			insertUser(t, bd, &User{ID: "user3", Cert: "cert"})
+
+			require.NoError(t, bd.DeleteExpiresBefore(expiration))
+			assert.False(t, bd.Check(depot.CrtTag("user1")))
+			assert.True(t, bd.Check(depot.CrtTag("user2")))
+			assert.True(t, bd.Check(depot.CrtTag("user3")))
+		},
+		"SavePersistsAcrossReopen": func(t *testing.T, path string, bd *boltDepot) {
+			const name = "saved"
+			bd.opts = DepotOptions{CA: caName, DefaultExpiration: time.Hour}
+			creds, err := bd.Generate(name)
+			require.NoError(t, err)
+			require.NoError(t, bd.Save(name, creds))
+			require.NoError(t, bd.Close())
+
+			d, err := NewBoltDBCertDepot(&BoltDBOptions{
+				Path:         path,
+				DepotOptions: DepotOptions{CA: caName},
+			})
+			require.NoError(t, err)
+			reopened := d.(*boltDepot)
+			defer func() {
+				assert.NoError(t, reopened.Close())
+			}()
+
+			found, err := reopened.Find(name)
+			require.NoError(t, err)
+			assert.Equal(t, creds.Cert, found.Cert)
+			assert.Equal(t, creds.Key, found.Key)
+
+			ttl, err := reopened.GetTTL(name)
+			require.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(time.Hour), ttl, time.Minute)
+		},
+		"CloseDoesNotCloseProvidedDatabase": func(t *testing.T, path string, bd *boltDepot) {
+			require.NoError(t, bd.Close())
+			db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+			require.NoError(t, err)
+			defer func() {
+				assert.NoError(t, db.Close())
+			}()
+
+			d, err := NewBoltDBCertDepotWithDB(db, &BoltDBOptions{})
+			require.NoError(t, err)
+			require.NoError(t, d.(*boltDepot).Close())
+			assert.True(t, d.Check(depot.CrtTag(caName)))
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			tempDir, err := ioutil.TempDir(".", "bolt-test")
+			require.NoError(t, err)
+			defer func() {
+				assert.NoError(t, os.RemoveAll(tempDir))
+			}()
+			path := filepath.Join(tempDir, "certs.db")
+
+			d, err := BootstrapDepot(context.Background(), BootstrapDepotConfig{
+				BoltDepot:   &BoltDBOptions{Path: path},
+				CAName:      caName,
+				ServiceName: serviceName,
+				CAOpts: &CertificateOptions{
+					CommonName: caName,
+					Expires:    24 * time.Hour,
+				},
+				ServiceOpts: &CertificateOptions{
+					CA:         caName,
+					CommonName: serviceName,
+					Host:       serviceName,
+					Expires:    24 * time.Hour,
+				},
+			})
+			require.NoError(t, err)
+			bd, ok := d.(*boltDepot)
+			require.True(t, ok)
+			defer bd.Close()
+
+			testCase(t, path, bd)
+		})
+	}
+}
@@ -9,8 +9,9 @@ import (
 )
 
 // BootstrapDepotConfig contains options for BootstrapDepot. Must provide
-// either the name of the FileDepot or the MongoDepot options, not both or
-// neither.
+// exactly one of the name of the FileDepot, the MongoDepot options, the
+// BoltDepot options, the SQLDepot options, the RemoteDepot options, or
+// MemoryDepot.
 type BootstrapDepotConfig struct {
 	// Name of FileDepot (directory). If a MongoDepot is desired, leave
 	// empty.
@@ -18,6 +19,19 @@ type BootstrapDepotConfig struct {
 	// Options for setting up a MongoDepot. If a FileDepot is desired,
 	// leave pointer nil or the struct empty.
 	MongoDepot *MongoDBOptions `bson:"mongo_depot,omitempty" json:"mongo_depot,omitempty" yaml:"mongo_depot,omitempty"`
+	// Options for setting up a depot backed by an embedded bbolt
+	// database. If another depot is desired, leave pointer nil or the
+	// struct empty.
+	BoltDepot *BoltDBOptions `bson:"bolt_depot,omitempty" json:"bolt_depot,omitempty" yaml:"bolt_depot,omitempty"`
+	// Options for setting up a depot backed by a SQL database. If another
+	// depot is desired, leave pointer nil or the struct empty.
+	SQLDepot *SQLDepotOptions `bson:"sql_depot,omitempty" json:"sql_depot,omitempty" yaml:"sql_depot,omitempty"`
+	// Options for setting up a depot backed by a remote depot service. If
+	// another depot is desired, leave pointer nil or the struct empty.
+	RemoteDepot *RemoteDepotOptions `bson:"remote_depot,omitempty" json:"remote_depot,omitempty" yaml:"remote_depot,omitempty"`
+	// Whether to use an in-memory depot. The contents of the depot are
+	// not persisted.
+	MemoryDepot bool `bson:"memory_depot,omitempty" json:"memory_depot,omitempty" yaml:"memory_depot,omitempty"`
 	// CA certificate, this is optional unless CAKey is not empty, in
 	// which case a CA certificate must also be provided.
 	CACert string `bson:"ca_cert" json:"ca_cert" yaml:"ca_cert"`
@@ -41,11 +55,31 @@ type BootstrapDepotConfig struct {
 
 // Validate ensures that the BootstrapDepotConfig is configured correctly.
 func (c *BootstrapDepotConfig) Validate() error {
-	if c.FileDepot != "" && c.MongoDepot != nil && !c.MongoDepot.IsZero() {
+	var depots int
+	if c.FileDepot != "" {
+		depots++
+	}
+	if c.MongoDepot != nil && !c.MongoDepot.IsZero() {
+		depots++
+	}
+	if c.BoltDepot != nil && !c.BoltDepot.IsZero() {
+		depots++
+	}
+	if c.SQLDepot != nil && !c.SQLDepot.IsZero() {
+		depots++
+	}
+	if c.RemoteDepot != nil && !c.RemoteDepot.IsZero() {
+		depots++
+	}
+	if c.MemoryDepot {
+		depots++
+	}
+
+	if depots > 1 {
 		return errors.New("cannot specify more than one depot configuration")
 	}
 
-	if c.FileDepot == "" && (c.MongoDepot == nil || c.MongoDepot.IsZero()) {
+	if depots == 0 {
 		return errors.New("must specify one depot configuration")
 	}
 
@@ -120,6 +154,23 @@ func CreateDepot(ctx context.Context, client *mongo.Client, conf BootstrapDepotC
 		if err != nil {
 			return nil, errors.Wrap(err, "problem initializing the file deopt")
 		}
+	} else if conf.MemoryDepot {
+		d = NewMemoryDepot(DepotOptions{})
+	} else if conf.BoltDepot != nil && !conf.BoltDepot.IsZero() {
+		d, err = NewBoltDBCertDepot(conf.BoltDepot)
+		if err != nil {
+			return nil, errors.Wrap(err, "problem initializing the bolt depot")
+		}
+	} else if conf.SQLDepot != nil && !conf.SQLDepot.IsZero() {
+		d, err = NewSQLCertDepot(ctx, conf.SQLDepot)
+		if err != nil {
+			return nil, errors.Wrap(err, "problem initializing the sql depot")
+		}
+	} else if conf.RemoteDepot != nil && !conf.RemoteDepot.IsZero() {
+		d, err = NewRemoteDepot(conf.RemoteDepot)
+		if err != nil {
+			return nil, errors.Wrap(err, "problem initializing the remote depot")
+		}
 	} else if !conf.MongoDepot.IsZero() {
 		if client != nil {
 			d, err = NewMongoDBCertDepotWithClient(ctx, client, conf.MongoDepot)
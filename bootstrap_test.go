@@ -53,6 +53,47 @@ func TestBootstrapDepotConfigValidate(t *testing.T) {
 				CAKey:       "ca key",
 			},
 		},
+		{
+			name: "ValidMemoryDepot",
+			conf: BootstrapDepotConfig{
+				MemoryDepot: true,
+				CAName:      "root",
+				ServiceName: "localhost",
+				CACert:      "ca cert",
+				CAKey:       "ca key",
+			},
+		},
+		{
+			name: "ValidBoltDepot",
+			conf: BootstrapDepotConfig{
+				BoltDepot:   &BoltDBOptions{Path: "certs.db"},
+				CAName:      "root",
+				ServiceName: "localhost",
+				CACert:      "ca cert",
+				CAKey:       "ca key",
+			},
+		},
+		{
+			name: "ValidSQLDepot",
+			conf: BootstrapDepotConfig{
+				SQLDepot: &SQLDepotOptions{
+					DriverName:     "sqlite",
+					DataSourceName: "certs.db",
+				},
+				CAName:      "root",
+				ServiceName: "localhost",
+				CACert:      "ca cert",
+				CAKey:       "ca key",
+			},
+		},
+		{
+			name: "ValidRemoteDepot",
+			conf: BootstrapDepotConfig{
+				RemoteDepot: &RemoteDepotOptions{URL: "https://localhost"},
+				CAName:      "root",
+				ServiceName: "localhost",
+			},
+		},
 		{
 			name: "UnsetDepot",
 			conf: BootstrapDepotConfig{
@@ -89,6 +130,58 @@ func TestBootstrapDepotConfigValidate(t *testing.T) {
 			},
 			fail: true,
 		},
+		{
+			name: "FileAndMemoryDepotSet",
+			conf: BootstrapDepotConfig{
+				FileDepot:   "depot",
+				MemoryDepot: true,
+				CAName:      "root",
+				ServiceName: "localhost",
+				CACert:      "ca cert",
+				CAKey:       "ca key",
+			},
+			fail: true,
+		},
+		{
+			name: "MongoAndBoltDepotSet",
+			conf: BootstrapDepotConfig{
+				MongoDepot: &MongoDBOptions{
+					DatabaseName:   "one",
+					CollectionName: "two",
+				},
+				BoltDepot:   &BoltDBOptions{Path: "certs.db"},
+				CAName:      "root",
+				ServiceName: "localhost",
+				CACert:      "ca cert",
+				CAKey:       "ca key",
+			},
+			fail: true,
+		},
+		{
+			name: "BoltAndSQLDepotSet",
+			conf: BootstrapDepotConfig{
+				BoltDepot: &BoltDBOptions{Path: "certs.db"},
+				SQLDepot: &SQLDepotOptions{
+					DriverName:     "sqlite",
+					DataSourceName: "certs.db",
+				},
+				CAName:      "root",
+				ServiceName: "localhost",
+				CACert:      "ca cert",
+				CAKey:       "ca key",
+			},
+			fail: true,
+		},
+		{
+			name: "FileAndRemoteDepotSet",
+			conf: BootstrapDepotConfig{
+				FileDepot:   "depot",
+				RemoteDepot: &RemoteDepotOptions{URL: "https://localhost"},
+				CAName:      "root",
+				ServiceName: "localhost",
+			},
+			fail: true,
+		},
 		{
 			name: "NoCANameOrServiceName",
 			conf: BootstrapDepotConfig{
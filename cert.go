@@ -14,11 +14,17 @@ import (
 
 // CertificateOptions contains options to use for Init, CertRequest, and Sign.
 type CertificateOptions struct {
+	// Name of the profile in the depot that provides the values of unset
+	// options.
+	Profile string `bson:"profile,omitempty" json:"profile,omitempty" yaml:"profile,omitempty"`
+
 	//
 	// Options specific to Init and CertRequest.
 	//
 	// Passprhase to encrypt private-key PEM block.
 	Passphrase string `bson:"passphrase,omitempty" json:"passphrase,omitempty" yaml:"passphrase,omitempty"`
+	// Type of keypair to generate (defaults to RSA).
+	KeyType KeyType `bson:"key_type,omitempty" json:"key_type,omitempty" yaml:"key_type,omitempty"`
 	// Size (in bits) of RSA keypair to generate (defaults to 2048).
 	KeyBits int `bson:"key_bits,omitempty" json:"key_bits,omitempty" yaml:"key_bits,omitempty"`
 	// Sets the Organization (O) field of the certificate.
@@ -47,6 +53,13 @@ type CertificateOptions struct {
 	//
 	// How long until the certificate expires.
 	Expires time.Duration `bson:"expires,omitempty" json:"expires,omitempty" yaml:"expires,omitempty"`
+	// Maximum number of intermediate CAs that may follow a CA certificate
+	// in a chain. By default, a CA may not issue any intermediate CAs. An
+	// intermediate issued by a CA with a maximum path length must have a
+	// shorter one.
+	MaxPathLen int `bson:"max_path_len,omitempty" json:"max_path_len,omitempty" yaml:"max_path_len,omitempty"`
+	// Names that a CA certificate may issue certificates for.
+	NameConstraints NameConstraints `bson:"name_constraints,omitempty" json:"name_constraints,omitempty" yaml:"name_constraints,omitempty"`
 
 	//
 	// Options specific to Sign.
@@ -59,6 +72,18 @@ type CertificateOptions struct {
 	CAPassphrase string `bson:"ca_passphrase,omitempty" json:"ca_passphrase,omitempty" yaml:"ca_passphrase,omitempty"`
 	// Whether generated certificate should be an intermediate.
 	Intermediate bool `bson:"intermediate,omitempty" json:"intermediate,omitempty" yaml:"intermediate,omitempty"`
+	// Whether generated certificate should be a delegated OCSP signer for
+	// the CA.
+	OCSPSigner bool `bson:"ocsp_signer,omitempty" json:"ocsp_signer,omitempty" yaml:"ocsp_signer,omitempty"`
+	// URLs of the CA's CRL to add to the certificate as CRL distribution
+	// points.
+	CRLDistributionPoints []string `bson:"crl_distribution_points,omitempty" json:"crl_distribution_points,omitempty" yaml:"crl_distribution_points,omitempty"`
+	// Purposes for which the certificate may be used. If empty, the
+	// certificate may be used both as a TLS server and as a TLS client.
+	ExtKeyUsage []ExtKeyUsage `bson:"ext_key_usage,omitempty" json:"ext_key_usage,omitempty" yaml:"ext_key_usage,omitempty"`
+	// Operations the certificate's key may be used for, which must be
+	// consistent with ExtKeyUsage. If empty, all operations are allowed.
+	KeyUsage []KeyUsage `bson:"key_usage,omitempty" json:"key_usage,omitempty" yaml:"key_usage,omitempty"`
 
 	csr *pkix.CertificateSigningRequest
 	key *pkix.Key
@@ -67,6 +92,9 @@ type CertificateOptions struct {
 
 // Init initializes a new CA.
 func (opts *CertificateOptions) Init(wd depot.Depot) error {
+	if err := opts.ApplyProfile(wd); err != nil {
+		return errors.Wrap(err, "problem applying profile")
+	}
 	if opts.CommonName == "" {
 		return errors.New("must provide common name of CA")
 	}
@@ -76,13 +104,18 @@ func (opts *CertificateOptions) Init(wd depot.Depot) error {
 		return errors.New("CA with specified name already exists")
 	}
 
+	constraints, err := opts.caConstraints()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
 	key, err := opts.getOrCreatePrivateKey()
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
 	expiresTime := time.Now().Add(opts.Expires)
-	crt, err := pkix.CreateCertificateAuthority(
+	crt, err := createCertificateAuthority(
 		key,
 		opts.OrganizationalUnit,
 		expiresTime,
@@ -91,6 +124,7 @@ func (opts *CertificateOptions) Init(wd depot.Depot) error {
 		opts.Province,
 		opts.Locality,
 		opts.CommonName,
+		constraints,
 	)
 	if err != nil {
 		return errors.Wrap(err, "problem creating certificate authority")
@@ -101,11 +135,11 @@ func (opts *CertificateOptions) Init(wd depot.Depot) error {
 	}
 
 	if opts.Passphrase != "" {
-		if err = depot.PutEncryptedPrivateKey(wd, formattedName, key, []byte(opts.Passphrase)); err != nil {
+		if err = PutEncryptedPrivateKey(wd, formattedName, key, []byte(opts.Passphrase)); err != nil {
 			return errors.Wrap(err, "problem saving encrypted private key")
 		}
 	} else {
-		if err = depot.PutPrivateKey(wd, formattedName, key); err != nil {
+		if err = PutPrivateKey(wd, formattedName, key); err != nil {
 			return errors.Wrap(err, "problem saving private key")
 		}
 	}
@@ -119,15 +153,20 @@ func (opts *CertificateOptions) Init(wd depot.Depot) error {
 		return errors.Wrap(err, "problem saving certificate revocation list")
 	}
 
-	if md, ok := wd.(*mongoDepot); ok {
+	if _, ok := wd.(ExpirationManager); ok {
 		rawCrt, err := crt.GetRawCertificate()
 		if err != nil {
 			return errors.Wrap(err, "problem getting raw cert")
 		}
-		if err = md.PutTTL(formattedName, rawCrt.NotAfter); err != nil {
+		if err = putTTL(wd, formattedName, rawCrt.NotAfter); err != nil {
 			return errors.Wrap(err, "problem setting certificate TTL")
 		}
 	}
+	// a root CA has no issuer, so clear any record left by a previous
+	// certificate with the same name
+	if err = putParent(wd, formattedName, ""); err != nil {
+		return errors.Wrap(err, "problem clearing certificate issuer")
+	}
 	return nil
 }
 
@@ -144,6 +183,11 @@ func (opts *CertificateOptions) Reset() {
 // CertRequest creates a new certificate signing request (CSR) and key and puts
 // them in the depot.
 func (opts *CertificateOptions) CertRequest(wd depot.Depot) error {
+	if !opts.certRequestedInMemory() {
+		if err := opts.ApplyProfile(wd); err != nil {
+			return errors.Wrap(err, "problem applying profile")
+		}
+	}
 	if _, _, err := opts.CertRequestInMemory(); err != nil {
 		return errors.Wrap(err, "problem creating cert request and key")
 	}
@@ -226,11 +270,11 @@ func (opts *CertificateOptions) PutCertRequestFromMemory(wd depot.Depot) error {
 	}
 
 	if opts.Passphrase != "" {
-		if err = depot.PutEncryptedPrivateKey(wd, formattedName, opts.key, []byte(opts.Passphrase)); err != nil {
+		if err = PutEncryptedPrivateKey(wd, formattedName, opts.key, []byte(opts.Passphrase)); err != nil {
 			return errors.Wrap(err, "problem saving encrypted private key")
 		}
 	} else {
-		if err = depot.PutPrivateKey(wd, formattedName, opts.key); err != nil {
+		if err = PutPrivateKey(wd, formattedName, opts.key); err != nil {
 			return errors.Wrap(err, "problem saving private key error")
 		}
 	}
@@ -259,6 +303,9 @@ func (opts *CertificateOptions) SignInMemory(wd depot.Depot) (*pkix.Certificate,
 	if opts.signedInMemory() {
 		return opts.crt, nil
 	}
+	if err := opts.ApplyProfile(wd); err != nil {
+		return nil, errors.Wrap(err, "problem applying profile")
+	}
 	if opts.Host == "" {
 		return nil, errors.New("must provide name of host")
 	}
@@ -266,7 +313,6 @@ func (opts *CertificateOptions) SignInMemory(wd depot.Depot) (*pkix.Certificate,
 		return nil, errors.New("must provide name of CA")
 	}
 	formattedReqName := strings.Replace(opts.Host, " ", "_", -1)
-	formattedCAName := strings.Replace(opts.CA, " ", "_", -1)
 
 	var csr *pkix.CertificateSigningRequest
 	if opts.certRequestedInMemory() {
@@ -278,6 +324,70 @@ func (opts *CertificateOptions) SignInMemory(wd depot.Depot) (*pkix.Certificate,
 			return nil, errors.Wrap(err, "problem getting host's certificate signing request")
 		}
 	}
+
+	return opts.signInMemory(wd, csr)
+}
+
+// SignCertificateRequestInMemory is the same as SignInMemory but signs the
+// given certificate request, such as one submitted by a client that holds the
+// private key, instead of one created from the options. The signature of the
+// certificate request is checked before it is signed. Host is only required to
+// put the certificate in the depot with PutCertFromMemory.
+func (opts *CertificateOptions) SignCertificateRequestInMemory(wd depot.Depot, csr *pkix.CertificateSigningRequest) (*pkix.Certificate, error) {
+	if csr == nil {
+		return nil, errors.New("must provide a certificate request")
+	}
+	if err := opts.ApplyProfile(wd); err != nil {
+		return nil, errors.Wrap(err, "problem applying profile")
+	}
+	if opts.CA == "" {
+		return nil, errors.New("must provide name of CA")
+	}
+
+	rawCsr, err := csr.GetRawCertificateSigningRequest()
+	if err != nil {
+		return nil, errors.Wrap(err, "problem getting raw certificate request")
+	}
+	if err = rawCsr.CheckSignature(); err != nil {
+		return nil, errors.Wrap(err, "invalid certificate request signature")
+	}
+
+	opts.Reset()
+	return opts.signInMemory(wd, csr)
+}
+
+func (opts *CertificateOptions) signInMemory(wd depot.Depot, csr *pkix.CertificateSigningRequest) (*pkix.Certificate, error) {
+	if opts.Intermediate && opts.OCSPSigner {
+		return nil, errors.New("certificate cannot be both an intermediate and an OCSP signer")
+	}
+	hasUsages := len(opts.ExtKeyUsage) > 0 || len(opts.KeyUsage) > 0
+	if (opts.Intermediate || opts.OCSPSigner) && hasUsages {
+		return nil, errors.New("cannot set key usages of intermediate or OCSP signer certificates")
+	}
+	if !opts.Intermediate && opts.hasCAConstraints() {
+		return nil, errors.New("cannot set path length or name constraints of certificates that are not CAs")
+	}
+	if signer, ok := wd.(CertificateSigner); ok {
+		if opts.Intermediate || opts.OCSPSigner {
+			return nil, errors.New("depot does not support signing intermediate or OCSP signer certificates")
+		}
+		if len(opts.CRLDistributionPoints) > 0 {
+			return nil, errors.New("depot does not support setting CRL distribution points")
+		}
+		if hasUsages {
+			return nil, errors.New("depot does not support setting key usages")
+		}
+		crtOut, err := signer.SignCertificateRequest(opts.CA, csr, opts.Expires)
+		if err != nil {
+			return nil, errors.Wrap(err, "problem signing certificate request with depot")
+		}
+		opts.crt = crtOut
+
+		return crtOut, nil
+	}
+
+	formattedCAName := strings.Replace(opts.CA, " ", "_", -1)
+
 	crt, err := depot.GetCertificate(wd, formattedCAName)
 	if err != nil {
 		return nil, errors.Wrap(err, "problem getting CA certificate")
@@ -288,21 +398,28 @@ func (opts *CertificateOptions) SignInMemory(wd depot.Depot) (*pkix.Certificate,
 	if err != nil {
 		return nil, errors.Wrap(err, "problem getting raw CA certificate")
 	}
-	// we punt on checking BasicConstraintsValid and checking MaxPathLen. The goal
-	// is to prevent accidentally creating invalid certificates, not protecting
-	// against malicious input.
-	if !rawCrt.IsCA {
+	if !rawCrt.BasicConstraintsValid || !rawCrt.IsCA {
 		return nil, errors.Errorf("%s is not allowed to sign certificates", opts.CA)
 	}
+	rawCsr, err := csr.GetRawCertificateSigningRequest()
+	if err != nil {
+		return nil, errors.Wrap(err, "problem getting raw certificate request")
+	}
+	if err = checkNameConstraints(wd, formattedCAName, rawCrt, rawCsr); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = opts.checkPolicy(wd, formattedCAName, rawCsr); err != nil {
+		return nil, errors.WithStack(err)
+	}
 
 	var key *pkix.Key
 	if opts.CAPassphrase == "" {
-		key, err = depot.GetPrivateKey(wd, formattedCAName)
+		key, err = GetPrivateKey(wd, formattedCAName)
 		if err != nil {
 			return nil, errors.Wrap(err, "problem getting unencrypted (assumed) CA key")
 		}
 	} else {
-		key, err = depot.GetEncryptedPrivateKey(wd, formattedCAName, []byte(opts.CAPassphrase))
+		key, err = GetEncryptedPrivateKey(wd, formattedCAName, []byte(opts.CAPassphrase))
 		if err != nil {
 			return nil, errors.Wrap(err, "problem getting encrypted CA key")
 		}
@@ -310,10 +427,24 @@ func (opts *CertificateOptions) SignInMemory(wd depot.Depot) (*pkix.Certificate,
 
 	expiresTime := time.Now().Add(opts.Expires)
 	var crtOut *pkix.Certificate
-	if opts.Intermediate {
-		crtOut, err = pkix.CreateIntermediateCertificateAuthority(crt, key, csr, expiresTime)
-	} else {
-		crtOut, err = pkix.CreateCertificateHost(crt, key, csr, expiresTime)
+	switch {
+	case opts.Intermediate:
+		var constraints caConstraints
+		constraints, err = opts.intermediateConstraints(rawCrt)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		crtOut, err = createIntermediateCertificateAuthority(crt, key, csr, expiresTime, opts.CRLDistributionPoints, constraints)
+	case opts.OCSPSigner:
+		crtOut, err = createOCSPSigner(crt, key, csr, expiresTime, opts.CRLDistributionPoints)
+	default:
+		var keyUsage x509.KeyUsage
+		var extKeyUsage []x509.ExtKeyUsage
+		keyUsage, extKeyUsage, err = resolveUsages(opts.KeyUsage, opts.ExtKeyUsage, rawCsr.PublicKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid key usages")
+		}
+		crtOut, err = createCertificateHost(crt, key, csr, expiresTime, opts.CRLDistributionPoints, keyUsage, extKeyUsage)
 	}
 	if err != nil {
 		return nil, errors.Wrap(err, "problem creating certificate")
@@ -325,7 +456,9 @@ func (opts *CertificateOptions) SignInMemory(wd depot.Depot) (*pkix.Certificate,
 }
 
 // PutCertFromMemory stores the certificate generated from the options in the
-// depot, along with the expiration TTL on the certificate.
+// depot, along with the expiration TTL on the certificate and the name of the
+// CA that issued it. An empty CRL is also stored for an intermediate CA whose
+// key was generated from the options.
 func (opts *CertificateOptions) PutCertFromMemory(wd depot.Depot) error {
 	if !opts.signedInMemory() {
 		return errors.New("must sign cert first before putting into depot")
@@ -340,15 +473,34 @@ func (opts *CertificateOptions) PutCertFromMemory(wd depot.Depot) error {
 		return errors.Wrap(err, "problem saving certificate")
 	}
 
-	if md, ok := wd.(*mongoDepot); ok {
+	if _, ok := wd.(ExpirationManager); ok {
 		rawCrt, err := opts.crt.GetRawCertificate()
 		if err != nil {
 			return errors.Wrap(err, "problem getting raw certificate")
 		}
-		if err = md.PutTTL(formattedReqName, rawCrt.NotAfter); err != nil {
+		if err = putTTL(wd, formattedReqName, rawCrt.NotAfter); err != nil {
 			return errors.Wrap(err, "problem saving certificate TTL")
 		}
 	}
+	if err := putParent(wd, formattedReqName, opts.CA); err != nil {
+		return errors.Wrap(err, "problem saving certificate issuer")
+	}
+
+	// like Init, create an empty CRL for an intermediate CA, which requires
+	// its key
+	if opts.Intermediate && opts.key != nil && !wd.Check(CrlTag(formattedReqName)) {
+		rawCrt, err := opts.crt.GetRawCertificate()
+		if err != nil {
+			return errors.Wrap(err, "problem getting raw certificate")
+		}
+		crl, err := pkix.CreateCertificateRevocationList(opts.key, opts.crt, rawCrt.NotAfter)
+		if err != nil {
+			return errors.Wrap(err, "problem creating certificate revocation list")
+		}
+		if err = depot.PutCertificateRevocationList(wd, formattedReqName, crl); err != nil {
+			return errors.Wrap(err, "problem saving certificate revocation list")
+		}
+	}
 
 	return nil
 }
@@ -387,7 +539,7 @@ func (opts CertificateOptions) getOrCreatePrivateKey() (*pkix.Key, error) {
 		if err != nil {
 			return nil, errors.Wrapf(err, "problem reading key from %s", opts.Key)
 		}
-		key, err = pkix.NewKeyFromPrivateKeyPEM(keyBytes)
+		key, err = parsePrivateKey(keyBytes)
 		if err != nil {
 			return nil, errors.Wrapf(err, "problem getting key from PEM")
 		}
@@ -396,9 +548,9 @@ func (opts CertificateOptions) getOrCreatePrivateKey() (*pkix.Key, error) {
 			opts.KeyBits = 2048
 		}
 		var err error
-		key, err = pkix.CreateRSAKey(opts.KeyBits)
+		key, err = createPrivateKey(opts.KeyType, opts.KeyBits)
 		if err != nil {
-			return nil, errors.Wrap(err, "problem creating RSA key")
+			return nil, errors.Wrap(err, "problem creating key")
 		}
 	}
 	return key, nil
@@ -436,26 +588,24 @@ func (opts *CertificateOptions) CreateCertificate(wd depot.Depot) error {
 
 // CreateCertificateOnExpiration checks if a certificate does not exist or if
 // it expires within the duration `after` and creates a new certificate if
-// either condition is met. True is returned if a certificate is created,
-// false otherwise. If the certificate is a CA, the behavior is undefined.
+// either condition is met. An expiring certificate is replaced using Renew, so
+// it is only removed once the new certificate has been created. True is
+// returned if a certificate is created, false otherwise. If the certificate is
+// a CA, the behavior is undefined.
 func (opts *CertificateOptions) CreateCertificateOnExpiration(wd depot.Depot, after time.Duration) (bool, error) {
-	dne := true
-	var created bool
-	var err error
-
-	if depot.CheckCertificate(wd, opts.CommonName) {
-		dne, err = DeleteOnExpiration(wd, opts.CommonName, after)
-		if err != nil {
-			return created, errors.Wrap(err, "problem deleting expiring certificate")
-		}
+	if !depot.CheckCertificate(wd, opts.CommonName) {
+		return true, errors.Wrap(opts.CreateCertificate(wd), "problem creating certificate")
 	}
 
-	if dne {
-		err = opts.CreateCertificate(wd)
-		created = true
+	rawCert, err := getRawCertificate(wd, opts.CommonName)
+	if err != nil {
+		return false, errors.Wrap(err, "problem getting raw certificate")
+	}
+	if !rawCert.NotAfter.Before(time.Now().Add(after)) {
+		return false, nil
 	}
 
-	return created, errors.Wrap(err, "problem creating certificate")
+	return true, errors.Wrap(opts.Renew(wd), "problem renewing certificate")
 }
 
 // ValidityBounds returns the date range for which the certificate is valid.
@@ -560,6 +560,136 @@ func TestInMemory(t *testing.T) {
 
 					assert.Equal(t, dbCrt, pemCrt)
 				},
+				"CreatesOCSPSigner": func(t *testing.T, name string) {
+					opts.OCSPSigner = true
+					defer func() { opts.OCSPSigner = false }()
+					_, _, err := opts.CertRequestInMemory()
+					require.NoError(t, err)
+					crt, err := opts.SignInMemory(d)
+					require.NoError(t, err)
+
+					rawCrt, err := crt.GetRawCertificate()
+					require.NoError(t, err)
+					checkMatchingCert(t, opts, rawCrt)
+					assert.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}, rawCrt.ExtKeyUsage)
+					assert.False(t, rawCrt.IsCA)
+					var hasNoCheck bool
+					for _, ext := range rawCrt.Extensions {
+						hasNoCheck = hasNoCheck || ext.Id.Equal(oidOCSPNoCheck)
+					}
+					assert.True(t, hasNoCheck)
+				},
+				"FailsAsIntermediateAndOCSPSigner": func(t *testing.T, name string) {
+					opts.Intermediate = true
+					opts.OCSPSigner = true
+					defer func() {
+						opts.Intermediate = false
+						opts.OCSPSigner = false
+					}()
+					_, _, err := opts.CertRequestInMemory()
+					require.NoError(t, err)
+					_, err = opts.SignInMemory(d)
+					assert.Error(t, err)
+				},
+				"SetsCRLDistributionPoints": func(t *testing.T, name string) {
+					opts.CRLDistributionPoints = []string{"http://crl.example.com/ca.crl"}
+					defer func() { opts.CRLDistributionPoints = nil }()
+					_, _, err := opts.CertRequestInMemory()
+					require.NoError(t, err)
+					crt, err := opts.SignInMemory(d)
+					require.NoError(t, err)
+
+					rawCrt, err := crt.GetRawCertificate()
+					require.NoError(t, err)
+					checkMatchingCert(t, opts, rawCrt)
+					assert.Equal(t, opts.CRLDistributionPoints, rawCrt.CRLDistributionPoints)
+				},
+				"SetsUsages": func(t *testing.T, name string) {
+					defer func() {
+						opts.ExtKeyUsage = nil
+						opts.KeyUsage = nil
+					}()
+					for usageName, usages := range map[string]struct {
+						extKeyUsage         []ExtKeyUsage
+						keyUsage            []KeyUsage
+						expectedExtKeyUsage []x509.ExtKeyUsage
+						expectedKeyUsage    x509.KeyUsage
+					}{
+						"Default": {
+							expectedExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+							expectedKeyUsage:    x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement,
+						},
+						"ServerOnly": {
+							extKeyUsage:         []ExtKeyUsage{ExtKeyUsageServerAuth},
+							expectedExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+							expectedKeyUsage:    x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement,
+						},
+						"ClientOnlyWithKeyUsage": {
+							extKeyUsage:         []ExtKeyUsage{ExtKeyUsageClientAuth},
+							keyUsage:            []KeyUsage{KeyUsageDigitalSignature},
+							expectedExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+							expectedKeyUsage:    x509.KeyUsageDigitalSignature,
+						},
+						"CodeSigning": {
+							extKeyUsage:         []ExtKeyUsage{ExtKeyUsageCodeSigning},
+							keyUsage:            []KeyUsage{KeyUsageDigitalSignature},
+							expectedExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+							expectedKeyUsage:    x509.KeyUsageDigitalSignature,
+						},
+					} {
+						opts.Reset()
+						opts.ExtKeyUsage = usages.extKeyUsage
+						opts.KeyUsage = usages.keyUsage
+						_, _, err := opts.CertRequestInMemory()
+						require.NoError(t, err, usageName)
+						crt, err := opts.SignInMemory(d)
+						require.NoError(t, err, usageName)
+
+						rawCrt, err := crt.GetRawCertificate()
+						require.NoError(t, err, usageName)
+						assert.Equal(t, usages.expectedExtKeyUsage, rawCrt.ExtKeyUsage, usageName)
+						assert.Equal(t, usages.expectedKeyUsage, rawCrt.KeyUsage, usageName)
+					}
+				},
+				"FailsWithInvalidUsages": func(t *testing.T, name string) {
+					defer func() {
+						opts.ExtKeyUsage = nil
+						opts.KeyUsage = nil
+						opts.Intermediate = false
+						opts.OCSPSigner = false
+					}()
+					for usageName, setUsages := range map[string]func(){
+						"UnknownExtKeyUsage": func() {
+							opts.ExtKeyUsage = []ExtKeyUsage{"unknown"}
+						},
+						"UnknownKeyUsage": func() {
+							opts.KeyUsage = []KeyUsage{"certSign"}
+						},
+						"IncompatibleKeyUsage": func() {
+							opts.ExtKeyUsage = []ExtKeyUsage{ExtKeyUsageServerAuth}
+							opts.KeyUsage = []KeyUsage{KeyUsageContentCommitment}
+						},
+						"Intermediate": func() {
+							opts.ExtKeyUsage = []ExtKeyUsage{ExtKeyUsageServerAuth}
+							opts.Intermediate = true
+						},
+						"OCSPSigner": func() {
+							opts.KeyUsage = []KeyUsage{KeyUsageDigitalSignature}
+							opts.OCSPSigner = true
+						},
+					} {
+						opts.Reset()
+						opts.ExtKeyUsage = nil
+						opts.KeyUsage = nil
+						opts.Intermediate = false
+						opts.OCSPSigner = false
+						setUsages()
+						_, _, err := opts.CertRequestInMemory()
+						require.NoError(t, err, usageName)
+						_, err = opts.SignInMemory(d)
+						assert.Error(t, err, usageName)
+					}
+				},
 				"ReturnsIdenticalOnSubsequentCalls": func(t *testing.T, name string) {
 					_, _, err := opts.CertRequestInMemory()
 					require.NoError(t, err)
@@ -611,6 +741,35 @@ func TestInMemory(t *testing.T) {
 					require.NoError(t, err)
 					assert.Equal(t, pemCert, depotCert)
 				},
+				"SucceedsWithSignCertificateRequestInMemory": func(t *testing.T, name string) {
+					external := &CertificateOptions{CommonName: "external", Domain: []string{"external"}}
+					csr, _, err := external.CertRequestInMemory()
+					require.NoError(t, err)
+
+					cert, err := opts.SignCertificateRequestInMemory(d, csr)
+					require.NoError(t, err)
+					rawCert, err := cert.GetRawCertificate()
+					require.NoError(t, err)
+					assert.Equal(t, "external", rawCert.Subject.CommonName)
+					assert.Equal(t, []string{"external"}, rawCert.DNSNames)
+
+					require.NoError(t, opts.PutCertFromMemory(d))
+					assert.True(t, depot.CheckCertificate(d, name))
+				},
+				"SignCertificateRequestInMemoryFailsWithInvalidSignature": func(t *testing.T, name string) {
+					external := &CertificateOptions{CommonName: "external"}
+					csr, _, err := external.CertRequestInMemory()
+					require.NoError(t, err)
+					der, err := csr.GetRawCertificateSigningRequest()
+					require.NoError(t, err)
+					raw := append([]byte{}, der.Raw...)
+					raw[len(raw)-1] ^= 0xff
+
+					_, err = opts.SignCertificateRequestInMemory(d, pkix.NewCertificateSigningRequestFromDER(raw))
+					assert.Error(t, err)
+					_, err = opts.SignCertificateRequestInMemory(d, nil)
+					assert.Error(t, err)
+				},
 			} {
 				t.Run(subTestName, func(t *testing.T) {
 					name, err := opts.getFormattedCertificateRequestName()
@@ -690,6 +849,7 @@ func TestSign(t *testing.T) {
 		OrganizationalUnit: "dag",
 		Province:           "Pichincha",
 		Expires:            48 * time.Hour,
+		MaxPathLen:         1,
 	}
 	csrOpts := &CertificateOptions{
 		CommonName:         "exists",
@@ -0,0 +1,174 @@
+package certdepot
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"time"
+
+	"github.com/pkg/errors"
+	cpkix "github.com/square/certstrap/pkix"
+)
+
+// The functions in this file mirror the certificate creation functions in
+// certstrap's pkix package, which only support RSA keys.
+
+// notBeforeSkew is subtracted from the current time when setting NotBefore so
+// that certificates are valid on hosts with slightly skewed clocks.
+const notBeforeSkew = 10 * time.Minute
+
+func newSerialNumber() (*big.Int, error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	return serialNumber, errors.Wrap(err, "problem generating serial number")
+}
+
+func newAuthTemplate() x509.Certificate {
+	return x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-notBeforeSkew).UTC(),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		// Do not allow any non-self-issued intermediate CA.
+		MaxPathLenZero: true,
+	}
+}
+
+// issuedNotAfter returns the proposed expiry, capped so that the certificate
+// does not expire after its issuer.
+func issuedNotAfter(crtAuth *cpkix.Certificate, proposedExpiry time.Time) time.Time {
+	caExpiry := time.Now().Add(crtAuth.GetExpirationDuration())
+	if caExpiry.Before(proposedExpiry) {
+		return caExpiry
+	}
+	return proposedExpiry
+}
+
+// createCertificateAuthority creates a self-signed CA certificate for the key
+// with the given constraints.
+func createCertificateAuthority(key *cpkix.Key, organizationalUnit string, expiry time.Time, organization string, country string, province string, locality string, commonName string, constraints caConstraints) (*cpkix.Certificate, error) {
+	authTemplate := newAuthTemplate()
+	if err := constraints.apply(&authTemplate); err != nil {
+		return nil, errors.Wrap(err, "problem applying CA constraints")
+	}
+
+	subjectKeyID, err := generateSubjectKeyID(key.Public)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem generating subject key ID")
+	}
+	authTemplate.SubjectKeyId = subjectKeyID
+	authTemplate.NotAfter = expiry
+	if len(country) > 0 {
+		authTemplate.Subject.Country = []string{country}
+	}
+	if len(province) > 0 {
+		authTemplate.Subject.Province = []string{province}
+	}
+	if len(locality) > 0 {
+		authTemplate.Subject.Locality = []string{locality}
+	}
+	if len(organization) > 0 {
+		authTemplate.Subject.Organization = []string{organization}
+	}
+	if len(organizationalUnit) > 0 {
+		authTemplate.Subject.OrganizationalUnit = []string{organizationalUnit}
+	}
+	if len(commonName) > 0 {
+		authTemplate.Subject.CommonName = commonName
+	}
+
+	crtBytes, err := x509.CreateCertificate(rand.Reader, &authTemplate, &authTemplate, key.Public, key.Private)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem creating certificate")
+	}
+
+	return cpkix.NewCertificateFromDER(crtBytes), nil
+}
+
+// createIntermediateCertificateAuthority creates an intermediate CA
+// certificate with the given constraints from the CSR signed by the given
+// authority.
+func createIntermediateCertificateAuthority(crtAuth *cpkix.Certificate, keyAuth *cpkix.Key, csr *cpkix.CertificateSigningRequest, proposedExpiry time.Time, crlDistributionPoints []string, constraints caConstraints) (*cpkix.Certificate, error) {
+	authTemplate := newAuthTemplate()
+	if err := constraints.apply(&authTemplate); err != nil {
+		return nil, errors.Wrap(err, "problem applying CA constraints")
+	}
+
+	return signCertificateRequest(&authTemplate, crtAuth, keyAuth, csr, proposedExpiry, crlDistributionPoints)
+}
+
+// oidOCSPNoCheck is the id-pkix-ocsp-nocheck extension, which tells clients
+// not to check the revocation status of a delegated OCSP signer.
+var oidOCSPNoCheck = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+
+// createOCSPSigner creates a certificate from the CSR signed by the given
+// authority that the authority delegates to sign OCSP responses.
+func createOCSPSigner(crtAuth *cpkix.Certificate, keyAuth *cpkix.Key, csr *cpkix.CertificateSigningRequest, proposedExpiry time.Time, crlDistributionPoints []string) (*cpkix.Certificate, error) {
+	signerTemplate := x509.Certificate{
+		Subject:     pkix.Name{},
+		NotBefore:   time.Now().Add(-notBeforeSkew).UTC(),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidOCSPNoCheck, Value: asn1.NullBytes},
+		},
+	}
+
+	return signCertificateRequest(&signerTemplate, crtAuth, keyAuth, csr, proposedExpiry, crlDistributionPoints)
+}
+
+// createCertificateHost creates a host certificate with the given usages from
+// the CSR signed by the given authority.
+func createCertificateHost(crtAuth *cpkix.Certificate, keyAuth *cpkix.Key, csr *cpkix.CertificateSigningRequest, proposedExpiry time.Time, crlDistributionPoints []string, keyUsage x509.KeyUsage, extKeyUsage []x509.ExtKeyUsage) (*cpkix.Certificate, error) {
+	hostTemplate := x509.Certificate{
+		Subject:     pkix.Name{},
+		NotBefore:   time.Now().Add(-notBeforeSkew).UTC(),
+		KeyUsage:    keyUsage,
+		ExtKeyUsage: extKeyUsage,
+	}
+
+	return signCertificateRequest(&hostTemplate, crtAuth, keyAuth, csr, proposedExpiry, crlDistributionPoints)
+}
+
+func signCertificateRequest(template *x509.Certificate, crtAuth *cpkix.Certificate, keyAuth *cpkix.Key, csr *cpkix.CertificateSigningRequest, proposedExpiry time.Time, crlDistributionPoints []string) (*cpkix.Certificate, error) {
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	template.SerialNumber = serialNumber
+
+	rawCsr, err := csr.GetRawCertificateSigningRequest()
+	if err != nil {
+		return nil, errors.Wrap(err, "problem getting raw certificate request")
+	}
+
+	// pkix.Name{} doesn't take ordering into account. RawSubject works
+	// because CreateCertificate() first checks if RawSubject has a value.
+	template.RawSubject = rawCsr.RawSubject
+	template.NotAfter = issuedNotAfter(crtAuth, proposedExpiry)
+
+	template.SubjectKeyId, err = generateSubjectKeyID(rawCsr.PublicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem generating subject key ID")
+	}
+
+	template.IPAddresses = rawCsr.IPAddresses
+	template.DNSNames = rawCsr.DNSNames
+	template.URIs = rawCsr.URIs
+	template.CRLDistributionPoints = crlDistributionPoints
+
+	rawCrtAuth, err := crtAuth.GetRawCertificate()
+	if err != nil {
+		return nil, errors.Wrap(err, "problem getting raw CA certificate")
+	}
+
+	crtBytes, err := x509.CreateCertificate(rand.Reader, template, rawCrtAuth, rawCsr.PublicKey, keyAuth.Private)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem creating certificate")
+	}
+
+	return cpkix.NewCertificateFromDER(crtBytes), nil
+}
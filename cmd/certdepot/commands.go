@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/deciduosity/certdepot"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+)
+
+// Environment variables holding the passphrases of private keys, which are
+// never passed as flags.
+const (
+	passphraseEnv   = "CERTDEPOT_PASSPHRASE"
+	caPassphraseEnv = "CERTDEPOT_CA_PASSPHRASE"
+)
+
+type stringSlice []string
+
+func (s *stringSlice) String() string { return strings.Join(*s, ",") }
+
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+type keyTypeValue certdepot.KeyType
+
+func (k *keyTypeValue) String() string { return string(*k) }
+
+func (k *keyTypeValue) Set(value string) error {
+	if err := certdepot.KeyType(value).Validate(); err != nil {
+		return err
+	}
+	*k = keyTypeValue(value)
+	return nil
+}
+
+type extKeyUsageSlice []certdepot.ExtKeyUsage
+
+func (s *extKeyUsageSlice) String() string {
+	usages := make([]string, 0, len(*s))
+	for _, usage := range *s {
+		usages = append(usages, string(usage))
+	}
+	return strings.Join(usages, ",")
+}
+
+func (s *extKeyUsageSlice) Set(value string) error {
+	if err := certdepot.ExtKeyUsage(value).Validate(); err != nil {
+		return err
+	}
+	*s = append(*s, certdepot.ExtKeyUsage(value))
+	return nil
+}
+
+type keyUsageSlice []certdepot.KeyUsage
+
+func (s *keyUsageSlice) String() string {
+	usages := make([]string, 0, len(*s))
+	for _, usage := range *s {
+		usages = append(usages, string(usage))
+	}
+	return strings.Join(usages, ",")
+}
+
+func (s *keyUsageSlice) Set(value string) error {
+	if err := certdepot.KeyUsage(value).Validate(); err != nil {
+		return err
+	}
+	*s = append(*s, certdepot.KeyUsage(value))
+	return nil
+}
+
+// passphraseFileValue reads a passphrase from the file named by the flag, so
+// that it is not exposed in the command line of the process.
+type passphraseFileValue string
+
+func (p *passphraseFileValue) String() string { return "" }
+
+func (p *passphraseFileValue) Set(value string) error {
+	data, err := ioutil.ReadFile(value)
+	if err != nil {
+		return errors.Wrapf(err, "problem reading passphrase file '%s'", value)
+	}
+	*p = passphraseFileValue(strings.TrimRight(string(data), "\r\n"))
+	return nil
+}
+
+// registerPassphraseFlag registers a flag with the path to a file holding the
+// passphrase. The passphrase defaults to the value of the environment
+// variable.
+func registerPassphraseFlag(fs *flag.FlagSet, passphrase *string, name, env, usage string) {
+	*passphrase = os.Getenv(env)
+	fs.Var((*passphraseFileValue)(passphrase), name, fmt.Sprintf("path to a file holding the %s (defaults to $%s)", usage, env))
+}
+
+// registerRequestFlags registers the CertificateOptions used by Init and
+// CertRequest.
+func registerRequestFlags(fs *flag.FlagSet, opts *certdepot.CertificateOptions) {
+	fs.StringVar(&opts.CommonName, "cn", "", "common name (CN) of the certificate")
+	registerPassphraseFlag(fs, &opts.Passphrase, "passphrase-file", passphraseEnv, "passphrase to encrypt the private key")
+	fs.Var((*keyTypeValue)(&opts.KeyType), "key-type", "type of key to generate (rsa, ecdsa-p256, ecdsa-p384, ecdsa-p521, ed25519)")
+	fs.IntVar(&opts.KeyBits, "key-bits", 0, "size of the RSA key to generate (defaults to 2048)")
+	fs.StringVar(&opts.Key, "key", "", "path to an existing private key PEM file to use instead of generating one")
+	fs.StringVar(&opts.Organization, "o", "", "organization (O) of the certificate")
+	fs.StringVar(&opts.OrganizationalUnit, "ou", "", "organizational unit (OU) of the certificate")
+	fs.StringVar(&opts.Country, "c", "", "country (C) of the certificate")
+	fs.StringVar(&opts.Province, "st", "", "state or province (ST) of the certificate")
+	fs.StringVar(&opts.Locality, "l", "", "locality (L) of the certificate")
+}
+
+// registerSANFlags registers the subject alternative names of
+// CertificateOptions.
+func registerSANFlags(fs *flag.FlagSet, opts *certdepot.CertificateOptions) {
+	fs.Var((*stringSlice)(&opts.Domain), "domain", "DNS name to add as a subject alt name (may be repeated)")
+	fs.Var((*stringSlice)(&opts.IP), "ip", "IP address to add as a subject alt name (may be repeated)")
+	fs.Var((*stringSlice)(&opts.URI), "uri", "URI to add as a subject alt name (may be repeated)")
+}
+
+// registerSignFlags registers the CertificateOptions used by Sign. The CA is
+// selected with the -ca depot flag.
+func registerSignFlags(fs *flag.FlagSet, opts *certdepot.CertificateOptions) {
+	fs.StringVar(&opts.Host, "host", "", "name of the certificate to sign (defaults to the common name)")
+	registerPassphraseFlag(fs, &opts.CAPassphrase, "ca-passphrase-file", caPassphraseEnv, "passphrase to decrypt the CA private key")
+	fs.BoolVar(&opts.Intermediate, "intermediate", false, "whether the certificate is an intermediate CA")
+	fs.Var((*stringSlice)(&opts.CRLDistributionPoints), "crl-distribution-point", "URL of the CA's CRL to add to the certificate (may be repeated)")
+	fs.Var((*extKeyUsageSlice)(&opts.ExtKeyUsage), "ext-key-usage", "purpose of the certificate (serverAuth, clientAuth, codeSigning, emailProtection, OCSPSigning; may be repeated)")
+	fs.Var((*keyUsageSlice)(&opts.KeyUsage), "key-usage", "operation allowed for the key (digitalSignature, contentCommitment, keyEncipherment, dataEncipherment, keyAgreement; may be repeated)")
+}
+
+// registerCAFlags registers the CertificateOptions that constrain CAs created
+// by Init or signed as intermediates.
+func registerCAFlags(fs *flag.FlagSet, opts *certdepot.CertificateOptions) {
+	fs.IntVar(&opts.MaxPathLen, "max-path-len", 0, "maximum number of intermediate CAs that may follow the CA")
+	fs.Var((*stringSlice)(&opts.NameConstraints.PermittedDNSDomains), "permit-dns", "DNS domain the CA may issue certificates for (may be repeated)")
+	fs.Var((*stringSlice)(&opts.NameConstraints.ExcludedDNSDomains), "exclude-dns", "DNS domain the CA may not issue certificates for (may be repeated)")
+	fs.Var((*stringSlice)(&opts.NameConstraints.PermittedIPRanges), "permit-ip", "IP range in CIDR notation the CA may issue certificates for (may be repeated)")
+	fs.Var((*stringSlice)(&opts.NameConstraints.ExcludedIPRanges), "exclude-ip", "IP range in CIDR notation the CA may not issue certificates for (may be repeated)")
+	fs.Var((*stringSlice)(&opts.NameConstraints.PermittedURIDomains), "permit-uri", "URI domain the CA may issue certificates for (may be repeated)")
+	fs.Var((*stringSlice)(&opts.NameConstraints.ExcludedURIDomains), "exclude-uri", "URI domain the CA may not issue certificates for (may be repeated)")
+}
+
+func registerExpiresFlag(fs *flag.FlagSet, opts *certdepot.CertificateOptions) {
+	fs.DurationVar(&opts.Expires, "expires", 365*24*time.Hour, "how long until the certificate expires")
+}
+
+// resolveSignOptions fills in the CA and host of the options once the flags
+// have been parsed and the depot has been opened.
+func resolveSignOptions(opts *certdepot.CertificateOptions, df *depotFlags) error {
+	opts.CA = df.ca
+	if opts.CA == "" {
+		return errors.New("must specify a CA")
+	}
+	if opts.Host == "" {
+		opts.Host = opts.CommonName
+	}
+	return nil
+}
+
+func initCA(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("init-ca", flag.ContinueOnError)
+	opts := &certdepot.CertificateOptions{}
+	registerRequestFlags(fs, opts)
+	registerCAFlags(fs, opts)
+	registerExpiresFlag(fs, opts)
+	df := &depotFlags{}
+
+	d, err := parse(ctx, fs, args, df)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer df.close()
+	if opts.CommonName == "" {
+		opts.CommonName = df.ca
+	}
+
+	if err = opts.Init(d); err != nil {
+		return errors.WithStack(err)
+	}
+	fmt.Fprintf(out, "created CA %s\n", opts.CommonName)
+	return nil
+}
+
+func request(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("request", flag.ContinueOnError)
+	opts := &certdepot.CertificateOptions{}
+	registerRequestFlags(fs, opts)
+	registerSANFlags(fs, opts)
+	df := &depotFlags{}
+
+	d, err := parse(ctx, fs, args, df)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer df.close()
+
+	if err = opts.CertRequest(d); err != nil {
+		return errors.WithStack(err)
+	}
+	fmt.Fprintf(out, "created certificate request for %s\n", opts.CommonName)
+	return nil
+}
+
+func sign(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("sign", flag.ContinueOnError)
+	opts := &certdepot.CertificateOptions{}
+	registerSignFlags(fs, opts)
+	registerCAFlags(fs, opts)
+	registerExpiresFlag(fs, opts)
+	df := &depotFlags{}
+
+	d, err := parse(ctx, fs, args, df)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer df.close()
+	if opts.Host == "" && fs.NArg() == 1 {
+		opts.Host = fs.Arg(0)
+	}
+	if err = resolveSignOptions(opts, df); err != nil {
+		return errors.WithStack(err)
+	}
+	if opts.Host == "" {
+		return errors.New("must specify the host to sign")
+	}
+
+	if err = opts.Sign(d); err != nil {
+		return errors.WithStack(err)
+	}
+	fmt.Fprintf(out, "signed certificate for %s with %s\n", opts.Host, opts.CA)
+	return nil
+}
+
+func create(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	opts := &certdepot.CertificateOptions{}
+	registerRequestFlags(fs, opts)
+	registerSANFlags(fs, opts)
+	registerSignFlags(fs, opts)
+	registerCAFlags(fs, opts)
+	registerExpiresFlag(fs, opts)
+	df := &depotFlags{}
+
+	d, err := parse(ctx, fs, args, df)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer df.close()
+	if err = resolveSignOptions(opts, df); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = opts.CreateCertificate(d); err != nil {
+		return errors.WithStack(err)
+	}
+	fmt.Fprintf(out, "created certificate for %s signed by %s\n", opts.Host, opts.CA)
+	return nil
+}
+
+func list(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	kind := fs.String("kind", string(certdepot.CrtKind), "kind of data to list (crt, key, csr, crl)")
+	df := &depotFlags{}
+
+	d, err := parse(ctx, fs, args, df)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer df.close()
+
+	names, err := certdepot.ListNames(d, certdepot.TagKind(*kind))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, name := range names {
+		fmt.Fprintln(out, name)
+	}
+	return nil
+}
+
+func show(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("show", flag.ContinueOnError)
+	df := &depotFlags{}
+
+	d, err := parse(ctx, fs, args, df)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer df.close()
+	name, err := nameArg(fs)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	crt, err := certdepot.GetCertificate(d, name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return errors.Wrap(err, "problem parsing certificate")
+	}
+
+	fmt.Fprintf(out, "Name:       %s\n", name)
+	fmt.Fprintf(out, "Subject:    %s\n", rawCrt.Subject)
+	fmt.Fprintf(out, "Issuer:     %s\n", rawCrt.Issuer)
+	fmt.Fprintf(out, "Serial:     %s\n", rawCrt.SerialNumber)
+	fmt.Fprintf(out, "Not Before: %s\n", rawCrt.NotBefore.UTC().Format(time.RFC3339))
+	fmt.Fprintf(out, "Not After:  %s\n", rawCrt.NotAfter.UTC().Format(time.RFC3339))
+	fmt.Fprintf(out, "CA:         %t\n", rawCrt.IsCA)
+	if len(rawCrt.DNSNames) != 0 {
+		fmt.Fprintf(out, "DNS:        %s\n", strings.Join(rawCrt.DNSNames, ", "))
+	}
+	if len(rawCrt.IPAddresses) != 0 {
+		ips := make([]string, 0, len(rawCrt.IPAddresses))
+		for _, ip := range rawCrt.IPAddresses {
+			ips = append(ips, ip.String())
+		}
+		fmt.Fprintf(out, "IP:         %s\n", strings.Join(ips, ", "))
+	}
+	if len(rawCrt.URIs) != 0 {
+		uris := make([]string, 0, len(rawCrt.URIs))
+		for _, uri := range rawCrt.URIs {
+			uris = append(uris, uri.String())
+		}
+		fmt.Fprintf(out, "URI:        %s\n", strings.Join(uris, ", "))
+	}
+	if df.ca != "" && !rawCrt.IsCA {
+		revoked, err := certdepot.IsRevoked(d, df.ca, crt)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		fmt.Fprintf(out, "Revoked:    %t\n", revoked)
+	}
+
+	return nil
+}
+
+func export(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	dir := fs.String("out", "", "directory to write <name>.crt, <name>.key and <ca>.crt to (defaults to stdout)")
+	df := &depotFlags{}
+
+	d, err := parse(ctx, fs, args, df)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer df.close()
+	name, err := nameArg(fs)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	type file struct {
+		name string
+		data []byte
+		perm os.FileMode
+	}
+	var files []file
+	crt, err := d.Get(certdepot.CrtTag(name))
+	if err != nil {
+		return errors.Wrapf(err, "problem getting certificate for %s", name)
+	}
+	files = append(files, file{name: name + ".crt", data: crt, perm: 0644})
+	if d.Check(certdepot.PrivKeyTag(name)) {
+		key, err := d.Get(certdepot.PrivKeyTag(name))
+		if err != nil {
+			return errors.Wrapf(err, "problem getting key for %s", name)
+		}
+		files = append(files, file{name: name + ".key", data: key, perm: 0600})
+	}
+	if df.ca != "" && df.ca != name {
+		caCrt, err := d.Get(certdepot.CrtTag(df.ca))
+		if err != nil {
+			return errors.Wrapf(err, "problem getting CA certificate for %s", df.ca)
+		}
+		files = append(files, file{name: df.ca + ".crt", data: caCrt, perm: 0644})
+	}
+
+	for _, f := range files {
+		if *dir == "" {
+			if _, err = out.Write(f.data); err != nil {
+				return errors.WithStack(err)
+			}
+			continue
+		}
+		path := filepath.Join(*dir, f.name)
+		if err = ioutil.WriteFile(path, f.data, f.perm); err != nil {
+			return errors.Wrapf(err, "problem writing '%s'", path)
+		}
+		fmt.Fprintln(out, path)
+	}
+	return nil
+}
+
+func importCredentials(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	crtPath := fs.String("cert", "", "path to the certificate PEM file")
+	keyPath := fs.String("key", "", "path to the private key PEM file")
+	df := &depotFlags{}
+
+	d, err := parse(ctx, fs, args, df)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer df.close()
+	name, err := nameArg(fs)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if *crtPath == "" || *keyPath == "" {
+		return errors.New("must specify a certificate and key file")
+	}
+
+	crt, err := ioutil.ReadFile(*crtPath)
+	if err != nil {
+		return errors.Wrapf(err, "problem reading certificate file '%s'", *crtPath)
+	}
+	key, err := ioutil.ReadFile(*keyPath)
+	if err != nil {
+		return errors.Wrapf(err, "problem reading key file '%s'", *keyPath)
+	}
+	if _, err = tls.X509KeyPair(crt, key); err != nil {
+		return errors.Wrap(err, "certificate and key do not form a valid key pair")
+	}
+
+	if err = d.Save(name, &certdepot.Credentials{Cert: crt, Key: key}); err != nil {
+		return errors.Wrapf(err, "problem saving credentials for %s", name)
+	}
+	fmt.Fprintf(out, "imported %s\n", name)
+	return nil
+}
+
+func revoke(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("revoke", flag.ContinueOnError)
+	opts := certdepot.RevokeOptions{}
+	registerPassphraseFlag(fs, &opts.CAPassphrase, "ca-passphrase-file", caPassphraseEnv, "passphrase to decrypt the CA private key")
+	fs.BoolVar(&opts.DeleteCredentials, "delete", false, "delete the certificate, key and request of the revoked credentials")
+	fs.DurationVar(&opts.NextUpdate, "next-update", 0, "how long until the next CRL update (defaults to the CA expiration)")
+	reason := fs.Int("reason", 0, "CRLReason code as defined in RFC 5280")
+	df := &depotFlags{}
+
+	d, err := parse(ctx, fs, args, df)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer df.close()
+	name, err := nameArg(fs)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if df.ca == "" {
+		return errors.New("must specify a CA")
+	}
+
+	if err = certdepot.RevokeWithOptions(d, df.ca, name, *reason, opts); err != nil {
+		return errors.WithStack(err)
+	}
+	fmt.Fprintf(out, "revoked %s\n", name)
+	return nil
+}
+
+func rotate(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("rotate", flag.ContinueOnError)
+	opts := &certdepot.CertificateOptions{}
+	registerRequestFlags(fs, opts)
+	registerSANFlags(fs, opts)
+	registerSignFlags(fs, opts)
+	registerCAFlags(fs, opts)
+	registerExpiresFlag(fs, opts)
+	window := fs.Duration("window", 0, "only renew if the certificate expires within this duration (renews unconditionally if zero)")
+	df := &depotFlags{}
+
+	d, err := parse(ctx, fs, args, df)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer df.close()
+	if err = resolveSignOptions(opts, df); err != nil {
+		return errors.WithStack(err)
+	}
+
+	renewed := true
+	if *window > 0 {
+		renewed, err = opts.CreateCertificateOnExpiration(d, *window)
+	} else {
+		err = opts.Renew(d)
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if renewed {
+		fmt.Fprintf(out, "renewed %s\n", opts.Host)
+	} else {
+		fmt.Fprintf(out, "%s does not expire within %s\n", opts.Host, *window)
+	}
+	return nil
+}
+
+func deleteCredentials(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("delete", flag.ContinueOnError)
+	df := &depotFlags{}
+
+	d, err := parse(ctx, fs, args, df)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer df.close()
+	name, err := nameArg(fs)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var deleted bool
+	for _, tag := range []func(string) *depot.Tag{
+		certdepot.CrtTag,
+		certdepot.PrivKeyTag,
+		certdepot.CsrTag,
+		certdepot.CrlTag,
+	} {
+		if !d.Check(tag(name)) {
+			continue
+		}
+		if err = d.Delete(tag(name)); err != nil {
+			return errors.Wrapf(err, "problem deleting %s", name)
+		}
+		deleted = true
+	}
+	if !deleted {
+		return errors.Errorf("%s does not exist", name)
+	}
+
+	fmt.Fprintf(out, "deleted %s\n", name)
+	return nil
+}
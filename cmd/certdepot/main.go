@@ -0,0 +1,236 @@
+// Command certdepot manages the certificates in a certificate depot.
+//
+// Every subcommand selects the depot with the flags returned by
+// "certdepot <command> -h" or with a configuration file in the format of
+// certdepot.BootstrapDepotConfig (YAML or JSON). Flags override the values in
+// the configuration file.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/deciduosity/certdepot"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, args []string, out io.Writer) error
+}
+
+var commands = map[string]command{
+	"init-ca": {usage: "initialize a new CA", run: initCA},
+	"request": {usage: "create a certificate request and key", run: request},
+	"sign":    {usage: "sign a certificate request with a CA", run: sign},
+	"create":  {usage: "create a certificate request and sign it with a CA", run: create},
+	"list":    {usage: "list the names in the depot", run: list},
+	"show":    {usage: "show the details of a certificate", run: show},
+	"export":  {usage: "export a certificate and key from the depot", run: export},
+	"import":  {usage: "import a certificate and key into the depot", run: importCredentials},
+	"revoke":  {usage: "revoke a certificate", run: revoke},
+	"rotate":  {usage: "renew a certificate that is about to expire", run: rotate},
+	"delete":  {usage: "delete a certificate, key, request and CRL", run: deleteCredentials},
+}
+
+func main() {
+	if err := run(context.Background(), os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "certdepot:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "help" {
+		printUsage(out)
+		return nil
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		printUsage(out)
+		return errors.Errorf("unknown command '%s'", args[0])
+	}
+
+	err := cmd.run(ctx, args[1:], out)
+	if errors.Cause(err) == flag.ErrHelp {
+		return nil
+	}
+	return errors.Wrap(err, args[0])
+}
+
+func printUsage(out io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(out, "usage: certdepot <command> [flags] [args]")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "commands:")
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-8s  %s\n", name, commands[name].usage)
+	}
+}
+
+// depotFlags select the depot and the default CA used by a subcommand.
+type depotFlags struct {
+	config          string
+	file            string
+	mongoURI        string
+	mongoDatabase   string
+	mongoCollection string
+	bolt            string
+	ca              string
+
+	depot certdepot.Depot
+}
+
+func (f *depotFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.config, "config", "", "path to a YAML or JSON depot configuration file")
+	fs.StringVar(&f.file, "file", "", "directory of a file depot")
+	fs.StringVar(&f.mongoURI, "mongo-uri", "", "URI of a MongoDB depot")
+	fs.StringVar(&f.mongoDatabase, "mongo-database", "", "database of a MongoDB depot")
+	fs.StringVar(&f.mongoCollection, "mongo-collection", "", "collection of a MongoDB depot")
+	fs.StringVar(&f.bolt, "bolt", "", "path to the database file of a bbolt depot")
+	fs.StringVar(&f.ca, "ca", "", "name of the CA (defaults to ca_name in the configuration file)")
+}
+
+// loadConfig reads the configuration file, if any, and applies the flags on
+// top of it.
+func (f *depotFlags) loadConfig() (*certdepot.BootstrapDepotConfig, error) {
+	conf := &certdepot.BootstrapDepotConfig{}
+	if f.config != "" {
+		data, err := ioutil.ReadFile(f.config)
+		if err != nil {
+			return nil, errors.Wrapf(err, "problem reading config file '%s'", f.config)
+		}
+		if err = yaml.Unmarshal(data, conf); err != nil {
+			return nil, errors.Wrapf(err, "problem parsing config file '%s'", f.config)
+		}
+	}
+
+	if f.file != "" || f.mongoURI != "" || f.mongoDatabase != "" || f.mongoCollection != "" || f.bolt != "" {
+		*conf = certdepot.BootstrapDepotConfig{CAName: conf.CAName}
+	}
+	if f.file != "" {
+		conf.FileDepot = f.file
+	}
+	if f.mongoURI != "" || f.mongoDatabase != "" || f.mongoCollection != "" {
+		conf.MongoDepot = &certdepot.MongoDBOptions{
+			MongoDBURI:     f.mongoURI,
+			DatabaseName:   f.mongoDatabase,
+			CollectionName: f.mongoCollection,
+		}
+	}
+	if f.bolt != "" {
+		conf.BoltDepot = &certdepot.BoltDBOptions{Path: f.bolt}
+	}
+	if f.ca != "" {
+		conf.CAName = f.ca
+	}
+
+	return conf, nil
+}
+
+// open returns the depot selected by the flags and configuration file. The
+// depot must be released with close.
+func (f *depotFlags) open(ctx context.Context) (certdepot.Depot, error) {
+	d, err := f.openDepot(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	f.depot = d
+
+	return d, nil
+}
+
+// close closes the depot opened by open, if the depot needs to be closed.
+func (f *depotFlags) close() {
+	closer, ok := f.depot.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := closer.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, "certdepot: problem closing depot:", err)
+	}
+}
+
+func (f *depotFlags) openDepot(ctx context.Context) (certdepot.Depot, error) {
+	conf, err := f.loadConfig()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	f.ca = conf.CAName
+
+	var selected []string
+	if conf.FileDepot != "" {
+		selected = append(selected, "file")
+	}
+	if conf.MongoDepot != nil && !conf.MongoDepot.IsZero() {
+		selected = append(selected, "mongo")
+	}
+	if conf.BoltDepot != nil && !conf.BoltDepot.IsZero() {
+		selected = append(selected, "bolt")
+	}
+	if conf.RemoteDepot != nil && !conf.RemoteDepot.IsZero() {
+		selected = append(selected, "remote")
+	}
+	if conf.SQLDepot != nil && !conf.SQLDepot.IsZero() {
+		return nil, errors.New("SQL depots are not supported")
+	}
+	if conf.MemoryDepot {
+		return nil, errors.New("memory depots are not supported")
+	}
+	if len(selected) != 1 {
+		return nil, errors.Errorf("must specify exactly one depot, found [%s]", strings.Join(selected, ", "))
+	}
+
+	switch selected[0] {
+	case "file":
+		d, err := certdepot.NewFileDepot(conf.FileDepot)
+		return d, errors.Wrap(err, "problem opening file depot")
+	case "mongo":
+		if conf.MongoDepot.DepotOptions.CA == "" {
+			conf.MongoDepot.DepotOptions.CA = conf.CAName
+		}
+		d, err := certdepot.NewMongoDBCertDepot(ctx, conf.MongoDepot)
+		return d, errors.Wrap(err, "problem opening mongo depot")
+	case "remote":
+		d, err := certdepot.NewRemoteDepot(conf.RemoteDepot)
+		return d, errors.Wrap(err, "problem opening remote depot")
+	default:
+		if conf.BoltDepot.DepotOptions.CA == "" {
+			conf.BoltDepot.DepotOptions.CA = conf.CAName
+		}
+		d, err := certdepot.NewBoltDBCertDepot(conf.BoltDepot)
+		return d, errors.Wrap(err, "problem opening bolt depot")
+	}
+}
+
+// parse registers the depot flags, parses the arguments and opens the depot,
+// which must be released with depotFlags.close.
+func parse(ctx context.Context, fs *flag.FlagSet, args []string, df *depotFlags) (certdepot.Depot, error) {
+	df.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return df.open(ctx)
+}
+
+// nameArg returns the single positional argument of the flag set.
+func nameArg(fs *flag.FlagSet) (string, error) {
+	if fs.NArg() != 1 {
+		return "", errors.New("must specify exactly one name")
+	}
+	return fs.Arg(0), nil
+}
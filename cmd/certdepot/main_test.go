@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/deciduosity/certdepot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCLI(t *testing.T) {
+	ctx := context.Background()
+	exec := func(t *testing.T, args ...string) (string, error) {
+		out := &bytes.Buffer{}
+		err := run(ctx, args, out)
+		return out.String(), err
+	}
+	mustExec := func(t *testing.T, args ...string) string {
+		out, err := exec(t, args...)
+		require.NoError(t, err, out)
+		return out
+	}
+
+	for testName, testCase := range map[string]func(t *testing.T, tempDir string, depotArgs []string){
+		"UsageListsCommands": func(t *testing.T, _ string, _ []string) {
+			out := mustExec(t)
+			for name := range commands {
+				assert.Contains(t, out, name)
+			}
+			_, err := exec(t, "nonexistent")
+			assert.Error(t, err)
+		},
+		"RequiresExactlyOneDepot": func(t *testing.T, tempDir string, _ []string) {
+			_, err := exec(t, "list")
+			assert.Error(t, err)
+			_, err = exec(t, "list", "-file", tempDir, "-bolt", filepath.Join(tempDir, "bolt.db"))
+			assert.Error(t, err)
+		},
+		"MongoURIFlagOverridesConfig": func(t *testing.T, tempDir string, depotArgs []string) {
+			df := &depotFlags{config: depotArgs[1], mongoURI: "mongodb://localhost:27017"}
+			conf, err := df.loadConfig()
+			require.NoError(t, err)
+			assert.Empty(t, conf.FileDepot)
+			require.NotNil(t, conf.MongoDepot)
+			assert.Equal(t, "mongodb://localhost:27017", conf.MongoDepot.MongoDBURI)
+			assert.Equal(t, "ca", conf.CAName)
+		},
+		"ClosesBoltDepot": func(t *testing.T, tempDir string, _ []string) {
+			boltArgs := []string{"-bolt", filepath.Join(tempDir, "bolt.db"), "-ca", "ca"}
+			mustExec(t, append([]string{"init-ca", "-expires", "48h"}, boltArgs...)...)
+
+			out := mustExec(t, append([]string{"list"}, boltArgs...)...)
+			assert.Equal(t, []string{"ca"}, strings.Fields(out))
+		},
+		"CreateListShowAndDelete": func(t *testing.T, _ string, depotArgs []string) {
+			mustExec(t, append([]string{"create", "-cn", "server", "-domain", "server.example.com", "-expires", "1h"}, depotArgs...)...)
+
+			out := mustExec(t, append([]string{"list"}, depotArgs...)...)
+			assert.Equal(t, []string{"ca", "server"}, strings.Fields(out))
+			out = mustExec(t, append([]string{"list", "-kind", "csr"}, depotArgs...)...)
+			assert.Equal(t, []string{"server"}, strings.Fields(out))
+
+			out = mustExec(t, append(append([]string{"show"}, depotArgs...), "server")...)
+			assert.Contains(t, out, "CN=server")
+			assert.Contains(t, out, "server.example.com")
+			assert.Contains(t, out, "Revoked:    false")
+
+			mustExec(t, append(append([]string{"delete"}, depotArgs...), "server")...)
+			out = mustExec(t, append([]string{"list"}, depotArgs...)...)
+			assert.Equal(t, []string{"ca"}, strings.Fields(out))
+			_, err := exec(t, append(append([]string{"delete"}, depotArgs...), "server")...)
+			assert.Error(t, err)
+		},
+		"RequestAndSign": func(t *testing.T, _ string, depotArgs []string) {
+			mustExec(t, append([]string{"request", "-cn", "client", "-key-type", "ecdsa-p256"}, depotArgs...)...)
+			_, err := exec(t, append(append([]string{"sign", "-expires", "1h", "-ext-key-usage", "invalid"}, depotArgs...), "client")...)
+			assert.Error(t, err)
+			mustExec(t, append(append([]string{"sign", "-expires", "1h", "-ext-key-usage", "clientAuth", "-key-usage", "digitalSignature"}, depotArgs...), "client")...)
+
+			out := mustExec(t, append(append([]string{"show"}, depotArgs...), "client")...)
+			assert.Contains(t, out, "Issuer:     CN=ca")
+
+			_, err = exec(t, append([]string{"request", "-key-type", "invalid", "-cn", "other"}, depotArgs...)...)
+			assert.Error(t, err)
+		},
+		"CreateConstrainedIntermediate": func(t *testing.T, _ string, depotArgs []string) {
+			mustExec(t, append([]string{"create", "-cn", "team", "-intermediate", "-max-path-len", "0", "-permit-dns", "team.example.com", "-expires", "1h"}, depotArgs...)...)
+
+			_, err := exec(t, append([]string{"create", "-cn", "other", "-ca", "team", "-domain", "other.example.com", "-expires", "1h"}, depotArgs...)...)
+			assert.Error(t, err)
+			_, err = exec(t, append([]string{"create", "-cn", "nested", "-ca", "team", "-intermediate", "-expires", "1h"}, depotArgs...)...)
+			assert.Error(t, err)
+			mustExec(t, append([]string{"create", "-cn", "server", "-ca", "team", "-domain", "api.team.example.com", "-expires", "1h"}, depotArgs...)...)
+
+			_, err = exec(t, append([]string{"create", "-cn", "invalid", "-intermediate", "-max-path-len", "-1"}, depotArgs...)...)
+			assert.Error(t, err)
+		},
+		"ExportAndImport": func(t *testing.T, tempDir string, depotArgs []string) {
+			mustExec(t, append([]string{"create", "-cn", "server", "-expires", "1h"}, depotArgs...)...)
+
+			exportDir := filepath.Join(tempDir, "export")
+			require.NoError(t, os.Mkdir(exportDir, 0755))
+			mustExec(t, append(append([]string{"export", "-out", exportDir}, depotArgs...), "server")...)
+			for _, name := range []string{"server.crt", "server.key", "ca.crt"} {
+				assert.FileExists(t, filepath.Join(exportDir, name))
+			}
+
+			out := mustExec(t, append(append([]string{"export"}, depotArgs...), "server")...)
+			assert.Contains(t, out, "BEGIN CERTIFICATE")
+
+			mustExec(t, append(append([]string{
+				"import",
+				"-cert", filepath.Join(exportDir, "server.crt"),
+				"-key", filepath.Join(exportDir, "server.key"),
+			}, depotArgs...), "imported")...)
+			out = mustExec(t, append([]string{"list"}, depotArgs...)...)
+			assert.Contains(t, strings.Fields(out), "imported")
+
+			_, err := exec(t, append(append([]string{
+				"import",
+				"-cert", filepath.Join(exportDir, "ca.crt"),
+				"-key", filepath.Join(exportDir, "server.key"),
+			}, depotArgs...), "mismatched")...)
+			assert.Error(t, err)
+		},
+		"Revoke": func(t *testing.T, _ string, depotArgs []string) {
+			mustExec(t, append([]string{"create", "-cn", "server", "-expires", "1h"}, depotArgs...)...)
+			mustExec(t, append(append([]string{"revoke", "-reason", "1"}, depotArgs...), "server")...)
+
+			out := mustExec(t, append(append([]string{"show"}, depotArgs...), "server")...)
+			assert.Contains(t, out, "Revoked:    true")
+		},
+		"Rotate": func(t *testing.T, _ string, depotArgs []string) {
+			mustExec(t, append([]string{"create", "-cn", "server", "-expires", "24h"}, depotArgs...)...)
+
+			out := mustExec(t, append([]string{"rotate", "-cn", "server", "-expires", "24h", "-window", "1h"}, depotArgs...)...)
+			assert.Contains(t, out, "does not expire")
+			out = mustExec(t, append([]string{"rotate", "-cn", "server", "-expires", "24h"}, depotArgs...)...)
+			assert.Contains(t, out, "renewed server")
+
+			out = mustExec(t, append([]string{"list"}, depotArgs...)...)
+			assert.Contains(t, strings.Fields(out), "server")
+			assert.NotContains(t, strings.Fields(out), certdepot.ArchiveName("server"))
+		},
+		"ReadsPassphrasesFromFilesAndEnvironment": func(t *testing.T, tempDir string, depotArgs []string) {
+			passphraseFile := filepath.Join(tempDir, "passphrase")
+			require.NoError(t, ioutil.WriteFile(passphraseFile, []byte("secret\n"), 0600))
+			mustExec(t, append([]string{"init-ca", "-cn", "secure", "-passphrase-file", passphraseFile, "-expires", "48h"}, depotArgs...)...)
+
+			_, err := exec(t, append([]string{"create", "-ca", "secure", "-cn", "denied", "-expires", "1h"}, depotArgs...)...)
+			assert.Error(t, err)
+			_, err = exec(t, append([]string{"create", "-ca", "secure", "-cn", "missing", "-ca-passphrase-file", filepath.Join(tempDir, "missing"), "-expires", "1h"}, depotArgs...)...)
+			assert.Error(t, err)
+			mustExec(t, append([]string{"create", "-ca", "secure", "-cn", "server", "-ca-passphrase-file", passphraseFile, "-expires", "1h"}, depotArgs...)...)
+
+			t.Setenv(caPassphraseEnv, "secret")
+			mustExec(t, append([]string{"create", "-ca", "secure", "-cn", "client", "-expires", "1h"}, depotArgs...)...)
+			mustExec(t, append([]string{"revoke", "-ca", "secure"}, append(depotArgs, "client")...)...)
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			tempDir, err := ioutil.TempDir("", "certdepot-cli")
+			require.NoError(t, err)
+			defer func() {
+				assert.NoError(t, os.RemoveAll(tempDir))
+			}()
+
+			depotDir := filepath.Join(tempDir, "depot")
+			config := filepath.Join(tempDir, "config.yaml")
+			require.NoError(t, ioutil.WriteFile(config, []byte("file_depot: "+depotDir+"\nca_name: ca\n"), 0600))
+			depotArgs := []string{"-config", config}
+
+			mustExec(t, append([]string{"init-ca", "-expires", "48h", "-max-path-len", "1"}, depotArgs...)...)
+
+			testCase(t, tempDir, depotArgs)
+		})
+	}
+}
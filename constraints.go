@@ -0,0 +1,244 @@
+package certdepot
+
+import (
+	"crypto/x509"
+	"net"
+	"strings"
+
+	"github.com/cdr/grip"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+)
+
+// NameConstraints restrict the names that may appear in the subject alternative
+// names of certificates issued by a CA, including those issued by its
+// intermediate CAs.
+//
+// DNS and URI constraints are domains: a domain with a leading period, such as
+// ".example.com", matches only its subdomains, and a domain without one matches
+// the domain itself and its subdomains. IP constraints are ranges in CIDR
+// notation, such as "10.0.0.0/8". If any permitted constraints of a type are
+// given, every name of that type must match one of them, and no name may match
+// an excluded constraint.
+type NameConstraints struct {
+	PermittedDNSDomains []string `bson:"permitted_dns_domains,omitempty" json:"permitted_dns_domains,omitempty" yaml:"permitted_dns_domains,omitempty"`
+	ExcludedDNSDomains  []string `bson:"excluded_dns_domains,omitempty" json:"excluded_dns_domains,omitempty" yaml:"excluded_dns_domains,omitempty"`
+	PermittedIPRanges   []string `bson:"permitted_ip_ranges,omitempty" json:"permitted_ip_ranges,omitempty" yaml:"permitted_ip_ranges,omitempty"`
+	ExcludedIPRanges    []string `bson:"excluded_ip_ranges,omitempty" json:"excluded_ip_ranges,omitempty" yaml:"excluded_ip_ranges,omitempty"`
+	PermittedURIDomains []string `bson:"permitted_uri_domains,omitempty" json:"permitted_uri_domains,omitempty" yaml:"permitted_uri_domains,omitempty"`
+	ExcludedURIDomains  []string `bson:"excluded_uri_domains,omitempty" json:"excluded_uri_domains,omitempty" yaml:"excluded_uri_domains,omitempty"`
+}
+
+// Validate checks that the IP ranges are valid CIDR ranges.
+func (c NameConstraints) Validate() error {
+	catcher := grip.NewBasicCatcher()
+	for _, ranges := range [][]string{c.PermittedIPRanges, c.ExcludedIPRanges} {
+		if _, err := parseIPRanges(ranges); err != nil {
+			catcher.Add(err)
+		}
+	}
+	return catcher.Resolve()
+}
+
+// IsZero returns whether no constraints are set.
+func (c NameConstraints) IsZero() bool {
+	return len(c.PermittedDNSDomains) == 0 && len(c.ExcludedDNSDomains) == 0 &&
+		len(c.PermittedIPRanges) == 0 && len(c.ExcludedIPRanges) == 0 &&
+		len(c.PermittedURIDomains) == 0 && len(c.ExcludedURIDomains) == 0
+}
+
+func parseIPRanges(ranges []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(ranges))
+	for _, r := range ranges {
+		_, ipNet, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid IP range '%s'", r)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// caConstraints are the constraints set on a CA certificate when it is
+// created.
+type caConstraints struct {
+	maxPathLen int
+	names      NameConstraints
+}
+
+// apply sets the constraints on the CA certificate template. The template
+// keeps its maximum path length of zero unless a longer one is set.
+func (c caConstraints) apply(template *x509.Certificate) error {
+	if c.maxPathLen > 0 {
+		template.MaxPathLen = c.maxPathLen
+		template.MaxPathLenZero = false
+	}
+	if c.names.IsZero() {
+		return nil
+	}
+
+	permittedIPRanges, err := parseIPRanges(c.names.PermittedIPRanges)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	excludedIPRanges, err := parseIPRanges(c.names.ExcludedIPRanges)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	template.PermittedDNSDomains = c.names.PermittedDNSDomains
+	template.ExcludedDNSDomains = c.names.ExcludedDNSDomains
+	template.PermittedIPRanges = permittedIPRanges
+	template.ExcludedIPRanges = excludedIPRanges
+	template.PermittedURIDomains = c.names.PermittedURIDomains
+	template.ExcludedURIDomains = c.names.ExcludedURIDomains
+
+	return nil
+}
+
+// hasCAConstraints returns whether the options set any constraints that only
+// apply to CA certificates.
+func (opts *CertificateOptions) hasCAConstraints() bool {
+	return opts.MaxPathLen != 0 || !opts.NameConstraints.IsZero()
+}
+
+// caConstraints returns the constraints of a CA created with the options
+// after checking that they are valid.
+func (opts *CertificateOptions) caConstraints() (caConstraints, error) {
+	if opts.MaxPathLen < 0 {
+		return caConstraints{}, errors.New("maximum path length cannot be negative")
+	}
+	if err := opts.NameConstraints.Validate(); err != nil {
+		return caConstraints{}, errors.Wrap(err, "invalid name constraints")
+	}
+
+	return caConstraints{
+		maxPathLen: opts.MaxPathLen,
+		names:      opts.NameConstraints,
+	}, nil
+}
+
+// intermediateConstraints returns the constraints of an intermediate CA
+// created with the options and issued by the given CA. The issuer must allow
+// intermediates, and the path length of the intermediate must be shorter than
+// the one of the issuer.
+func (opts *CertificateOptions) intermediateConstraints(issuer *x509.Certificate) (caConstraints, error) {
+	constraints, err := opts.caConstraints()
+	if err != nil {
+		return caConstraints{}, errors.WithStack(err)
+	}
+
+	switch {
+	case issuer.MaxPathLen == 0 && issuer.MaxPathLenZero:
+		return caConstraints{}, errors.Errorf("%s is not allowed to issue intermediate CAs", opts.CA)
+	case issuer.MaxPathLen > 0 && constraints.maxPathLen >= issuer.MaxPathLen:
+		return caConstraints{}, errors.Errorf("maximum path length must be less than %d, the maximum path length of %s", issuer.MaxPathLen, opts.CA)
+	}
+
+	return constraints, nil
+}
+
+// checkNameConstraints checks that the names in the certificate request are
+// allowed by the name constraints of the CA with the given name and of the
+// CAs recorded as its ancestors in the depot.
+func checkNameConstraints(d depot.Depot, name string, ca *x509.Certificate, csr *x509.CertificateRequest) error {
+	seen := map[string]bool{}
+	for {
+		if err := checkCertificateNameConstraints(ca, csr); err != nil {
+			return errors.Wrapf(err, "names are not allowed by %s", name)
+		}
+		seen[name] = true
+
+		parent, err := getParent(d, name)
+		if err != nil {
+			return errors.Wrapf(err, "problem getting parent of %s", name)
+		}
+		if parent == "" || seen[parent] {
+			return nil
+		}
+
+		name = parent
+		ca, err = getRawCertificate(d, name)
+		if err != nil {
+			return errors.Wrapf(err, "problem getting certificate for CA %s", name)
+		}
+	}
+}
+
+// checkCertificateNameConstraints checks that the names in the certificate
+// request are allowed by the name constraints of the CA certificate.
+func checkCertificateNameConstraints(ca *x509.Certificate, csr *x509.CertificateRequest) error {
+	catcher := grip.NewBasicCatcher()
+
+	for _, dnsName := range csr.DNSNames {
+		catcher.Add(checkDomainConstraints("DNS name", dnsName, dnsName, ca.PermittedDNSDomains, ca.ExcludedDNSDomains))
+	}
+	for _, ip := range csr.IPAddresses {
+		catcher.Add(checkIPConstraints(ip, ca.PermittedIPRanges, ca.ExcludedIPRanges))
+	}
+	for _, uri := range csr.URIs {
+		if len(ca.PermittedURIDomains) == 0 && len(ca.ExcludedURIDomains) == 0 {
+			continue
+		}
+		host := uri.Hostname()
+		if host == "" || net.ParseIP(host) != nil {
+			catcher.Errorf("URI '%s' must have a domain name to check against name constraints", uri)
+			continue
+		}
+		catcher.Add(checkDomainConstraints("URI", uri.String(), host, ca.PermittedURIDomains, ca.ExcludedURIDomains))
+	}
+
+	return catcher.Resolve()
+}
+
+// checkDomainConstraints checks that the domain of the name matches one of the
+// permitted constraints, if there are any, and none of the excluded
+// constraints.
+func checkDomainConstraints(kind, name, domain string, permitted, excluded []string) error {
+	for _, constraint := range excluded {
+		if matchDomainConstraint(domain, constraint) {
+			return errors.Errorf("%s '%s' is excluded by constraint '%s'", kind, name, constraint)
+		}
+	}
+	if len(permitted) == 0 {
+		return nil
+	}
+	for _, constraint := range permitted {
+		if matchDomainConstraint(domain, constraint) {
+			return nil
+		}
+	}
+	return errors.Errorf("%s '%s' is not permitted", kind, name)
+}
+
+// checkIPConstraints checks that the IP address is in one of the permitted
+// ranges, if there are any, and none of the excluded ranges.
+func checkIPConstraints(ip net.IP, permitted, excluded []*net.IPNet) error {
+	for _, ipNet := range excluded {
+		if ipNet.Contains(ip) {
+			return errors.Errorf("IP address '%s' is excluded by constraint '%s'", ip, ipNet)
+		}
+	}
+	if len(permitted) == 0 {
+		return nil
+	}
+	for _, ipNet := range permitted {
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+	return errors.Errorf("IP address '%s' is not permitted", ip)
+}
+
+// matchDomainConstraint returns whether the domain name matches the domain
+// constraint, as described by NameConstraints.
+func matchDomainConstraint(name, constraint string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	constraint = strings.ToLower(constraint)
+	if constraint == "" {
+		return true
+	}
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(name, constraint)
+	}
+	return name == constraint || strings.HasSuffix(name, "."+constraint)
+}
@@ -0,0 +1,226 @@
+package certdepot
+
+import (
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConstraints(t *testing.T) {
+	const (
+		rootName = "root"
+		teamName = "team"
+	)
+
+	rawCertificate := func(t *testing.T, d Depot, name string) *x509.Certificate {
+		rawCrt, err := getRawCertificate(d, name)
+		require.NoError(t, err)
+		return rawCrt
+	}
+	leaf := func(ca, name string) *CertificateOptions {
+		return &CertificateOptions{
+			CA:         ca,
+			CommonName: name,
+			Host:       name,
+			Expires:    time.Hour,
+		}
+	}
+	intermediate := func(ca, name string) *CertificateOptions {
+		opts := leaf(ca, name)
+		opts.Intermediate = true
+		return opts
+	}
+
+	t.Run("MaxPathLen", func(t *testing.T) {
+		for testName, testCase := range map[string]func(t *testing.T, d Depot){
+			"ZeroByDefault": func(t *testing.T, d Depot) {
+				require.NoError(t, (&CertificateOptions{CommonName: rootName, Expires: time.Hour}).Init(d))
+				rawCrt := rawCertificate(t, d, rootName)
+				assert.Equal(t, 0, rawCrt.MaxPathLen)
+				assert.True(t, rawCrt.MaxPathLenZero)
+
+				assert.Error(t, intermediate(rootName, teamName).CreateCertificate(d))
+				assert.NoError(t, leaf(rootName, "server").CreateCertificate(d))
+			},
+			"IntermediateDefaultsToZero": func(t *testing.T, d Depot) {
+				require.NoError(t, (&CertificateOptions{
+					CommonName: rootName,
+					Expires:    time.Hour,
+					MaxPathLen: 2,
+				}).Init(d))
+				require.NoError(t, intermediate(rootName, teamName).CreateCertificate(d))
+
+				rawCrt := rawCertificate(t, d, teamName)
+				assert.True(t, rawCrt.IsCA)
+				assert.Equal(t, 0, rawCrt.MaxPathLen)
+				assert.True(t, rawCrt.MaxPathLenZero)
+
+				assert.Error(t, intermediate(teamName, "nested").CreateCertificate(d))
+				assert.NoError(t, leaf(teamName, "server").CreateCertificate(d))
+			},
+			"IntermediateAllowsShorterPathLen": func(t *testing.T, d Depot) {
+				require.NoError(t, (&CertificateOptions{
+					CommonName: rootName,
+					Expires:    time.Hour,
+					MaxPathLen: 2,
+				}).Init(d))
+				opts := intermediate(rootName, teamName)
+				opts.MaxPathLen = 1
+				require.NoError(t, opts.CreateCertificate(d))
+
+				rawCrt := rawCertificate(t, d, teamName)
+				assert.Equal(t, 1, rawCrt.MaxPathLen)
+				assert.False(t, rawCrt.MaxPathLenZero)
+
+				assert.NoError(t, intermediate(teamName, "nested").CreateCertificate(d))
+			},
+			"IntermediateFailsWithPathLenNotShorterThanIssuer": func(t *testing.T, d Depot) {
+				require.NoError(t, (&CertificateOptions{
+					CommonName: rootName,
+					Expires:    time.Hour,
+					MaxPathLen: 1,
+				}).Init(d))
+				opts := intermediate(rootName, teamName)
+				opts.MaxPathLen = 1
+				assert.Error(t, opts.CreateCertificate(d))
+			},
+			"FailsWithNegativePathLen": func(t *testing.T, d Depot) {
+				assert.Error(t, (&CertificateOptions{
+					CommonName: rootName,
+					Expires:    time.Hour,
+					MaxPathLen: -1,
+				}).Init(d))
+			},
+			"FailsForLeafCertificate": func(t *testing.T, d Depot) {
+				require.NoError(t, (&CertificateOptions{CommonName: rootName, Expires: time.Hour}).Init(d))
+				opts := leaf(rootName, "server")
+				opts.MaxPathLen = 1
+				assert.Error(t, opts.CreateCertificate(d))
+			},
+		} {
+			t.Run(testName, func(t *testing.T) {
+				testCase(t, NewMemoryDepot(DepotOptions{}))
+			})
+		}
+	})
+	t.Run("NameConstraints", func(t *testing.T) {
+		for testName, testCase := range map[string]func(t *testing.T, d Depot){
+			"SetOnCA": func(t *testing.T, d Depot) {
+				rawCrt := rawCertificate(t, d, teamName)
+				assert.Equal(t, []string{"team.example.com"}, rawCrt.PermittedDNSDomains)
+				assert.Equal(t, []string{"secret.team.example.com"}, rawCrt.ExcludedDNSDomains)
+				require.Len(t, rawCrt.PermittedIPRanges, 1)
+				assert.Equal(t, "10.1.0.0/16", rawCrt.PermittedIPRanges[0].String())
+				assert.Equal(t, []string{".team.example.com"}, rawCrt.PermittedURIDomains)
+			},
+			"AllowsPermittedNames": func(t *testing.T, d Depot) {
+				opts := leaf(teamName, "server")
+				opts.Domain = []string{"team.example.com", "api.team.example.com"}
+				opts.IP = []string{"10.1.2.3"}
+				opts.URI = []string{"spiffe://svc.team.example.com/server"}
+				require.NoError(t, opts.CreateCertificate(d))
+
+				roots := x509.NewCertPool()
+				roots.AddCert(rawCertificate(t, d, rootName))
+				intermediates := x509.NewCertPool()
+				intermediates.AddCert(rawCertificate(t, d, teamName))
+				_, err := rawCertificate(t, d, "server").Verify(x509.VerifyOptions{
+					DNSName:       "api.team.example.com",
+					Roots:         roots,
+					Intermediates: intermediates,
+				})
+				assert.NoError(t, err)
+			},
+			"RefusesOtherDomains": func(t *testing.T, d Depot) {
+				opts := leaf(teamName, "server")
+				opts.Domain = []string{"other.example.com"}
+				assert.Error(t, opts.CreateCertificate(d))
+				assert.False(t, d.Check(CrtTag("server")))
+			},
+			"RefusesExcludedDomains": func(t *testing.T, d Depot) {
+				opts := leaf(teamName, "server")
+				opts.Domain = []string{"db.secret.team.example.com"}
+				assert.Error(t, opts.CreateCertificate(d))
+			},
+			"RefusesIPOutsideRange": func(t *testing.T, d Depot) {
+				opts := leaf(teamName, "server")
+				opts.IP = []string{"10.2.0.1"}
+				assert.Error(t, opts.CreateCertificate(d))
+			},
+			"RefusesOtherURIs": func(t *testing.T, d Depot) {
+				for i, uri := range []string{"spiffe://other.example.com/server", "spiffe://team.example.com/server", "urn:team:server"} {
+					opts := leaf(teamName, fmt.Sprintf("server%d", i))
+					opts.URI = []string{uri}
+					assert.Error(t, opts.CreateCertificate(d), uri)
+				}
+			},
+			"RefusesNamesExcludedByAncestor": func(t *testing.T, d Depot) {
+				opts := intermediate(teamName, "nested")
+				require.NoError(t, opts.CreateCertificate(d))
+
+				opts = leaf("nested", "server")
+				opts.IP = []string{"192.168.1.1"}
+				assert.Error(t, opts.CreateCertificate(d))
+
+				opts = leaf("nested", "other")
+				opts.Domain = []string{"nested.team.example.com"}
+				assert.NoError(t, opts.CreateCertificate(d))
+			},
+			"FailsWithInvalidIPRange": func(t *testing.T, d Depot) {
+				opts := intermediate(rootName, "invalid")
+				opts.NameConstraints.PermittedIPRanges = []string{"10.1.0.0"}
+				assert.Error(t, opts.CreateCertificate(d))
+			},
+			"FailsForLeafCertificate": func(t *testing.T, d Depot) {
+				opts := leaf(rootName, "server")
+				opts.NameConstraints.PermittedDNSDomains = []string{"example.com"}
+				assert.Error(t, opts.CreateCertificate(d))
+			},
+		} {
+			t.Run(testName, func(t *testing.T) {
+				d := NewMemoryDepot(DepotOptions{})
+				require.NoError(t, (&CertificateOptions{
+					CommonName: rootName,
+					Expires:    time.Hour,
+					MaxPathLen: 2,
+					NameConstraints: NameConstraints{
+						ExcludedIPRanges: []string{"192.168.0.0/16"},
+					},
+				}).Init(d))
+				opts := intermediate(rootName, teamName)
+				opts.MaxPathLen = 1
+				opts.NameConstraints = NameConstraints{
+					PermittedDNSDomains: []string{"team.example.com"},
+					ExcludedDNSDomains:  []string{"secret.team.example.com"},
+					PermittedIPRanges:   []string{"10.1.0.0/16"},
+					PermittedURIDomains: []string{".team.example.com"},
+				}
+				require.NoError(t, opts.CreateCertificate(d))
+
+				testCase(t, d)
+			})
+		}
+	})
+	t.Run("MatchDomainConstraint", func(t *testing.T) {
+		for _, testCase := range []struct {
+			name       string
+			constraint string
+			expected   bool
+		}{
+			{name: "example.com", constraint: "", expected: true},
+			{name: "example.com", constraint: "example.com", expected: true},
+			{name: "api.example.com", constraint: "example.com", expected: true},
+			{name: "API.Example.com.", constraint: "example.com", expected: true},
+			{name: "badexample.com", constraint: "example.com", expected: false},
+			{name: "example.com", constraint: ".example.com", expected: false},
+			{name: "api.example.com", constraint: ".example.com", expected: true},
+			{name: "example.org", constraint: "example.com", expected: false},
+		} {
+			assert.Equal(t, testCase.expected, matchDomainConstraint(testCase.name, testCase.constraint), "%s %s", testCase.name, testCase.constraint)
+		}
+	})
+}
@@ -0,0 +1,346 @@
+package certdepot
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/cdr/grip"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+)
+
+// CopyPolicy determines how CopyDepot handles names that already exist in the
+// destination depot.
+type CopyPolicy string
+
+const (
+	// CopySkipExisting leaves names that already exist in the destination
+	// untouched. This is the default.
+	CopySkipExisting CopyPolicy = "skip"
+	// CopyOverwrite replaces the entries of names that already exist in
+	// the destination.
+	CopyOverwrite CopyPolicy = "overwrite"
+)
+
+// Validate checks that the copy policy is one of the known policies.
+func (p CopyPolicy) Validate() error {
+	switch p {
+	case "", CopySkipExisting, CopyOverwrite:
+		return nil
+	default:
+		return errors.Errorf("unrecognized copy policy '%s'", p)
+	}
+}
+
+// CopyDepotOptions contains options for CopyDepot.
+type CopyDepotOptions struct {
+	// Whether to only report what would be copied without modifying the
+	// destination depot.
+	DryRun bool `bson:"dry_run,omitempty" json:"dry_run,omitempty" yaml:"dry_run,omitempty"`
+	// How to handle names that already exist in the destination depot
+	// (defaults to CopySkipExisting).
+	Policy CopyPolicy `bson:"policy,omitempty" json:"policy,omitempty" yaml:"policy,omitempty"`
+	// Filter returns whether the name should be copied. If nil, all names
+	// are copied. Profiles and pending requests are copied regardless of
+	// the filter.
+	Filter func(string) bool `bson:"-" json:"-" yaml:"-"`
+}
+
+// CopyResult reports the outcome of copying a single name.
+type CopyResult struct {
+	// Name of the copied entries.
+	Name string
+	// Kinds of the entries that were copied, or would be copied if this
+	// is a dry run.
+	Kinds []TagKind
+	// Expiration copied to the destination, if any.
+	TTL time.Time
+	// Whether the name was skipped because it already exists in the
+	// destination.
+	Skipped bool
+	// Error is set if copying the name failed.
+	Error error
+}
+
+var copyKinds = []TagKind{CrtKind, PrivKeyKind, CsrKind, CrlKind}
+
+// CopyDepot copies the certificates, keys, certificate requests and CRLs of
+// every name in the source depot to the destination depot, along with their
+// expirations if both depots are ExpirationManagers. If only the destination
+// is an ExpirationManager, the expiration of the certificate is used. The
+// profiles and pending requests are also copied if both depots are
+// ProfileManagers or PendingRequestManagers. The source depot must implement
+// Lister.
+//
+// A result is returned for every name that passes the filter. Failing to copy
+// one name does not prevent the others from being copied; the returned error
+// combines the errors of all names.
+func CopyDepot(ctx context.Context, src, dst Depot, opts CopyDepotOptions) ([]CopyResult, error) {
+	if src == nil || dst == nil {
+		return nil, errors.New("must specify a source and destination depot")
+	}
+	if err := opts.Policy.Validate(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	names, err := listAllNames(src)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	catcher := grip.NewBasicCatcher()
+	results := []CopyResult{}
+	for _, name := range names {
+		if opts.Filter != nil && !opts.Filter(name) {
+			continue
+		}
+		if err = ctx.Err(); err != nil {
+			catcher.Add(err)
+			break
+		}
+
+		result := copyName(src, dst, name, opts)
+		catcher.Wrapf(result.Error, "problem copying %s", name)
+		results = append(results, result)
+	}
+
+	if _, ok := dst.(ProfileManager); ok && !opts.DryRun && ctx.Err() == nil {
+		profiles, err := listProfiles(src)
+		if err != nil {
+			catcher.Add(err)
+		}
+		for _, name := range sortedProfileNames(profiles) {
+			catcher.Wrapf(copyProfile(dst, name, profiles[name], opts.Policy), "problem copying profile %s", name)
+		}
+	}
+	if _, ok := dst.(PendingRequestManager); ok && !opts.DryRun && ctx.Err() == nil {
+		reqs, err := listPendingRequests(src)
+		if err != nil {
+			catcher.Add(err)
+		}
+		for i := range reqs {
+			catcher.Wrapf(copyPendingRequest(dst, &reqs[i], opts.Policy), "problem copying pending request %s", reqs[i].ID)
+		}
+	}
+
+	return results, catcher.Resolve()
+}
+
+// listAllNames returns the sorted names of entries of any kind in the depot.
+func listAllNames(dpt depot.Depot) ([]string, error) {
+	seen := map[string]bool{}
+	for _, kind := range copyKinds {
+		names, err := ListNames(dpt, kind)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, name := range names {
+			seen[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func copyName(src, dst Depot, name string, opts CopyDepotOptions) CopyResult {
+	result := CopyResult{Name: name}
+
+	data := map[TagKind][]byte{}
+	for _, kind := range copyKinds {
+		tag := KindTag(kind, name)
+		if !src.Check(tag) {
+			continue
+		}
+		out, err := src.Get(tag)
+		if err != nil {
+			result.Error = errors.Wrapf(err, "problem getting %s entry", kind)
+			return result
+		}
+		data[kind] = out
+		result.Kinds = append(result.Kinds, kind)
+	}
+	if opts.Policy != CopyOverwrite && nameExists(dst, name) {
+		result.Kinds = nil
+		result.Skipped = true
+		return result
+	}
+
+	if _, ok := data[CrtKind]; ok {
+		if _, ok = dst.(ExpirationManager); ok {
+			ttl, err := copyTTL(src, name)
+			if err != nil {
+				result.Error = errors.WithStack(err)
+				return result
+			}
+			result.TTL = ttl
+		}
+	}
+
+	if opts.DryRun {
+		return result
+	}
+
+	var parent string
+	var policy *Policy
+	if _, ok := data[CrtKind]; ok {
+		var err error
+		parent, err = getParent(src, name)
+		if err != nil {
+			result.Error = errors.Wrap(err, "problem getting parent")
+			return result
+		}
+		policy, err = GetPolicy(src, name)
+		if err != nil {
+			result.Error = errors.Wrap(err, "problem getting policy")
+			return result
+		}
+	}
+
+	result.Error = putName(dst, name, data, result.TTL, parent, policy)
+	return result
+}
+
+// putName replaces all entries of the name in the depot with the given data
+// and sets the expiration, parent and policy if they are not empty. The policy
+// is skipped if the depot does not support policies.
+func putName(dst Depot, name string, data map[TagKind][]byte, ttl time.Time, parent string, policy *Policy) error {
+	for _, kind := range copyKinds {
+		tag := KindTag(kind, name)
+		if err := deleteIfExists(dst, tag); err != nil {
+			return errors.Wrapf(err, "problem deleting existing %s entry", kind)
+		}
+		out, ok := data[kind]
+		if !ok {
+			continue
+		}
+		if err := dst.Put(tag, out); err != nil {
+			return errors.Wrapf(err, "problem putting %s entry", kind)
+		}
+	}
+
+	if !ttl.IsZero() {
+		if err := putTTL(dst, name, ttl); err != nil {
+			return errors.Wrap(err, "problem putting TTL")
+		}
+	}
+	if parent != "" {
+		if err := putParent(dst, name, parent); err != nil {
+			return errors.Wrap(err, "problem putting parent")
+		}
+	}
+	if _, ok := dst.(PolicyManager); ok && policy != nil {
+		if err := PutPolicy(dst, name, policy); err != nil {
+			return errors.Wrap(err, "problem putting policy")
+		}
+	}
+
+	return nil
+}
+
+// listProfiles returns all profiles in the depot by name, or none if the depot
+// does not support profiles.
+func listProfiles(d Depot) (map[string]*Profile, error) {
+	pm, ok := d.(ProfileManager)
+	if !ok {
+		return nil, nil
+	}
+	profiles, err := pm.ListProfiles()
+	return profiles, errors.Wrap(err, "problem listing profiles")
+}
+
+func sortedProfileNames(profiles map[string]*Profile) []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// copyProfile puts the profile in the depot unless a profile with the name
+// already exists and the policy is not CopyOverwrite.
+func copyProfile(dst Depot, name string, profile *Profile, policy CopyPolicy) error {
+	if policy != CopyOverwrite {
+		existing, err := GetProfile(dst, name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if existing != nil {
+			return nil
+		}
+	}
+
+	return errors.WithStack(PutProfile(dst, name, profile))
+}
+
+// listPendingRequests returns all pending requests in the depot sorted by ID,
+// or none if the depot does not support pending requests.
+func listPendingRequests(d Depot) ([]PendingRequest, error) {
+	prm, ok := d.(PendingRequestManager)
+	if !ok {
+		return nil, nil
+	}
+	reqs, err := prm.ListPendingRequests()
+	if err != nil {
+		return nil, errors.Wrap(err, "problem listing pending requests")
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].ID < reqs[j].ID })
+
+	return reqs, nil
+}
+
+// copyPendingRequest puts the pending request in the depot unless a request
+// with the ID already exists and the policy is not CopyOverwrite.
+func copyPendingRequest(dst Depot, req *PendingRequest, policy CopyPolicy) error {
+	prm := dst.(PendingRequestManager)
+	if policy != CopyOverwrite {
+		existing, err := prm.GetPendingRequest(req.ID)
+		if err != nil {
+			return errors.Wrap(err, "problem getting pending request")
+		}
+		if existing != nil {
+			return nil
+		}
+	}
+
+	return errors.Wrap(prm.PutPendingRequest(req), "problem putting pending request")
+}
+
+// nameExists returns whether any entry of the name exists in the depot.
+func nameExists(d depot.Depot, name string) bool {
+	for _, kind := range copyKinds {
+		if d.Check(KindTag(kind, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyTTL returns the expiration of the name in the source depot, falling
+// back to the expiration of its certificate.
+func copyTTL(src Depot, name string) (time.Time, error) {
+	if em, ok := src.(ExpirationManager); ok {
+		ttl, err := em.GetTTL(name)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "problem getting TTL")
+		}
+		if !ttl.IsZero() {
+			return ttl, nil
+		}
+	}
+
+	_, notAfter, err := ValidityBounds(src, name)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "problem getting certificate expiration")
+	}
+
+	return notAfter, nil
+}
@@ -0,0 +1,254 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyDepot(t *testing.T) {
+	const caName = "ca"
+	ctx := context.Background()
+
+	populate := func(t *testing.T, d Depot) {
+		caOpts := &CertificateOptions{
+			CommonName: caName,
+			Expires:    24 * time.Hour,
+		}
+		require.NoError(t, caOpts.Init(d))
+		for _, name := range []string{"alice", "bob"} {
+			opts := &CertificateOptions{
+				CA:         caName,
+				CommonName: name,
+				Host:       name,
+				Expires:    time.Hour,
+			}
+			require.NoError(t, opts.CreateCertificate(d))
+		}
+	}
+	assertCopied := func(t *testing.T, src, dst Depot, name string) {
+		for _, kind := range copyKinds {
+			tag := KindTag(kind, name)
+			require.Equal(t, src.Check(tag), dst.Check(tag), "%s/%s", name, kind)
+			if !src.Check(tag) {
+				continue
+			}
+			srcData, err := src.Get(tag)
+			require.NoError(t, err)
+			dstData, err := dst.Get(tag)
+			require.NoError(t, err)
+			assert.Equal(t, srcData, dstData, "%s/%s", name, kind)
+		}
+	}
+	resultNames := func(results []CopyResult) []string {
+		names := []string{}
+		for _, result := range results {
+			names = append(names, result.Name)
+		}
+		return names
+	}
+
+	for testName, testCase := range map[string]func(t *testing.T, src, dst Depot){
+		"CopiesAllNames": func(t *testing.T, src, dst Depot) {
+			results, err := CopyDepot(ctx, src, dst, CopyDepotOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"alice", "bob", caName}, resultNames(results))
+			for _, result := range results {
+				assert.NoError(t, result.Error)
+				assert.False(t, result.Skipped)
+				assertCopied(t, src, dst, result.Name)
+			}
+			assert.ElementsMatch(t, []TagKind{CrtKind, PrivKeyKind, CrlKind}, results[2].Kinds)
+			assert.ElementsMatch(t, []TagKind{CrtKind, PrivKeyKind, CsrKind}, results[0].Kinds)
+
+			creds, err := depotFind(dst, "alice", DepotOptions{CA: caName})
+			require.NoError(t, err)
+			_, err = creds.Resolve()
+			assert.NoError(t, err)
+		},
+		"CopiesTTL": func(t *testing.T, src, dst Depot) {
+			_, notAfter, err := ValidityBounds(src, "alice")
+			require.NoError(t, err)
+			ttl := notAfter.Add(-time.Minute).UTC().Truncate(time.Second)
+			require.NoError(t, src.(ExpirationManager).PutTTL("alice", ttl))
+
+			results, err := CopyDepot(ctx, src, dst, CopyDepotOptions{})
+			require.NoError(t, err)
+			require.Equal(t, "alice", results[0].Name)
+			assert.True(t, ttl.Equal(results[0].TTL))
+
+			dstTTL, err := dst.(ExpirationManager).GetTTL("alice")
+			require.NoError(t, err)
+			assert.True(t, ttl.Equal(dstTTL))
+		},
+		"SkipsArchivedVersions": func(t *testing.T, src, dst Depot) {
+			opts := &CertificateOptions{
+				CA:         caName,
+				CommonName: "alice",
+				Host:       "alice",
+				Expires:    time.Hour,
+			}
+			require.NoError(t, opts.Renew(src))
+			require.True(t, CheckCertificate(src, ArchiveName("alice")))
+
+			results, err := CopyDepot(ctx, src, dst, CopyDepotOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"alice", "bob", caName}, resultNames(results))
+			assert.False(t, CheckCertificate(dst, ArchiveName("alice")))
+		},
+		"DryRunDoesNotModifyDestination": func(t *testing.T, src, dst Depot) {
+			results, err := CopyDepot(ctx, src, dst, CopyDepotOptions{DryRun: true})
+			require.NoError(t, err)
+			require.Len(t, results, 3)
+			for _, result := range results {
+				assert.NotEmpty(t, result.Kinds)
+				assert.False(t, dst.Check(CrtTag(result.Name)))
+			}
+		},
+		"FiltersNames": func(t *testing.T, src, dst Depot) {
+			results, err := CopyDepot(ctx, src, dst, CopyDepotOptions{
+				Filter: func(name string) bool { return name != "bob" },
+			})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"alice", caName}, resultNames(results))
+			assert.True(t, dst.Check(CrtTag("alice")))
+			assert.False(t, dst.Check(CrtTag("bob")))
+		},
+		"SkipsExistingNames": func(t *testing.T, src, dst Depot) {
+			require.NoError(t, dst.Put(CrtTag("alice"), []byte("existing")))
+
+			results, err := CopyDepot(ctx, src, dst, CopyDepotOptions{})
+			require.NoError(t, err)
+			require.Equal(t, "alice", results[0].Name)
+			assert.True(t, results[0].Skipped)
+			assert.Empty(t, results[0].Kinds)
+
+			data, err := dst.Get(CrtTag("alice"))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("existing"), data)
+			assert.False(t, dst.Check(PrivKeyTag("alice")))
+			assertCopied(t, src, dst, "bob")
+		},
+		"OverwritesExistingNames": func(t *testing.T, src, dst Depot) {
+			require.NoError(t, dst.Put(CrtTag("alice"), []byte("existing")))
+
+			results, err := CopyDepot(ctx, src, dst, CopyDepotOptions{Policy: CopyOverwrite})
+			require.NoError(t, err)
+			require.Equal(t, "alice", results[0].Name)
+			assert.False(t, results[0].Skipped)
+			assertCopied(t, src, dst, "alice")
+		},
+		"CopiesProfiles": func(t *testing.T, src, dst Depot) {
+			profile := &Profile{CA: caName, Organization: "Example"}
+			require.NoError(t, PutProfile(src, "client device", profile))
+
+			_, err := CopyDepot(ctx, src, dst, CopyDepotOptions{DryRun: true})
+			require.NoError(t, err)
+			copied, err := GetProfile(dst, "client device")
+			require.NoError(t, err)
+			assert.Nil(t, copied)
+
+			_, err = CopyDepot(ctx, src, dst, CopyDepotOptions{})
+			require.NoError(t, err)
+			copied, err = GetProfile(dst, "client device")
+			require.NoError(t, err)
+			assert.Equal(t, profile, copied)
+		},
+		"SkipsExistingProfiles": func(t *testing.T, src, dst Depot) {
+			require.NoError(t, PutProfile(src, "client", &Profile{CA: caName}))
+			existing := &Profile{Organization: "Existing"}
+			require.NoError(t, PutProfile(dst, "client", existing))
+
+			_, err := CopyDepot(ctx, src, dst, CopyDepotOptions{})
+			require.NoError(t, err)
+			copied, err := GetProfile(dst, "client")
+			require.NoError(t, err)
+			assert.Equal(t, existing, copied)
+
+			_, err = CopyDepot(ctx, src, dst, CopyDepotOptions{Policy: CopyOverwrite})
+			require.NoError(t, err)
+			copied, err = GetProfile(dst, "client")
+			require.NoError(t, err)
+			assert.Equal(t, &Profile{CA: caName}, copied)
+		},
+		"CopiesPendingRequests": func(t *testing.T, src, dst Depot) {
+			csr, _, err := (&CertificateOptions{CommonName: "carol", Host: "carol"}).CertRequestInMemory()
+			require.NoError(t, err)
+			req, err := (&CertificateOptions{CA: caName, Host: "carol", Expires: time.Hour}).SubmitCertificateRequest(src, csr, SubmitOptions{})
+			require.NoError(t, err)
+
+			_, err = CopyDepot(ctx, src, dst, CopyDepotOptions{DryRun: true})
+			require.NoError(t, err)
+			copied, err := dst.(PendingRequestManager).GetPendingRequest(req.ID)
+			require.NoError(t, err)
+			assert.Nil(t, copied)
+
+			_, err = CopyDepot(ctx, src, dst, CopyDepotOptions{})
+			require.NoError(t, err)
+			copied, err = GetPendingRequest(dst, req.ID)
+			require.NoError(t, err)
+			require.NotNil(t, copied)
+			assert.Equal(t, req.CertificateRequest, copied.CertificateRequest)
+			assert.Equal(t, PendingRequestPending, copied.Status)
+
+			_, err = ApprovePendingRequest(dst, req.ID, ApproveOptions{Approver: "admin"})
+			require.NoError(t, err)
+			assert.True(t, CheckCertificate(dst, "carol"))
+		},
+		"FailsWithInvalidPolicy": func(t *testing.T, src, dst Depot) {
+			_, err := CopyDepot(ctx, src, dst, CopyDepotOptions{Policy: "invalid"})
+			assert.Error(t, err)
+			assert.False(t, dst.Check(CrtTag("alice")))
+		},
+		"FailsWithCanceledContext": func(t *testing.T, src, dst Depot) {
+			canceled, cancel := context.WithCancel(ctx)
+			cancel()
+			_, err := CopyDepot(canceled, src, dst, CopyDepotOptions{})
+			assert.Error(t, err)
+			assert.False(t, dst.Check(CrtTag("alice")))
+		},
+	} {
+		for depotName, makeDepots := range map[string]func(t *testing.T, tempDir string) (Depot, Depot){
+			"MemoryToFile": func(t *testing.T, tempDir string) (Depot, Depot) {
+				dst, err := NewFileDepot(tempDir)
+				require.NoError(t, err)
+				return NewMemoryDepot(DepotOptions{}), dst
+			},
+			"FileToMemory": func(t *testing.T, tempDir string) (Depot, Depot) {
+				src, err := NewFileDepot(tempDir)
+				require.NoError(t, err)
+				return src, NewMemoryDepot(DepotOptions{})
+			},
+			"FileToBolt": func(t *testing.T, tempDir string) (Depot, Depot) {
+				src, err := NewFileDepot(filepath.Join(tempDir, "depot"))
+				require.NoError(t, err)
+				dst, err := NewBoltDBCertDepot(&BoltDBOptions{Path: filepath.Join(tempDir, "bolt.db")})
+				require.NoError(t, err)
+				return src, dst
+			},
+		} {
+			t.Run(depotName+"/"+testName, func(t *testing.T) {
+				tempDir, err := ioutil.TempDir(".", "copy-test")
+				require.NoError(t, err)
+				defer func() {
+					assert.NoError(t, os.RemoveAll(tempDir))
+				}()
+
+				src, dst := makeDepots(t, tempDir)
+				populate(t, src)
+
+				testCase(t, src, dst)
+			})
+		}
+	}
+	t.Run("FailsForNilDepot", func(t *testing.T) {
+		_, err := CopyDepot(ctx, nil, NewMemoryDepot(DepotOptions{}), CopyDepotOptions{})
+		assert.Error(t, err)
+	})
+}
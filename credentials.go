@@ -22,6 +22,10 @@ type Credentials struct {
 	CACert []byte `bson:"ca_cert" json:"ca_cert" yaml:"ca_cert"`
 	// Cert is the PEM-encoded certificate.
 	Cert []byte `bson:"cert" json:"cert" yaml:"cert"`
+	// Chain is the PEM-encoded certificate followed by the certificates of
+	// the intermediate CAs between it and the root CA in CACert. If it is
+	// empty, only Cert is presented during the TLS handshake.
+	Chain []byte `bson:"chain,omitempty" json:"chain,omitempty" yaml:"chain,omitempty"`
 	// Key is the PEM-encoded private key.
 	Key []byte `bson:"key" json:"key" yaml:"key"`
 
@@ -81,24 +85,18 @@ func (c *Credentials) Validate() error {
 	return catcher.Resolve()
 }
 
-// Resolve converts the Credentials struct into a tls.Config.
+// Resolve converts the Credentials struct into a tls.Config that can be used
+// both by a server and by a client. The usages of the certificate are not
+// checked; use ResolveServer or ResolveClient to check that the certificate
+// may be used in a given role.
 func (c *Credentials) Resolve() (*tls.Config, error) {
-	if err := c.Validate(); err != nil {
-		return nil, errors.Wrap(err, "invalid credentials")
-	}
-
-	caCerts := x509.NewCertPool()
-	if !caCerts.AppendCertsFromPEM(c.CACert) {
-		return nil, errors.New("failed to append client CA certificate")
-	}
-
-	cert, err := tls.X509KeyPair(c.Cert, c.Key)
+	cert, caCerts, err := c.resolve()
 	if err != nil {
-		return nil, errors.Wrap(err, "problem loading key pair")
+		return nil, errors.WithStack(err)
 	}
 
 	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
+		Certificates: []tls.Certificate{*cert},
 
 		// Server-specific options
 		ClientAuth: tls.RequireAndVerifyClientCert,
@@ -110,6 +108,89 @@ func (c *Credentials) Resolve() (*tls.Config, error) {
 	}, nil
 }
 
+// ResolveServer converts the Credentials struct into a tls.Config for a
+// server that requires clients to present a certificate signed by the CA. It
+// returns an error if the certificate may not be used to authenticate a
+// server.
+func (c *Credentials) ResolveServer() (*tls.Config, error) {
+	cert, caCerts, err := c.resolve(x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    caCerts,
+	}, nil
+}
+
+// ResolveClient converts the Credentials struct into a tls.Config for a
+// client that verifies that the server at ServerName presents a certificate
+// signed by the CA. It returns an error if the certificate may not be used to
+// authenticate a client.
+func (c *Credentials) ResolveClient() (*tls.Config, error) {
+	cert, caCerts, err := c.resolve(x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		RootCAs:      caCerts,
+		ServerName:   c.ServerName,
+	}, nil
+}
+
+// resolve returns the key pair and CA certificates of the credentials after
+// checking that the certificate may be used for the given purposes.
+func (c *Credentials) resolve(usages ...x509.ExtKeyUsage) (*tls.Certificate, *x509.CertPool, error) {
+	if err := c.Validate(); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid credentials")
+	}
+
+	caCerts := x509.NewCertPool()
+	if !caCerts.AppendCertsFromPEM(c.CACert) {
+		return nil, nil, errors.New("failed to append client CA certificate")
+	}
+
+	cert, err := c.keyPair()
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	if len(usages) == 0 {
+		return &cert, caCerts, nil
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "problem parsing certificate")
+	}
+	for _, usage := range usages {
+		if !hasExtKeyUsage(leaf, usage) {
+			return nil, nil, errors.Errorf("certificate may not be used for %s", extKeyUsageName(usage))
+		}
+	}
+
+	return &cert, caCerts, nil
+}
+
+// keyPair returns the key pair of the credentials with the full chain of the
+// certificate, if there is one.
+func (c *Credentials) keyPair() (tls.Certificate, error) {
+	chain := c.Chain
+	if len(chain) == 0 {
+		chain = c.Cert
+	}
+
+	cert, err := tls.X509KeyPair(chain, c.Key)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "problem loading key pair")
+	}
+
+	return cert, nil
+}
+
 // Export exports the Credentials struct into JSON-encoded bytes.
 func (c *Credentials) Export() ([]byte, error) {
 	if err := c.Validate(); err != nil {
@@ -160,6 +160,41 @@ EKTcWGekdmdDPsHloRNtsiCa697B2O9IFA==
 			require.NoError(t, err)
 			assert.NotNil(t, config)
 		},
+		"ResolveServerSucceedsWithServerCert": func(t *testing.T) {
+			creds := &Credentials{
+				CACert: pemRootCert,
+				Cert:   pemCert,
+				Key:    pemKey,
+			}
+			config, err := creds.ResolveServer()
+			require.NoError(t, err)
+			require.NotNil(t, config)
+			assert.Len(t, config.Certificates, 1)
+			assert.NotNil(t, config.ClientCAs)
+			assert.Nil(t, config.RootCAs)
+		},
+		"ResolveClientFailsWithServerCert": func(t *testing.T) {
+			creds := &Credentials{
+				CACert: pemRootCert,
+				Cert:   pemCert,
+				Key:    pemKey,
+			}
+			config, err := creds.ResolveClient()
+			assert.Error(t, err)
+			assert.Nil(t, config)
+		},
+		"ResolveServerAndClientFailWithMissingFields": func(t *testing.T) {
+			creds := &Credentials{
+				CACert: pemRootCert,
+				Cert:   pemCert,
+			}
+			config, err := creds.ResolveServer()
+			assert.Error(t, err)
+			assert.Nil(t, config)
+			config, err = creds.ResolveClient()
+			assert.Error(t, err)
+			assert.Nil(t, config)
+		},
 	} {
 		t.Run(testName, func(t *testing.T) {
 			testCase(t)
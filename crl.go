@@ -0,0 +1,164 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/x509"
+	"strings"
+	"time"
+
+	"github.com/cdr/grip"
+	"github.com/cdr/grip/message"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/pkix"
+)
+
+// CRLOptions contains options for RefreshCRL and CreateCRL.
+type CRLOptions struct {
+	// Name of the CA whose CRL is refreshed.
+	CA string `bson:"ca" json:"ca" yaml:"ca"`
+	// Passphrase to decrypt the CA's private-key PEM block.
+	CAPassphrase string `bson:"ca_passphrase,omitempty" json:"ca_passphrase,omitempty" yaml:"ca_passphrase,omitempty"`
+	// How long until the next CRL update. If zero, the CRL is valid until
+	// the CA certificate expires.
+	NextUpdate time.Duration `bson:"next_update,omitempty" json:"next_update,omitempty" yaml:"next_update,omitempty"`
+}
+
+// RefreshCRL signs and stores a new version of the CRL of the CA, with the
+// same revoked certificates and a new next update time, so that clients keep
+// accepting it. It errors if the CA does not have a CRL, since a missing CRL
+// cannot tell which certificates were revoked; use CreateCRL to create an
+// empty CRL for a CA that never had one.
+func RefreshCRL(d Depot, opts CRLOptions) error {
+	formattedCAName, rawCACrt, caKey, err := opts.getCA(d)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(updateRevocationList(d, formattedCAName, rawCACrt, caKey, opts.NextUpdate, func(*x509.RevocationList) bool {
+		return true
+	}))
+}
+
+// CreateCRL signs and stores an empty CRL for a CA that does not have one. It
+// errors if the CA already has a CRL.
+func CreateCRL(d Depot, opts CRLOptions) error {
+	formattedCAName, rawCACrt, caKey, err := opts.getCA(d)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	unlock := lockRevocationList(formattedCAName)
+	defer unlock()
+
+	if d.Check(CrlTag(formattedCAName)) {
+		return errors.Errorf("%s already has a certificate revocation list", opts.CA)
+	}
+	crl, err := signRevocationList(&x509.RevocationList{}, rawCACrt, caKey, opts.NextUpdate)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	created, err := swapRevocationList(d, formattedCAName, nil, crl)
+	if err != nil {
+		return errors.Wrap(err, "problem saving certificate revocation list")
+	}
+	if !created {
+		return errors.Errorf("%s already has a certificate revocation list", opts.CA)
+	}
+
+	return nil
+}
+
+// getCA returns the formatted name, certificate and key of the CA.
+func (opts CRLOptions) getCA(d Depot) (string, *x509.Certificate, *pkix.Key, error) {
+	if opts.CA == "" {
+		return "", nil, nil, errors.New("must provide name of CA")
+	}
+	formattedCAName := strings.Replace(opts.CA, " ", "_", -1)
+
+	rawCACrt, err := getRawCertificate(d, formattedCAName)
+	if err != nil {
+		return "", nil, nil, errors.Wrap(err, "problem getting CA certificate")
+	}
+	caKey, err := getCAKey(d, formattedCAName, opts.CAPassphrase)
+	if err != nil {
+		return "", nil, nil, errors.WithStack(err)
+	}
+
+	return formattedCAName, rawCACrt, caKey, nil
+}
+
+// CRLManagerOptions contains options for NewCRLManager.
+type CRLManagerOptions struct {
+	// Depot containing the CAs.
+	Depot Depot
+	// CAs whose CRLs are refreshed. Each must specify a NextUpdate longer
+	// than the interval so that the CRLs do not expire between refreshes.
+	CAs []CRLOptions
+	// How often to refresh the CRLs.
+	Interval time.Duration
+}
+
+// Validate checks that the options are set correctly.
+func (opts *CRLManagerOptions) Validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(opts.Depot == nil, "must specify a depot")
+	catcher.NewWhen(len(opts.CAs) == 0, "must specify at least one CA")
+	catcher.NewWhen(opts.Interval <= 0, "interval must be positive")
+	for _, crlOpts := range opts.CAs {
+		catcher.NewWhen(crlOpts.CA == "", "must specify the name of every CA")
+		catcher.ErrorfWhen(crlOpts.NextUpdate <= opts.Interval, "next update for CA %s must be longer than the interval", crlOpts.CA)
+	}
+	return catcher.Resolve()
+}
+
+// CRLManager periodically refreshes the CRLs of CAs in a depot, so that they
+// can be issued with a short next update time instead of being valid until
+// the CA expires.
+type CRLManager struct {
+	opts CRLManagerOptions
+}
+
+// NewCRLManager returns a CRLManager with the given options.
+func NewCRLManager(opts CRLManagerOptions) (*CRLManager, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+
+	return &CRLManager{opts: opts}, nil
+}
+
+// Start refreshes the CRLs immediately and then at every interval in a
+// background goroutine until the context is canceled.
+func (m *CRLManager) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(m.opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			grip.Warning(message.WrapError(m.Refresh(ctx), message.Fields{
+				"message": "problem refreshing CRLs",
+			}))
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Refresh refreshes the CRL of every CA once.
+func (m *CRLManager) Refresh(ctx context.Context) error {
+	catcher := grip.NewBasicCatcher()
+	for _, crlOpts := range m.opts.CAs {
+		if ctx.Err() != nil {
+			catcher.Add(ctx.Err())
+			break
+		}
+
+		catcher.Wrapf(RefreshCRL(m.opts.Depot, crlOpts), "problem refreshing CRL for %s", crlOpts.CA)
+	}
+
+	return catcher.Resolve()
+}
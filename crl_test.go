@@ -0,0 +1,213 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCRLManager(t *testing.T) {
+	const (
+		caName     = "ca"
+		passphrase = "passphrase"
+	)
+
+	getCRL := func(t *testing.T, d Depot) *x509.RevocationList {
+		crl, err := GetCertificateRevocationList(d, caName)
+		require.NoError(t, err)
+		rawCRL, err := x509.ParseRevocationList(crl.DERBytes())
+		require.NoError(t, err)
+		return rawCRL
+	}
+	// crlNumber returns the CRL number of the CA's CRL, which is zero for the
+	// CRL created by Init.
+	crlNumber := func(t *testing.T, d Depot) int64 {
+		number := getCRL(t, d).Number
+		if number == nil {
+			return 0
+		}
+		return number.Int64()
+	}
+	crlOpts := CRLOptions{
+		CA:           caName,
+		CAPassphrase: passphrase,
+		NextUpdate:   time.Hour,
+	}
+
+	t.Run("ValidateOptions", func(t *testing.T) {
+		d := NewMemoryDepot(DepotOptions{})
+		for testName, opts := range map[string]CRLManagerOptions{
+			"MissingDepot": {
+				CAs:      []CRLOptions{crlOpts},
+				Interval: time.Minute,
+			},
+			"MissingCAs": {
+				Depot:    d,
+				Interval: time.Minute,
+			},
+			"MissingInterval": {
+				Depot: d,
+				CAs:   []CRLOptions{crlOpts},
+			},
+			"MissingCAName": {
+				Depot:    d,
+				CAs:      []CRLOptions{{NextUpdate: time.Hour}},
+				Interval: time.Minute,
+			},
+			"NextUpdateNotLongerThanInterval": {
+				Depot:    d,
+				CAs:      []CRLOptions{crlOpts},
+				Interval: time.Hour,
+			},
+		} {
+			t.Run(testName, func(t *testing.T) {
+				_, err := NewCRLManager(opts)
+				assert.Error(t, err)
+			})
+		}
+	})
+
+	for testName, testCase := range map[string]func(t *testing.T, d Depot){
+		"RefreshSetsNextUpdate": func(t *testing.T, d Depot) {
+			before := getCRL(t, d)
+			number := crlNumber(t, d)
+			require.NoError(t, RefreshCRL(d, crlOpts))
+
+			after := getCRL(t, d)
+			assert.Equal(t, number+1, crlNumber(t, d))
+			assert.True(t, after.NextUpdate.Before(before.NextUpdate))
+			assert.Equal(t, time.Hour, after.NextUpdate.Sub(after.ThisUpdate))
+		},
+		"RefreshKeepsRevokedCertificates": func(t *testing.T, d Depot) {
+			opts := &CertificateOptions{
+				CA:           caName,
+				CAPassphrase: passphrase,
+				CommonName:   "server",
+				Host:         "server",
+				Expires:      time.Hour,
+			}
+			require.NoError(t, opts.CreateCertificate(d))
+			require.NoError(t, RevokeWithOptions(d, caName, "server", 1, RevokeOptions{CAPassphrase: passphrase}))
+
+			require.NoError(t, RefreshCRL(d, crlOpts))
+			crt, err := GetCertificate(d, "server")
+			require.NoError(t, err)
+			revoked, err := IsRevoked(d, caName, crt)
+			require.NoError(t, err)
+			assert.True(t, revoked)
+			assert.Len(t, getCRL(t, d).RevokedCertificateEntries, 1)
+		},
+		"RefreshFailsWithMissingCRL": func(t *testing.T, d Depot) {
+			require.NoError(t, d.Delete(CrlTag(caName)))
+
+			assert.Error(t, RefreshCRL(d, crlOpts))
+			assert.False(t, d.Check(CrlTag(caName)))
+		},
+		"RefreshKeepsConcurrentRevocations": func(t *testing.T, d Depot) {
+			const certs = 5
+			for i := 0; i < certs; i++ {
+				name := fmt.Sprintf("server%d", i)
+				require.NoError(t, (&CertificateOptions{
+					CA:           caName,
+					CAPassphrase: passphrase,
+					CommonName:   name,
+					Host:         name,
+					Expires:      time.Hour,
+				}).CreateCertificate(d))
+			}
+
+			wg := sync.WaitGroup{}
+			errs := make(chan error, 2*certs)
+			for i := 0; i < certs; i++ {
+				wg.Add(2)
+				go func(name string) {
+					defer wg.Done()
+					errs <- RevokeWithOptions(d, caName, name, 1, RevokeOptions{CAPassphrase: passphrase})
+				}(fmt.Sprintf("server%d", i))
+				go func() {
+					defer wg.Done()
+					errs <- RefreshCRL(d, crlOpts)
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				assert.NoError(t, err)
+			}
+
+			assert.Len(t, getCRL(t, d).RevokedCertificateEntries, certs)
+			assert.EqualValues(t, 2*certs, crlNumber(t, d))
+		},
+		"CreateCreatesMissingCRL": func(t *testing.T, d Depot) {
+			require.NoError(t, d.Delete(CrlTag(caName)))
+
+			require.NoError(t, CreateCRL(d, crlOpts))
+			crl := getCRL(t, d)
+			assert.Empty(t, crl.RevokedCertificateEntries)
+			assert.EqualValues(t, 1, crlNumber(t, d))
+			assert.Equal(t, time.Hour, crl.NextUpdate.Sub(crl.ThisUpdate))
+		},
+		"CreateFailsWithExistingCRL": func(t *testing.T, d Depot) {
+			number := crlNumber(t, d)
+			assert.Error(t, CreateCRL(d, crlOpts))
+			assert.Equal(t, number, crlNumber(t, d))
+
+			assert.Error(t, CreateCRL(d, CRLOptions{}))
+			assert.Error(t, CreateCRL(d, CRLOptions{CA: "nonexistent"}))
+		},
+		"RefreshFailsWithInvalidOptions": func(t *testing.T, d Depot) {
+			assert.Error(t, RefreshCRL(d, CRLOptions{}))
+			assert.Error(t, RefreshCRL(d, CRLOptions{CA: "nonexistent"}))
+			assert.Error(t, RefreshCRL(d, CRLOptions{CA: caName}))
+		},
+		"StartRefreshesInBackground": func(t *testing.T, d Depot) {
+			number := crlNumber(t, d)
+			m, err := NewCRLManager(CRLManagerOptions{
+				Depot:    d,
+				CAs:      []CRLOptions{crlOpts},
+				Interval: 10 * time.Millisecond,
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			m.Start(ctx)
+
+			assert.Eventually(t, func() bool {
+				return crlNumber(t, d) >= number+2
+			}, 5*time.Second, 10*time.Millisecond)
+		},
+		"RefreshFailsWithCanceledContext": func(t *testing.T, d Depot) {
+			number := crlNumber(t, d)
+			m, err := NewCRLManager(CRLManagerOptions{
+				Depot:    d,
+				CAs:      []CRLOptions{crlOpts},
+				Interval: time.Minute,
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			assert.Error(t, m.Refresh(ctx))
+			assert.Equal(t, number, crlNumber(t, d))
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			d := NewMemoryDepot(DepotOptions{CA: caName})
+			caOpts := &CertificateOptions{
+				CommonName: caName,
+				Expires:    48 * time.Hour,
+				Passphrase: passphrase,
+			}
+			require.NoError(t, caOpts.Init(d))
+
+			testCase(t, d)
+		})
+	}
+}
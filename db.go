@@ -6,6 +6,8 @@ import (
 
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // PutTTL sets the TTL to the given expiration time for the name. If the name is
@@ -46,6 +48,205 @@ func (m *mongoDepot) GetTTL(name string) (time.Time, error) {
 	return user.TTL, nil
 }
 
+// PutParent records the name of the CA that issued the certificate with the
+// given name. If the name is not found in the collection, this will error.
+func (m *mongoDepot) PutParent(name, parent string) error {
+	formattedName := strings.Replace(name, " ", "_", -1)
+	updateRes, err := m.client.Database(m.databaseName).Collection(m.collectionName).UpdateOne(m.ctx,
+		bson.M{userIDKey: formattedName},
+		bson.M{"$set": bson.M{userParentKey: strings.Replace(parent, " ", "_", -1)}})
+	if err != nil {
+		return errors.Wrap(err, "problem updating parent in the database")
+	}
+	if updateRes.MatchedCount == 0 {
+		return errors.Errorf("could not find %s in the database", name)
+	}
+	return nil
+}
+
+// GetParent returns the name of the CA that issued the certificate with the
+// given name.
+func (m *mongoDepot) GetParent(name string) (string, error) {
+	formattedName := strings.Replace(name, " ", "_", -1)
+	var user User
+	if err := m.client.Database(m.databaseName).Collection(m.collectionName).FindOne(m.ctx,
+		bson.M{userIDKey: formattedName},
+	).Decode(&user); err != nil {
+		return "", errors.Wrap(err, "could not get parent from database")
+	}
+	return user.Parent, nil
+}
+
+// HasChildren returns whether any certificate records the CA with the given
+// name as its parent.
+func (m *mongoDepot) HasChildren(name string) (bool, error) {
+	formattedName := strings.Replace(name, " ", "_", -1)
+	err := m.client.Database(m.databaseName).Collection(m.collectionName).FindOne(m.ctx,
+		bson.M{userParentKey: formattedName},
+		options.FindOne().SetProjection(bson.M{userIDKey: 1}),
+	).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "could not find children in database")
+	}
+	return true, nil
+}
+
+// SwapRevocationList replaces the CRL of the CA with the given name if the
+// stored CRL is equal to prev.
+func (m *mongoDepot) SwapRevocationList(name string, prev, next []byte) (bool, error) {
+	if next == nil {
+		return false, errors.New("data is nil")
+	}
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	filter := bson.M{userIDKey: formattedName, userCertRevocListKey: string(prev)}
+	if len(prev) == 0 {
+		filter[userCertRevocListKey] = bson.M{"$in": bson.A{nil, ""}}
+	}
+	updateRes, err := m.client.Database(m.databaseName).Collection(m.collectionName).UpdateOne(m.ctx,
+		filter,
+		bson.M{"$set": bson.M{userCertRevocListKey: string(next)}})
+	if err != nil {
+		return false, errors.Wrap(err, "problem updating certificate revocation list in the database")
+	}
+
+	return updateRes.MatchedCount == 1, nil
+}
+
+// PutPolicy attaches the policy to the CA with the given name. If the name is
+// not found in the collection, this will error.
+func (m *mongoDepot) PutPolicy(name string, policy *Policy) error {
+	formattedName := strings.Replace(name, " ", "_", -1)
+	update := bson.M{"$set": bson.M{userPolicyKey: policy}}
+	if policy == nil {
+		update = bson.M{"$unset": bson.M{userPolicyKey: ""}}
+	}
+	updateRes, err := m.client.Database(m.databaseName).Collection(m.collectionName).UpdateOne(m.ctx,
+		bson.M{userIDKey: formattedName}, update)
+	if err != nil {
+		return errors.Wrap(err, "problem updating policy in the database")
+	}
+	if updateRes.MatchedCount == 0 {
+		return errors.Errorf("could not find %s in the database", name)
+	}
+	return nil
+}
+
+// GetPolicy returns the policy of the CA with the given name.
+func (m *mongoDepot) GetPolicy(name string) (*Policy, error) {
+	formattedName := strings.Replace(name, " ", "_", -1)
+	var user User
+	if err := m.client.Database(m.databaseName).Collection(m.collectionName).FindOne(m.ctx,
+		bson.M{userIDKey: formattedName},
+	).Decode(&user); err != nil {
+		return nil, errors.Wrap(err, "could not get policy from database")
+	}
+	return user.Policy, nil
+}
+
+// PutProfile stores the profile under the given name in the profiles
+// collection.
+func (m *mongoDepot) PutProfile(name string, profile *Profile) error {
+	coll := m.client.Database(m.databaseName).Collection(profileCollectionName(m.collectionName))
+	if profile == nil {
+		_, err := coll.DeleteOne(m.ctx, bson.M{userIDKey: name})
+		return errors.Wrap(err, "problem deleting profile from the database")
+	}
+
+	_, err := coll.UpdateOne(m.ctx,
+		bson.M{userIDKey: name},
+		bson.M{"$set": bson.M{profileDocumentProfileKey: profile}},
+		options.Update().SetUpsert(true))
+	return errors.Wrap(err, "problem updating profile in the database")
+}
+
+// GetProfile returns the profile with the given name.
+func (m *mongoDepot) GetProfile(name string) (*Profile, error) {
+	doc := profileDocument{}
+	err := m.client.Database(m.databaseName).Collection(profileCollectionName(m.collectionName)).FindOne(m.ctx,
+		bson.M{userIDKey: name},
+	).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get profile from database")
+	}
+	return doc.Profile, nil
+}
+
+// ListProfiles returns all profiles by name.
+func (m *mongoDepot) ListProfiles() (map[string]*Profile, error) {
+	res, err := m.client.Database(m.databaseName).Collection(profileCollectionName(m.collectionName)).Find(m.ctx, bson.M{})
+	if err != nil {
+		return nil, errors.Wrap(err, "problem finding profiles")
+	}
+	docs := []profileDocument{}
+	if err = res.All(m.ctx, &docs); err != nil {
+		return nil, errors.Wrap(err, "problem decoding profiles")
+	}
+
+	profiles := make(map[string]*Profile, len(docs))
+	for _, doc := range docs {
+		profiles[doc.ID] = doc.Profile
+	}
+	return profiles, nil
+}
+
+// PutPendingRequest inserts or replaces the pending request in the requests
+// collection.
+func (m *mongoDepot) PutPendingRequest(req *PendingRequest) error {
+	_, err := m.client.Database(m.databaseName).Collection(requestCollectionName(m.collectionName)).ReplaceOne(m.ctx,
+		bson.M{userIDKey: req.ID},
+		req,
+		options.Replace().SetUpsert(true))
+	return errors.Wrap(err, "problem updating pending request in the database")
+}
+
+// SwapPendingRequest replaces the pending request if the stored request has
+// the given status.
+func (m *mongoDepot) SwapPendingRequest(req *PendingRequest, prev PendingRequestStatus) (bool, error) {
+	updateRes, err := m.client.Database(m.databaseName).Collection(requestCollectionName(m.collectionName)).UpdateOne(m.ctx,
+		bson.M{userIDKey: req.ID, pendingRequestStatusKey: prev},
+		bson.M{"$set": req})
+	if err != nil {
+		return false, errors.Wrap(err, "problem updating pending request in the database")
+	}
+
+	return updateRes.MatchedCount == 1, nil
+}
+
+// GetPendingRequest returns the pending request with the given ID.
+func (m *mongoDepot) GetPendingRequest(id string) (*PendingRequest, error) {
+	req := &PendingRequest{}
+	err := m.client.Database(m.databaseName).Collection(requestCollectionName(m.collectionName)).FindOne(m.ctx,
+		bson.M{userIDKey: id},
+	).Decode(req)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get pending request from database")
+	}
+	return req, nil
+}
+
+// ListPendingRequests returns all pending requests.
+func (m *mongoDepot) ListPendingRequests() ([]PendingRequest, error) {
+	res, err := m.client.Database(m.databaseName).Collection(requestCollectionName(m.collectionName)).Find(m.ctx, bson.M{})
+	if err != nil {
+		return nil, errors.Wrap(err, "problem finding pending requests")
+	}
+	reqs := []PendingRequest{}
+	if err = res.All(m.ctx, &reqs); err != nil {
+		return nil, errors.Wrap(err, "problem decoding pending requests")
+	}
+	return reqs, nil
+}
+
 // FindExpiresBefore finds all Users that expire before the given cutoff time.
 func (m *mongoDepot) FindExpiresBefore(cutoff time.Time) ([]User, error) {
 	users := []User{}
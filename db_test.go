@@ -10,6 +10,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	mgo "gopkg.in/mgo.v2"
 )
 
 func TestDB(t *testing.T) {
@@ -122,6 +123,177 @@ func TestDB(t *testing.T) {
 				})
 			}
 		},
+		"GetParent": func(ctx context.Context, t *testing.T, md *mongoDepot, client *mongo.Client, coll *mongo.Collection) {
+			for subTestName, subTestCase := range map[string]func(ctx context.Context, t *testing.T){
+				"FailsForNonexistentDocument": func(ctx context.Context, t *testing.T) {
+					_, err := md.GetParent("nonexistent")
+					assert.Error(t, err)
+				},
+				"PassesForExistingDocument": func(ctx context.Context, t *testing.T) {
+					name := "user"
+					_, err := coll.InsertOne(ctx, &User{ID: name, Cert: "cert", Parent: "ca"})
+					require.NoError(t, err)
+
+					parent, err := md.GetParent(name)
+					require.NoError(t, err)
+					assert.Equal(t, "ca", parent)
+				},
+				"HasChildrenFindsRecordedParent": func(ctx context.Context, t *testing.T) {
+					_, err := coll.InsertOne(ctx, &User{ID: "user", Cert: "cert", Parent: "ca"})
+					require.NoError(t, err)
+
+					hasChildren, err := md.HasChildren("ca")
+					require.NoError(t, err)
+					assert.True(t, hasChildren)
+					hasChildren, err = md.HasChildren("user")
+					require.NoError(t, err)
+					assert.False(t, hasChildren)
+				},
+				"PutParentDoesNotInsert": func(ctx context.Context, t *testing.T) {
+					name := "user"
+					require.Error(t, md.PutParent(name, "ca"))
+					assert.Equal(t, mongo.ErrNoDocuments, coll.FindOne(ctx, bson.M{userIDKey: name}).Decode(&User{}))
+				},
+			} {
+				t.Run(subTestName, func(t *testing.T) {
+					require.NoError(t, coll.Drop(ctx))
+					defer func() {
+						assert.NoError(t, coll.Drop(ctx))
+					}()
+					tctx, cancel := context.WithTimeout(ctx, dbTimeout)
+					defer cancel()
+					subTestCase(tctx, t)
+				})
+			}
+		},
+		"GetPolicy": func(ctx context.Context, t *testing.T, md *mongoDepot, client *mongo.Client, coll *mongo.Collection) {
+			for subTestName, subTestCase := range map[string]func(ctx context.Context, t *testing.T){
+				"FailsForNonexistentDocument": func(ctx context.Context, t *testing.T) {
+					_, err := md.GetPolicy("nonexistent")
+					assert.Error(t, err)
+				},
+				"PutPolicySetsValueOnExistingDocument": func(ctx context.Context, t *testing.T) {
+					name := "ca"
+					_, err := coll.InsertOne(ctx, &User{ID: name, Cert: "cert"})
+					require.NoError(t, err)
+
+					expected := &Policy{AllowedNames: []string{"*.example.com"}, MaxLifetime: time.Hour}
+					require.NoError(t, md.PutPolicy(name, expected))
+					policy, err := md.GetPolicy(name)
+					require.NoError(t, err)
+					assert.Equal(t, expected, policy)
+
+					require.NoError(t, md.PutPolicy(name, nil))
+					policy, err = md.GetPolicy(name)
+					require.NoError(t, err)
+					assert.Nil(t, policy)
+				},
+				"PutPolicyDoesNotInsert": func(ctx context.Context, t *testing.T) {
+					name := "user"
+					require.Error(t, md.PutPolicy(name, &Policy{}))
+					assert.Equal(t, mongo.ErrNoDocuments, coll.FindOne(ctx, bson.M{userIDKey: name}).Decode(&User{}))
+				},
+			} {
+				t.Run(subTestName, func(t *testing.T) {
+					require.NoError(t, coll.Drop(ctx))
+					defer func() {
+						assert.NoError(t, coll.Drop(ctx))
+					}()
+					tctx, cancel := context.WithTimeout(ctx, dbTimeout)
+					defer cancel()
+					subTestCase(tctx, t)
+				})
+			}
+		},
+		"GetProfile": func(ctx context.Context, t *testing.T, md *mongoDepot, client *mongo.Client, coll *mongo.Collection) {
+			profileColl := client.Database(coll.Database().Name()).Collection(profileCollectionName(coll.Name()))
+			for subTestName, subTestCase := range map[string]func(ctx context.Context, t *testing.T){
+				"ReturnsNilForNonexistentProfile": func(ctx context.Context, t *testing.T) {
+					profile, err := md.GetProfile("nonexistent")
+					require.NoError(t, err)
+					assert.Nil(t, profile)
+				},
+				"PutProfileStoresInProfilesCollection": func(ctx context.Context, t *testing.T) {
+					expected := &Profile{CA: "ca", Organization: "Example", Expires: time.Hour}
+					require.NoError(t, md.PutProfile("server", expected))
+					profile, err := md.GetProfile("server")
+					require.NoError(t, err)
+					assert.Equal(t, expected, profile)
+					assert.Equal(t, mongo.ErrNoDocuments, coll.FindOne(ctx, bson.M{userIDKey: "server"}).Decode(&User{}))
+
+					require.NoError(t, md.PutProfile("server", nil))
+					profile, err = md.GetProfile("server")
+					require.NoError(t, err)
+					assert.Nil(t, profile)
+				},
+			} {
+				t.Run(subTestName, func(t *testing.T) {
+					require.NoError(t, profileColl.Drop(ctx))
+					defer func() {
+						assert.NoError(t, profileColl.Drop(ctx))
+					}()
+					tctx, cancel := context.WithTimeout(ctx, dbTimeout)
+					defer cancel()
+					subTestCase(tctx, t)
+				})
+			}
+		},
+		"PendingRequests": func(ctx context.Context, t *testing.T, md *mongoDepot, client *mongo.Client, coll *mongo.Collection) {
+			requestColl := client.Database(coll.Database().Name()).Collection(requestCollectionName(coll.Name()))
+			for subTestName, subTestCase := range map[string]func(ctx context.Context, t *testing.T){
+				"ReturnsNilForNonexistentRequest": func(ctx context.Context, t *testing.T) {
+					req, err := md.GetPendingRequest("nonexistent")
+					require.NoError(t, err)
+					assert.Nil(t, req)
+				},
+				"PutPendingRequestStoresInRequestsCollection": func(ctx context.Context, t *testing.T) {
+					expected := &PendingRequest{
+						ID:        "id",
+						Options:   CertificateOptions{CA: "ca", Host: "server"},
+						Requester: Requester{Name: "alice"},
+						Status:    PendingRequestPending,
+					}
+					require.NoError(t, md.PutPendingRequest(expected))
+					req, err := md.GetPendingRequest("id")
+					require.NoError(t, err)
+					require.NotNil(t, req)
+					assert.Equal(t, "server", req.Options.Host)
+					assert.Equal(t, "alice", req.Requester.Name)
+					assert.Equal(t, mongo.ErrNoDocuments, coll.FindOne(ctx, bson.M{userIDKey: "id"}).Decode(&User{}))
+
+					expected.Status = PendingRequestDenied
+					require.NoError(t, md.PutPendingRequest(expected))
+					reqs, err := md.ListPendingRequests()
+					require.NoError(t, err)
+					require.Len(t, reqs, 1)
+					assert.Equal(t, PendingRequestDenied, reqs[0].Status)
+				},
+				"ApproveSignsCertificate": func(ctx context.Context, t *testing.T) {
+					defer func() {
+						assert.NoError(t, coll.Drop(ctx))
+					}()
+					require.NoError(t, (&CertificateOptions{CommonName: "ca", Expires: time.Hour}).Init(md))
+					csr, _, err := (&CertificateOptions{CommonName: "server"}).CertRequestInMemory()
+					require.NoError(t, err)
+					req, err := (&CertificateOptions{CA: "ca", Host: "server"}).SubmitCertificateRequest(md, csr, SubmitOptions{})
+					require.NoError(t, err)
+
+					_, err = ApprovePendingRequest(md, req.ID, ApproveOptions{Approver: "bob"})
+					require.NoError(t, err)
+					assert.True(t, md.Check(CrtTag("server")))
+				},
+			} {
+				t.Run(subTestName, func(t *testing.T) {
+					require.NoError(t, requestColl.Drop(ctx))
+					defer func() {
+						assert.NoError(t, requestColl.Drop(ctx))
+					}()
+					tctx, cancel := context.WithTimeout(ctx, dbTimeout)
+					defer cancel()
+					subTestCase(tctx, t)
+				})
+			}
+		},
 		"FindExpiresBefore": func(ctx context.Context, t *testing.T, md *mongoDepot, client *mongo.Client, coll *mongo.Collection) {
 			for subTestName, subTestCase := range map[string]func(ctx context.Context, t *testing.T){
 				"MatchesExpired": func(ctx context.Context, t *testing.T) {
@@ -254,3 +426,195 @@ func TestDB(t *testing.T) {
 		})
 	}
 }
+
+func TestMgoDB(t *testing.T) {
+	const (
+		uri            = "mongodb://localhost:27017"
+		databaseName   = "certDepot"
+		collectionName = "mgoCerts"
+		caName         = "ca"
+	)
+
+	session, err := mgo.DialWithTimeout(uri, 2*time.Second)
+	require.NoError(t, err)
+	defer session.Close()
+	coll := session.DB(databaseName).C(collectionName)
+
+	for name, testCase := range map[string]func(t *testing.T, md *mgoCertDepot){
+		"PutTTLSetsValueOnExistingDocument": func(t *testing.T, md *mgoCertDepot) {
+			name := "foo"
+			opts := &CertificateOptions{
+				CA:         caName,
+				CommonName: name,
+				Host:       name,
+				Expires:    24 * time.Hour,
+			}
+			require.NoError(t, opts.CreateCertificate(md))
+
+			dbUser := &User{}
+			require.NoError(t, coll.FindId(name).One(dbUser))
+			assert.WithinDuration(t, time.Now().Add(opts.Expires), dbUser.TTL, time.Minute)
+
+			ttl, err := md.GetTTL(name)
+			require.NoError(t, err)
+			assert.WithinDuration(t, dbUser.TTL, ttl, time.Second)
+		},
+		"PutTTLDoesNotInsert": func(t *testing.T, md *mgoCertDepot) {
+			name := "user"
+			require.Error(t, md.PutTTL(name, time.Now()))
+			assert.Equal(t, mgo.ErrNotFound, coll.FindId(name).One(&User{}))
+		},
+		"PutParentSetsValueOnExistingDocument": func(t *testing.T, md *mgoCertDepot) {
+			name := "foo"
+			require.NoError(t, (&CertificateOptions{
+				CA:         caName,
+				CommonName: name,
+				Host:       name,
+				Expires:    24 * time.Hour,
+			}).CreateCertificate(md))
+
+			dbUser := &User{}
+			require.NoError(t, coll.FindId(name).One(dbUser))
+			assert.Equal(t, caName, dbUser.Parent)
+
+			parent, err := md.GetParent(name)
+			require.NoError(t, err)
+			assert.Equal(t, caName, parent)
+
+			hasChildren, err := md.HasChildren(caName)
+			require.NoError(t, err)
+			assert.True(t, hasChildren)
+			hasChildren, err = md.HasChildren(name)
+			require.NoError(t, err)
+			assert.False(t, hasChildren)
+		},
+		"PutParentDoesNotInsert": func(t *testing.T, md *mgoCertDepot) {
+			name := "user"
+			require.Error(t, md.PutParent(name, caName))
+			assert.Equal(t, mgo.ErrNotFound, coll.FindId(name).One(&User{}))
+		},
+		"PutPolicySetsValueOnExistingDocument": func(t *testing.T, md *mgoCertDepot) {
+			expected := &Policy{AllowedNames: []string{"*.example.com"}, MaxLifetime: time.Hour}
+			require.NoError(t, md.PutPolicy(caName, expected))
+
+			dbUser := &User{}
+			require.NoError(t, coll.FindId(caName).One(dbUser))
+			assert.Equal(t, expected, dbUser.Policy)
+
+			policy, err := md.GetPolicy(caName)
+			require.NoError(t, err)
+			assert.Equal(t, expected, policy)
+
+			require.NoError(t, md.PutPolicy(caName, nil))
+			policy, err = md.GetPolicy(caName)
+			require.NoError(t, err)
+			assert.Nil(t, policy)
+		},
+		"PutPolicyDoesNotInsert": func(t *testing.T, md *mgoCertDepot) {
+			name := "user"
+			require.Error(t, md.PutPolicy(name, &Policy{}))
+			assert.Equal(t, mgo.ErrNotFound, coll.FindId(name).One(&User{}))
+		},
+		"PutProfileStoresInProfilesCollection": func(t *testing.T, md *mgoCertDepot) {
+			profile, err := md.GetProfile("server")
+			require.NoError(t, err)
+			assert.Nil(t, profile)
+
+			expected := &Profile{CA: caName, Organization: "Example", Expires: time.Hour}
+			require.NoError(t, md.PutProfile("server", expected))
+			profile, err = md.GetProfile("server")
+			require.NoError(t, err)
+			assert.Equal(t, expected, profile)
+			assert.Equal(t, mgo.ErrNotFound, coll.FindId("server").One(&User{}))
+
+			require.NoError(t, md.PutProfile("server", nil))
+			profile, err = md.GetProfile("server")
+			require.NoError(t, err)
+			assert.Nil(t, profile)
+		},
+		"PutPendingRequestStoresInRequestsCollection": func(t *testing.T, md *mgoCertDepot) {
+			requestColl := session.DB(databaseName).C(requestCollectionName(collectionName))
+			defer func() {
+				if err := requestColl.DropCollection(); err != nil {
+					assert.Equal(t, "ns not found", err.Error())
+				}
+			}()
+
+			req, err := md.GetPendingRequest("id")
+			require.NoError(t, err)
+			assert.Nil(t, req)
+
+			expected := &PendingRequest{
+				ID:      "id",
+				Options: CertificateOptions{CA: caName, Host: "server"},
+				Status:  PendingRequestPending,
+			}
+			require.NoError(t, md.PutPendingRequest(expected))
+			req, err = md.GetPendingRequest("id")
+			require.NoError(t, err)
+			require.NotNil(t, req)
+			assert.Equal(t, "server", req.Options.Host)
+			assert.Equal(t, mgo.ErrNotFound, coll.FindId("id").One(&User{}))
+
+			expected.Status = PendingRequestDenied
+			require.NoError(t, md.PutPendingRequest(expected))
+			reqs, err := md.ListPendingRequests()
+			require.NoError(t, err)
+			require.Len(t, reqs, 1)
+			assert.Equal(t, PendingRequestDenied, reqs[0].Status)
+		},
+		"GetTTLFailsForNonexistentDocument": func(t *testing.T, md *mgoCertDepot) {
+			_, err := md.GetTTL("nonexistent")
+			assert.Error(t, err)
+		},
+		"FindAndDeleteExpiresBefore": func(t *testing.T, md *mgoCertDepot) {
+			ttl := time.Now()
+			expiration := ttl.Add(time.Hour)
+			require.NoError(t, coll.Insert(&User{ID: "user1", TTL: ttl}))
+			require.NoError(t, coll.Insert(&User{ID: "user2", TTL: expiration.Add(time.Hour)}))
+
+			users, err := md.FindExpiresBefore(expiration)
+			require.NoError(t, err)
+			require.Len(t, users, 1)
+			assert.Equal(t, "user1", users[0].ID)
+
+			require.NoError(t, md.DeleteExpiresBefore(expiration))
+			assert.Equal(t, mgo.ErrNotFound, coll.FindId("user1").One(&User{}))
+			assert.NoError(t, coll.FindId("user2").One(&User{}))
+		},
+		"SaveSetsTTL": func(t *testing.T, md *mgoCertDepot) {
+			name := "saved"
+			md.opts = DepotOptions{CA: caName, DefaultExpiration: time.Hour}
+			creds, err := md.Generate(name)
+			require.NoError(t, err)
+			require.NoError(t, md.Save(name, creds))
+
+			ttl, err := md.GetTTL(name)
+			require.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(time.Hour), ttl, time.Minute)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d, err := NewMgoCertDepotWithSession(session, &MongoDBOptions{
+				DatabaseName:   databaseName,
+				CollectionName: collectionName,
+			})
+			require.NoError(t, err)
+			md, ok := d.(*mgoCertDepot)
+			require.True(t, ok)
+			defer func() {
+				if err := coll.DropCollection(); err != nil {
+					assert.Equal(t, "ns not found", err.Error())
+				}
+			}()
+
+			caOpts := &CertificateOptions{
+				CommonName: caName,
+				Expires:    24 * time.Hour,
+			}
+			require.NoError(t, caOpts.Init(md))
+
+			testCase(t, md)
+		})
+	}
+}
@@ -2,6 +2,8 @@ package certdepot
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -11,10 +13,12 @@ import (
 	"github.com/square/certstrap/depot"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	mgo "gopkg.in/mgo.v2"
+	_ "modernc.org/sqlite"
 )
 
 func getTagPath(tag *depot.Tag) string {
@@ -36,6 +40,9 @@ func getTagPath(tag *depot.Tag) string {
 func TestDepot(t *testing.T) {
 	var tempDir string
 	var data []byte
+	var md *memoryDepot
+	var bd *boltDepot
+	var sd *sqlDepot
 
 	session, err := mgo.DialWithTimeout("mongodb://localhost:27017", 2*time.Second)
 	require.NoError(t, err)
@@ -72,8 +79,8 @@ func TestDepot(t *testing.T) {
 			setup: func() depot.Depot {
 				tempDir, err = ioutil.TempDir(".", "file_depot")
 				require.NoError(t, err)
-				var d *depot.FileDepot
-				d, err = depot.NewFileDepot(tempDir)
+				var d Depot
+				d, err = NewFileDepot(tempDir)
 				require.NoError(t, err)
 				return d
 			},
@@ -126,6 +133,211 @@ func TestDepot(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "Memory",
+			setup: func() depot.Depot {
+				md = NewMemoryDepot(DepotOptions{}).(*memoryDepot)
+				return md
+			},
+			check: func(t *testing.T, tag *depot.Tag, data []byte) {
+				var name, key string
+				name, key, err = getNameAndKey(tag)
+				require.NoError(t, err)
+
+				u, ok := md.users[name]
+				if data == nil && !ok {
+					return
+				}
+				require.True(t, ok)
+				assert.Equal(t, name, u.ID)
+
+				var value string
+				switch key {
+				case userCertKey:
+					value = u.Cert
+				case userPrivateKeyKey:
+					value = u.PrivateKey
+				case userCertReqKey:
+					value = u.CertReq
+				case userCertRevocListKey:
+					value = u.CertRevocList
+				}
+				assert.Equal(t, string(data), value)
+			},
+			cleanup: func() {
+				md = nil
+			},
+			tests: []testCase{
+				{
+					name: "PutUpdates",
+					test: func(t *testing.T, d depot.Depot) {
+						const name = "bob"
+
+						require.NoError(t, d.Put(depot.CrtTag(name), []byte("cert")))
+						require.NoError(t, d.Put(depot.PrivKeyTag(name), []byte("key")))
+
+						certData := []byte("bob's new fake certificate")
+						assert.NoError(t, d.Put(depot.CrtTag(name), certData))
+						data, err = d.Get(depot.CrtTag(name))
+						require.NoError(t, err)
+						assert.Equal(t, certData, data)
+						data, err = d.Get(depot.PrivKeyTag(name))
+						require.NoError(t, err)
+						assert.Equal(t, []byte("key"), data)
+					},
+				},
+				{
+					name: "DeleteWhenDNE",
+					test: func(t *testing.T, d depot.Depot) {
+						const name = "bob"
+
+						assert.NoError(t, d.Delete(depot.CrtTag(name)))
+						assert.NoError(t, d.Delete(depot.PrivKeyTag(name)))
+						assert.NoError(t, d.Delete(depot.CsrTag(name)))
+						assert.NoError(t, d.Delete(depot.CrlTag(name)))
+					},
+				},
+			},
+		},
+		{
+			name: "Bolt",
+			setup: func() depot.Depot {
+				tempDir, err = ioutil.TempDir(".", "bolt_depot")
+				require.NoError(t, err)
+				var d Depot
+				d, err = NewBoltDBCertDepot(&BoltDBOptions{Path: filepath.Join(tempDir, "certs.db")})
+				require.NoError(t, err)
+				bd = d.(*boltDepot)
+				return bd
+			},
+			check: func(t *testing.T, tag *depot.Tag, data []byte) {
+				var name, key string
+				name, key, err = getNameAndKey(tag)
+				require.NoError(t, err)
+
+				var u *User
+				require.NoError(t, bd.db.View(func(tx *bolt.Tx) error {
+					u, err = bd.getUser(tx, name)
+					return err
+				}))
+				if data == nil && u == nil {
+					return
+				}
+				require.NotNil(t, u)
+				assert.Equal(t, name, u.ID)
+
+				var value string
+				switch key {
+				case userCertKey:
+					value = u.Cert
+				case userPrivateKeyKey:
+					value = u.PrivateKey
+				case userCertReqKey:
+					value = u.CertReq
+				case userCertRevocListKey:
+					value = u.CertRevocList
+				}
+				assert.Equal(t, string(data), value)
+			},
+			cleanup: func() {
+				require.NoError(t, bd.db.Close())
+				require.NoError(t, os.RemoveAll(tempDir))
+			},
+			tests: []testCase{
+				{
+					name: "PutUpdates",
+					test: func(t *testing.T, d depot.Depot) {
+						const name = "bob"
+
+						require.NoError(t, d.Put(depot.CrtTag(name), []byte("cert")))
+						require.NoError(t, d.Put(depot.PrivKeyTag(name), []byte("key")))
+
+						certData := []byte("bob's new fake certificate")
+						assert.NoError(t, d.Put(depot.CrtTag(name), certData))
+						data, err = d.Get(depot.CrtTag(name))
+						require.NoError(t, err)
+						assert.Equal(t, certData, data)
+						data, err = d.Get(depot.PrivKeyTag(name))
+						require.NoError(t, err)
+						assert.Equal(t, []byte("key"), data)
+					},
+				},
+				{
+					name: "DeleteWhenDNE",
+					test: func(t *testing.T, d depot.Depot) {
+						const name = "bob"
+
+						assert.NoError(t, d.Delete(depot.CrtTag(name)))
+						assert.NoError(t, d.Delete(depot.PrivKeyTag(name)))
+						assert.NoError(t, d.Delete(depot.CsrTag(name)))
+						assert.NoError(t, d.Delete(depot.CrlTag(name)))
+					},
+				},
+			},
+		},
+		{
+			name: "SQL",
+			setup: func() depot.Depot {
+				tempDir, err = ioutil.TempDir(".", "sql_depot")
+				require.NoError(t, err)
+				var d Depot
+				d, err = NewSQLCertDepot(context.Background(), &SQLDepotOptions{
+					DriverName:     "sqlite",
+					DataSourceName: filepath.Join(tempDir, "certs.db"),
+				})
+				require.NoError(t, err)
+				sd = d.(*sqlDepot)
+				return sd
+			},
+			check: func(t *testing.T, tag *depot.Tag, data []byte) {
+				var name, key string
+				name, key, err = getNameAndKey(tag)
+				require.NoError(t, err)
+
+				var value string
+				err = sd.db.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", key, sd.tableName), name).Scan(&value)
+				if data == nil && err == sql.ErrNoRows {
+					return
+				}
+				require.NoError(t, err)
+				assert.Equal(t, string(data), value)
+			},
+			cleanup: func() {
+				require.NoError(t, sd.db.Close())
+				require.NoError(t, os.RemoveAll(tempDir))
+			},
+			tests: []testCase{
+				{
+					name: "PutUpdates",
+					test: func(t *testing.T, d depot.Depot) {
+						const name = "bob"
+
+						require.NoError(t, d.Put(depot.CrtTag(name), []byte("cert")))
+						require.NoError(t, d.Put(depot.PrivKeyTag(name), []byte("key")))
+
+						certData := []byte("bob's new fake certificate")
+						assert.NoError(t, d.Put(depot.CrtTag(name), certData))
+						data, err = d.Get(depot.CrtTag(name))
+						require.NoError(t, err)
+						assert.Equal(t, certData, data)
+						data, err = d.Get(depot.PrivKeyTag(name))
+						require.NoError(t, err)
+						assert.Equal(t, []byte("key"), data)
+					},
+				},
+				{
+					name: "DeleteWhenDNE",
+					test: func(t *testing.T, d depot.Depot) {
+						const name = "bob"
+
+						assert.NoError(t, d.Delete(depot.CrtTag(name)))
+						assert.NoError(t, d.Delete(depot.PrivKeyTag(name)))
+						assert.NoError(t, d.Delete(depot.CsrTag(name)))
+						assert.NoError(t, d.Delete(depot.CrlTag(name)))
+					},
+				},
+			},
+		},
 		{
 			name: "LegacyMongoDB",
 			setup: func() depot.Depot {
@@ -560,6 +772,39 @@ func TestDepot(t *testing.T) {
 					assert.Equal(t, certRevocListData, data)
 				})
 			})
+			t.Run("List", func(t *testing.T) {
+				d := impl.setup()
+				defer impl.cleanup()
+
+				require.NoError(t, d.Put(depot.CrtTag("alice"), []byte("alice's fake certificate")))
+				require.NoError(t, d.Put(depot.PrivKeyTag("alice"), []byte("alice's fake private key")))
+				require.NoError(t, d.Put(depot.CrtTag("bob"), []byte("bob's fake certificate")))
+				require.NoError(t, d.Put(depot.CrlTag("bob"), []byte("bob's fake certificate revocation list")))
+
+				for kind, expected := range map[TagKind][]string{
+					CrtKind:     {"alice", "bob"},
+					PrivKeyKind: {"alice"},
+					CsrKind:     {},
+					CrlKind:     {"bob"},
+				} {
+					t.Run(string(kind), func(t *testing.T) {
+						names, err := ListNames(d, kind)
+						require.NoError(t, err)
+						assert.Equal(t, expected, names)
+					})
+				}
+
+				t.Run("ExcludesDeletedData", func(t *testing.T) {
+					require.NoError(t, d.Delete(depot.CrtTag("alice")))
+					names, err := ListNames(d, CrtKind)
+					require.NoError(t, err)
+					assert.Equal(t, []string{"bob"}, names)
+				})
+				t.Run("FailsWithInvalidKind", func(t *testing.T) {
+					_, err := ListNames(d, TagKind("foo"))
+					assert.Error(t, err)
+				})
+			})
 			t.Run("Delete", func(t *testing.T) {
 				d := impl.setup()
 				defer impl.cleanup()
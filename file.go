@@ -1,13 +1,47 @@
 package certdepot
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cdr/grip"
 	"github.com/pkg/errors"
 	"github.com/square/certstrap/depot"
 )
 
+// ttlSuffix is the extension of the sidecar files in which the file depot
+// records expirations set with PutTTL.
+const ttlSuffix = ".ttl"
+
+// parentSuffix is the extension of the sidecar files in which the file depot
+// records the issuer of a certificate set with PutParent.
+const parentSuffix = ".parent"
+
+// policySuffix is the extension of the sidecar files in which the file depot
+// records the issuance policy of a CA set with PutPolicy.
+const policySuffix = ".policy"
+
+// profileSuffix is the extension of the files in which the file depot stores
+// profiles set with PutProfile.
+const profileSuffix = ".profile"
+
+// requestSuffix is the extension of the files in which the file depot stores
+// certificate requests submitted for approval.
+const requestSuffix = ".request"
+
 type fileDepot struct {
 	*depot.FileDepot
+	dir  string
 	opts DepotOptions
+	// crlMu serializes SwapRevocationList.
+	crlMu sync.Mutex
+	// requestMu serializes writes of pending requests.
+	requestMu sync.Mutex
 }
 
 // NewFileDepot creates a FileDepot wrapped with certdepot.Depot.
@@ -17,7 +51,7 @@ func NewFileDepot(dir string) (Depot, error) {
 		return nil, errors.WithStack(err)
 
 	}
-	return &fileDepot{FileDepot: dt}, nil
+	return &fileDepot{FileDepot: dt, dir: dir}, nil
 }
 
 // MakeFileDepot constructs a file-based depot implementation and
@@ -42,3 +76,508 @@ func (fd *fileDepot) Find(name string) (*Credentials, error)     { return depotF
 func (fd *fileDepot) Generate(name string) (*Credentials, error) {
 	return depotGenerate(fd, name, fd.opts)
 }
+
+// List returns the names of all files in the depot directory that hold data
+// of the given kind.
+func (fd *fileDepot) List(kind TagKind) ([]string, error) {
+	var getName func(*depot.Tag) string
+	switch kind {
+	case CrtKind:
+		getName = depot.GetNameFromCrtTag
+	case PrivKeyKind:
+		getName = depot.GetNameFromPrivKeyTag
+	case CsrKind:
+		getName = depot.GetNameFromCsrTag
+	case CrlKind:
+		getName = depot.GetNameFromCrlTag
+	default:
+		return nil, errors.Errorf("unrecognized tag kind '%s'", kind)
+	}
+
+	names := []string{}
+	for _, tag := range fd.FileDepot.List() {
+		if name := getName(tag); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// Delete removes the data specified by the tag. Deleting a certificate also
+// removes its expiration, parent and policy.
+func (fd *fileDepot) Delete(tag *depot.Tag) error {
+	if err := fd.FileDepot.Delete(tag); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if name := depot.GetNameFromCrtTag(tag); name != "" {
+		if err := fd.deleteTTL(name); err != nil {
+			return errors.Wrap(err, "problem removing expiration")
+		}
+		if err := fd.deletePolicy(name); err != nil {
+			return errors.Wrap(err, "problem removing policy")
+		}
+		return errors.Wrap(fd.deleteParent(name), "problem removing parent")
+	}
+
+	return nil
+}
+
+func (fd *fileDepot) ttlPath(name string) string {
+	return filepath.Join(fd.dir, name+ttlSuffix)
+}
+
+func (fd *fileDepot) deleteTTL(name string) error {
+	if err := os.Remove(fd.ttlPath(name)); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// PutTTL sets the TTL to the given expiration time for the name by writing it
+// to a sidecar file next to the certificate. If the certificate for the name
+// does not exist, this will error. The expiration must be within the validity
+// bounds of the certificate for the given name.
+func (fd *fileDepot) PutTTL(name string, expiration time.Time) error {
+	formattedName := strings.Replace(name, " ", "_", -1)
+	expiration = expiration.UTC()
+
+	minExpiration, maxExpiration, err := ValidityBounds(fd, formattedName)
+	if err != nil {
+		return errors.Wrap(err, "could not get certificate validity bounds")
+	}
+	if expiration.Before(minExpiration) || expiration.After(maxExpiration) {
+		return errors.Errorf("cannot set expiration to %s because it must be between %s and %s", expiration, minExpiration, maxExpiration)
+	}
+
+	if err = ioutil.WriteFile(fd.ttlPath(formattedName), []byte(expiration.Format(time.RFC3339Nano)), 0600); err != nil {
+		return errors.Wrapf(err, "problem writing TTL for %s", name)
+	}
+
+	return nil
+}
+
+// GetTTL returns the TTL for the given name. If no TTL has been set with
+// PutTTL, the expiration of the certificate is returned.
+func (fd *fileDepot) GetTTL(name string) (time.Time, error) {
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	data, err := ioutil.ReadFile(fd.ttlPath(formattedName))
+	if os.IsNotExist(err) {
+		_, notAfter, err := ValidityBounds(fd, formattedName)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "could not get TTL from certificate")
+		}
+		return notAfter.UTC(), nil
+	}
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "problem reading TTL for %s", name)
+	}
+
+	ttl, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "problem parsing TTL for %s", name)
+	}
+
+	return ttl, nil
+}
+
+func (fd *fileDepot) parentPath(name string) string {
+	return filepath.Join(fd.dir, name+parentSuffix)
+}
+
+func (fd *fileDepot) deleteParent(name string) error {
+	if err := os.Remove(fd.parentPath(name)); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// PutParent records the name of the CA that issued the certificate with the
+// given name by writing it to a sidecar file next to the certificate. If the
+// certificate for the name does not exist, this will error.
+func (fd *fileDepot) PutParent(name, parent string) error {
+	formattedName := strings.Replace(name, " ", "_", -1)
+	if !depot.CheckCertificate(fd, formattedName) {
+		return errors.Errorf("could not find certificate for %s in the depot", name)
+	}
+	if parent == "" {
+		return errors.Wrapf(fd.deleteParent(formattedName), "problem removing parent for %s", name)
+	}
+
+	if err := ioutil.WriteFile(fd.parentPath(formattedName), []byte(strings.Replace(parent, " ", "_", -1)), 0600); err != nil {
+		return errors.Wrapf(err, "problem writing parent for %s", name)
+	}
+
+	return nil
+}
+
+// GetParent returns the name of the CA that issued the certificate with the
+// given name.
+func (fd *fileDepot) GetParent(name string) (string, error) {
+	data, err := ioutil.ReadFile(fd.parentPath(strings.Replace(name, " ", "_", -1)))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "problem reading parent for %s", name)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// HasChildren returns whether any parent sidecar file in the depot directory
+// names the CA with the given name.
+func (fd *fileDepot) HasChildren(name string) (bool, error) {
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	infos, err := ioutil.ReadDir(fd.dir)
+	if err != nil {
+		return false, errors.Wrap(err, "problem reading depot directory")
+	}
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), parentSuffix) {
+			continue
+		}
+		parent, err := fd.GetParent(strings.TrimSuffix(info.Name(), parentSuffix))
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		if parent == formattedName {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// crlPath returns the path of the CRL file, which certstrap names after the
+// CA with the ".crl" extension.
+func (fd *fileDepot) crlPath(name string) string {
+	return filepath.Join(fd.dir, name+".crl")
+}
+
+// SwapRevocationList replaces the CRL of the CA with the given name if the
+// stored CRL is equal to prev. The new CRL is written to a temporary file
+// that is renamed over the existing one, so readers never see a missing or
+// partially written CRL. The comparison is only atomic within the process,
+// so the depot directory must not be shared by concurrent writers.
+func (fd *fileDepot) SwapRevocationList(name string, prev, next []byte) (bool, error) {
+	if next == nil {
+		return false, errors.New("data is nil")
+	}
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	fd.crlMu.Lock()
+	defer fd.crlMu.Unlock()
+
+	current, err := ioutil.ReadFile(fd.crlPath(formattedName))
+	if err != nil && !os.IsNotExist(err) {
+		return false, errors.Wrapf(err, "problem reading certificate revocation list for %s", name)
+	}
+	if string(current) != string(prev) {
+		return false, nil
+	}
+
+	tmp, err := ioutil.TempFile(fd.dir, formattedName+".crl.*.tmp")
+	if err != nil {
+		return false, errors.Wrap(err, "problem creating temporary file")
+	}
+	catcher := grip.NewBasicCatcher()
+	_, err = tmp.Write(next)
+	catcher.Wrap(err, "problem writing temporary file")
+	catcher.Wrap(tmp.Close(), "problem closing temporary file")
+	catcher.Wrap(os.Chmod(tmp.Name(), depot.LeafPerm), "problem setting permissions of temporary file")
+	if !catcher.HasErrors() {
+		catcher.Wrapf(os.Rename(tmp.Name(), fd.crlPath(formattedName)), "problem replacing certificate revocation list for %s", name)
+	}
+	if catcher.HasErrors() {
+		catcher.Add(os.Remove(tmp.Name()))
+		return false, catcher.Resolve()
+	}
+
+	return true, nil
+}
+
+func (fd *fileDepot) policyPath(name string) string {
+	return filepath.Join(fd.dir, name+policySuffix)
+}
+
+func (fd *fileDepot) deletePolicy(name string) error {
+	if err := os.Remove(fd.policyPath(name)); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// PutPolicy attaches the policy to the CA with the given name by writing it as
+// JSON to a sidecar file next to the certificate. If the certificate for the
+// name does not exist, this will error.
+func (fd *fileDepot) PutPolicy(name string, policy *Policy) error {
+	formattedName := strings.Replace(name, " ", "_", -1)
+	if !depot.CheckCertificate(fd, formattedName) {
+		return errors.Errorf("could not find certificate for %s in the depot", name)
+	}
+	if policy == nil {
+		return errors.Wrapf(fd.deletePolicy(formattedName), "problem removing policy for %s", name)
+	}
+
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return errors.Wrap(err, "problem encoding policy")
+	}
+	if err = ioutil.WriteFile(fd.policyPath(formattedName), data, 0600); err != nil {
+		return errors.Wrapf(err, "problem writing policy for %s", name)
+	}
+
+	return nil
+}
+
+// GetPolicy returns the policy of the CA with the given name.
+func (fd *fileDepot) GetPolicy(name string) (*Policy, error) {
+	data, err := ioutil.ReadFile(fd.policyPath(strings.Replace(name, " ", "_", -1)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "problem reading policy for %s", name)
+	}
+
+	policy := &Policy{}
+	if err = json.Unmarshal(data, policy); err != nil {
+		return nil, errors.Wrapf(err, "problem decoding policy for %s", name)
+	}
+
+	return policy, nil
+}
+
+func (fd *fileDepot) profilePath(name string) string {
+	return filepath.Join(fd.dir, name+profileSuffix)
+}
+
+// PutProfile stores the profile under the given name by writing it as JSON to
+// a file in the depot directory.
+func (fd *fileDepot) PutProfile(name string, profile *Profile) error {
+	if profile == nil {
+		if err := os.Remove(fd.profilePath(name)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "problem removing profile %s", name)
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return errors.Wrap(err, "problem encoding profile")
+	}
+	if err = ioutil.WriteFile(fd.profilePath(name), data, 0600); err != nil {
+		return errors.Wrapf(err, "problem writing profile %s", name)
+	}
+
+	return nil
+}
+
+// GetProfile returns the profile with the given name.
+func (fd *fileDepot) GetProfile(name string) (*Profile, error) {
+	data, err := ioutil.ReadFile(fd.profilePath(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "problem reading profile %s", name)
+	}
+
+	profile := &Profile{}
+	if err = json.Unmarshal(data, profile); err != nil {
+		return nil, errors.Wrapf(err, "problem decoding profile %s", name)
+	}
+
+	return profile, nil
+}
+
+// ListProfiles returns all profiles in the depot directory by name.
+func (fd *fileDepot) ListProfiles() (map[string]*Profile, error) {
+	infos, err := ioutil.ReadDir(fd.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem reading depot directory")
+	}
+
+	profiles := map[string]*Profile{}
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), profileSuffix) {
+			continue
+		}
+		name := strings.TrimSuffix(info.Name(), profileSuffix)
+		profile, err := fd.GetProfile(name)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if profile != nil {
+			profiles[name] = profile
+		}
+	}
+
+	return profiles, nil
+}
+
+func (fd *fileDepot) requestPath(id string) string {
+	return filepath.Join(fd.dir, id+requestSuffix)
+}
+
+// PutPendingRequest inserts or replaces the pending request by writing it as
+// JSON to a file in the depot directory.
+func (fd *fileDepot) PutPendingRequest(req *PendingRequest) error {
+	fd.requestMu.Lock()
+	defer fd.requestMu.Unlock()
+
+	return errors.WithStack(fd.writePendingRequest(req))
+}
+
+// SwapPendingRequest replaces the pending request if the stored request has
+// the given status. The status is only checked atomically within the
+// process, so the depot directory must not be shared by concurrent writers.
+func (fd *fileDepot) SwapPendingRequest(req *PendingRequest, prev PendingRequestStatus) (bool, error) {
+	fd.requestMu.Lock()
+	defer fd.requestMu.Unlock()
+
+	current, err := fd.GetPendingRequest(req.ID)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if current == nil || current.Status != prev {
+		return false, nil
+	}
+	if err = fd.writePendingRequest(req); err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	return true, nil
+}
+
+// writePendingRequest writes the request to a temporary file that is renamed
+// over the existing one, so readers never see a partially written request.
+func (fd *fileDepot) writePendingRequest(req *PendingRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrapf(err, "problem encoding pending request %s", req.ID)
+	}
+
+	tmp, err := ioutil.TempFile(fd.dir, req.ID+requestSuffix+".*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "problem creating temporary file")
+	}
+	catcher := grip.NewBasicCatcher()
+	_, err = tmp.Write(data)
+	catcher.Wrap(err, "problem writing temporary file")
+	catcher.Wrap(tmp.Close(), "problem closing temporary file")
+	catcher.Wrap(os.Chmod(tmp.Name(), 0600), "problem setting permissions of temporary file")
+	if !catcher.HasErrors() {
+		catcher.Wrapf(os.Rename(tmp.Name(), fd.requestPath(req.ID)), "problem writing pending request %s", req.ID)
+	}
+	if catcher.HasErrors() {
+		catcher.Add(os.Remove(tmp.Name()))
+	}
+
+	return catcher.Resolve()
+}
+
+// GetPendingRequest returns the pending request with the given ID.
+func (fd *fileDepot) GetPendingRequest(id string) (*PendingRequest, error) {
+	data, err := ioutil.ReadFile(fd.requestPath(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "problem reading pending request %s", id)
+	}
+
+	req := &PendingRequest{}
+	if err = json.Unmarshal(data, req); err != nil {
+		return nil, errors.Wrapf(err, "problem decoding pending request %s", id)
+	}
+
+	return req, nil
+}
+
+// ListPendingRequests returns all pending requests in the depot directory.
+func (fd *fileDepot) ListPendingRequests() ([]PendingRequest, error) {
+	infos, err := ioutil.ReadDir(fd.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem reading depot directory")
+	}
+
+	reqs := []PendingRequest{}
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), requestSuffix) {
+			continue
+		}
+		req, err := fd.GetPendingRequest(strings.TrimSuffix(info.Name(), requestSuffix))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if req != nil {
+			reqs = append(reqs, *req)
+		}
+	}
+
+	return reqs, nil
+}
+
+// FindExpiresBefore finds all Users with a certificate that expires before
+// the given cutoff time.
+func (fd *fileDepot) FindExpiresBefore(cutoff time.Time) ([]User, error) {
+	names, err := fd.List(CrtKind)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem listing certificates")
+	}
+
+	users := []User{}
+	for _, name := range names {
+		ttl, err := fd.GetTTL(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "problem getting TTL for %s", name)
+		}
+		if ttl.After(cutoff) {
+			continue
+		}
+
+		parent, err := fd.GetParent(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "problem getting parent for %s", name)
+		}
+
+		u := User{ID: name, TTL: ttl, Parent: parent}
+		for tag, dst := range map[*depot.Tag]*string{
+			depot.CrtTag(name):     &u.Cert,
+			depot.PrivKeyTag(name): &u.PrivateKey,
+			depot.CsrTag(name):     &u.CertReq,
+			depot.CrlTag(name):     &u.CertRevocList,
+		} {
+			if data, err := fd.FileDepot.Get(tag); err == nil {
+				*dst = string(data)
+			}
+		}
+		users = append(users, u)
+	}
+
+	return users, nil
+}
+
+// DeleteExpiresBefore removes the files of all Users with a certificate that
+// expires before the given cutoff time.
+func (fd *fileDepot) DeleteExpiresBefore(cutoff time.Time) error {
+	users, err := fd.FindExpiresBefore(cutoff)
+	if err != nil {
+		return errors.Wrap(err, "problem finding expired users")
+	}
+
+	catcher := grip.NewBasicCatcher()
+	for _, u := range users {
+		catcher.Add(deleteIfExists(fd.FileDepot, depot.CrtTag(u.ID), depot.PrivKeyTag(u.ID), depot.CsrTag(u.ID), depot.CrlTag(u.ID)))
+		catcher.Add(fd.deleteTTL(u.ID))
+		catcher.Add(fd.deleteParent(u.ID))
+		catcher.Add(fd.deletePolicy(u.ID))
+	}
+
+	return errors.Wrap(catcher.Resolve(), "problem removing expired users")
+}
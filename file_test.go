@@ -0,0 +1,223 @@
+package certdepot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/depot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileDepotExpiration(t *testing.T) {
+	const (
+		caName      = "ca"
+		serviceName = "localhost"
+	)
+
+	for testName, testCase := range map[string]func(t *testing.T, fd *fileDepot){
+		"GetTTLDefaultsToCertificateExpiration": func(t *testing.T, fd *fileDepot) {
+			require.NoError(t, os.Remove(fd.ttlPath(serviceName)))
+
+			_, notAfter, err := ValidityBounds(fd, serviceName)
+			require.NoError(t, err)
+			ttl, err := fd.GetTTL(serviceName)
+			require.NoError(t, err)
+			assert.True(t, notAfter.Equal(ttl))
+		},
+		"SignSetsTTL": func(t *testing.T, fd *fileDepot) {
+			_, err := os.Stat(fd.ttlPath(serviceName))
+			require.NoError(t, err)
+
+			ttl, err := fd.GetTTL(serviceName)
+			require.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(24*time.Hour), ttl, time.Minute)
+		},
+		"PutTTLOverridesCertificateExpiration": func(t *testing.T, fd *fileDepot) {
+			expiration := time.Now().Add(time.Hour).Round(time.Second)
+			require.NoError(t, fd.PutTTL(serviceName, expiration))
+
+			ttl, err := fd.GetTTL(serviceName)
+			require.NoError(t, err)
+			assert.True(t, expiration.Equal(ttl))
+		},
+		"TTLFormatsName": func(t *testing.T, fd *fileDepot) {
+			const name = "service with spaces"
+			opts := &CertificateOptions{
+				CA:         caName,
+				CommonName: name,
+				Host:       name,
+				Expires:    24 * time.Hour,
+			}
+			require.NoError(t, opts.CreateCertificate(fd))
+
+			expiration := time.Now().Add(time.Hour).Round(time.Second)
+			require.NoError(t, fd.PutTTL(name, expiration))
+			_, err := os.Stat(fd.ttlPath("service_with_spaces"))
+			require.NoError(t, err)
+
+			ttl, err := fd.GetTTL(name)
+			require.NoError(t, err)
+			assert.True(t, expiration.Equal(ttl))
+
+			require.NoError(t, os.Remove(fd.ttlPath("service_with_spaces")))
+			_, notAfter, err := ValidityBounds(fd, "service_with_spaces")
+			require.NoError(t, err)
+			ttl, err = fd.GetTTL(name)
+			require.NoError(t, err)
+			assert.True(t, notAfter.Equal(ttl))
+		},
+		"PutTTLFailsOutsideValidityBounds": func(t *testing.T, fd *fileDepot) {
+			assert.Error(t, fd.PutTTL(serviceName, time.Now().Add(48*time.Hour)))
+		},
+		"PutTTLFailsForNonexistentUser": func(t *testing.T, fd *fileDepot) {
+			assert.Error(t, fd.PutTTL("nonexistent", time.Now()))
+			_, err := os.Stat(fd.ttlPath("nonexistent"))
+			assert.True(t, os.IsNotExist(err))
+		},
+		"GetTTLFailsForNonexistentUser": func(t *testing.T, fd *fileDepot) {
+			_, err := fd.GetTTL("nonexistent")
+			assert.Error(t, err)
+		},
+		"DeleteCertificateRemovesTTL": func(t *testing.T, fd *fileDepot) {
+			require.NoError(t, fd.Delete(depot.CrtTag(serviceName)))
+			_, err := os.Stat(fd.ttlPath(serviceName))
+			assert.True(t, os.IsNotExist(err))
+		},
+		"SignSetsParent": func(t *testing.T, fd *fileDepot) {
+			parent, err := fd.GetParent(serviceName)
+			require.NoError(t, err)
+			assert.Equal(t, caName, parent)
+
+			parent, err = fd.GetParent(caName)
+			require.NoError(t, err)
+			assert.Empty(t, parent)
+			_, err = os.Stat(fd.parentPath(caName))
+			assert.True(t, os.IsNotExist(err))
+		},
+		"PutParentFailsForNonexistentUser": func(t *testing.T, fd *fileDepot) {
+			assert.Error(t, fd.PutParent("nonexistent", caName))
+			_, err := os.Stat(fd.parentPath("nonexistent"))
+			assert.True(t, os.IsNotExist(err))
+		},
+		"HasChildrenFindsRecordedParent": func(t *testing.T, fd *fileDepot) {
+			hasChildren, err := fd.HasChildren(caName)
+			require.NoError(t, err)
+			assert.True(t, hasChildren)
+			hasChildren, err = fd.HasChildren(serviceName)
+			require.NoError(t, err)
+			assert.False(t, hasChildren)
+
+			require.NoError(t, fd.Delete(depot.CrtTag(serviceName)))
+			hasChildren, err = fd.HasChildren(caName)
+			require.NoError(t, err)
+			assert.False(t, hasChildren)
+		},
+		"DeleteCertificateRemovesParent": func(t *testing.T, fd *fileDepot) {
+			require.NoError(t, fd.Delete(depot.CrtTag(serviceName)))
+			parent, err := fd.GetParent(serviceName)
+			require.NoError(t, err)
+			assert.Empty(t, parent)
+		},
+		"PutPolicyWritesSidecar": func(t *testing.T, fd *fileDepot) {
+			policy, err := fd.GetPolicy(caName)
+			require.NoError(t, err)
+			assert.Nil(t, policy)
+
+			expected := &Policy{AllowedNames: []string{"*.example.com"}, MaxLifetime: time.Hour}
+			require.NoError(t, fd.PutPolicy(caName, expected))
+			policy, err = fd.GetPolicy(caName)
+			require.NoError(t, err)
+			assert.Equal(t, expected, policy)
+
+			require.NoError(t, fd.PutPolicy(caName, nil))
+			_, err = os.Stat(fd.policyPath(caName))
+			assert.True(t, os.IsNotExist(err))
+		},
+		"PutPolicyFailsForNonexistentUser": func(t *testing.T, fd *fileDepot) {
+			assert.Error(t, fd.PutPolicy("nonexistent", &Policy{}))
+			_, err := os.Stat(fd.policyPath("nonexistent"))
+			assert.True(t, os.IsNotExist(err))
+		},
+		"DeleteCertificateRemovesPolicy": func(t *testing.T, fd *fileDepot) {
+			require.NoError(t, fd.PutPolicy(caName, &Policy{MaxLifetime: time.Hour}))
+			require.NoError(t, fd.Delete(depot.CrtTag(caName)))
+			_, err := os.Stat(fd.policyPath(caName))
+			assert.True(t, os.IsNotExist(err))
+		},
+		"FindAndDeleteExpiresBefore": func(t *testing.T, fd *fileDepot) {
+			const name = "expiring"
+			opts := &CertificateOptions{
+				CA:         caName,
+				CommonName: name,
+				Host:       name,
+				Expires:    time.Hour,
+			}
+			require.NoError(t, opts.CreateCertificate(fd))
+
+			users, err := fd.FindExpiresBefore(time.Now().Add(2 * time.Hour))
+			require.NoError(t, err)
+			require.Len(t, users, 1)
+			assert.Equal(t, name, users[0].ID)
+			assert.NotEmpty(t, users[0].Cert)
+			assert.NotEmpty(t, users[0].PrivateKey)
+
+			require.NoError(t, fd.DeleteExpiresBefore(time.Now().Add(2*time.Hour)))
+			assert.False(t, fd.Check(depot.CrtTag(name)))
+			assert.False(t, fd.Check(depot.PrivKeyTag(name)))
+			_, err = os.Stat(fd.ttlPath(name))
+			assert.True(t, os.IsNotExist(err))
+			assert.True(t, fd.Check(depot.CrtTag(serviceName)))
+			assert.True(t, fd.Check(depot.CrtTag(caName)))
+		},
+		"GenerateSaveAndFind": func(t *testing.T, fd *fileDepot) {
+			const name = "generated"
+			fd.opts = DepotOptions{CA: caName, DefaultExpiration: time.Hour}
+			creds, err := fd.Generate(name)
+			require.NoError(t, err)
+			require.NoError(t, fd.Save(name, creds))
+
+			found, err := fd.Find(name)
+			require.NoError(t, err)
+			assert.Equal(t, creds.Cert, found.Cert)
+			assert.Equal(t, creds.Key, found.Key)
+
+			ttl, err := fd.GetTTL(name)
+			require.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(time.Hour), ttl, time.Minute)
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			tempDir, err := ioutil.TempDir(".", "file-test")
+			require.NoError(t, err)
+			defer func() {
+				assert.NoError(t, os.RemoveAll(tempDir))
+			}()
+
+			d, err := BootstrapDepot(context.Background(), BootstrapDepotConfig{
+				FileDepot:   filepath.Join(tempDir, "depot"),
+				CAName:      caName,
+				ServiceName: serviceName,
+				CAOpts: &CertificateOptions{
+					CommonName: caName,
+					Expires:    24 * time.Hour,
+				},
+				ServiceOpts: &CertificateOptions{
+					CA:         caName,
+					CommonName: serviceName,
+					Host:       serviceName,
+					Expires:    24 * time.Hour,
+				},
+			})
+			require.NoError(t, err)
+			fd, ok := d.(*fileDepot)
+			require.True(t, ok)
+
+			testCase(t, fd)
+		})
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/deciduosity/certdepot
 
-go 1.14
+go 1.21
 
 require (
 	github.com/cdr/grip v0.0.0-20201130212745-71f7f3863c33
@@ -8,6 +8,52 @@ require (
 	github.com/pkg/errors v0.9.1
 	github.com/square/certstrap v1.2.0
 	github.com/stretchr/testify v1.6.1
+	go.etcd.io/bbolt v1.3.5
 	go.mongodb.org/mongo-driver v1.4.2
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/net v0.0.0-20200520182314-0ba52f642ac2
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
+	modernc.org/sqlite v1.20.4
+)
+
+require (
+	github.com/andygrunwald/go-jira v1.13.0 // indirect
+	github.com/aws/aws-sdk-go v1.34.28 // indirect
+	github.com/bluele/slack v0.0.0-20180528010058-b4b4d354a079 // indirect
+	github.com/cenkalti/backoff v2.1.1+incompatible // indirect
+	github.com/coreos/go-systemd v0.0.0-20191104093116-d3cd4ed1dbcf // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dghubble/go-twitter v0.0.0-20190719072343-39e5462e111f // indirect
+	github.com/dghubble/oauth1 v0.6.0 // indirect
+	github.com/dghubble/sling v1.3.0 // indirect
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
+	github.com/dustin/go-humanize v1.0.0 // indirect
+	github.com/fatih/structs v1.0.0 // indirect
+	github.com/fuyufjh/splunk-hec-go v0.3.3 // indirect
+	github.com/gen2brain/beeep v0.0.0-20200420150314-13046a26d502 // indirect
+	github.com/go-stack/stack v1.8.0 // indirect
+	github.com/godbus/dbus v4.1.0+incompatible // indirect
+	github.com/golang/snappy v0.0.1 // indirect
+	github.com/google/go-github v17.0.0+incompatible // indirect
+	github.com/google/go-querystring v1.0.0 // indirect
+	github.com/google/uuid v1.3.0 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/klauspost/compress v1.9.5 // indirect
+	github.com/mattn/go-isatty v0.0.16 // indirect
+	github.com/mattn/go-xmpp v0.0.0-20200309091041-899ef71e80d2 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20200410134404-eec4a21b6bb0 // indirect
+	github.com/satori/go.uuid v1.2.0 // indirect
+	github.com/shirou/gopsutil v2.20.8+incompatible // indirect
+	github.com/trivago/tgo v1.0.7 // indirect
+	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c // indirect
+	github.com/xdg/stringprep v0.0.0-20180714160509-73f8eece6fdc // indirect
+	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d // indirect
+	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e // indirect
+	golang.org/x/sys v0.0.0-20220811171246-fbc7d0a398ab // indirect
+	golang.org/x/text v0.3.3 // indirect
+	modernc.org/libc v1.22.2 // indirect
+	modernc.org/mathutil v1.5.0 // indirect
+	modernc.org/memory v1.4.0 // indirect
 )
@@ -0,0 +1,154 @@
+package certdepot
+
+import (
+	"bytes"
+	"crypto/x509"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+	"github.com/square/certstrap/pkix"
+)
+
+// putParent records the CA that issued the certificate with the given name if
+// the depot supports it.
+func putParent(d depot.Depot, name, parent string) error {
+	hm, ok := d.(HierarchyManager)
+	if !ok {
+		return nil
+	}
+	return hm.PutParent(name, strings.Replace(parent, " ", "_", -1))
+}
+
+// getParent returns the recorded issuer of the certificate with the given name,
+// or an empty string if the depot does not record issuers.
+func getParent(d depot.Depot, name string) (string, error) {
+	hm, ok := d.(HierarchyManager)
+	if !ok {
+		return "", nil
+	}
+	return hm.GetParent(name)
+}
+
+// GetParent returns the name of the CA that issued the certificate with the
+// given name, or an empty string if the certificate is a root CA or the depot
+// does not record issuers.
+func GetParent(d depot.Depot, name string) (string, error) {
+	parent, err := getParent(d, strings.Replace(name, " ", "_", -1))
+	return parent, errors.Wrapf(err, "problem getting parent of %s", name)
+}
+
+// HasChildren returns whether the depot records any certificate as issued by
+// the CA with the given name, which identifies a CA even if its own
+// certificate is missing. It returns false if the depot does not record
+// issuers.
+func HasChildren(d depot.Depot, name string) (bool, error) {
+	hm, ok := d.(HierarchyManager)
+	if !ok {
+		return false, nil
+	}
+	hasChildren, err := hm.HasChildren(strings.Replace(name, " ", "_", -1))
+	return hasChildren, errors.Wrapf(err, "problem finding certificates issued by %s", name)
+}
+
+// depotChain builds the chain of the PEM-encoded certificate by following the
+// recorded issuer of each CA in the depot, starting from the CA with the given
+// name. It returns the certificate followed by its intermediate CAs, and the
+// root CA that terminates the chain. A CA that is not self-signed but has no
+// recorded issuer, such as an intermediate imported into the depot, is treated
+// as the root of the chain.
+func depotChain(dpt depot.Depot, crt []byte, issuer string) ([]byte, []byte, error) {
+	rawCrt, err := parseCertificatePEM(crt)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "problem parsing certificate")
+	}
+	if isSelfSigned(rawCrt) {
+		return crt, crt, nil
+	}
+	issuer = strings.Replace(issuer, " ", "_", -1)
+
+	chain := append([]byte{}, crt...)
+	seen := map[string]bool{}
+	for {
+		if seen[issuer] {
+			return nil, nil, errors.Errorf("certificate hierarchy contains a cycle at %s", issuer)
+		}
+		seen[issuer] = true
+
+		issuerCrt, err := dpt.Get(CrtTag(issuer))
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "problem getting certificate for CA %s", issuer)
+		}
+		rawIssuer, err := parseCertificatePEM(issuerCrt)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "problem parsing certificate for CA %s", issuer)
+		}
+		if err = rawCrt.CheckSignatureFrom(rawIssuer); err != nil {
+			return nil, nil, errors.Wrapf(err, "certificate in the chain is not signed by %s", issuer)
+		}
+		if isSelfSigned(rawIssuer) {
+			return chain, issuerCrt, nil
+		}
+
+		next, err := getParent(dpt, issuer)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "problem getting parent of %s", issuer)
+		}
+		if next == "" {
+			return chain, issuerCrt, nil
+		}
+
+		chain = appendPEM(chain, issuerCrt)
+		rawCrt = rawIssuer
+		issuer = next
+	}
+}
+
+// defaultCAChain returns the certificate alone as the chain and the
+// certificate of the CA with the given name as the root, if the CA issued the
+// certificate.
+func defaultCAChain(dpt depot.Depot, crt []byte, ca string) ([]byte, []byte, error) {
+	if ca == "" {
+		return nil, nil, errors.New("no default CA")
+	}
+	ca = strings.Replace(ca, " ", "_", -1)
+
+	caCrt, err := dpt.Get(CrtTag(ca))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "problem getting certificate for CA %s", ca)
+	}
+	rawCA, err := parseCertificatePEM(caCrt)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "problem parsing certificate for CA %s", ca)
+	}
+	rawCrt, err := parseCertificatePEM(crt)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "problem parsing certificate")
+	}
+	if err = rawCrt.CheckSignatureFrom(rawCA); err != nil {
+		return nil, nil, errors.Wrapf(err, "certificate is not signed by %s", ca)
+	}
+
+	return crt, caCrt, nil
+}
+
+func parseCertificatePEM(data []byte) (*x509.Certificate, error) {
+	crt, err := pkix.NewCertificateFromPEM(data)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return crt.GetRawCertificate()
+}
+
+func isSelfSigned(crt *x509.Certificate) bool {
+	return bytes.Equal(crt.RawSubject, crt.RawIssuer) && crt.CheckSignatureFrom(crt) == nil
+}
+
+// appendPEM appends the PEM-encoded data to the PEM bundle, separating them
+// with a newline if necessary.
+func appendPEM(bundle, data []byte) []byte {
+	if len(bundle) > 0 && !bytes.HasSuffix(bundle, []byte("\n")) {
+		bundle = append(bundle, '\n')
+	}
+	return append(bundle, data...)
+}
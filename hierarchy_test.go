@@ -0,0 +1,216 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHierarchy(t *testing.T) {
+	const (
+		rootName         = "root"
+		intermediateName = "intermediate"
+		serverName       = "server"
+		clientName       = "client"
+	)
+
+	create := func(t *testing.T, d Depot, ca, name string, intermediate bool) {
+		require.NoError(t, (&CertificateOptions{
+			CA:           ca,
+			CommonName:   name,
+			Host:         name,
+			Domain:       []string{name},
+			Expires:      time.Hour,
+			Intermediate: intermediate,
+		}).CreateCertificate(d))
+	}
+	parseChain := func(t *testing.T, data []byte) []*x509.Certificate {
+		var crts []*x509.Certificate
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			crt, err := x509.ParseCertificate(block.Bytes)
+			require.NoError(t, err)
+			crts = append(crts, crt)
+		}
+		return crts
+	}
+	get := func(t *testing.T, d Depot, name string) []byte {
+		data, err := d.Get(CrtTag(name))
+		require.NoError(t, err)
+		return data
+	}
+
+	for testName, testCase := range map[string]func(t *testing.T, d Depot){
+		"InitDoesNotSetParent": func(t *testing.T, d Depot) {
+			parent, err := GetParent(d, rootName)
+			require.NoError(t, err)
+			assert.Empty(t, parent)
+		},
+		"SignSetsParent": func(t *testing.T, d Depot) {
+			for name, expected := range map[string]string{
+				intermediateName: rootName,
+				serverName:       intermediateName,
+			} {
+				parent, err := GetParent(d, name)
+				require.NoError(t, err)
+				assert.Equal(t, expected, parent)
+			}
+		},
+		"HasChildren": func(t *testing.T, d Depot) {
+			for name, expected := range map[string]bool{
+				rootName:         true,
+				intermediateName: true,
+				serverName:       false,
+			} {
+				hasChildren, err := HasChildren(d, name)
+				require.NoError(t, err)
+				assert.Equal(t, expected, hasChildren, name)
+			}
+		},
+		"FindReturnsChainAndRoot": func(t *testing.T, d Depot) {
+			creds, err := d.Find(serverName)
+			require.NoError(t, err)
+			assert.Equal(t, get(t, d, rootName), creds.CACert)
+			assert.Equal(t, get(t, d, serverName), creds.Cert)
+
+			chain := parseChain(t, creds.Chain)
+			require.Len(t, chain, 2)
+			assert.Equal(t, serverName, chain[0].Subject.CommonName)
+			assert.Equal(t, intermediateName, chain[1].Subject.CommonName)
+		},
+		"FindUsesRecordedParentOverDefaultCA": func(t *testing.T, d Depot) {
+			create(t, d, rootName, "direct", false)
+
+			creds, err := d.Find("direct")
+			require.NoError(t, err)
+			assert.Equal(t, get(t, d, rootName), creds.CACert)
+			assert.Len(t, parseChain(t, creds.Chain), 1)
+		},
+		"FindFallsBackToDefaultCA": func(t *testing.T, d Depot) {
+			require.NoError(t, d.(HierarchyManager).PutParent(serverName, ""))
+
+			creds, err := d.Find(serverName)
+			require.NoError(t, err)
+			assert.Equal(t, get(t, d, rootName), creds.CACert)
+			assert.Len(t, parseChain(t, creds.Chain), 2)
+		},
+		"FindReturnsRootCA": func(t *testing.T, d Depot) {
+			creds, err := d.Find(rootName)
+			require.NoError(t, err)
+			assert.Equal(t, creds.Cert, creds.CACert)
+			assert.Equal(t, creds.Cert, creds.Chain)
+		},
+		"FindFallsBackToLeafWithWrongParent": func(t *testing.T, d Depot) {
+			require.NoError(t, d.(HierarchyManager).PutParent(serverName, rootName))
+
+			creds, err := d.Find(serverName)
+			require.NoError(t, err)
+			assert.Equal(t, get(t, d, intermediateName), creds.CACert)
+			assert.Equal(t, get(t, d, serverName), creds.Chain)
+		},
+		"FindFailsWithRenewedCA": func(t *testing.T, d Depot) {
+			require.NoError(t, d.Delete(CrtTag(intermediateName)))
+			require.NoError(t, d.Delete(PrivKeyTag(intermediateName)))
+			require.NoError(t, d.Delete(CsrTag(intermediateName)))
+			create(t, d, rootName, intermediateName, true)
+
+			_, err := d.Find(serverName)
+			assert.Error(t, err)
+		},
+		"FindFailsWithWrongParentAndDefaultCA": func(t *testing.T, d Depot) {
+			create(t, d, rootName, "direct", false)
+			require.NoError(t, d.(HierarchyManager).PutParent("direct", intermediateName))
+
+			_, err := d.Find("direct")
+			assert.Error(t, err)
+		},
+		"FindFailsWithCycle": func(t *testing.T, d Depot) {
+			create(t, d, intermediateName, "nested", true)
+			create(t, d, "nested", "leaf", false)
+			require.NoError(t, d.(HierarchyManager).PutParent(intermediateName, "nested"))
+
+			_, err := d.Find("leaf")
+			assert.Error(t, err)
+		},
+		"GenerateReturnsChainAndRoot": func(t *testing.T, d Depot) {
+			creds, err := d.Generate("generated")
+			require.NoError(t, err)
+			assert.Equal(t, get(t, d, rootName), creds.CACert)
+
+			chain := parseChain(t, creds.Chain)
+			require.Len(t, chain, 2)
+			assert.Equal(t, "generated", chain[0].Subject.CommonName)
+			assert.Equal(t, intermediateName, chain[1].Subject.CommonName)
+		},
+		"ResolvePresentsFullChain": func(t *testing.T, d Depot) {
+			creds, err := d.Find(serverName)
+			require.NoError(t, err)
+			conf, err := creds.Resolve()
+			require.NoError(t, err)
+			require.Len(t, conf.Certificates, 1)
+			assert.Len(t, conf.Certificates[0].Certificate, 2)
+		},
+		"HandshakeVerifiesChain": func(t *testing.T, d Depot) {
+			create(t, d, intermediateName, clientName, false)
+
+			serverCreds, err := d.Find(serverName)
+			require.NoError(t, err)
+			serverConf, err := serverCreds.ResolveServer()
+			require.NoError(t, err)
+			clientCreds, err := d.Find(clientName)
+			require.NoError(t, err)
+			clientCreds.ServerName = serverName
+			clientConf, err := clientCreds.ResolveClient()
+			require.NoError(t, err)
+
+			serverConn, clientConn := net.Pipe()
+			defer serverConn.Close()
+			defer clientConn.Close()
+
+			errs := make(chan error, 1)
+			go func() {
+				errs <- tls.Server(serverConn, serverConf).Handshake()
+			}()
+			assert.NoError(t, tls.Client(clientConn, clientConf).Handshake())
+			assert.NoError(t, <-errs)
+		},
+		"CopyDepotCopiesParent": func(t *testing.T, d Depot) {
+			dst := NewMemoryDepot(DepotOptions{CA: intermediateName})
+			results, err := CopyDepot(context.Background(), d, dst, CopyDepotOptions{})
+			require.NoError(t, err)
+			for _, result := range results {
+				require.NoError(t, result.Error)
+			}
+
+			parent, err := GetParent(dst, serverName)
+			require.NoError(t, err)
+			assert.Equal(t, intermediateName, parent)
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			d := NewMemoryDepot(DepotOptions{CA: intermediateName, DefaultExpiration: time.Hour})
+			require.NoError(t, (&CertificateOptions{
+				CommonName: rootName,
+				Expires:    24 * time.Hour,
+				MaxPathLen: 2,
+			}).Init(d))
+			require.NoError(t, (&CertificateOptions{
+				CA:           rootName,
+				CommonName:   intermediateName,
+				Host:         intermediateName,
+				Expires:      time.Hour,
+				Intermediate: true,
+				MaxPathLen:   1,
+			}).CreateCertificate(d))
+			create(t, d, intermediateName, serverName, false)
+
+			testCase(t, d)
+		})
+	}
+}
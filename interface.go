@@ -3,7 +3,9 @@ package certdepot
 import (
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/square/certstrap/depot"
+	"github.com/square/certstrap/pkix"
 )
 
 // Depot is a superset wrapper around certrstap's depot.Depot interface so users only
@@ -15,9 +17,154 @@ type Depot interface {
 	Generate(string) (*Credentials, error)
 }
 
+// ExpirationManager is implemented by depots that track the expiration of the
+// credentials they hold.
+type ExpirationManager interface {
+	// PutTTL sets the expiration of the credentials with the given name.
+	// The expiration must be within the validity bounds of the
+	// certificate.
+	PutTTL(string, time.Time) error
+	// GetTTL returns the expiration of the credentials with the given
+	// name.
+	GetTTL(string) (time.Time, error)
+	// FindExpiresBefore returns all users that expire before the cutoff.
+	FindExpiresBefore(time.Time) ([]User, error)
+	// DeleteExpiresBefore removes all users that expire before the
+	// cutoff.
+	DeleteExpiresBefore(time.Time) error
+}
+
+// HierarchyManager is implemented by depots that record which CA issued each
+// certificate, so that the chain of a certificate issued by an intermediate CA
+// can be built from the depot.
+type HierarchyManager interface {
+	// PutParent records the name of the CA that issued the certificate
+	// with the given name. An empty parent clears the record, as for a
+	// root CA.
+	PutParent(name, parent string) error
+	// GetParent returns the name of the CA that issued the certificate
+	// with the given name, or an empty string if none is recorded.
+	GetParent(name string) (string, error)
+	// HasChildren returns whether any certificate records the CA with the
+	// given name as its parent.
+	HasChildren(name string) (bool, error)
+}
+
+// PolicyManager is implemented by depots that can attach a Policy to a CA,
+// which restricts the certificates that the CA signs.
+type PolicyManager interface {
+	// PutPolicy attaches the policy to the CA with the given name. A nil
+	// policy removes the policy of the CA.
+	PutPolicy(name string, policy *Policy) error
+	// GetPolicy returns the policy of the CA with the given name, or nil if
+	// it has none.
+	GetPolicy(name string) (*Policy, error)
+}
+
+// ProfileManager is implemented by depots that can store named Profiles of
+// certificate options.
+type ProfileManager interface {
+	// PutProfile stores the profile under the given name. A nil profile
+	// removes the profile with the name.
+	PutProfile(name string, profile *Profile) error
+	// GetProfile returns the profile with the given name, or nil if there
+	// is none.
+	GetProfile(name string) (*Profile, error)
+	// ListProfiles returns all profiles by name.
+	ListProfiles() (map[string]*Profile, error)
+}
+
+// PendingRequestManager is implemented by depots that can hold certificate
+// requests that were submitted for approval.
+type PendingRequestManager interface {
+	// PutPendingRequest inserts the request or replaces the request with
+	// the same ID.
+	PutPendingRequest(req *PendingRequest) error
+	// GetPendingRequest returns the request with the given ID, or nil if
+	// there is none.
+	GetPendingRequest(id string) (*PendingRequest, error)
+	// ListPendingRequests returns all requests, regardless of their
+	// status.
+	ListPendingRequests() ([]PendingRequest, error)
+	// SwapPendingRequest replaces the request with the same ID if the
+	// stored request has the given status, and returns whether it was
+	// replaced. This allows only one caller to change the status of a
+	// request.
+	SwapPendingRequest(req *PendingRequest, prev PendingRequestStatus) (bool, error)
+}
+
+// RevocationListSwapper is implemented by depots that can replace the CRL of
+// a CA atomically, so that concurrent updates of the CRL do not overwrite
+// each other.
+type RevocationListSwapper interface {
+	// SwapRevocationList replaces the CRL of the CA with the given name by
+	// next only if the stored CRL is still equal to prev, which is nil if
+	// the CA has no CRL. It returns whether the CRL was replaced.
+	SwapRevocationList(name string, prev, next []byte) (bool, error)
+}
+
+// CertificateSigner is implemented by depots that sign certificate requests
+// with their CAs themselves, such as a remote depot, so that the CA key never
+// leaves the depot. CertificateOptions.SignInMemory uses it instead of
+// getting the CA key from the depot.
+type CertificateSigner interface {
+	// SignCertificateRequest signs the certificate request with the CA of
+	// the given name and returns a certificate that expires after the
+	// given duration.
+	SignCertificateRequest(ca string, csr *pkix.CertificateSigningRequest, expires time.Duration) (*pkix.Certificate, error)
+}
+
 // DepotOptions capture default options used during certificate
 // generation and creation used by depots.
 type DepotOptions struct {
 	CA                string        `bson:"ca" json:"ca" yaml:"ca"`
 	DefaultExpiration time.Duration `bson:"default_expiration" json:"default_expiration" yaml:"default_expiration"`
+	// KeyType is the type of key generated by Generate (defaults to RSA).
+	KeyType KeyType `bson:"key_type,omitempty" json:"key_type,omitempty" yaml:"key_type,omitempty"`
+	// Profile is the name of the profile in the depot used by Generate.
+	// CA, DefaultExpiration and KeyType take precedence over the values
+	// from the profile.
+	Profile string `bson:"profile,omitempty" json:"profile,omitempty" yaml:"profile,omitempty"`
+}
+
+// TagKind identifies the kind of data stored in a depot under a name.
+type TagKind string
+
+const (
+	// CrtKind identifies certificates.
+	CrtKind TagKind = "crt"
+	// PrivKeyKind identifies private keys.
+	PrivKeyKind TagKind = "key"
+	// CsrKind identifies certificate signing requests.
+	CsrKind TagKind = "csr"
+	// CrlKind identifies certificate revocation lists.
+	CrlKind TagKind = "crl"
+)
+
+// Validate checks that the tag kind is one of the known kinds.
+func (k TagKind) Validate() error {
+	_, err := k.userKey()
+	return err
+}
+
+func (k TagKind) userKey() (string, error) {
+	switch k {
+	case CrtKind:
+		return userCertKey, nil
+	case PrivKeyKind:
+		return userPrivateKeyKey, nil
+	case CsrKind:
+		return userCertReqKey, nil
+	case CrlKind:
+		return userCertRevocListKey, nil
+	default:
+		return "", errors.Errorf("unrecognized tag kind '%s'", k)
+	}
+}
+
+// Lister is implemented by depots that can enumerate the names they hold.
+type Lister interface {
+	// List returns the names of all entries in the depot that hold data
+	// of the given kind.
+	List(TagKind) ([]string, error)
 }
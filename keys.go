@@ -0,0 +1,406 @@
+package certdepot
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"hash"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/pkix"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// KeyType is the algorithm used to generate a private key.
+type KeyType string
+
+const (
+	// RSAKey generates an RSA key with the configured number of bits.
+	RSAKey KeyType = "rsa"
+	// ECDSAP256Key generates an ECDSA key on the NIST P-256 curve.
+	ECDSAP256Key KeyType = "ecdsa-p256"
+	// ECDSAP384Key generates an ECDSA key on the NIST P-384 curve.
+	ECDSAP384Key KeyType = "ecdsa-p384"
+	// ECDSAP521Key generates an ECDSA key on the NIST P-521 curve.
+	ECDSAP521Key KeyType = "ecdsa-p521"
+	// Ed25519Key generates an Ed25519 key.
+	Ed25519Key KeyType = "ed25519"
+)
+
+const (
+	rsaPrivateKeyPEMBlockType   = "RSA PRIVATE KEY"
+	ecPrivateKeyPEMBlockType    = "EC PRIVATE KEY"
+	pkcs8PrivateKeyPEMBlockType = "PRIVATE KEY"
+	// encryptedPKCS8PEMBlockType is the type of PEM blocks holding a
+	// PKCS#8 EncryptedPrivateKeyInfo (RFC 5958).
+	encryptedPKCS8PEMBlockType = "ENCRYPTED PRIVATE KEY"
+)
+
+// pbkdf2Iterations is the PBKDF2 iteration count used to derive the key that
+// encrypts PKCS#8 private keys.
+const pbkdf2Iterations = 100000
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// Validate checks that the key type is supported. The empty key type is
+// valid and is equivalent to RSAKey.
+func (t KeyType) Validate() error {
+	switch t {
+	case "", RSAKey, ECDSAP256Key, ECDSAP384Key, ECDSAP521Key, Ed25519Key:
+		return nil
+	default:
+		return errors.Errorf("unsupported key type '%s'", t)
+	}
+}
+
+// createPrivateKey generates a new key of the given type. The number of bits
+// is only used for RSA keys.
+func createPrivateKey(keyType KeyType, bits int) (*pkix.Key, error) {
+	var curve elliptic.Curve
+	switch keyType {
+	case "", RSAKey:
+		key, err := pkix.CreateRSAKey(bits)
+		return key, errors.Wrap(err, "problem creating RSA key")
+	case Ed25519Key:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "problem creating Ed25519 key")
+		}
+		return pkix.NewKey(pub, priv), nil
+	case ECDSAP256Key:
+		curve = elliptic.P256()
+	case ECDSAP384Key:
+		curve = elliptic.P384()
+	case ECDSAP521Key:
+		curve = elliptic.P521()
+	default:
+		return nil, errors.Errorf("unsupported key type '%s'", keyType)
+	}
+
+	priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem creating ECDSA key")
+	}
+	return pkix.NewKey(&priv.PublicKey, priv), nil
+}
+
+// privateKeyBlock returns the unencrypted PEM block for the key. RSA keys are
+// encoded in PKCS#1 and ECDSA keys in SEC 1 so that they remain readable by
+// certstrap and OpenSSL; Ed25519 keys are encoded in PKCS#8.
+func privateKeyBlock(key *pkix.Key) (*pem.Block, error) {
+	switch priv := key.Private.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: rsaPrivateKeyPEMBlockType, Bytes: x509.MarshalPKCS1PrivateKey(priv)}, nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return nil, errors.Wrap(err, "problem marshalling ECDSA key")
+		}
+		return &pem.Block{Type: ecPrivateKeyPEMBlockType, Bytes: der}, nil
+	case ed25519.PrivateKey:
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, errors.Wrap(err, "problem marshalling Ed25519 key")
+		}
+		return &pem.Block{Type: pkcs8PrivateKeyPEMBlockType, Bytes: der}, nil
+	default:
+		return nil, errors.Errorf("unsupported private key type %T", key.Private)
+	}
+}
+
+// exportPrivateKey exports the key as PEM-encoded bytes.
+func exportPrivateKey(key *pkix.Key) ([]byte, error) {
+	block, err := privateKeyBlock(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return pem.EncodeToMemory(block), nil
+}
+
+// exportEncryptedPrivateKey exports the key as PEM-encoded bytes encrypted
+// with the passphrase. RSA keys are encrypted the same way as certstrap
+// encrypts them, with the legacy OpenSSL PEM encryption, so that certstrap can
+// still read them. Every other key type is encrypted in PKCS#8 with PBES2
+// (RFC 8018), using PBKDF2 with HMAC-SHA256 and AES-256-CBC.
+func exportEncryptedPrivateKey(key *pkix.Key, passphrase []byte) ([]byte, error) {
+	if _, ok := key.Private.(*rsa.PrivateKey); ok {
+		data, err := key.ExportEncryptedPrivate(passphrase)
+		return data, errors.Wrap(err, "problem encrypting RSA key")
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem marshalling key")
+	}
+	encrypted, err := encryptPKCS8(der, passphrase)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem encrypting key")
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: encryptedPKCS8PEMBlockType, Bytes: encrypted}), nil
+}
+
+// algorithmIdentifier is an X.509 AlgorithmIdentifier.
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+// encryptedPrivateKeyInfo is a PKCS#8 EncryptedPrivateKeyInfo.
+type encryptedPrivateKeyInfo struct {
+	Algorithm     algorithmIdentifier
+	EncryptedData []byte
+}
+
+// pbes2Params are the parameters of the PBES2 encryption scheme.
+type pbes2Params struct {
+	KeyDerivationFunc algorithmIdentifier
+	EncryptionScheme  algorithmIdentifier
+}
+
+// pbkdf2Params are the parameters of the PBKDF2 key derivation function.
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                 `asn1:"optional"`
+	PRF            algorithmIdentifier `asn1:"optional"`
+}
+
+// encryptPKCS8 encrypts the DER-encoded PKCS#8 private key with PBES2 and
+// returns the DER-encoded EncryptedPrivateKeyInfo.
+func encryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	for _, b := range [][]byte{salt, iv} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, errors.Wrap(err, "problem generating random bytes")
+		}
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(passphrase, salt, pbkdf2Iterations, 32, sha256.New))
+	if err != nil {
+		return nil, errors.Wrap(err, "problem creating cipher")
+	}
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	encrypted := append(append([]byte{}, der...), make([]byte, padding)...)
+	for i := len(der); i < len(encrypted); i++ {
+		encrypted[i] = byte(padding)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	nullParams := asn1.RawValue{Tag: asn1.TagNull}
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pbkdf2Iterations,
+		PRF:            algorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: nullParams},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "problem encoding key derivation parameters")
+	}
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem encoding initialization vector")
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: algorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  algorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParams}},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "problem encoding encryption parameters")
+	}
+
+	data, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     algorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: encrypted,
+	})
+	return data, errors.Wrap(err, "problem encoding encrypted private key")
+}
+
+// decryptPKCS8 decrypts the DER-encoded PKCS#8 EncryptedPrivateKeyInfo, which
+// must be encrypted with PBES2 using PBKDF2 and AES-CBC, and returns the
+// DER-encoded PKCS#8 private key.
+func decryptPKCS8(data, passphrase []byte) ([]byte, error) {
+	info := encryptedPrivateKeyInfo{}
+	if _, err := asn1.Unmarshal(data, &info); err != nil {
+		return nil, errors.Wrap(err, "problem parsing encrypted private key")
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errors.Errorf("unsupported encryption algorithm %s", info.Algorithm.Algorithm)
+	}
+	params := pbes2Params{}
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, errors.Wrap(err, "problem parsing encryption parameters")
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, errors.Errorf("unsupported key derivation function %s", params.KeyDerivationFunc.Algorithm)
+	}
+	kdfParams := pbkdf2Params{}
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, errors.Wrap(err, "problem parsing key derivation parameters")
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case len(kdfParams.PRF.Algorithm) == 0, kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	default:
+		return nil, errors.Errorf("unsupported pseudorandom function %s", kdfParams.PRF.Algorithm)
+	}
+	var keyLen int
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		keyLen = 16
+	case scheme.Equal(oidAES192CBC):
+		keyLen = 24
+	case scheme.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, errors.Errorf("unsupported encryption scheme %s", scheme)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, errors.Wrap(err, "problem parsing initialization vector")
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid initialization vector")
+	}
+	if kdfParams.IterationCount <= 0 {
+		return nil, errors.New("invalid iteration count")
+	}
+	if len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid encrypted data length")
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(passphrase, kdfParams.Salt, kdfParams.IterationCount, keyLen, prf))
+	if err != nil {
+		return nil, errors.Wrap(err, "problem creating cipher")
+	}
+	der := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(der, info.EncryptedData)
+
+	// An incorrect passphrase almost always produces invalid padding.
+	padding := int(der[len(der)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("incorrect passphrase")
+	}
+	for _, b := range der[len(der)-padding:] {
+		if int(b) != padding {
+			return nil, errors.New("incorrect passphrase")
+		}
+	}
+
+	return der[:len(der)-padding], nil
+}
+
+// parsePrivateKey parses a PEM-encoded private key in PKCS#1, SEC 1 or PKCS#8
+// form.
+func parsePrivateKey(data []byte) (*pkix.Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("cannot find the next PEM formatted block")
+	}
+	if len(block.Headers) != 0 {
+		return nil, errors.New("unexpected headers in unencrypted key")
+	}
+
+	return parsePrivateKeyDER(block.Type, block.Bytes)
+}
+
+// parseEncryptedPrivateKey decrypts and parses a PEM-encoded private key that
+// was encrypted with the passphrase, either in PKCS#8 or with the legacy
+// OpenSSL PEM encryption used for RSA keys and by earlier versions for every
+// key type.
+func parseEncryptedPrivateKey(data, passphrase []byte) (*pkix.Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("cannot find the next PEM formatted block")
+	}
+
+	if block.Type == encryptedPKCS8PEMBlockType {
+		der, err := decryptPKCS8(block.Bytes, passphrase)
+		if err != nil {
+			return nil, errors.Wrap(err, "problem decrypting key")
+		}
+		return parsePrivateKeyDER(pkcs8PrivateKeyPEMBlockType, der)
+	}
+
+	// Legacy PEM encryption is insecure, but it is still read for
+	// compatibility with certstrap and with previously stored keys.
+	der, err := x509.DecryptPEMBlock(block, passphrase)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem decrypting key")
+	}
+
+	return parsePrivateKeyDER(block.Type, der)
+}
+
+func parsePrivateKeyDER(blockType string, der []byte) (*pkix.Key, error) {
+	var priv crypto.PrivateKey
+	var err error
+	switch blockType {
+	case rsaPrivateKeyPEMBlockType:
+		priv, err = x509.ParsePKCS1PrivateKey(der)
+	case ecPrivateKeyPEMBlockType:
+		priv, err = x509.ParseECPrivateKey(der)
+	case pkcs8PrivateKeyPEMBlockType:
+		priv, err = x509.ParsePKCS8PrivateKey(der)
+	default:
+		return nil, errors.Errorf("unsupported PEM block type '%s'", blockType)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "problem parsing private key")
+	}
+
+	switch priv := priv.(type) {
+	case *rsa.PrivateKey:
+		return pkix.NewKey(&priv.PublicKey, priv), nil
+	case *ecdsa.PrivateKey:
+		return pkix.NewKey(&priv.PublicKey, priv), nil
+	case ed25519.PrivateKey:
+		return pkix.NewKey(priv.Public(), priv), nil
+	default:
+		return nil, errors.Errorf("unsupported private key type %T", priv)
+	}
+}
+
+// generateSubjectKeyID generates the subject key identifier of a public key,
+// which is the 160-bit SHA-1 hash of the BIT STRING subjectPublicKey (RFC 5280
+// section 4.2.1.2). Unlike certstrap, this supports every key type.
+func generateSubjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem marshalling public key")
+	}
+
+	var info struct {
+		Algorithm        asn1.RawValue
+		SubjectPublicKey asn1.BitString
+	}
+	if _, err = asn1.Unmarshal(der, &info); err != nil {
+		return nil, errors.Wrap(err, "problem parsing public key")
+	}
+
+	hash := sha1.Sum(info.SubjectPublicKey.Bytes)
+	return hash[:], nil
+}
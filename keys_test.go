@@ -0,0 +1,198 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/pkix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyType(t *testing.T) {
+	keyTypes := map[KeyType]func(t *testing.T, key *pkix.Key){
+		RSAKey: func(t *testing.T, key *pkix.Key) {
+			_, ok := key.Private.(*rsa.PrivateKey)
+			assert.True(t, ok)
+		},
+		ECDSAP256Key: func(t *testing.T, key *pkix.Key) {
+			priv, ok := key.Private.(*ecdsa.PrivateKey)
+			require.True(t, ok)
+			assert.Equal(t, "P-256", priv.Curve.Params().Name)
+		},
+		ECDSAP384Key: func(t *testing.T, key *pkix.Key) {
+			priv, ok := key.Private.(*ecdsa.PrivateKey)
+			require.True(t, ok)
+			assert.Equal(t, "P-384", priv.Curve.Params().Name)
+		},
+		ECDSAP521Key: func(t *testing.T, key *pkix.Key) {
+			priv, ok := key.Private.(*ecdsa.PrivateKey)
+			require.True(t, ok)
+			assert.Equal(t, "P-521", priv.Curve.Params().Name)
+		},
+		Ed25519Key: func(t *testing.T, key *pkix.Key) {
+			_, ok := key.Private.(ed25519.PrivateKey)
+			assert.True(t, ok)
+		},
+	}
+
+	t.Run("ValidateRejectsUnknownType", func(t *testing.T) {
+		assert.NoError(t, KeyType("").Validate())
+		assert.Error(t, KeyType("dsa").Validate())
+		_, err := createPrivateKey(KeyType("dsa"), 0)
+		assert.Error(t, err)
+	})
+	t.Run("ParseRejectsInvalidPEM", func(t *testing.T) {
+		_, err := parsePrivateKey([]byte("not a key"))
+		assert.Error(t, err)
+	})
+	t.Run("RSASubjectKeyIDMatchesCertstrap", func(t *testing.T) {
+		key, err := createPrivateKey(RSAKey, 1024)
+		require.NoError(t, err)
+		expected, err := pkix.GenerateSubjectKeyID(key.Public)
+		require.NoError(t, err)
+		actual, err := generateSubjectKeyID(key.Public)
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	})
+
+	for keyType, checkKey := range keyTypes {
+		t.Run(string(keyType), func(t *testing.T) {
+			key, err := createPrivateKey(keyType, 1024)
+			require.NoError(t, err)
+			checkKey(t, key)
+
+			t.Run("ExportAndParse", func(t *testing.T) {
+				data, err := exportPrivateKey(key)
+				require.NoError(t, err)
+				parsed, err := parsePrivateKey(data)
+				require.NoError(t, err)
+				checkKey(t, parsed)
+				assert.Equal(t, key.Private, parsed.Private)
+			})
+			t.Run("ExportAndParseEncrypted", func(t *testing.T) {
+				data, err := exportEncryptedPrivateKey(key, []byte("passphrase"))
+				require.NoError(t, err)
+				_, err = parsePrivateKey(data)
+				assert.Error(t, err)
+				_, err = parseEncryptedPrivateKey(data, []byte("wrong"))
+				assert.Error(t, err)
+
+				parsed, err := parseEncryptedPrivateKey(data, []byte("passphrase"))
+				require.NoError(t, err)
+				assert.Equal(t, key.Private, parsed.Private)
+
+				block, _ := pem.Decode(data)
+				require.NotNil(t, block)
+				if keyType == RSAKey {
+					assert.Equal(t, rsaPrivateKeyPEMBlockType, block.Type)
+				} else {
+					assert.Equal(t, encryptedPKCS8PEMBlockType, block.Type)
+				}
+			})
+			t.Run("ParseLegacyEncrypted", func(t *testing.T) {
+				block, err := privateKeyBlock(key)
+				require.NoError(t, err)
+				encrypted, err := x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte("passphrase"), x509.PEMCipherAES256)
+				require.NoError(t, err)
+
+				parsed, err := parseEncryptedPrivateKey(pem.EncodeToMemory(encrypted), []byte("passphrase"))
+				require.NoError(t, err)
+				assert.Equal(t, key.Private, parsed.Private)
+			})
+			t.Run("EncryptedCAStorageAndSigning", func(t *testing.T) {
+				d := NewMemoryDepot(DepotOptions{})
+				caOpts := &CertificateOptions{
+					CommonName: "ca",
+					Expires:    time.Hour,
+					KeyType:    keyType,
+					KeyBits:    1024,
+					Passphrase: "passphrase",
+				}
+				require.NoError(t, caOpts.Init(d))
+
+				caKey, err := GetEncryptedPrivateKey(d, "ca", []byte("passphrase"))
+				require.NoError(t, err)
+				checkKey(t, caKey)
+
+				opts := &CertificateOptions{
+					CommonName:   "host",
+					Host:         "host",
+					CA:           "ca",
+					CAPassphrase: "passphrase",
+					Expires:      time.Hour,
+					KeyType:      keyType,
+					KeyBits:      1024,
+				}
+				require.NoError(t, opts.CreateCertificate(d))
+
+				hostKey, err := GetPrivateKey(d, "host")
+				require.NoError(t, err)
+				checkKey(t, hostKey)
+			})
+			t.Run("TLSHandshake", func(t *testing.T) {
+				d, err := BootstrapDepot(context.Background(), BootstrapDepotConfig{
+					MemoryDepot: true,
+					CAName:      "ca",
+					ServiceName: "server",
+					CAOpts: &CertificateOptions{
+						CommonName: "ca",
+						Expires:    time.Hour,
+						KeyType:    keyType,
+						KeyBits:    1024,
+					},
+					ServiceOpts: &CertificateOptions{
+						CommonName: "server",
+						Host:       "server",
+						CA:         "ca",
+						Domain:     []string{"server"},
+						Expires:    time.Hour,
+						KeyType:    keyType,
+						KeyBits:    1024,
+					},
+				})
+				require.NoError(t, err)
+				md := d.(*memoryDepot)
+				md.opts = DepotOptions{CA: "ca", DefaultExpiration: time.Hour, KeyType: keyType}
+
+				serverCreds, err := md.Find("server")
+				require.NoError(t, err)
+				serverKey, err := parsePrivateKey(serverCreds.Key)
+				require.NoError(t, err)
+				checkKey(t, serverKey)
+
+				clientCreds, err := md.Generate("client")
+				require.NoError(t, err)
+				clientKey, err := parsePrivateKey(clientCreds.Key)
+				require.NoError(t, err)
+				checkKey(t, clientKey)
+				clientCreds.ServerName = "server"
+
+				serverConf, err := serverCreds.Resolve()
+				require.NoError(t, err)
+				clientConf, err := clientCreds.Resolve()
+				require.NoError(t, err)
+
+				serverConn, clientConn := net.Pipe()
+				defer serverConn.Close()
+				defer clientConn.Close()
+
+				errs := make(chan error, 1)
+				go func() {
+					errs <- tls.Server(serverConn, serverConf).Handshake()
+				}()
+				assert.NoError(t, tls.Client(clientConn, clientConf).Handshake())
+				assert.NoError(t, <-errs)
+			})
+		})
+	}
+}
@@ -0,0 +1,452 @@
+package certdepot
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+)
+
+type memoryDepot struct {
+	mu       sync.RWMutex
+	users    map[string]*User
+	profiles map[string]*Profile
+	requests map[string]PendingRequest
+	opts     DepotOptions
+}
+
+// NewMemoryDepot returns a new cert depot that holds all data in memory. The
+// depot is safe for concurrent use, but its contents are lost when the
+// process exits, which makes it suitable for tests and ephemeral services.
+func NewMemoryDepot(opts DepotOptions) Depot {
+	return &memoryDepot{
+		users:    map[string]*User{},
+		profiles: map[string]*Profile{},
+		requests: map[string]PendingRequest{},
+		opts:     opts,
+	}
+}
+
+// Put inserts the data into the user specified by the tag, creating the user
+// if it does not exist.
+func (m *memoryDepot) Put(tag *depot.Tag, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+
+	name, key, err := getNameAndKey(tag)
+	if err != nil {
+		return errors.Wrapf(err, "could not format name %s", name)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[name]
+	if !ok {
+		u = &User{ID: name}
+		m.users[name] = u
+	}
+
+	switch key {
+	case userCertKey:
+		u.Cert = string(data)
+	case userPrivateKeyKey:
+		u.PrivateKey = string(data)
+	case userCertReqKey:
+		u.CertReq = string(data)
+	case userCertRevocListKey:
+		u.CertRevocList = string(data)
+	default:
+		return errors.Errorf("unrecognized tag for %s", name)
+	}
+
+	return nil
+}
+
+// Check returns whether the user and data specified by the tag exists.
+func (m *memoryDepot) Check(tag *depot.Tag) bool {
+	name, key, err := getNameAndKey(tag)
+	if err != nil {
+		return false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[name]
+	if !ok {
+		return false
+	}
+
+	switch key {
+	case userCertKey:
+		return u.Cert != ""
+	case userPrivateKeyKey:
+		return u.PrivateKey != ""
+	case userCertReqKey:
+		return u.CertReq != ""
+	case userCertRevocListKey:
+		return u.CertRevocList != ""
+	default:
+		return false
+	}
+}
+
+// Get reads the data for the user specified by tag. Returns an error if the
+// user does not exist or if the data is empty.
+func (m *memoryDepot) Get(tag *depot.Tag) ([]byte, error) {
+	name, key, err := getNameAndKey(tag)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not format name %s", name)
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[name]
+	if !ok {
+		return nil, errors.Errorf("could not find %s in the depot", name)
+	}
+
+	var data []byte
+	switch key {
+	case userCertKey:
+		data = []byte(u.Cert)
+	case userPrivateKeyKey:
+		data = []byte(u.PrivateKey)
+	case userCertReqKey:
+		data = []byte(u.CertReq)
+	case userCertRevocListKey:
+		data = []byte(u.CertRevocList)
+	}
+
+	if len(data) == 0 {
+		return nil, errors.New("no data available")
+	}
+	return data, nil
+}
+
+// Delete removes the data from a user specified by the tag.
+func (m *memoryDepot) Delete(tag *depot.Tag) error {
+	name, key, err := getNameAndKey(tag)
+	if err != nil {
+		return errors.Wrapf(err, "could not format name %s", name)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[name]
+	if !ok {
+		return nil
+	}
+
+	switch key {
+	case userCertKey:
+		u.Cert = ""
+	case userPrivateKeyKey:
+		u.PrivateKey = ""
+	case userCertReqKey:
+		u.CertReq = ""
+	case userCertRevocListKey:
+		u.CertRevocList = ""
+	}
+
+	return nil
+}
+
+func (m *memoryDepot) Save(name string, creds *Credentials) error { return depotSave(m, name, creds) }
+func (m *memoryDepot) Find(name string) (*Credentials, error)     { return depotFind(m, name, m.opts) }
+func (m *memoryDepot) Generate(name string) (*Credentials, error) {
+	return depotGenerate(m, name, m.opts)
+}
+
+// List returns the names of all users that hold data of the given kind.
+func (m *memoryDepot) List(kind TagKind) ([]string, error) {
+	key, err := kind.userKey()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	names := []string{}
+	for name, u := range m.users {
+		if userHasKind(u, key) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// PutTTL sets the TTL to the given expiration time for the name. If the name is
+// not found in the depot, this will error. The expiration must be within the
+// validity bounds of the certificate for the given name.
+func (m *memoryDepot) PutTTL(name string, expiration time.Time) error {
+	expiration = expiration.UTC()
+
+	minExpiration, maxExpiration, err := ValidityBounds(m, name)
+	if err != nil {
+		return errors.Wrap(err, "could not get certificate validity bounds")
+	}
+	if expiration.Before(minExpiration) || expiration.After(maxExpiration) {
+		return errors.Errorf("cannot set expiration to %s because it must be between %s and %s", expiration, minExpiration, maxExpiration)
+	}
+
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[formattedName]
+	if !ok {
+		return errors.Errorf("could not find %s in the depot", name)
+	}
+	u.TTL = expiration
+
+	return nil
+}
+
+// GetTTL returns the TTL for the given name.
+func (m *memoryDepot) GetTTL(name string) (time.Time, error) {
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[formattedName]
+	if !ok {
+		return time.Time{}, errors.Errorf("could not find %s in the depot", name)
+	}
+
+	return u.TTL, nil
+}
+
+// PutParent records the name of the CA that issued the certificate with the
+// given name. If the name is not found in the depot, this will error.
+func (m *memoryDepot) PutParent(name, parent string) error {
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[formattedName]
+	if !ok {
+		return errors.Errorf("could not find %s in the depot", name)
+	}
+	u.Parent = strings.Replace(parent, " ", "_", -1)
+
+	return nil
+}
+
+// GetParent returns the name of the CA that issued the certificate with the
+// given name.
+func (m *memoryDepot) GetParent(name string) (string, error) {
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[formattedName]
+	if !ok {
+		return "", errors.Errorf("could not find %s in the depot", name)
+	}
+
+	return u.Parent, nil
+}
+
+// HasChildren returns whether any certificate records the CA with the given
+// name as its parent.
+func (m *memoryDepot) HasChildren(name string) (bool, error) {
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, u := range m.users {
+		if u.Parent == formattedName {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// SwapRevocationList replaces the CRL of the CA with the given name if the
+// stored CRL is equal to prev.
+func (m *memoryDepot) SwapRevocationList(name string, prev, next []byte) (bool, error) {
+	if next == nil {
+		return false, errors.New("data is nil")
+	}
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[formattedName]
+	if !ok {
+		return false, errors.Errorf("could not find %s in the depot", name)
+	}
+	if u.CertRevocList != string(prev) {
+		return false, nil
+	}
+	u.CertRevocList = string(next)
+
+	return true, nil
+}
+
+// PutPolicy attaches the policy to the CA with the given name. If the name is
+// not found in the depot, this will error.
+func (m *memoryDepot) PutPolicy(name string, policy *Policy) error {
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[formattedName]
+	if !ok {
+		return errors.Errorf("could not find %s in the depot", name)
+	}
+	u.Policy = policy
+
+	return nil
+}
+
+// GetPolicy returns the policy of the CA with the given name.
+func (m *memoryDepot) GetPolicy(name string) (*Policy, error) {
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[formattedName]
+	if !ok {
+		return nil, errors.Errorf("could not find %s in the depot", name)
+	}
+
+	return u.Policy, nil
+}
+
+// PutProfile stores the profile under the given name.
+func (m *memoryDepot) PutProfile(name string, profile *Profile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if profile == nil {
+		delete(m.profiles, name)
+		return nil
+	}
+	m.profiles[name] = profile
+
+	return nil
+}
+
+// GetProfile returns the profile with the given name.
+func (m *memoryDepot) GetProfile(name string) (*Profile, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.profiles[name], nil
+}
+
+// ListProfiles returns all profiles by name.
+func (m *memoryDepot) ListProfiles() (map[string]*Profile, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	profiles := make(map[string]*Profile, len(m.profiles))
+	for name, profile := range m.profiles {
+		profiles[name] = profile
+	}
+
+	return profiles, nil
+}
+
+// PutPendingRequest inserts or replaces the pending request.
+func (m *memoryDepot) PutPendingRequest(req *PendingRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[req.ID] = *req
+
+	return nil
+}
+
+// GetPendingRequest returns the pending request with the given ID.
+func (m *memoryDepot) GetPendingRequest(id string) (*PendingRequest, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	req, ok := m.requests[id]
+	if !ok {
+		return nil, nil
+	}
+
+	return &req, nil
+}
+
+// ListPendingRequests returns all pending requests.
+func (m *memoryDepot) ListPendingRequests() ([]PendingRequest, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	reqs := make([]PendingRequest, 0, len(m.requests))
+	for _, req := range m.requests {
+		reqs = append(reqs, req)
+	}
+
+	return reqs, nil
+}
+
+// SwapPendingRequest replaces the pending request if the stored request has
+// the given status.
+func (m *memoryDepot) SwapPendingRequest(req *PendingRequest, prev PendingRequestStatus) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, ok := m.requests[req.ID]
+	if !ok || current.Status != prev {
+		return false, nil
+	}
+	m.requests[req.ID] = *req
+
+	return true, nil
+}
+
+// FindExpiresBefore finds all Users that expire before the given cutoff time.
+func (m *memoryDepot) FindExpiresBefore(cutoff time.Time) ([]User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	users := []User{}
+	for _, u := range m.users {
+		if expiresBefore(u, cutoff) {
+			users = append(users, *u)
+		}
+	}
+
+	return users, nil
+}
+
+// DeleteExpiresBefore removes all Users that expire before the given cutoff
+// time.
+func (m *memoryDepot) DeleteExpiresBefore(cutoff time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for name, u := range m.users {
+		if expiresBefore(u, cutoff) {
+			delete(m.users, name)
+		}
+	}
+
+	return nil
+}
+
+func expiresBefore(u *User, cutoff time.Time) bool {
+	return !u.TTL.IsZero() && !u.TTL.After(cutoff)
+}
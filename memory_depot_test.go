@@ -0,0 +1,162 @@
+package certdepot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/depot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryDepot(t *testing.T) {
+	const (
+		caName      = "ca"
+		serviceName = "localhost"
+	)
+
+	bootstrap := func(t *testing.T) *memoryDepot {
+		d, err := BootstrapDepot(context.Background(), BootstrapDepotConfig{
+			MemoryDepot: true,
+			CAName:      caName,
+			ServiceName: serviceName,
+			CAOpts: &CertificateOptions{
+				CommonName: caName,
+				Expires:    24 * time.Hour,
+			},
+			ServiceOpts: &CertificateOptions{
+				CA:         caName,
+				CommonName: serviceName,
+				Host:       serviceName,
+				Expires:    24 * time.Hour,
+			},
+		})
+		require.NoError(t, err)
+
+		md, ok := d.(*memoryDepot)
+		require.True(t, ok)
+		md.opts = DepotOptions{CA: caName, DefaultExpiration: time.Hour}
+
+		return md
+	}
+
+	for testName, testCase := range map[string]func(t *testing.T, md *memoryDepot){
+		"InitSetsTTL": func(t *testing.T, md *memoryDepot) {
+			ttl, err := md.GetTTL(caName)
+			require.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(24*time.Hour), ttl, time.Minute)
+		},
+		"SignSetsTTL": func(t *testing.T, md *memoryDepot) {
+			ttl, err := md.GetTTL(serviceName)
+			require.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(24*time.Hour), ttl, time.Minute)
+		},
+		"PutTTLFailsOutsideValidityBounds": func(t *testing.T, md *memoryDepot) {
+			assert.Error(t, md.PutTTL(serviceName, time.Now().Add(48*time.Hour)))
+		},
+		"PutTTLFailsForNonexistentUser": func(t *testing.T, md *memoryDepot) {
+			assert.Error(t, md.PutTTL("nonexistent", time.Now()))
+		},
+		"GetTTLFailsForNonexistentUser": func(t *testing.T, md *memoryDepot) {
+			_, err := md.GetTTL("nonexistent")
+			assert.Error(t, err)
+		},
+		"SignSetsParent": func(t *testing.T, md *memoryDepot) {
+			parent, err := md.GetParent(serviceName)
+			require.NoError(t, err)
+			assert.Equal(t, caName, parent)
+
+			parent, err = md.GetParent(caName)
+			require.NoError(t, err)
+			assert.Empty(t, parent)
+		},
+		"PutParentFailsForNonexistentUser": func(t *testing.T, md *memoryDepot) {
+			assert.Error(t, md.PutParent("nonexistent", caName))
+			_, err := md.GetParent("nonexistent")
+			assert.Error(t, err)
+		},
+		"PutPolicySetsValue": func(t *testing.T, md *memoryDepot) {
+			policy, err := md.GetPolicy(caName)
+			require.NoError(t, err)
+			assert.Nil(t, policy)
+
+			expected := &Policy{AllowedNames: []string{"*.example.com"}}
+			require.NoError(t, md.PutPolicy(caName, expected))
+			policy, err = md.GetPolicy(caName)
+			require.NoError(t, err)
+			assert.Equal(t, expected, policy)
+		},
+		"PutPolicyFailsForNonexistentUser": func(t *testing.T, md *memoryDepot) {
+			assert.Error(t, md.PutPolicy("nonexistent", &Policy{}))
+			_, err := md.GetPolicy("nonexistent")
+			assert.Error(t, err)
+		},
+		"FindAndDeleteExpiresBefore": func(t *testing.T, md *memoryDepot) {
+			const name = "expiring"
+			opts := &CertificateOptions{
+				CA:         caName,
+				CommonName: name,
+				Host:       name,
+				Expires:    time.Hour,
+			}
+			require.NoError(t, opts.CreateCertificate(md))
+
+			users, err := md.FindExpiresBefore(time.Now().Add(2 * time.Hour))
+			require.NoError(t, err)
+			require.Len(t, users, 1)
+			assert.Equal(t, name, users[0].ID)
+
+			require.NoError(t, md.DeleteExpiresBefore(time.Now().Add(2*time.Hour)))
+			assert.False(t, md.Check(depot.CrtTag(name)))
+			assert.True(t, md.Check(depot.CrtTag(serviceName)))
+			assert.True(t, md.Check(depot.CrtTag(caName)))
+		},
+		"GenerateSaveAndFind": func(t *testing.T, md *memoryDepot) {
+			const name = "generated"
+			creds, err := md.Generate(name)
+			require.NoError(t, err)
+			require.NoError(t, md.Save(name, creds))
+
+			found, err := md.Find(name)
+			require.NoError(t, err)
+			assert.Equal(t, creds.CACert, found.CACert)
+			assert.Equal(t, creds.Cert, found.Cert)
+			assert.Equal(t, creds.Key, found.Key)
+
+			ttl, err := md.GetTTL(name)
+			require.NoError(t, err)
+			_, notAfter, err := ValidityBounds(md, name)
+			require.NoError(t, err)
+			assert.True(t, notAfter.Equal(ttl))
+
+			deleted, err := DeleteOnExpiration(md, name, 2*time.Hour)
+			require.NoError(t, err)
+			assert.True(t, deleted)
+			assert.False(t, md.Check(depot.CrtTag(name)))
+		},
+		"ConcurrentAccess": func(t *testing.T, md *memoryDepot) {
+			wg := &sync.WaitGroup{}
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					name := fmt.Sprintf("user%d", i)
+					assert.NoError(t, md.Put(depot.CrtTag(name), []byte(name)))
+					assert.True(t, md.Check(depot.CrtTag(name)))
+					data, err := md.Get(depot.CrtTag(name))
+					assert.NoError(t, err)
+					assert.Equal(t, []byte(name), data)
+					assert.NoError(t, md.Delete(depot.CrtTag(name)))
+				}(i)
+			}
+			wg.Wait()
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			testCase(t, bootstrap(t))
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package certdepot
 
 import (
+	"strings"
+	"time"
+
 	"github.com/cdr/grip"
 	"github.com/cdr/grip/message"
 	"github.com/pkg/errors"
@@ -14,9 +17,12 @@ type mgoCertDepot struct {
 	databaseName   string
 	collectionName string
 	opts           DepotOptions
+	ownsSession    bool
 }
 
-// NewMgoCertDepot creates a new cert depot using the legacy mgo driver.
+// NewMgoCertDepot creates a new cert depot using the legacy mgo driver. The
+// depot implements io.Closer, and closing it closes the session that it
+// creates.
 func NewMgoCertDepot(opts *MongoDBOptions) (Depot, error) {
 	s, err := mgo.DialWithTimeout(opts.MongoDBURI, opts.MongoDBDialTimeout)
 	if err != nil {
@@ -24,11 +30,19 @@ func NewMgoCertDepot(opts *MongoDBOptions) (Depot, error) {
 	}
 	s.SetSocketTimeout(opts.MongoDBSocketTimeout)
 
-	return NewMgoCertDepotWithSession(s, opts)
+	d, err := NewMgoCertDepotWithSession(s, opts)
+	if err != nil {
+		s.Close()
+		return nil, errors.WithStack(err)
+	}
+	d.(*mgoCertDepot).ownsSession = true
+
+	return d, nil
 }
 
 // NewMgoCertDepotWithSession creates a certificate depot using the provided
-// legacy mgo drivers session.
+// legacy mgo drivers session. The caller owns the session: closing the depot
+// does not close it.
 func NewMgoCertDepotWithSession(s *mgo.Session, opts *MongoDBOptions) (Depot, error) {
 	if s == nil {
 		return nil, errors.New("must specify a non-nil session")
@@ -46,6 +60,14 @@ func NewMgoCertDepotWithSession(s *mgo.Session, opts *MongoDBOptions) (Depot, er
 	}, nil
 }
 
+// Close closes the session if the depot created it.
+func (m *mgoCertDepot) Close() error {
+	if m.ownsSession {
+		m.session.Close()
+	}
+	return nil
+}
+
 // Put inserts the data into the document specified by the tag.
 func (m *mgoCertDepot) Put(tag *depot.Tag, data []byte) error {
 	if data == nil {
@@ -168,6 +190,318 @@ func (m *mgoCertDepot) Generate(name string) (*Credentials, error) {
 	return depotGenerate(m, name, m.opts)
 }
 
+// List returns the names of all users that hold data of the given kind.
+func (m *mgoCertDepot) List(kind TagKind) ([]string, error) {
+	key, err := kind.userKey()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	session := m.session.Clone()
+	defer session.Close()
+
+	users := []User{}
+	if err = session.DB(m.databaseName).C(m.collectionName).Find(bson.M{key: bson.M{"$exists": true, "$ne": ""}}).
+		Select(bson.M{userIDKey: 1}).All(&users); err != nil {
+		return nil, errors.Wrapf(err, "problem listing %s entries", kind)
+	}
+
+	names := make([]string, 0, len(users))
+	for _, u := range users {
+		names = append(names, u.ID)
+	}
+	return names, nil
+}
+
+// PutTTL sets the TTL to the given expiration time for the name. If the name is
+// not found in the collection, this will error. The expiration must be within
+// the validity bounds of the certificate for the given name.
+func (m *mgoCertDepot) PutTTL(name string, expiration time.Time) error {
+	expiration = expiration.UTC()
+
+	minExpiration, maxExpiration, err := ValidityBounds(m, name)
+	if err != nil {
+		return errors.Wrap(err, "could not get certificate validity bounds")
+	}
+	if expiration.Before(minExpiration) || expiration.After(maxExpiration) {
+		return errors.Errorf("cannot set expiration to %s because it must be between %s and %s", expiration, minExpiration, maxExpiration)
+	}
+
+	session := m.session.Clone()
+	defer session.Close()
+
+	formattedName := strings.Replace(name, " ", "_", -1)
+	if err = session.DB(m.databaseName).C(m.collectionName).UpdateId(formattedName,
+		bson.M{"$set": bson.M{userTTLKey: expiration}}); err != nil {
+		return errors.Wrapf(err, "problem updating TTL for user %s in the database", name)
+	}
+
+	return nil
+}
+
+// GetTTL returns the TTL for the given name.
+func (m *mgoCertDepot) GetTTL(name string) (time.Time, error) {
+	session := m.session.Clone()
+	defer session.Close()
+
+	formattedName := strings.Replace(name, " ", "_", -1)
+	u := &User{}
+	if err := session.DB(m.databaseName).C(m.collectionName).FindId(formattedName).One(u); err != nil {
+		return time.Time{}, errors.Wrap(err, "could not get TTL from database")
+	}
+
+	return u.TTL, nil
+}
+
+// PutParent records the name of the CA that issued the certificate with the
+// given name. If the name is not found in the collection, this will error.
+func (m *mgoCertDepot) PutParent(name, parent string) error {
+	session := m.session.Clone()
+	defer session.Close()
+
+	formattedName := strings.Replace(name, " ", "_", -1)
+	if err := session.DB(m.databaseName).C(m.collectionName).UpdateId(formattedName,
+		bson.M{"$set": bson.M{userParentKey: strings.Replace(parent, " ", "_", -1)}}); err != nil {
+		return errors.Wrapf(err, "problem updating parent for user %s in the database", name)
+	}
+
+	return nil
+}
+
+// GetParent returns the name of the CA that issued the certificate with the
+// given name.
+func (m *mgoCertDepot) GetParent(name string) (string, error) {
+	session := m.session.Clone()
+	defer session.Close()
+
+	formattedName := strings.Replace(name, " ", "_", -1)
+	u := &User{}
+	if err := session.DB(m.databaseName).C(m.collectionName).FindId(formattedName).One(u); err != nil {
+		return "", errors.Wrap(err, "could not get parent from database")
+	}
+
+	return u.Parent, nil
+}
+
+// HasChildren returns whether any certificate records the CA with the given
+// name as its parent.
+func (m *mgoCertDepot) HasChildren(name string) (bool, error) {
+	session := m.session.Clone()
+	defer session.Close()
+
+	formattedName := strings.Replace(name, " ", "_", -1)
+	count, err := session.DB(m.databaseName).C(m.collectionName).Find(bson.M{userParentKey: formattedName}).Limit(1).Count()
+	if err != nil {
+		return false, errors.Wrap(err, "could not find children in database")
+	}
+
+	return count > 0, nil
+}
+
+// SwapRevocationList replaces the CRL of the CA with the given name if the
+// stored CRL is equal to prev.
+func (m *mgoCertDepot) SwapRevocationList(name string, prev, next []byte) (bool, error) {
+	if next == nil {
+		return false, errors.New("data is nil")
+	}
+	session := m.session.Clone()
+	defer session.Close()
+
+	formattedName := strings.Replace(name, " ", "_", -1)
+	selector := bson.M{userIDKey: formattedName, userCertRevocListKey: string(prev)}
+	if len(prev) == 0 {
+		selector[userCertRevocListKey] = bson.M{"$in": []interface{}{nil, ""}}
+	}
+	err := session.DB(m.databaseName).C(m.collectionName).Update(selector,
+		bson.M{"$set": bson.M{userCertRevocListKey: string(next)}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "problem updating certificate revocation list for user %s in the database", name)
+	}
+
+	return true, nil
+}
+
+// PutPolicy attaches the policy to the CA with the given name. If the name is
+// not found in the collection, this will error.
+func (m *mgoCertDepot) PutPolicy(name string, policy *Policy) error {
+	session := m.session.Clone()
+	defer session.Close()
+
+	formattedName := strings.Replace(name, " ", "_", -1)
+	update := bson.M{"$set": bson.M{userPolicyKey: policy}}
+	if policy == nil {
+		update = bson.M{"$unset": bson.M{userPolicyKey: ""}}
+	}
+	if err := session.DB(m.databaseName).C(m.collectionName).UpdateId(formattedName, update); err != nil {
+		return errors.Wrapf(err, "problem updating policy for user %s in the database", name)
+	}
+
+	return nil
+}
+
+// GetPolicy returns the policy of the CA with the given name.
+func (m *mgoCertDepot) GetPolicy(name string) (*Policy, error) {
+	session := m.session.Clone()
+	defer session.Close()
+
+	formattedName := strings.Replace(name, " ", "_", -1)
+	u := &User{}
+	if err := session.DB(m.databaseName).C(m.collectionName).FindId(formattedName).One(u); err != nil {
+		return nil, errors.Wrap(err, "could not get policy from database")
+	}
+
+	return u.Policy, nil
+}
+
+// PutProfile stores the profile under the given name in the profiles
+// collection.
+func (m *mgoCertDepot) PutProfile(name string, profile *Profile) error {
+	session := m.session.Clone()
+	defer session.Close()
+
+	coll := session.DB(m.databaseName).C(profileCollectionName(m.collectionName))
+	if profile == nil {
+		if err := coll.RemoveId(name); err != nil && err != mgo.ErrNotFound {
+			return errors.Wrapf(err, "problem deleting profile %s from the database", name)
+		}
+		return nil
+	}
+
+	if _, err := coll.UpsertId(name, bson.M{"$set": bson.M{profileDocumentProfileKey: profile}}); err != nil {
+		return errors.Wrapf(err, "problem updating profile %s in the database", name)
+	}
+
+	return nil
+}
+
+// GetProfile returns the profile with the given name.
+func (m *mgoCertDepot) GetProfile(name string) (*Profile, error) {
+	session := m.session.Clone()
+	defer session.Close()
+
+	doc := &profileDocument{}
+	err := session.DB(m.databaseName).C(profileCollectionName(m.collectionName)).FindId(name).One(doc)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get profile from database")
+	}
+
+	return doc.Profile, nil
+}
+
+// ListProfiles returns all profiles by name.
+func (m *mgoCertDepot) ListProfiles() (map[string]*Profile, error) {
+	session := m.session.Clone()
+	defer session.Close()
+
+	docs := []profileDocument{}
+	if err := session.DB(m.databaseName).C(profileCollectionName(m.collectionName)).Find(bson.M{}).All(&docs); err != nil {
+		return nil, errors.Wrap(err, "problem finding profiles")
+	}
+
+	profiles := make(map[string]*Profile, len(docs))
+	for _, doc := range docs {
+		profiles[doc.ID] = doc.Profile
+	}
+
+	return profiles, nil
+}
+
+// PutPendingRequest inserts or replaces the pending request in the requests
+// collection.
+func (m *mgoCertDepot) PutPendingRequest(req *PendingRequest) error {
+	session := m.session.Clone()
+	defer session.Close()
+
+	if _, err := session.DB(m.databaseName).C(requestCollectionName(m.collectionName)).UpsertId(req.ID, req); err != nil {
+		return errors.Wrapf(err, "problem updating pending request %s in the database", req.ID)
+	}
+
+	return nil
+}
+
+// SwapPendingRequest replaces the pending request if the stored request has
+// the given status.
+func (m *mgoCertDepot) SwapPendingRequest(req *PendingRequest, prev PendingRequestStatus) (bool, error) {
+	session := m.session.Clone()
+	defer session.Close()
+
+	err := session.DB(m.databaseName).C(requestCollectionName(m.collectionName)).Update(
+		bson.M{userIDKey: req.ID, pendingRequestStatusKey: prev}, req)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "problem updating pending request %s in the database", req.ID)
+	}
+
+	return true, nil
+}
+
+// GetPendingRequest returns the pending request with the given ID.
+func (m *mgoCertDepot) GetPendingRequest(id string) (*PendingRequest, error) {
+	session := m.session.Clone()
+	defer session.Close()
+
+	req := &PendingRequest{}
+	err := session.DB(m.databaseName).C(requestCollectionName(m.collectionName)).FindId(id).One(req)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get pending request from database")
+	}
+
+	return req, nil
+}
+
+// ListPendingRequests returns all pending requests.
+func (m *mgoCertDepot) ListPendingRequests() ([]PendingRequest, error) {
+	session := m.session.Clone()
+	defer session.Close()
+
+	reqs := []PendingRequest{}
+	if err := session.DB(m.databaseName).C(requestCollectionName(m.collectionName)).Find(bson.M{}).All(&reqs); err != nil {
+		return nil, errors.Wrap(err, "problem finding pending requests")
+	}
+
+	return reqs, nil
+}
+
+// FindExpiresBefore finds all Users that expire before the given cutoff time.
+func (m *mgoCertDepot) FindExpiresBefore(cutoff time.Time) ([]User, error) {
+	session := m.session.Clone()
+	defer session.Close()
+
+	users := []User{}
+	if err := session.DB(m.databaseName).C(m.collectionName).Find(mgoExpiresBeforeQuery(cutoff)).All(&users); err != nil {
+		return nil, errors.Wrap(err, "problem finding expired users")
+	}
+
+	return users, nil
+}
+
+// DeleteExpiresBefore removes all Users that expire before the given cutoff
+// time.
+func (m *mgoCertDepot) DeleteExpiresBefore(cutoff time.Time) error {
+	session := m.session.Clone()
+	defer session.Close()
+
+	if _, err := session.DB(m.databaseName).C(m.collectionName).RemoveAll(mgoExpiresBeforeQuery(cutoff)); err != nil {
+		return errors.Wrap(err, "problem removing expired users")
+	}
+
+	return nil
+}
+
+func mgoExpiresBeforeQuery(cutoff time.Time) bson.M {
+	return bson.M{userTTLKey: bson.M{"$lte": cutoff}}
+}
+
 func errNotNotFound(err error) bool {
 	return err != nil && err != mgo.ErrNotFound
 }
@@ -18,10 +18,12 @@ type mongoDepot struct {
 	databaseName   string
 	collectionName string
 	opts           DepotOptions
+	ownsClient     bool
 }
 
 // NewMongoDBCertDepot returns a new cert depot backed by MongoDB using the
-// mongo driver.
+// mongo driver. The depot implements io.Closer, and closing it disconnects
+// the client that it creates.
 func NewMongoDBCertDepot(ctx context.Context, opts *MongoDBOptions) (Depot, error) {
 	if err := opts.validate(); err != nil {
 		return nil, errors.Wrap(err, "invalid options")
@@ -38,11 +40,13 @@ func NewMongoDBCertDepot(ctx context.Context, opts *MongoDBOptions) (Depot, erro
 		databaseName:   opts.DatabaseName,
 		collectionName: opts.CollectionName,
 		opts:           opts.DepotOptions,
+		ownsClient:     true,
 	}, nil
 }
 
 // NewMongoDBCertDepotWithClient returns a new cert depot backed by MongoDB
-// using the provided mongo driver client.
+// using the provided mongo driver client. The caller owns the client: closing
+// the depot does not disconnect it.
 func NewMongoDBCertDepotWithClient(ctx context.Context, client *mongo.Client, opts *MongoDBOptions) (Depot, error) {
 	if client == nil {
 		return nil, errors.New("must specify a non-nil client")
@@ -61,6 +65,14 @@ func NewMongoDBCertDepotWithClient(ctx context.Context, client *mongo.Client, op
 	}, nil
 }
 
+// Close disconnects the client if the depot created it.
+func (m *mongoDepot) Close() error {
+	if !m.ownsClient {
+		return nil
+	}
+	return errors.Wrap(m.client.Disconnect(m.ctx), "problem disconnecting from database")
+}
+
 // Put inserts the data into the document specified by the tag.
 func (m *mongoDepot) Put(tag *depot.Tag, data []byte) error {
 	if data == nil {
@@ -179,6 +191,31 @@ func (m *mongoDepot) Generate(name string) (*Credentials, error) {
 	return depotGenerate(m, name, m.opts)
 }
 
+// List returns the names of all users that hold data of the given kind.
+func (m *mongoDepot) List(kind TagKind) ([]string, error) {
+	key, err := kind.userKey()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	users := []User{}
+	res, err := m.client.Database(m.databaseName).Collection(m.collectionName).Find(m.ctx,
+		bson.M{key: bson.M{"$exists": true, "$ne": ""}},
+		options.Find().SetProjection(bson.M{userIDKey: 1}))
+	if err != nil {
+		return nil, errors.Wrapf(err, "problem listing %s entries", kind)
+	}
+	if err = res.All(m.ctx, &users); err != nil {
+		return nil, errors.Wrap(err, "problem decoding results")
+	}
+
+	names := make([]string, 0, len(users))
+	for _, u := range users {
+		names = append(names, u.ID)
+	}
+	return names, nil
+}
+
 func errNotNoDocuments(err error) bool {
 	return err != nil && err != mongo.ErrNoDocuments
 }
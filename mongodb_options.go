@@ -14,6 +14,8 @@ type User struct {
 	CertReq       string    `bson:"cert_req"`
 	CertRevocList string    `bson:"cert_revoc_list"`
 	TTL           time.Time `bson:"ttl,omitempty"`
+	Parent        string    `bson:"parent,omitempty"`
+	Policy        *Policy   `bson:"policy,omitempty"`
 }
 
 var (
@@ -23,8 +25,33 @@ var (
 	userCertReqKey       = bsonutil.MustHaveTag(User{}, "CertReq")
 	userCertRevocListKey = bsonutil.MustHaveTag(User{}, "CertRevocList")
 	userTTLKey           = bsonutil.MustHaveTag(User{}, "TTL")
+	userParentKey        = bsonutil.MustHaveTag(User{}, "Parent")
+	userPolicyKey        = bsonutil.MustHaveTag(User{}, "Policy")
 )
 
+// profileDocument stores a Profile in the profiles collection of the mongo
+// certificate depot.
+type profileDocument struct {
+	ID      string   `bson:"_id"`
+	Profile *Profile `bson:"profile"`
+}
+
+var profileDocumentProfileKey = bsonutil.MustHaveTag(profileDocument{}, "Profile")
+
+// profileCollectionName returns the name of the collection in which the
+// profiles of the depot with the given collection are stored.
+func profileCollectionName(collectionName string) string {
+	return collectionName + ".profiles"
+}
+
+var pendingRequestStatusKey = bsonutil.MustHaveTag(PendingRequest{}, "Status")
+
+// requestCollectionName returns the name of the collection in which the
+// pending requests of the depot with the given collection are stored.
+func requestCollectionName(collectionName string) string {
+	return collectionName + ".requests"
+}
+
 // MongoDBOptions contains options for NewMongoDBCertDepot,
 // NewMongoDBCertDepotWithClient, NewMgoCertDepot, and
 // NewMgoCertDepotWithSession.
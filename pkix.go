@@ -49,6 +49,37 @@ func GetNameFromCrlTag(tag *depot.Tag) string {
 	return depot.GetNameFromCrlTag(tag)
 }
 
+// KindTag returns a tag corresponding to the given kind of data for a name.
+func KindTag(kind TagKind, name string) *depot.Tag {
+	switch kind {
+	case PrivKeyKind:
+		return PrivKeyTag(name)
+	case CsrKind:
+		return CsrTag(name)
+	case CrlKind:
+		return CrlTag(name)
+	default:
+		return CrtTag(name)
+	}
+}
+
+// GetKindAndNameFromTag returns the kind of data and the host name from a tag.
+func GetKindAndNameFromTag(tag *depot.Tag) (TagKind, string, error) {
+	if name := depot.GetNameFromCrtTag(tag); name != "" {
+		return CrtKind, name, nil
+	}
+	if name := depot.GetNameFromPrivKeyTag(tag); name != "" {
+		return PrivKeyKind, name, nil
+	}
+	if name := depot.GetNameFromCsrTag(tag); name != "" {
+		return CsrKind, name, nil
+	}
+	if name := depot.GetNameFromCrlTag(tag); name != "" {
+		return CrlKind, name, nil
+	}
+	return "", "", errors.New("unrecognized tag")
+}
+
 // PutCertificate creates a certificate file for a given name in the depot.
 func PutCertificate(d depot.Depot, name string, crt *pkix.Certificate) error {
 	return depot.PutCertificate(d, name, crt)
@@ -96,8 +127,13 @@ func DeleteCertificateSigningRequest(d depot.Depot, name string) error {
 }
 
 // PutPrivateKey creates a private key file for a given name in the depot.
+// Unlike certstrap, this supports RSA, ECDSA and Ed25519 keys.
 func PutPrivateKey(d depot.Depot, name string, key *pkix.Key) error {
-	return depot.PutPrivateKey(d, name, key)
+	data, err := exportPrivateKey(key)
+	if err != nil {
+		return errors.Wrap(err, "problem exporting private key")
+	}
+	return d.Put(depot.PrivKeyTag(name), data)
 }
 
 // CheckPrivateKey checks the depot for existence of a private key file for a
@@ -108,7 +144,11 @@ func CheckPrivateKey(d depot.Depot, name string) bool {
 
 // GetPrivateKey retrieves a private key file for a given name from the depot.
 func GetPrivateKey(d depot.Depot, name string) (key *pkix.Key, err error) {
-	return depot.GetPrivateKey(d, name)
+	data, err := d.Get(depot.PrivKeyTag(name))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return parsePrivateKey(data)
 }
 
 // DeletePrivateKey removes a private key file for a given host name from the
@@ -120,13 +160,21 @@ func DeletePrivateKey(d Depot, name string) error {
 // PutEncryptedPrivateKey creates an encrypted private key file for a given
 // name in the depot.
 func PutEncryptedPrivateKey(d depot.Depot, name string, key *pkix.Key, passphrase []byte) error {
-	return depot.PutEncryptedPrivateKey(d, name, key, passphrase)
+	data, err := exportEncryptedPrivateKey(key, passphrase)
+	if err != nil {
+		return errors.Wrap(err, "problem exporting encrypted private key")
+	}
+	return d.Put(depot.PrivKeyTag(name), data)
 }
 
 // GetEncryptedPrivateKey retrieves an encrypted private key file for a given
 // name from the depot.
 func GetEncryptedPrivateKey(d depot.Depot, name string, passphrase []byte) (key *pkix.Key, err error) {
-	return depot.GetEncryptedPrivateKey(d, name, passphrase)
+	data, err := d.Get(depot.PrivKeyTag(name))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return parseEncryptedPrivateKey(data, passphrase)
 }
 
 // PutCertificateRevocationList creates a CRL file for a given name in the
@@ -146,11 +194,11 @@ func DeleteCertificateRevocationList(d Depot, name string) error {
 	return d.Delete(depot.CrlTag(name))
 }
 
-// PutTTL puts a new TTL for a given name in the mongo depot.
+// putTTL puts a new TTL for a given name in the depot.
 func putTTL(d depot.Depot, name string, expiration time.Time) error {
-	md, ok := d.(*mongoDepot)
+	em, ok := d.(ExpirationManager)
 	if !ok {
-		return errors.New("cannot put TTL if depot is not a mongo depot")
+		return errors.New("cannot put TTL if depot does not support expiration")
 	}
-	return md.PutTTL(name, expiration)
+	return em.PutTTL(name, expiration)
 }
@@ -0,0 +1,486 @@
+package certdepot
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cdr/grip"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+	cpkix "github.com/square/certstrap/pkix"
+)
+
+// SubjectField is a field of the subject of a certificate.
+type SubjectField string
+
+const (
+	// SubjectOrganization is the Organization (O) field.
+	SubjectOrganization SubjectField = "O"
+	// SubjectOrganizationalUnit is the Organizational Unit (OU) field.
+	SubjectOrganizationalUnit SubjectField = "OU"
+	// SubjectCountry is the Country (C) field.
+	SubjectCountry SubjectField = "C"
+	// SubjectProvince is the State/Province (ST) field.
+	SubjectProvince SubjectField = "ST"
+	// SubjectLocality is the Locality (L) field.
+	SubjectLocality SubjectField = "L"
+)
+
+// Validate checks that the subject field is supported.
+func (f SubjectField) Validate() error {
+	switch f {
+	case SubjectOrganization, SubjectOrganizationalUnit, SubjectCountry, SubjectProvince, SubjectLocality:
+		return nil
+	default:
+		return errors.Errorf("unsupported subject field '%s'", f)
+	}
+}
+
+func (f SubjectField) values(subject pkix.Name) []string {
+	switch f {
+	case SubjectOrganization:
+		return subject.Organization
+	case SubjectOrganizationalUnit:
+		return subject.OrganizationalUnit
+	case SubjectCountry:
+		return subject.Country
+	case SubjectProvince:
+		return subject.Province
+	case SubjectLocality:
+		return subject.Locality
+	default:
+		return nil
+	}
+}
+
+// Policy restricts the certificates that a CA signs. A policy is attached to a
+// CA in the depot with PutPolicy and is evaluated whenever a certificate is
+// signed with the CA, including by Generate. Rules that are not set do not
+// restrict certificates.
+type Policy struct {
+	// Patterns that the host name, the common name and the DNS subject alt
+	// names of certificates must each match, with the syntax of
+	// path.Match, such as "*.example.com".
+	AllowedNames []string `bson:"allowed_names,omitempty" json:"allowed_names,omitempty" yaml:"allowed_names,omitempty"`
+	// Patterns that the URI subject alt names of certificates must each
+	// match, with the syntax of path.Match.
+	AllowedURIs []string `bson:"allowed_uris,omitempty" json:"allowed_uris,omitempty" yaml:"allowed_uris,omitempty"`
+	// Ranges in CIDR notation that the IP subject alt names of
+	// certificates must each be in.
+	AllowedIPRanges []string `bson:"allowed_ip_ranges,omitempty" json:"allowed_ip_ranges,omitempty" yaml:"allowed_ip_ranges,omitempty"`
+	// Subject fields that must be set in certificates.
+	RequiredSubjectFields []SubjectField `bson:"required_subject_fields,omitempty" json:"required_subject_fields,omitempty" yaml:"required_subject_fields,omitempty"`
+	// Maximum time that certificates may be valid for.
+	MaxLifetime time.Duration `bson:"max_lifetime,omitempty" json:"max_lifetime,omitempty" yaml:"max_lifetime,omitempty"`
+	// Types of keys that certificates may have.
+	AllowedKeyTypes []KeyType `bson:"allowed_key_types,omitempty" json:"allowed_key_types,omitempty" yaml:"allowed_key_types,omitempty"`
+	// Minimum size in bits of RSA keys.
+	MinRSAKeyBits int `bson:"min_rsa_key_bits,omitempty" json:"min_rsa_key_bits,omitempty" yaml:"min_rsa_key_bits,omitempty"`
+	// Extended key usages that certificates may have. Certificates that do
+	// not set their usages may be used as a TLS server and as a TLS client,
+	// so both serverAuth and clientAuth must be allowed for them. The
+	// usages of intermediate CAs and OCSP signers are not restricted.
+	AllowedExtKeyUsages []ExtKeyUsage `bson:"allowed_ext_key_usages,omitempty" json:"allowed_ext_key_usages,omitempty" yaml:"allowed_ext_key_usages,omitempty"`
+}
+
+// Validate checks that the rules of the policy are valid.
+func (p *Policy) Validate() error {
+	catcher := grip.NewBasicCatcher()
+
+	for _, pattern := range append(append([]string{}, p.AllowedNames...), p.AllowedURIs...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			catcher.Errorf("invalid pattern '%s'", pattern)
+		}
+	}
+	if _, err := parseIPRanges(p.AllowedIPRanges); err != nil {
+		catcher.Add(err)
+	}
+	for _, field := range p.RequiredSubjectFields {
+		catcher.Add(field.Validate())
+	}
+	catcher.NewWhen(p.MaxLifetime < 0, "maximum lifetime cannot be negative")
+	for _, keyType := range p.AllowedKeyTypes {
+		catcher.NewWhen(keyType == "", "allowed key type cannot be empty")
+		catcher.Add(keyType.Validate())
+	}
+	catcher.NewWhen(p.MinRSAKeyBits < 0, "minimum RSA key size cannot be negative")
+	for _, usage := range p.AllowedExtKeyUsages {
+		catcher.Add(usage.Validate())
+	}
+
+	return catcher.Resolve()
+}
+
+// PolicyRule identifies a rule of a Policy.
+type PolicyRule string
+
+// The rules of a Policy, which are named after the fields that set them.
+const (
+	PolicyRuleAllowedNames          PolicyRule = "allowed_names"
+	PolicyRuleAllowedURIs           PolicyRule = "allowed_uris"
+	PolicyRuleAllowedIPRanges       PolicyRule = "allowed_ip_ranges"
+	PolicyRuleRequiredSubjectFields PolicyRule = "required_subject_fields"
+	PolicyRuleMaxLifetime           PolicyRule = "max_lifetime"
+	PolicyRuleAllowedKeyTypes       PolicyRule = "allowed_key_types"
+	PolicyRuleMinRSAKeyBits         PolicyRule = "min_rsa_key_bits"
+	PolicyRuleAllowedExtKeyUsages   PolicyRule = "allowed_ext_key_usages"
+)
+
+// PolicyViolation describes a value in a certificate that violates a rule of
+// a Policy.
+type PolicyViolation struct {
+	// Rule is the rule that is violated.
+	Rule PolicyRule `bson:"rule" json:"rule" yaml:"rule"`
+	// Value is the value of the certificate that violates the rule.
+	Value string `bson:"value" json:"value" yaml:"value"`
+	// Message describes the violation.
+	Message string `bson:"message" json:"message" yaml:"message"`
+}
+
+// PolicyError is the cause of the error returned when a certificate violates
+// the policy of a CA, which can be retrieved with errors.Cause.
+type PolicyError struct {
+	// CA is the name of the CA whose policy is violated.
+	CA string `bson:"ca" json:"ca" yaml:"ca"`
+	// Violations are all of the violations of the policy.
+	Violations []PolicyViolation `bson:"violations" json:"violations" yaml:"violations"`
+}
+
+func (e *PolicyError) Error() string {
+	msgs := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		msgs = append(msgs, v.Message)
+	}
+	return fmt.Sprintf("certificate violates the policy of CA %s: %s", e.CA, strings.Join(msgs, "; "))
+}
+
+// policyRequest holds the values of a certificate that a Policy restricts.
+type policyRequest struct {
+	host     string
+	subject  pkix.Name
+	dnsNames []string
+	ips      []net.IP
+	uris     []*url.URL
+	lifetime time.Duration
+	keyType  KeyType
+	keyBits  int
+	// extKeyUsage is nil if the extended key usages are not restricted.
+	extKeyUsage []x509.ExtKeyUsage
+}
+
+// Evaluate checks whether the CA with the policy would sign a certificate for
+// the options, without creating a key or signing anything. If the options have
+// a certificate request in memory, it is evaluated instead of the options. If
+// the certificate violates the policy, the cause of the error is a
+// *PolicyError.
+func (p *Policy) Evaluate(opts *CertificateOptions) error {
+	req, err := opts.policyRequest()
+	if err != nil {
+		return errors.Wrap(err, "problem getting certificate values")
+	}
+	return errors.WithStack(p.evaluate(opts.CA, req))
+}
+
+func (p *Policy) evaluate(ca string, req *policyRequest) error {
+	var violations []PolicyViolation
+	violate := func(rule PolicyRule, value, format string, args ...interface{}) {
+		violations = append(violations, PolicyViolation{
+			Rule:    rule,
+			Value:   value,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	if len(p.AllowedNames) > 0 {
+		var names []string
+		if req.subject.CommonName != "" {
+			names = append(names, req.subject.CommonName)
+		}
+		if req.host != "" && req.host != req.subject.CommonName {
+			names = append(names, req.host)
+		}
+		names = append(names, req.dnsNames...)
+		for _, name := range names {
+			if !matchPatterns(p.AllowedNames, name) {
+				violate(PolicyRuleAllowedNames, name, "name '%s' is not allowed", name)
+			}
+		}
+	}
+	if len(p.AllowedURIs) > 0 {
+		for _, uri := range req.uris {
+			if !matchPatterns(p.AllowedURIs, uri.String()) {
+				violate(PolicyRuleAllowedURIs, uri.String(), "URI '%s' is not allowed", uri)
+			}
+		}
+	}
+	if len(p.AllowedIPRanges) > 0 {
+		ranges, err := parseIPRanges(p.AllowedIPRanges)
+		if err != nil {
+			return errors.Wrap(err, "invalid policy")
+		}
+		for _, ip := range req.ips {
+			if !ipInRanges(ranges, ip) {
+				violate(PolicyRuleAllowedIPRanges, ip.String(), "IP address '%s' is not allowed", ip)
+			}
+		}
+	}
+	for _, field := range p.RequiredSubjectFields {
+		if len(field.values(req.subject)) == 0 {
+			violate(PolicyRuleRequiredSubjectFields, string(field), "subject field %s is required", field)
+		}
+	}
+	if p.MaxLifetime > 0 && req.lifetime > p.MaxLifetime {
+		violate(PolicyRuleMaxLifetime, req.lifetime.String(), "lifetime %s exceeds the maximum of %s", req.lifetime, p.MaxLifetime)
+	}
+	if len(p.AllowedKeyTypes) > 0 && !containsKeyType(p.AllowedKeyTypes, req.keyType) {
+		violate(PolicyRuleAllowedKeyTypes, string(req.keyType), "key type '%s' is not allowed", req.keyType)
+	}
+	if p.MinRSAKeyBits > 0 && req.keyType == RSAKey && req.keyBits < p.MinRSAKeyBits {
+		violate(PolicyRuleMinRSAKeyBits, fmt.Sprint(req.keyBits), "RSA key size of %d bits is less than the minimum of %d", req.keyBits, p.MinRSAKeyBits)
+	}
+	if len(p.AllowedExtKeyUsages) > 0 {
+		for _, usage := range req.extKeyUsage {
+			if !containsExtKeyUsage(p.AllowedExtKeyUsages, usage) {
+				name := extKeyUsageName(usage)
+				violate(PolicyRuleAllowedExtKeyUsages, name, "extended key usage '%s' is not allowed", name)
+			}
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{CA: ca, Violations: violations}
+	}
+	return nil
+}
+
+func matchPatterns(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func ipInRanges(ranges []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ranges {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsKeyType(keyTypes []KeyType, keyType KeyType) bool {
+	for _, t := range keyTypes {
+		if t == keyType {
+			return true
+		}
+	}
+	return false
+}
+
+func containsExtKeyUsage(allowed []ExtKeyUsage, usage x509.ExtKeyUsage) bool {
+	for _, u := range allowed {
+		if extKeyUsages[u] == usage {
+			return true
+		}
+	}
+	return false
+}
+
+// publicKeyType returns the key type and size in bits of the public key.
+func publicKeyType(pub interface{}) (KeyType, int, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return RSAKey, key.N.BitLen(), nil
+	case *ecdsa.PublicKey:
+		bits := key.Curve.Params().BitSize
+		switch bits {
+		case 256:
+			return ECDSAP256Key, bits, nil
+		case 384:
+			return ECDSAP384Key, bits, nil
+		case 521:
+			return ECDSAP521Key, bits, nil
+		}
+		return "", 0, errors.Errorf("unsupported ECDSA curve %s", key.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return Ed25519Key, ed25519.PublicKeySize * 8, nil
+	default:
+		return "", 0, errors.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// policyRequest returns the values of the certificate that would be signed for
+// the options, using the certificate request in memory if there is one.
+func (opts *CertificateOptions) policyRequest() (*policyRequest, error) {
+	if opts.csr != nil {
+		rawCsr, err := opts.csr.GetRawCertificateSigningRequest()
+		if err != nil {
+			return nil, errors.Wrap(err, "problem getting raw certificate request")
+		}
+		return opts.csrPolicyRequest(rawCsr)
+	}
+
+	name, err := opts.getCertificateRequestName()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ips, err := cpkix.ParseAndValidateIPs(strings.Join(opts.IP, ","))
+	if err != nil {
+		return nil, errors.Wrapf(err, "problem parsing and validating IPs: %s", opts.IP)
+	}
+	uris, err := cpkix.ParseAndValidateURIs(strings.Join(opts.URI, ","))
+	if err != nil {
+		return nil, errors.Wrapf(err, "problem parsing and validating URIs: %s", opts.URI)
+	}
+
+	req := &policyRequest{
+		host:     opts.Host,
+		subject:  pkix.Name{CommonName: name},
+		dnsNames: opts.Domain,
+		ips:      ips,
+		uris:     uris,
+		lifetime: opts.Expires,
+	}
+	for field, value := range map[*[]string]string{
+		&req.subject.Organization:       opts.Organization,
+		&req.subject.OrganizationalUnit: opts.OrganizationalUnit,
+		&req.subject.Country:            opts.Country,
+		&req.subject.Province:           opts.Province,
+		&req.subject.Locality:           opts.Locality,
+	} {
+		if value != "" {
+			*field = []string{value}
+		}
+	}
+
+	var pub interface{}
+	if opts.Key != "" {
+		keyBytes, err := ioutil.ReadFile(opts.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "problem reading key from %s", opts.Key)
+		}
+		key, err := parsePrivateKey(keyBytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "problem getting key from PEM")
+		}
+		pub = key.Public
+		if req.keyType, req.keyBits, err = publicKeyType(pub); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	} else {
+		if err = opts.KeyType.Validate(); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		req.keyType = opts.KeyType
+		if req.keyType == "" {
+			req.keyType = RSAKey
+		}
+		req.keyBits = opts.KeyBits
+		if req.keyType == RSAKey && req.keyBits == 0 {
+			req.keyBits = 2048
+		}
+		// the key usages only depend on whether the key is an RSA key
+		if req.keyType == RSAKey {
+			pub = &rsa.PublicKey{}
+		}
+	}
+
+	if err = opts.setPolicyExtKeyUsage(req, pub); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return req, nil
+}
+
+// csrPolicyRequest returns the values of the certificate that would be signed
+// for the options from the certificate request.
+func (opts *CertificateOptions) csrPolicyRequest(csr *x509.CertificateRequest) (*policyRequest, error) {
+	req := &policyRequest{
+		host:     opts.Host,
+		subject:  csr.Subject,
+		dnsNames: csr.DNSNames,
+		ips:      csr.IPAddresses,
+		uris:     csr.URIs,
+		lifetime: opts.Expires,
+	}
+
+	var err error
+	if req.keyType, req.keyBits, err = publicKeyType(csr.PublicKey); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = opts.setPolicyExtKeyUsage(req, csr.PublicKey); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return req, nil
+}
+
+func (opts *CertificateOptions) setPolicyExtKeyUsage(req *policyRequest, pub interface{}) error {
+	if opts.Intermediate || opts.OCSPSigner {
+		return nil
+	}
+	_, extKeyUsage, err := resolveUsages(opts.KeyUsage, opts.ExtKeyUsage, pub)
+	if err != nil {
+		return errors.Wrap(err, "invalid key usages")
+	}
+	req.extKeyUsage = extKeyUsage
+	return nil
+}
+
+// checkPolicy checks that the certificate request signed with the options is
+// allowed by the policy of the CA with the given name, if it has one.
+func (opts *CertificateOptions) checkPolicy(d depot.Depot, ca string, csr *x509.CertificateRequest) error {
+	policy, err := GetPolicy(d, ca)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if policy == nil {
+		return nil
+	}
+
+	req, err := opts.csrPolicyRequest(csr)
+	if err != nil {
+		return errors.Wrap(err, "problem getting certificate values")
+	}
+	return policy.evaluate(opts.CA, req)
+}
+
+// PutPolicy attaches the policy to the CA with the given name, replacing any
+// existing policy. A nil policy removes the policy of the CA. The depot must
+// implement PolicyManager.
+func PutPolicy(d depot.Depot, ca string, policy *Policy) error {
+	pm, ok := d.(PolicyManager)
+	if !ok {
+		return errors.New("depot does not support policies")
+	}
+	if policy != nil {
+		if err := policy.Validate(); err != nil {
+			return errors.Wrap(err, "invalid policy")
+		}
+	}
+	return errors.Wrapf(pm.PutPolicy(strings.Replace(ca, " ", "_", -1), policy), "problem putting policy for %s", ca)
+}
+
+// GetPolicy returns the policy attached to the CA with the given name, or nil
+// if the CA has no policy or the depot does not support policies.
+func GetPolicy(d depot.Depot, ca string) (*Policy, error) {
+	pm, ok := d.(PolicyManager)
+	if !ok {
+		return nil, nil
+	}
+	policy, err := pm.GetPolicy(strings.Replace(ca, " ", "_", -1))
+	return policy, errors.Wrapf(err, "problem getting policy for %s", ca)
+}
@@ -0,0 +1,354 @@
+package certdepot
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy(t *testing.T) {
+	const caName = "ca"
+
+	leaf := func(name string) *CertificateOptions {
+		return &CertificateOptions{
+			CA:         caName,
+			CommonName: name,
+			Host:       name,
+			Expires:    time.Hour,
+		}
+	}
+	violations := func(t *testing.T, err error) []PolicyViolation {
+		require.Error(t, err)
+		policyErr, ok := errors.Cause(err).(*PolicyError)
+		require.True(t, ok, "error should be caused by a policy violation: %s", err)
+		assert.Equal(t, caName, policyErr.CA)
+		return policyErr.Violations
+	}
+	rules := func(violations []PolicyViolation) []PolicyRule {
+		var rules []PolicyRule
+		for _, v := range violations {
+			rules = append(rules, v.Rule)
+		}
+		return rules
+	}
+
+	t.Run("Validate", func(t *testing.T) {
+		for testName, testCase := range map[string]struct {
+			policy Policy
+			valid  bool
+		}{
+			"Empty":                   {policy: Policy{}, valid: true},
+			"AllRules":                {policy: Policy{AllowedNames: []string{"*.example.com"}, AllowedURIs: []string{"spiffe://example.com/*"}, AllowedIPRanges: []string{"10.0.0.0/8"}, RequiredSubjectFields: []SubjectField{SubjectOrganization}, MaxLifetime: time.Hour, AllowedKeyTypes: []KeyType{RSAKey}, MinRSAKeyBits: 2048, AllowedExtKeyUsages: []ExtKeyUsage{ExtKeyUsageServerAuth}}, valid: true},
+			"InvalidPattern":          {policy: Policy{AllowedNames: []string{"[example.com"}}},
+			"InvalidIPRange":          {policy: Policy{AllowedIPRanges: []string{"10.0.0.1"}}},
+			"InvalidSubjectField":     {policy: Policy{RequiredSubjectFields: []SubjectField{"CN"}}},
+			"NegativeMaxLifetime":     {policy: Policy{MaxLifetime: -time.Hour}},
+			"InvalidKeyType":          {policy: Policy{AllowedKeyTypes: []KeyType{"dsa"}}},
+			"EmptyKeyType":            {policy: Policy{AllowedKeyTypes: []KeyType{""}}},
+			"NegativeMinRSAKeyBits":   {policy: Policy{MinRSAKeyBits: -1}},
+			"InvalidExtendedKeyUsage": {policy: Policy{AllowedExtKeyUsages: []ExtKeyUsage{"unknown"}}},
+		} {
+			t.Run(testName, func(t *testing.T) {
+				err := testCase.policy.Validate()
+				if testCase.valid {
+					assert.NoError(t, err)
+				} else {
+					assert.Error(t, err)
+				}
+			})
+		}
+	})
+	t.Run("Evaluate", func(t *testing.T) {
+		for testName, testCase := range map[string]struct {
+			policy   Policy
+			opts     func() *CertificateOptions
+			expected []PolicyRule
+		}{
+			"AllowsMatchingCertificate": {
+				policy: Policy{
+					AllowedNames:          []string{"*.example.com"},
+					AllowedURIs:           []string{"spiffe://example.com/*"},
+					AllowedIPRanges:       []string{"10.0.0.0/8"},
+					RequiredSubjectFields: []SubjectField{SubjectOrganization},
+					MaxLifetime:           time.Hour,
+					AllowedKeyTypes:       []KeyType{RSAKey},
+					MinRSAKeyBits:         2048,
+					AllowedExtKeyUsages:   []ExtKeyUsage{ExtKeyUsageServerAuth, ExtKeyUsageClientAuth},
+				},
+				opts: func() *CertificateOptions {
+					opts := leaf("api.example.com")
+					opts.Domain = []string{"www.example.com"}
+					opts.URI = []string{"spiffe://example.com/api"}
+					opts.IP = []string{"10.1.2.3"}
+					opts.Organization = "example"
+					return opts
+				},
+			},
+			"RefusesNames": {
+				policy: Policy{AllowedNames: []string{"*.example.com"}},
+				opts: func() *CertificateOptions {
+					opts := leaf("api.example.com")
+					opts.Domain = []string{"api.example.org"}
+					return opts
+				},
+				expected: []PolicyRule{PolicyRuleAllowedNames},
+			},
+			"RefusesCommonName": {
+				policy:   Policy{AllowedNames: []string{"*.example.com"}},
+				opts:     func() *CertificateOptions { return leaf("example.org") },
+				expected: []PolicyRule{PolicyRuleAllowedNames},
+			},
+			"RefusesURIs": {
+				policy: Policy{AllowedURIs: []string{"spiffe://example.com/*"}},
+				opts: func() *CertificateOptions {
+					opts := leaf("server")
+					opts.URI = []string{"spiffe://example.org/api"}
+					return opts
+				},
+				expected: []PolicyRule{PolicyRuleAllowedURIs},
+			},
+			"RefusesIPs": {
+				policy: Policy{AllowedIPRanges: []string{"10.0.0.0/8"}},
+				opts: func() *CertificateOptions {
+					opts := leaf("server")
+					opts.IP = []string{"192.168.1.1"}
+					return opts
+				},
+				expected: []PolicyRule{PolicyRuleAllowedIPRanges},
+			},
+			"RefusesMissingSubjectFields": {
+				policy: Policy{RequiredSubjectFields: []SubjectField{SubjectOrganization, SubjectCountry}},
+				opts: func() *CertificateOptions {
+					opts := leaf("server")
+					opts.Organization = "example"
+					return opts
+				},
+				expected: []PolicyRule{PolicyRuleRequiredSubjectFields},
+			},
+			"RefusesLongLifetime": {
+				policy: Policy{MaxLifetime: time.Hour},
+				opts: func() *CertificateOptions {
+					opts := leaf("server")
+					opts.Expires = 2 * time.Hour
+					return opts
+				},
+				expected: []PolicyRule{PolicyRuleMaxLifetime},
+			},
+			"RefusesKeyTypes": {
+				policy: Policy{AllowedKeyTypes: []KeyType{ECDSAP256Key, Ed25519Key}},
+				opts: func() *CertificateOptions {
+					opts := leaf("server")
+					opts.KeyType = RSAKey
+					return opts
+				},
+				expected: []PolicyRule{PolicyRuleAllowedKeyTypes},
+			},
+			"RefusesDefaultKeyType": {
+				policy:   Policy{AllowedKeyTypes: []KeyType{ECDSAP256Key}},
+				opts:     func() *CertificateOptions { return leaf("server") },
+				expected: []PolicyRule{PolicyRuleAllowedKeyTypes},
+			},
+			"RefusesSmallRSAKeys": {
+				policy: Policy{MinRSAKeyBits: 4096},
+				opts: func() *CertificateOptions {
+					opts := leaf("server")
+					opts.KeyBits = 2048
+					return opts
+				},
+				expected: []PolicyRule{PolicyRuleMinRSAKeyBits},
+			},
+			"IgnoresKeySizeOfOtherKeyTypes": {
+				policy: Policy{MinRSAKeyBits: 4096},
+				opts: func() *CertificateOptions {
+					opts := leaf("server")
+					opts.KeyType = ECDSAP256Key
+					return opts
+				},
+			},
+			"RefusesExtendedKeyUsages": {
+				policy: Policy{AllowedExtKeyUsages: []ExtKeyUsage{ExtKeyUsageClientAuth}},
+				opts: func() *CertificateOptions {
+					opts := leaf("server")
+					opts.ExtKeyUsage = []ExtKeyUsage{ExtKeyUsageServerAuth}
+					return opts
+				},
+				expected: []PolicyRule{PolicyRuleAllowedExtKeyUsages},
+			},
+			"RefusesDefaultExtendedKeyUsages": {
+				policy:   Policy{AllowedExtKeyUsages: []ExtKeyUsage{ExtKeyUsageClientAuth}},
+				opts:     func() *CertificateOptions { return leaf("server") },
+				expected: []PolicyRule{PolicyRuleAllowedExtKeyUsages},
+			},
+			"IgnoresExtendedKeyUsagesOfIntermediates": {
+				policy: Policy{AllowedExtKeyUsages: []ExtKeyUsage{ExtKeyUsageClientAuth}},
+				opts: func() *CertificateOptions {
+					opts := leaf("intermediate")
+					opts.Intermediate = true
+					return opts
+				},
+			},
+			"ReportsAllViolations": {
+				policy: Policy{
+					AllowedNames: []string{"*.example.com"},
+					MaxLifetime:  time.Minute,
+				},
+				opts:     func() *CertificateOptions { return leaf("server") },
+				expected: []PolicyRule{PolicyRuleAllowedNames, PolicyRuleMaxLifetime},
+			},
+		} {
+			t.Run(testName, func(t *testing.T) {
+				err := testCase.policy.Evaluate(testCase.opts())
+				if len(testCase.expected) == 0 {
+					assert.NoError(t, err)
+					return
+				}
+				assert.Equal(t, testCase.expected, rules(violations(t, err)))
+			})
+		}
+	})
+	t.Run("EvaluateDoesNotModifyDepot", func(t *testing.T) {
+		d := NewMemoryDepot(DepotOptions{})
+		require.NoError(t, (&CertificateOptions{CommonName: caName, Expires: 24 * time.Hour}).Init(d))
+
+		policy := &Policy{MaxLifetime: time.Minute}
+		violations(t, policy.Evaluate(leaf("server")))
+		assert.False(t, d.Check(CsrTag("server")))
+		assert.False(t, d.Check(PrivKeyTag("server")))
+	})
+	t.Run("EvaluateUsesCertificateRequestInMemory", func(t *testing.T) {
+		opts := leaf("server")
+		opts.KeyType = ECDSAP256Key
+		_, _, err := opts.CertRequestInMemory()
+		require.NoError(t, err)
+
+		policy := &Policy{AllowedKeyTypes: []KeyType{RSAKey}}
+		opts.KeyType = RSAKey
+		assert.Equal(t, []PolicyRule{PolicyRuleAllowedKeyTypes}, rules(violations(t, policy.Evaluate(opts))))
+	})
+	t.Run("Enforcement", func(t *testing.T) {
+		policy := &Policy{
+			AllowedNames: []string{"*.example.com"},
+			MaxLifetime:  2 * time.Hour,
+		}
+		for testName, testCase := range map[string]func(t *testing.T, d Depot){
+			"CreateCertificateAllowsMatchingCertificate": func(t *testing.T, d Depot) {
+				require.NoError(t, leaf("api.example.com").CreateCertificate(d))
+				assert.True(t, d.Check(CrtTag("api.example.com")))
+			},
+			"CreateCertificateRefusesViolations": func(t *testing.T, d Depot) {
+				opts := leaf("server")
+				opts.Expires = 24 * time.Hour
+				vs := violations(t, opts.CreateCertificate(d))
+				assert.Equal(t, []PolicyRule{PolicyRuleAllowedNames, PolicyRuleMaxLifetime}, rules(vs))
+				assert.Equal(t, "server", vs[0].Value)
+				assert.False(t, d.Check(CrtTag("server")))
+			},
+			"SignCertificateRequestRefusesViolations": func(t *testing.T, d Depot) {
+				opts := leaf("server")
+				csr, _, err := opts.CertRequestInMemory()
+				require.NoError(t, err)
+				_, err = opts.SignCertificateRequestInMemory(d, csr)
+				violations(t, err)
+			},
+			"GenerateRefusesViolations": func(t *testing.T, d Depot) {
+				_, err := d.Generate("server")
+				violations(t, err)
+				assert.False(t, d.Check(CrtTag("server")))
+			},
+			"GenerateAllowsMatchingCertificate": func(t *testing.T, d Depot) {
+				creds, err := d.Generate("api.example.com")
+				require.NoError(t, err)
+				assert.NotEmpty(t, creds.Cert)
+			},
+			"OtherCAsAreUnrestricted": func(t *testing.T, d Depot) {
+				require.NoError(t, (&CertificateOptions{CommonName: "other", Expires: 24 * time.Hour}).Init(d))
+				opts := leaf("server")
+				opts.CA = "other"
+				assert.NoError(t, opts.CreateCertificate(d))
+			},
+			"RemovingPolicyAllowsCertificate": func(t *testing.T, d Depot) {
+				require.NoError(t, PutPolicy(d, caName, nil))
+				assert.NoError(t, leaf("server").CreateCertificate(d))
+			},
+			"GetPolicyReturnsPolicy": func(t *testing.T, d Depot) {
+				actual, err := GetPolicy(d, caName)
+				require.NoError(t, err)
+				assert.Equal(t, policy, actual)
+			},
+			"PutPolicyFailsWithInvalidPolicy": func(t *testing.T, d Depot) {
+				assert.Error(t, PutPolicy(d, caName, &Policy{MaxLifetime: -time.Hour}))
+			},
+			"CopyDepotCopiesPolicy": func(t *testing.T, d Depot) {
+				dst := NewMemoryDepot(DepotOptions{})
+				results, err := CopyDepot(context.Background(), d, dst, CopyDepotOptions{})
+				require.NoError(t, err)
+				for _, result := range results {
+					require.NoError(t, result.Error)
+				}
+
+				actual, err := GetPolicy(dst, caName)
+				require.NoError(t, err)
+				assert.Equal(t, policy, actual)
+			},
+			"BackupAndRestorePolicy": func(t *testing.T, d Depot) {
+				buf := &bytes.Buffer{}
+				require.NoError(t, Backup(d, buf))
+				dst := NewMemoryDepot(DepotOptions{})
+				require.NoError(t, Restore(dst, buf))
+
+				actual, err := GetPolicy(dst, caName)
+				require.NoError(t, err)
+				assert.Equal(t, policy, actual)
+			},
+		} {
+			t.Run(testName, func(t *testing.T) {
+				tempDir, err := ioutil.TempDir(".", "policy-test")
+				require.NoError(t, err)
+				defer func() {
+					assert.NoError(t, os.RemoveAll(tempDir))
+				}()
+
+				for depotName, makeDepot := range map[string]func(t *testing.T) Depot{
+					"Memory": func(t *testing.T) Depot {
+						return NewMemoryDepot(DepotOptions{CA: caName, DefaultExpiration: time.Hour})
+					},
+					"File": func(t *testing.T) Depot {
+						d, err := MakeFileDepot(tempDir, DepotOptions{CA: caName, DefaultExpiration: time.Hour})
+						require.NoError(t, err)
+						return d
+					},
+				} {
+					t.Run(depotName, func(t *testing.T) {
+						d := makeDepot(t)
+						require.NoError(t, (&CertificateOptions{CommonName: caName, Expires: 24 * time.Hour}).Init(d))
+						require.NoError(t, PutPolicy(d, caName, policy))
+
+						testCase(t, d)
+					})
+				}
+			})
+		}
+	})
+	t.Run("PutPolicyFailsForUnsupportedDepot", func(t *testing.T) {
+		tempDir, err := ioutil.TempDir(".", "policy-test")
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, os.RemoveAll(tempDir))
+		}()
+
+		d, err := NewFileDepot(tempDir)
+		require.NoError(t, err)
+		assert.Error(t, PutPolicy(struct{ Depot }{d}, caName, &Policy{}))
+
+		policy, err := GetPolicy(struct{ Depot }{d}, caName)
+		require.NoError(t, err)
+		assert.Nil(t, policy)
+	})
+}
@@ -0,0 +1,193 @@
+package certdepot
+
+import (
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/cdr/grip"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+	"gopkg.in/yaml.v3"
+)
+
+// Profile is a named set of certificate options stored in the depot, such as
+// "server-short-lived" or "client-device", that CertificateOptions reference
+// with their Profile field. Any field that is set in the CertificateOptions
+// overrides the value from the profile, so the profile only provides defaults
+// for the fields that are left unset.
+type Profile struct {
+	// CA is the name of the CA that signs certificates.
+	CA string `bson:"ca,omitempty" json:"ca,omitempty" yaml:"ca,omitempty"`
+	// KeyType is the type of key generated for certificates.
+	KeyType KeyType `bson:"key_type,omitempty" json:"key_type,omitempty" yaml:"key_type,omitempty"`
+	// KeyBits is the size of the RSA keys generated for certificates.
+	KeyBits            int    `bson:"key_bits,omitempty" json:"key_bits,omitempty" yaml:"key_bits,omitempty"`
+	Organization       string `bson:"o,omitempty" json:"o,omitempty" yaml:"o,omitempty"`
+	Country            string `bson:"c,omitempty" json:"c,omitempty" yaml:"c,omitempty"`
+	Locality           string `bson:"l,omitempty" json:"l,omitempty" yaml:"l,omitempty"`
+	OrganizationalUnit string `bson:"ou,omitempty" json:"ou,omitempty" yaml:"ou,omitempty"`
+	Province           string `bson:"st,omitempty" json:"st,omitempty" yaml:"st,omitempty"`
+	// Expires is how long certificates are valid for.
+	Expires time.Duration `bson:"expires,omitempty" json:"expires,omitempty" yaml:"expires,omitempty"`
+	// CRLDistributionPoints are the URLs of the CRL of the CA.
+	CRLDistributionPoints []string `bson:"crl_distribution_points,omitempty" json:"crl_distribution_points,omitempty" yaml:"crl_distribution_points,omitempty"`
+	// ExtKeyUsage are the purposes that certificates may be used for.
+	ExtKeyUsage []ExtKeyUsage `bson:"ext_key_usage,omitempty" json:"ext_key_usage,omitempty" yaml:"ext_key_usage,omitempty"`
+	// KeyUsage are the operations that the keys of certificates may be used
+	// for.
+	KeyUsage []KeyUsage `bson:"key_usage,omitempty" json:"key_usage,omitempty" yaml:"key_usage,omitempty"`
+}
+
+// Validate checks that the values of the profile are valid.
+func (p *Profile) Validate() error {
+	catcher := grip.NewBasicCatcher()
+
+	catcher.Add(p.KeyType.Validate())
+	catcher.NewWhen(p.KeyBits < 0, "key size cannot be negative")
+	catcher.NewWhen(p.Expires < 0, "expiration cannot be negative")
+	for _, usage := range p.ExtKeyUsage {
+		catcher.Add(usage.Validate())
+	}
+	for _, usage := range p.KeyUsage {
+		catcher.Add(usage.Validate())
+	}
+
+	return catcher.Resolve()
+}
+
+// apply sets each field of the options that is unset to the value from the
+// profile.
+func (p *Profile) apply(opts *CertificateOptions) {
+	for dst, src := range map[*string]string{
+		&opts.CA:                 p.CA,
+		&opts.Organization:       p.Organization,
+		&opts.Country:            p.Country,
+		&opts.Locality:           p.Locality,
+		&opts.OrganizationalUnit: p.OrganizationalUnit,
+		&opts.Province:           p.Province,
+	} {
+		if *dst == "" {
+			*dst = src
+		}
+	}
+	if opts.KeyType == "" {
+		opts.KeyType = p.KeyType
+	}
+	if opts.KeyBits == 0 {
+		opts.KeyBits = p.KeyBits
+	}
+	if opts.Expires == 0 {
+		opts.Expires = p.Expires
+	}
+	if len(opts.CRLDistributionPoints) == 0 {
+		opts.CRLDistributionPoints = append([]string{}, p.CRLDistributionPoints...)
+	}
+	if len(opts.ExtKeyUsage) == 0 {
+		opts.ExtKeyUsage = append([]ExtKeyUsage{}, p.ExtKeyUsage...)
+	}
+	if len(opts.KeyUsage) == 0 {
+		opts.KeyUsage = append([]KeyUsage{}, p.KeyUsage...)
+	}
+}
+
+// ApplyProfile sets each unset field of the options to the value from the
+// profile named by the Profile field, if there is one. Init, CertRequest,
+// SignInMemory and SignCertificateRequestInMemory apply the profile
+// automatically, but it must be applied before calling CertRequestInMemory
+// for the certificate request to include the values from the profile.
+func (opts *CertificateOptions) ApplyProfile(d depot.Depot) error {
+	if opts.Profile == "" {
+		return nil
+	}
+
+	profile, err := GetProfile(d, opts.Profile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if profile == nil {
+		return errors.Errorf("could not find profile %s in the depot", opts.Profile)
+	}
+	profile.apply(opts)
+
+	return nil
+}
+
+// PutProfile stores the profile in the depot under the given name, replacing
+// any existing profile with the name. A nil profile removes the profile with
+// the name. The depot must implement ProfileManager.
+func PutProfile(d depot.Depot, name string, profile *Profile) error {
+	pm, ok := d.(ProfileManager)
+	if !ok {
+		return errors.New("depot does not support profiles")
+	}
+	if name == "" {
+		return errors.New("must specify a profile name")
+	}
+	if strings.ContainsAny(name, `/\`) {
+		return errors.Errorf("invalid profile name '%s'", name)
+	}
+	if profile != nil {
+		if err := profile.Validate(); err != nil {
+			return errors.Wrap(err, "invalid profile")
+		}
+	}
+	return errors.Wrapf(pm.PutProfile(strings.Replace(name, " ", "_", -1), profile), "problem putting profile %s", name)
+}
+
+// GetProfile returns the profile stored in the depot under the given name, or
+// nil if there is no profile with the name. The depot must implement
+// ProfileManager.
+func GetProfile(d depot.Depot, name string) (*Profile, error) {
+	pm, ok := d.(ProfileManager)
+	if !ok {
+		return nil, errors.New("depot does not support profiles")
+	}
+	profile, err := pm.GetProfile(strings.Replace(name, " ", "_", -1))
+	return profile, errors.Wrapf(err, "problem getting profile %s", name)
+}
+
+// NewProfilesFromFile parses the profiles in the YAML or JSON file at path,
+// which maps the name of each profile to its values. For example:
+//
+//	server-short-lived:
+//	  ca: root
+//	  o: Example
+//	  expires: 24h
+//	  ext_key_usage: [serverAuth]
+//
+// The profiles can then be stored in a depot with PutProfiles.
+func NewProfilesFromFile(path string) (map[string]*Profile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "problem reading profiles file '%s'", path)
+	}
+
+	profiles := map[string]*Profile{}
+	if err = yaml.Unmarshal(data, &profiles); err != nil {
+		return nil, errors.Wrapf(err, "problem parsing profiles file '%s'", path)
+	}
+
+	catcher := grip.NewBasicCatcher()
+	for name, profile := range profiles {
+		if profile == nil {
+			profiles[name] = &Profile{}
+			continue
+		}
+		catcher.Wrapf(profile.Validate(), "invalid profile %s", name)
+	}
+	if catcher.HasErrors() {
+		return nil, catcher.Resolve()
+	}
+
+	return profiles, nil
+}
+
+// PutProfiles stores each of the profiles in the depot under its name.
+func PutProfiles(d depot.Depot, profiles map[string]*Profile) error {
+	catcher := grip.NewBasicCatcher()
+	for name, profile := range profiles {
+		catcher.Add(PutProfile(d, name, profile))
+	}
+	return catcher.Resolve()
+}
@@ -0,0 +1,308 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfile(t *testing.T) {
+	const (
+		caName      = "ca"
+		profileName = "server-short-lived"
+	)
+
+	profile := &Profile{
+		CA:                 caName,
+		KeyType:            ECDSAP256Key,
+		Organization:       "Example",
+		Country:            "US",
+		Locality:           "New York",
+		OrganizationalUnit: "Platform",
+		Province:           "NY",
+		Expires:            2 * time.Hour,
+		ExtKeyUsage:        []ExtKeyUsage{ExtKeyUsageServerAuth},
+	}
+	rawCertificate := func(t *testing.T, d Depot, name string) *x509.Certificate {
+		rawCrt, err := getRawCertificate(d, name)
+		require.NoError(t, err)
+		return rawCrt
+	}
+
+	t.Run("Validate", func(t *testing.T) {
+		for testName, testCase := range map[string]struct {
+			profile Profile
+			valid   bool
+		}{
+			"Empty":                   {profile: Profile{}, valid: true},
+			"AllFields":               {profile: *profile, valid: true},
+			"InvalidKeyType":          {profile: Profile{KeyType: "dsa"}},
+			"NegativeKeyBits":         {profile: Profile{KeyBits: -1}},
+			"NegativeExpiration":      {profile: Profile{Expires: -time.Hour}},
+			"InvalidExtendedKeyUsage": {profile: Profile{ExtKeyUsage: []ExtKeyUsage{"unknown"}}},
+			"InvalidKeyUsage":         {profile: Profile{KeyUsage: []KeyUsage{"unknown"}}},
+		} {
+			t.Run(testName, func(t *testing.T) {
+				err := testCase.profile.Validate()
+				if testCase.valid {
+					assert.NoError(t, err)
+				} else {
+					assert.Error(t, err)
+				}
+			})
+		}
+	})
+	t.Run("Apply", func(t *testing.T) {
+		for testName, testCase := range map[string]func(t *testing.T, d Depot){
+			"SetsUnsetFields": func(t *testing.T, d Depot) {
+				opts := &CertificateOptions{Profile: profileName, CommonName: "server"}
+				require.NoError(t, opts.ApplyProfile(d))
+				assert.Equal(t, caName, opts.CA)
+				assert.Equal(t, ECDSAP256Key, opts.KeyType)
+				assert.Equal(t, "Example", opts.Organization)
+				assert.Equal(t, 2*time.Hour, opts.Expires)
+				assert.Equal(t, []ExtKeyUsage{ExtKeyUsageServerAuth}, opts.ExtKeyUsage)
+			},
+			"OptionsOverrideProfile": func(t *testing.T, d Depot) {
+				opts := &CertificateOptions{
+					Profile:      profileName,
+					CommonName:   "server",
+					Organization: "Other",
+					Expires:      time.Hour,
+					ExtKeyUsage:  []ExtKeyUsage{ExtKeyUsageClientAuth},
+				}
+				require.NoError(t, opts.ApplyProfile(d))
+				assert.Equal(t, "Other", opts.Organization)
+				assert.Equal(t, time.Hour, opts.Expires)
+				assert.Equal(t, []ExtKeyUsage{ExtKeyUsageClientAuth}, opts.ExtKeyUsage)
+				assert.Equal(t, "US", opts.Country)
+			},
+			"DoesNotModifyStoredProfile": func(t *testing.T, d Depot) {
+				opts := &CertificateOptions{Profile: profileName}
+				require.NoError(t, opts.ApplyProfile(d))
+				opts.ExtKeyUsage[0] = ExtKeyUsageClientAuth
+
+				stored, err := GetProfile(d, profileName)
+				require.NoError(t, err)
+				assert.Equal(t, []ExtKeyUsage{ExtKeyUsageServerAuth}, stored.ExtKeyUsage)
+			},
+			"NoProfileIsNoop": func(t *testing.T, d Depot) {
+				opts := &CertificateOptions{CommonName: "server"}
+				require.NoError(t, opts.ApplyProfile(d))
+				assert.Empty(t, opts.CA)
+			},
+			"FailsWithNonexistentProfile": func(t *testing.T, d Depot) {
+				opts := &CertificateOptions{Profile: "nonexistent"}
+				assert.Error(t, opts.ApplyProfile(d))
+			},
+			"CreateCertificateUsesProfile": func(t *testing.T, d Depot) {
+				require.NoError(t, (&CertificateOptions{
+					Profile:    profileName,
+					CommonName: "server",
+					Host:       "server",
+				}).CreateCertificate(d))
+
+				rawCrt := rawCertificate(t, d, "server")
+				assert.Equal(t, []string{"Example"}, rawCrt.Subject.Organization)
+				assert.Equal(t, []string{"Platform"}, rawCrt.Subject.OrganizationalUnit)
+				assert.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, rawCrt.ExtKeyUsage)
+				assert.Equal(t, x509.ECDSA, rawCrt.PublicKeyAlgorithm)
+				assert.WithinDuration(t, time.Now().Add(2*time.Hour), rawCrt.NotAfter, time.Minute)
+
+				parent, err := GetParent(d, "server")
+				require.NoError(t, err)
+				assert.Equal(t, caName, parent)
+			},
+			"CreateCertificateFailsWithNonexistentProfile": func(t *testing.T, d Depot) {
+				assert.Error(t, (&CertificateOptions{
+					Profile:    "nonexistent",
+					CommonName: "server",
+					Host:       "server",
+				}).CreateCertificate(d))
+				assert.False(t, d.Check(CsrTag("server")))
+			},
+			"InitUsesProfile": func(t *testing.T, d Depot) {
+				require.NoError(t, (&CertificateOptions{
+					Profile:    profileName,
+					CommonName: "other",
+				}).Init(d))
+
+				rawCrt := rawCertificate(t, d, "other")
+				assert.True(t, rawCrt.IsCA)
+				assert.Equal(t, []string{"Example"}, rawCrt.Subject.Organization)
+			},
+			"RemovingProfile": func(t *testing.T, d Depot) {
+				require.NoError(t, PutProfile(d, profileName, nil))
+				stored, err := GetProfile(d, profileName)
+				require.NoError(t, err)
+				assert.Nil(t, stored)
+			},
+			"ListProfiles": func(t *testing.T, d Depot) {
+				require.NoError(t, PutProfile(d, "client device", &Profile{CA: caName}))
+
+				profiles, err := d.(ProfileManager).ListProfiles()
+				require.NoError(t, err)
+				require.Len(t, profiles, 2)
+				assert.Equal(t, profile, profiles[profileName])
+				assert.Equal(t, &Profile{CA: caName}, profiles["client_device"])
+			},
+			"PutProfileFailsWithInvalidProfile": func(t *testing.T, d Depot) {
+				assert.Error(t, PutProfile(d, "invalid", &Profile{Expires: -time.Hour}))
+				assert.Error(t, PutProfile(d, "", profile))
+				assert.Error(t, PutProfile(d, "../invalid", profile))
+			},
+		} {
+			t.Run(testName, func(t *testing.T) {
+				tempDir, err := ioutil.TempDir(".", "profile-test")
+				require.NoError(t, err)
+				defer func() {
+					assert.NoError(t, os.RemoveAll(tempDir))
+				}()
+
+				for depotName, makeDepot := range map[string]func(t *testing.T) Depot{
+					"Memory": func(t *testing.T) Depot {
+						return NewMemoryDepot(DepotOptions{})
+					},
+					"File": func(t *testing.T) Depot {
+						d, err := NewFileDepot(filepath.Join(tempDir, "file"))
+						require.NoError(t, err)
+						return d
+					},
+					"Bolt": func(t *testing.T) Depot {
+						d, err := NewBoltDBCertDepot(&BoltDBOptions{Path: filepath.Join(tempDir, "bolt.db")})
+						require.NoError(t, err)
+						return d
+					},
+					"SQL": func(t *testing.T) Depot {
+						d, err := NewSQLCertDepot(context.Background(), &SQLDepotOptions{DriverName: "sqlite", DataSourceName: filepath.Join(tempDir, "sql.db")})
+						require.NoError(t, err)
+						return d
+					},
+				} {
+					t.Run(depotName, func(t *testing.T) {
+						d := makeDepot(t)
+						require.NoError(t, (&CertificateOptions{CommonName: caName, Expires: 24 * time.Hour}).Init(d))
+						require.NoError(t, PutProfile(d, profileName, profile))
+
+						testCase(t, d)
+					})
+				}
+			})
+		}
+	})
+	t.Run("GenerateUsesDefaultProfile", func(t *testing.T) {
+		d := NewMemoryDepot(DepotOptions{Profile: profileName})
+		require.NoError(t, (&CertificateOptions{CommonName: caName, Expires: 24 * time.Hour}).Init(d))
+		require.NoError(t, PutProfile(d, profileName, profile))
+
+		creds, err := d.Generate("server")
+		require.NoError(t, err)
+		rawCrt, err := parseCertificatePEM(creds.Cert)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Example"}, rawCrt.Subject.Organization)
+		assert.Equal(t, x509.ECDSA, rawCrt.PublicKeyAlgorithm)
+		assert.WithinDuration(t, time.Now().Add(2*time.Hour), rawCrt.NotAfter, time.Minute)
+	})
+	t.Run("GenerateOptionsOverrideDefaultProfile", func(t *testing.T) {
+		d := NewMemoryDepot(DepotOptions{Profile: profileName, DefaultExpiration: time.Hour, KeyType: RSAKey})
+		require.NoError(t, (&CertificateOptions{CommonName: caName, Expires: 24 * time.Hour}).Init(d))
+		require.NoError(t, PutProfile(d, profileName, profile))
+
+		creds, err := d.Generate("server")
+		require.NoError(t, err)
+		rawCrt, err := parseCertificatePEM(creds.Cert)
+		require.NoError(t, err)
+		assert.Equal(t, x509.RSA, rawCrt.PublicKeyAlgorithm)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), rawCrt.NotAfter, time.Minute)
+	})
+	t.Run("GenerateFailsWithNonexistentDefaultProfile", func(t *testing.T) {
+		d := NewMemoryDepot(DepotOptions{CA: caName, Profile: "nonexistent"})
+		require.NoError(t, (&CertificateOptions{CommonName: caName, Expires: 24 * time.Hour}).Init(d))
+
+		_, err := d.Generate("server")
+		assert.Error(t, err)
+	})
+	t.Run("NewProfilesFromFile", func(t *testing.T) {
+		tempDir, err := ioutil.TempDir(".", "profile-test")
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, os.RemoveAll(tempDir))
+		}()
+
+		for testName, testCase := range map[string]struct {
+			contents string
+			expected map[string]*Profile
+			valid    bool
+		}{
+			"YAML": {
+				contents: `
+server-short-lived:
+  ca: ca
+  key_type: ecdsa-p256
+  o: Example
+  expires: 2h
+  ext_key_usage: [serverAuth]
+client-device:
+  key_bits: 4096
+`,
+				expected: map[string]*Profile{
+					profileName: {
+						CA:           caName,
+						KeyType:      ECDSAP256Key,
+						Organization: "Example",
+						Expires:      2 * time.Hour,
+						ExtKeyUsage:  []ExtKeyUsage{ExtKeyUsageServerAuth},
+					},
+					"client-device": {KeyBits: 4096},
+				},
+				valid: true,
+			},
+			"JSON": {
+				contents: `{"server-short-lived": {"ca": "ca", "o": "Example", "expires": "2h"}, "empty": null}`,
+				expected: map[string]*Profile{
+					profileName: {CA: caName, Organization: "Example", Expires: 2 * time.Hour},
+					"empty":     {},
+				},
+				valid: true,
+			},
+			"InvalidProfile": {contents: `server: {key_type: dsa}`},
+			"InvalidSyntax":  {contents: `server: [`},
+		} {
+			t.Run(testName, func(t *testing.T) {
+				path := filepath.Join(tempDir, testName)
+				require.NoError(t, ioutil.WriteFile(path, []byte(testCase.contents), 0600))
+
+				profiles, err := NewProfilesFromFile(path)
+				if !testCase.valid {
+					assert.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+				assert.Equal(t, testCase.expected, profiles)
+
+				d := NewMemoryDepot(DepotOptions{})
+				require.NoError(t, PutProfiles(d, profiles))
+				for name, expected := range testCase.expected {
+					actual, err := GetProfile(d, name)
+					require.NoError(t, err)
+					assert.Equal(t, expected, actual)
+				}
+			})
+		}
+
+		_, err = NewProfilesFromFile(filepath.Join(tempDir, "nonexistent"))
+		assert.Error(t, err)
+	})
+	t.Run("UnsupportedDepot", func(t *testing.T) {
+		d := struct{ Depot }{NewMemoryDepot(DepotOptions{})}
+		assert.Error(t, PutProfile(d, profileName, profile))
+		assert.Error(t, (&CertificateOptions{Profile: profileName}).ApplyProfile(d))
+	})
+}
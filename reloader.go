@@ -0,0 +1,218 @@
+package certdepot
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/cdr/grip"
+	"github.com/cdr/grip/message"
+	"github.com/pkg/errors"
+)
+
+// Reloader provides TLS configuration callbacks that always use the latest
+// credentials for a name in a depot, so that rotated certificates take effect
+// without restarting the process. The credentials are re-read from the depot
+// when Reload is called or periodically after Start is called; the parsed
+// certificate and CA pool are cached between reloads.
+type Reloader struct {
+	depot Depot
+	name  string
+
+	mu     sync.RWMutex
+	creds  *Credentials
+	cert   *tls.Certificate
+	caPool *x509.CertPool
+}
+
+// NewReloader returns a Reloader for the credentials with the given name in
+// the depot. The credentials are loaded immediately, so this errors if they
+// cannot be found.
+func NewReloader(d Depot, name string) (*Reloader, error) {
+	if d == nil {
+		return nil, errors.New("must specify a non-nil depot")
+	}
+	if name == "" {
+		return nil, errors.New("must specify a name")
+	}
+
+	r := &Reloader{
+		depot: d,
+		name:  name,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, errors.Wrap(err, "problem loading credentials")
+	}
+
+	return r, nil
+}
+
+// Reload re-reads the credentials from the depot. The cached certificate and
+// CA pool are only replaced if the credentials have changed. If the new
+// credentials are invalid, the previous ones remain in use.
+func (r *Reloader) Reload() error {
+	creds, err := r.depot.Find(r.name)
+	if err != nil {
+		return errors.Wrapf(err, "problem finding credentials for %s", r.name)
+	}
+
+	r.mu.RLock()
+	unchanged := r.creds != nil &&
+		bytes.Equal(r.creds.CACert, creds.CACert) &&
+		bytes.Equal(r.creds.Cert, creds.Cert) &&
+		bytes.Equal(r.creds.Chain, creds.Chain) &&
+		bytes.Equal(r.creds.Key, creds.Key)
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := creds.keyPair()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(creds.CACert) {
+		return errors.New("failed to append CA certificate")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.creds = creds
+	r.cert = &cert
+	r.caPool = caPool
+
+	return nil
+}
+
+// Start reloads the credentials at the given interval in a background
+// goroutine until the context is canceled. Errors during reloading are logged
+// and the previous credentials remain in use.
+func (r *Reloader) Start(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				grip.Warning(message.WrapError(r.Reload(), message.Fields{
+					"message": "problem reloading credentials",
+					"name":    r.name,
+				}))
+			}
+		}
+	}()
+}
+
+func (r *Reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, r.caPool
+}
+
+// GetCertificate returns the current certificate. It can be used as
+// tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, _ := r.current()
+	return cert, nil
+}
+
+// GetClientCertificate returns the current certificate. It can be used as
+// tls.Config.GetClientCertificate.
+func (r *Reloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert, _ := r.current()
+	return cert, nil
+}
+
+// VerifyPeerCertificate verifies that the peer's certificate chain is signed
+// by the current CA. It does not verify the peer's host name. It can be used as
+// tls.Config.VerifyPeerCertificate.
+func (r *Reloader) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return r.verifyPeer(rawCerts, "")
+}
+
+func (r *Reloader) verifyPeer(rawCerts [][]byte, serverName string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("peer did not provide a certificate")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return errors.Wrap(err, "problem parsing peer certificate")
+		}
+		certs = append(certs, cert)
+	}
+
+	_, caPool := r.current()
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         caPool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return errors.Wrap(err, "problem verifying peer certificate")
+}
+
+// GetConfigForClient returns a server configuration that uses the current
+// certificate and requires client certificates signed by the current CA. It
+// can be used as tls.Config.GetConfigForClient.
+func (r *Reloader) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	cert, caPool := r.current()
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    caPool,
+	}, nil
+}
+
+// ServerConfig returns a server configuration that picks up reloaded
+// credentials for every new connection.
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: r.GetConfigForClient,
+	}
+}
+
+// ClientConfig returns a client configuration that presents the current
+// certificate and verifies the server's certificate and host name against the
+// current CA for every new connection. The host name is the given server name
+// or, if it is empty, the name that the client dials, such as with tls.Dial.
+// Connections without a server name fail.
+func (r *Reloader) ClientConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName:           serverName,
+		GetClientCertificate: r.GetClientCertificate,
+		// The standard verification is replaced by VerifyConnection so that
+		// the reloaded CA pool is used.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if cs.ServerName == "" {
+				return errors.New("server name must be set to verify the server certificate")
+			}
+			rawCerts := make([][]byte, 0, len(cs.PeerCertificates))
+			for _, cert := range cs.PeerCertificates {
+				rawCerts = append(rawCerts, cert.Raw)
+			}
+			return r.verifyPeer(rawCerts, cs.ServerName)
+		},
+	}
+}
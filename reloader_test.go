@@ -0,0 +1,190 @@
+package certdepot
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloader(t *testing.T) {
+	const (
+		caName      = "ca"
+		serviceName = "server"
+	)
+
+	bootstrap := func(t *testing.T) *memoryDepot {
+		d, err := BootstrapDepot(context.Background(), BootstrapDepotConfig{
+			MemoryDepot: true,
+			CAName:      caName,
+			ServiceName: serviceName,
+			CAOpts: &CertificateOptions{
+				CommonName: caName,
+				Expires:    24 * time.Hour,
+			},
+			ServiceOpts: &CertificateOptions{
+				CA:         caName,
+				CommonName: serviceName,
+				Host:       serviceName,
+				Domain:     []string{serviceName},
+				Expires:    24 * time.Hour,
+			},
+		})
+		require.NoError(t, err)
+		md := d.(*memoryDepot)
+		md.opts = DepotOptions{CA: caName, DefaultExpiration: time.Hour}
+
+		return md
+	}
+	rotate := func(t *testing.T, d Depot, name string) {
+		opts := &CertificateOptions{
+			CA:         caName,
+			CommonName: name,
+			Host:       name,
+			Domain:     []string{name},
+			Expires:    time.Hour,
+		}
+		_, key, err := opts.CertRequestInMemory()
+		require.NoError(t, err)
+		crt, err := opts.SignInMemory(d)
+		require.NoError(t, err)
+
+		pemKey, err := exportPrivateKey(key)
+		require.NoError(t, err)
+		pemCrt, err := crt.Export()
+		require.NoError(t, err)
+		pemCACrt, err := d.Get(CrtTag(caName))
+		require.NoError(t, err)
+		creds, err := NewCredentials(pemCACrt, pemCrt, pemKey)
+		require.NoError(t, err)
+		require.NoError(t, d.Save(name, creds))
+	}
+	leaf := func(t *testing.T, r *Reloader) []byte {
+		cert, err := r.GetCertificate(nil)
+		require.NoError(t, err)
+		require.NotEmpty(t, cert.Certificate)
+		return cert.Certificate[0]
+	}
+	handshake := func(serverConf, clientConf *tls.Config) (error, error) {
+		serverConn, clientConn := net.Pipe()
+		defer serverConn.Close()
+		defer clientConn.Close()
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- tls.Server(serverConn, serverConf).Handshake()
+		}()
+		clientErr := tls.Client(clientConn, clientConf).Handshake()
+		if clientErr != nil {
+			clientConn.Close()
+		}
+		return <-errs, clientErr
+	}
+
+	for testName, testCase := range map[string]func(t *testing.T, md *memoryDepot){
+		"ConstructorFailsForNonexistentCredentials": func(t *testing.T, md *memoryDepot) {
+			_, err := NewReloader(md, "nonexistent")
+			assert.Error(t, err)
+			_, err = NewReloader(nil, serviceName)
+			assert.Error(t, err)
+			_, err = NewReloader(md, "")
+			assert.Error(t, err)
+		},
+		"ReloadPicksUpRotatedCertificate": func(t *testing.T, md *memoryDepot) {
+			r, err := NewReloader(md, serviceName)
+			require.NoError(t, err)
+			before := leaf(t, r)
+
+			require.NoError(t, r.Reload())
+			assert.Equal(t, before, leaf(t, r))
+
+			rotate(t, md, serviceName)
+			assert.Equal(t, before, leaf(t, r))
+			require.NoError(t, r.Reload())
+			assert.NotEqual(t, before, leaf(t, r))
+		},
+		"ReloadKeepsPreviousCredentialsOnError": func(t *testing.T, md *memoryDepot) {
+			r, err := NewReloader(md, serviceName)
+			require.NoError(t, err)
+			before := leaf(t, r)
+
+			require.NoError(t, md.Delete(PrivKeyTag(serviceName)))
+			assert.Error(t, r.Reload())
+			assert.Equal(t, before, leaf(t, r))
+		},
+		"StartPollsForChanges": func(t *testing.T, md *memoryDepot) {
+			r, err := NewReloader(md, serviceName)
+			require.NoError(t, err)
+			before := leaf(t, r)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			r.Start(ctx, 10*time.Millisecond)
+
+			rotate(t, md, serviceName)
+			assert.Eventually(t, func() bool {
+				return !bytes.Equal(before, leaf(t, r))
+			}, 5*time.Second, 10*time.Millisecond)
+		},
+		"HandshakeSucceedsAcrossRotation": func(t *testing.T, md *memoryDepot) {
+			rotate(t, md, "client")
+			server, err := NewReloader(md, serviceName)
+			require.NoError(t, err)
+			client, err := NewReloader(md, "client")
+			require.NoError(t, err)
+
+			serverErr, clientErr := handshake(server.ServerConfig(), client.ClientConfig(serviceName))
+			require.NoError(t, serverErr)
+			require.NoError(t, clientErr)
+
+			rotate(t, md, serviceName)
+			rotate(t, md, "client")
+			require.NoError(t, server.Reload())
+			require.NoError(t, client.Reload())
+
+			serverErr, clientErr = handshake(server.ServerConfig(), client.ClientConfig(serviceName))
+			assert.NoError(t, serverErr)
+			assert.NoError(t, clientErr)
+		},
+		"HandshakeFailsForWrongServerName": func(t *testing.T, md *memoryDepot) {
+			rotate(t, md, "client")
+			server, err := NewReloader(md, serviceName)
+			require.NoError(t, err)
+			client, err := NewReloader(md, "client")
+			require.NoError(t, err)
+
+			_, clientErr := handshake(server.ServerConfig(), client.ClientConfig("other"))
+			assert.Error(t, clientErr)
+		},
+		"HandshakeFailsWithoutServerName": func(t *testing.T, md *memoryDepot) {
+			rotate(t, md, "client")
+			server, err := NewReloader(md, serviceName)
+			require.NoError(t, err)
+			client, err := NewReloader(md, "client")
+			require.NoError(t, err)
+
+			_, clientErr := handshake(server.ServerConfig(), client.ClientConfig(""))
+			assert.Error(t, clientErr)
+		},
+		"VerifyPeerCertificateRejectsUntrustedCertificate": func(t *testing.T, md *memoryDepot) {
+			r, err := NewReloader(md, serviceName)
+			require.NoError(t, err)
+			assert.NoError(t, r.VerifyPeerCertificate([][]byte{leaf(t, r)}, nil))
+			assert.Error(t, r.VerifyPeerCertificate(nil, nil))
+
+			other := bootstrap(t)
+			otherReloader, err := NewReloader(other, serviceName)
+			require.NoError(t, err)
+			assert.Error(t, r.VerifyPeerCertificate([][]byte{leaf(t, otherReloader)}, nil))
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			testCase(t, bootstrap(t))
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package certdepot
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cdr/grip"
+	"github.com/cdr/grip/message"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+	"github.com/square/certstrap/pkix"
+)
+
+// RemoteDepotOptions contains options for NewRemoteDepot.
+type RemoteDepotOptions struct {
+	// URL of the depot service, such as "https://ca.example.com".
+	URL string `bson:"url" json:"url" yaml:"url"`
+	// Credentials to authenticate with the depot service. The CA
+	// certificate is used to verify the service.
+	Credentials *Credentials `bson:"credentials" json:"credentials" yaml:"credentials"`
+	// Timeout for each request to the depot service (defaults to 30
+	// seconds).
+	Timeout time.Duration `bson:"timeout,omitempty" json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+// IsZero returns whether the given RemoteDepotOptions struct holds the "zero"
+// value of the struct.
+func (opts *RemoteDepotOptions) IsZero() bool {
+	return opts.URL == ""
+}
+
+func (opts *RemoteDepotOptions) validate() error {
+	if opts.Credentials == nil {
+		return errors.New("must specify credentials")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+
+	return nil
+}
+
+type remoteDepot struct {
+	url    string
+	client *http.Client
+}
+
+// NewRemoteDepot returns a depot that is backed by a depot service, such as
+// the one in the server package, over HTTPS. Certificate requests are signed
+// by the service, so the CA key is never retrieved from the service.
+func NewRemoteDepot(opts *RemoteDepotOptions) (Depot, error) {
+	if opts.URL == "" {
+		return nil, errors.New("must specify the URL of the depot service")
+	}
+	if err := opts.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+
+	conf, err := opts.Credentials.ResolveClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "problem resolving credentials")
+	}
+
+	return &remoteDepot{
+		url: strings.TrimSuffix(opts.URL, "/"),
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: conf},
+			Timeout:   opts.Timeout,
+		},
+	}, nil
+}
+
+func (r *remoteDepot) Put(tag *depot.Tag, data []byte) error {
+	path, err := entryPath(tag)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	resp, err := r.do(http.MethodPut, path, bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "problem putting entry")
+	}
+
+	return errors.WithStack(closeResponse(resp))
+}
+
+func (r *remoteDepot) Check(tag *depot.Tag) bool {
+	path, err := entryPath(tag)
+	if err != nil {
+		return false
+	}
+
+	resp, err := r.do(http.MethodHead, path, nil)
+	if err != nil {
+		grip.Warning(message.WrapError(err, "problem checking entry"))
+		return false
+	}
+	grip.Warning(message.WrapError(resp.Body.Close(), "problem closing response body"))
+
+	return resp.StatusCode == http.StatusOK
+}
+
+func (r *remoteDepot) Get(tag *depot.Tag) ([]byte, error) {
+	path, err := entryPath(tag)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	resp, err := r.do(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem getting entry")
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem reading entry")
+	}
+
+	return data, nil
+}
+
+func (r *remoteDepot) Delete(tag *depot.Tag) error {
+	path, err := entryPath(tag)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	resp, err := r.do(http.MethodDelete, path, nil)
+	if err != nil {
+		return errors.Wrap(err, "problem deleting entry")
+	}
+
+	return errors.WithStack(closeResponse(resp))
+}
+
+func (r *remoteDepot) Save(name string, creds *Credentials) error {
+	body, err := json.Marshal(creds)
+	if err != nil {
+		return errors.Wrap(err, "problem encoding credentials")
+	}
+
+	resp, err := r.do(http.MethodPut, ServiceCredentialsPath+url.PathEscape(name), bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "problem saving credentials for %s", name)
+	}
+
+	return errors.WithStack(closeResponse(resp))
+}
+
+func (r *remoteDepot) Find(name string) (*Credentials, error) {
+	creds := &Credentials{}
+	if err := r.doJSON(http.MethodGet, ServiceCredentialsPath+url.PathEscape(name), nil, creds); err != nil {
+		return nil, errors.Wrapf(err, "problem finding credentials for %s", name)
+	}
+
+	return creds, nil
+}
+
+func (r *remoteDepot) Generate(name string) (*Credentials, error) {
+	creds := &Credentials{}
+	if err := r.doJSON(http.MethodPost, ServiceCredentialsPath+url.PathEscape(name), nil, creds); err != nil {
+		return nil, errors.Wrapf(err, "problem generating credentials for %s", name)
+	}
+
+	return creds, nil
+}
+
+func (r *remoteDepot) SignCertificateRequest(ca string, csr *pkix.CertificateSigningRequest, expires time.Duration) (*pkix.Certificate, error) {
+	pemCSR, err := csr.Export()
+	if err != nil {
+		return nil, errors.Wrap(err, "problem exporting certificate request")
+	}
+
+	out := SignResponse{}
+	if err = r.doJSON(http.MethodPost, ServiceSignPath, SignRequest{CSR: pemCSR, CA: ca, Expires: expires}, &out); err != nil {
+		return nil, errors.Wrap(err, "problem signing certificate request")
+	}
+
+	crt, err := pkix.NewCertificateFromPEM(out.Cert)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem parsing signed certificate")
+	}
+
+	return crt, nil
+}
+
+// doJSON sends the request body, if any, as JSON and decodes the JSON
+// response into out.
+func (r *remoteDepot) doJSON(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return errors.Wrap(err, "problem encoding request")
+		}
+		body = bytes.NewReader(data)
+	}
+
+	resp, err := r.do(method, path, body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(out), "problem decoding response")
+}
+
+// do sends the request and returns the response if it succeeded. HEAD
+// requests succeed regardless of the response status.
+func (r *remoteDepot) do(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, r.url+path, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem creating request")
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem sending request")
+	}
+	if method == http.MethodHead || resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	errResp := ErrorResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == "" {
+		return nil, errors.Errorf("depot service responded with status %d", resp.StatusCode)
+	}
+
+	return nil, errors.Errorf("depot service responded with status %d: %s", resp.StatusCode, errResp.Error)
+}
+
+func closeResponse(resp *http.Response) error {
+	return errors.Wrap(resp.Body.Close(), "problem closing response body")
+}
+
+// entryPath returns the path of the service endpoint for the depot entry.
+func entryPath(tag *depot.Tag) (string, error) {
+	kind, name, err := GetKindAndNameFromTag(tag)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return ServiceEntriesPath + string(kind) + "/" + url.PathEscape(name), nil
+}
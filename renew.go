@@ -0,0 +1,311 @@
+package certdepot
+
+import (
+	"crypto"
+	"strings"
+	"time"
+
+	"github.com/cdr/grip"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+	"github.com/square/certstrap/pkix"
+)
+
+// archiveSuffix is appended to a name to form its ArchiveName.
+const archiveSuffix = ".previous"
+
+// ArchiveName returns the name under which Renew preserves the previous
+// version of the credentials with the given name.
+func ArchiveName(name string) string {
+	return name + archiveSuffix
+}
+
+// isArchiveName returns whether the name is the ArchiveName of another name.
+func isArchiveName(name string) bool {
+	return strings.HasSuffix(name, archiveSuffix)
+}
+
+// Renew creates a new certificate for the options and replaces the existing
+// certificate, key and certificate request in the depot with it. The new
+// certificate is created in memory and validated against the CA before the
+// depot is modified, so a failure to sign leaves the existing certificate in
+// place. The previous version is preserved under ArchiveName and can be
+// restored with Rollback; if storing the new certificate fails, the previous
+// version is restored automatically. In depots that are ExpirationManagers,
+// the archive expires with the previous certificate, so DeleteExpiresBefore
+// removes it once it can no longer be restored.
+func (opts *CertificateOptions) Renew(wd depot.Depot) error {
+	opts.Reset()
+
+	if _, _, err := opts.CertRequestInMemory(); err != nil {
+		return errors.Wrap(err, "problem creating certificate request")
+	}
+	if _, err := opts.SignInMemory(wd); err != nil {
+		return errors.Wrap(err, "problem signing certificate")
+	}
+	if err := opts.validateSignedInMemory(wd); err != nil {
+		return errors.Wrap(err, "problem validating renewed certificate")
+	}
+
+	tags, err := opts.renewalTags()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	crtName := strings.Replace(opts.Host, " ", "_", -1)
+	existed := depot.CheckCertificate(wd, crtName)
+	if err = archiveTags(wd, tags); err != nil {
+		return errors.Wrap(err, "problem archiving previous certificate")
+	}
+	if existed {
+		if err = putArchiveTTL(wd, crtName); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if err = opts.putRenewed(wd, tags); err != nil {
+		catcher := grip.NewBasicCatcher()
+		catcher.Add(err)
+		if existed {
+			catcher.Wrap(opts.Rollback(wd), "problem restoring previous certificate")
+		} else {
+			for current := range tags {
+				catcher.Wrap(deleteIfExists(wd, current), "problem cleaning up renewed certificate")
+			}
+		}
+		return catcher.Resolve()
+	}
+
+	return nil
+}
+
+// ReplaceCertificate stores the certificate signed in memory from the
+// certificate request, such as with SignCertificateRequestInMemory, as the
+// certificate for the host, along with the certificate request. Any existing
+// certificate, certificate request and private key for the host are archived
+// under ArchiveName before they are removed, as with Renew, and restored if
+// storing the new certificate fails. Since the depot does not hold the key of
+// a certificate signed from a certificate request, the previous private key
+// is removed rather than replaced.
+func (opts *CertificateOptions) ReplaceCertificate(wd depot.Depot, csr *pkix.CertificateSigningRequest) error {
+	if !opts.signedInMemory() {
+		return errors.New("must sign cert first before putting into depot")
+	}
+	if csr == nil {
+		return errors.New("must provide a certificate request")
+	}
+	if opts.Host == "" {
+		return errors.New("must provide name of host")
+	}
+
+	crtName := strings.Replace(opts.Host, " ", "_", -1)
+	tags := map[*depot.Tag]*depot.Tag{
+		CrtTag(crtName):     CrtTag(ArchiveName(crtName)),
+		CsrTag(crtName):     CsrTag(ArchiveName(crtName)),
+		PrivKeyTag(crtName): PrivKeyTag(ArchiveName(crtName)),
+	}
+	existed := depot.CheckCertificate(wd, crtName)
+	if existed {
+		if err := archiveTags(wd, tags); err != nil {
+			return errors.Wrap(err, "problem archiving previous certificate")
+		}
+		if err := putArchiveTTL(wd, crtName); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	err := func() error {
+		for current := range tags {
+			if err := deleteIfExists(wd, current); err != nil {
+				return errors.Wrap(err, "problem deleting previous version")
+			}
+		}
+		if err := depot.PutCertificateSigningRequest(wd, crtName, csr); err != nil {
+			return errors.Wrap(err, "problem saving certificate request")
+		}
+		return errors.Wrap(opts.PutCertFromMemory(wd), "problem saving certificate")
+	}()
+	if err != nil {
+		catcher := grip.NewBasicCatcher()
+		catcher.Add(err)
+		if existed {
+			catcher.Wrap(restoreTags(wd, tags), "problem restoring previous certificate")
+			if _, ok := wd.(ExpirationManager); ok {
+				rawCrt, err := getRawCertificate(wd, crtName)
+				catcher.Wrap(err, "problem getting restored certificate")
+				if err == nil {
+					catcher.Wrap(putTTL(wd, crtName, rawCrt.NotAfter), "problem saving certificate TTL")
+				}
+			}
+		} else {
+			for current := range tags {
+				catcher.Wrap(deleteIfExists(wd, current), "problem cleaning up certificate")
+			}
+		}
+		return catcher.Resolve()
+	}
+
+	return nil
+}
+
+// Rollback restores the version of the certificate, key and certificate
+// request that was archived by the last call to Renew, replacing the current
+// version in the depot. The archived version is removed once it is restored.
+func (opts *CertificateOptions) Rollback(wd depot.Depot) error {
+	tags, err := opts.renewalTags()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	crtName := strings.Replace(opts.Host, " ", "_", -1)
+	if !depot.CheckCertificate(wd, ArchiveName(crtName)) {
+		return errors.Errorf("no archived certificate for %s", crtName)
+	}
+
+	if err = restoreTags(wd, tags); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, ok := wd.(ExpirationManager); ok {
+		rawCrt, err := getRawCertificate(wd, crtName)
+		if err != nil {
+			return errors.Wrap(err, "problem getting restored certificate")
+		}
+		if err = putTTL(wd, crtName, rawCrt.NotAfter); err != nil {
+			return errors.Wrap(err, "problem saving certificate TTL")
+		}
+	}
+	if err = putParent(wd, crtName, opts.CA); err != nil {
+		return errors.Wrap(err, "problem saving certificate issuer")
+	}
+
+	return nil
+}
+
+// renewalTags returns the tags of the certificate, key and certificate
+// request for the options, mapped to the tags of their archived versions.
+func (opts *CertificateOptions) renewalTags() (map[*depot.Tag]*depot.Tag, error) {
+	if opts.Host == "" {
+		return nil, errors.New("must provide name of host")
+	}
+	reqName, err := opts.getFormattedCertificateRequestName()
+	if err != nil {
+		return nil, errors.Wrap(err, "problem getting formatted name")
+	}
+	crtName := strings.Replace(opts.Host, " ", "_", -1)
+
+	return map[*depot.Tag]*depot.Tag{
+		CrtTag(crtName):     CrtTag(ArchiveName(crtName)),
+		CsrTag(reqName):     CsrTag(ArchiveName(reqName)),
+		PrivKeyTag(reqName): PrivKeyTag(ArchiveName(reqName)),
+	}, nil
+}
+
+// validateSignedInMemory checks that the certificate signed in memory was
+// issued by the CA, is currently valid and matches the key.
+func (opts *CertificateOptions) validateSignedInMemory(wd depot.Depot) error {
+	rawCACrt, err := getRawCertificate(wd, strings.Replace(opts.CA, " ", "_", -1))
+	if err != nil {
+		return errors.Wrap(err, "problem getting CA certificate")
+	}
+	rawCrt, err := opts.crt.GetRawCertificate()
+	if err != nil {
+		return errors.Wrap(err, "problem getting raw certificate")
+	}
+
+	if err = rawCrt.CheckSignatureFrom(rawCACrt); err != nil {
+		return errors.Wrapf(err, "certificate was not signed by %s", opts.CA)
+	}
+	now := time.Now()
+	if now.Before(rawCrt.NotBefore) || now.After(rawCrt.NotAfter) {
+		return errors.New("certificate is not currently valid")
+	}
+	pub, ok := rawCrt.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(opts.key.Public) {
+		return errors.New("certificate does not match private key")
+	}
+
+	return nil
+}
+
+// putRenewed replaces the current certificate, key and certificate request
+// with the ones created in memory.
+func (opts *CertificateOptions) putRenewed(wd depot.Depot, tags map[*depot.Tag]*depot.Tag) error {
+	for current := range tags {
+		if err := deleteIfExists(wd, current); err != nil {
+			return errors.Wrap(err, "problem deleting previous version")
+		}
+	}
+
+	if err := opts.PutCertRequestFromMemory(wd); err != nil {
+		return errors.Wrap(err, "problem saving certificate request")
+	}
+	if err := opts.PutCertFromMemory(wd); err != nil {
+		return errors.Wrap(err, "problem saving certificate")
+	}
+
+	return nil
+}
+
+// archiveTags copies the current version of each tag to its archive tag,
+// replacing any previously archived version.
+func archiveTags(wd depot.Depot, tags map[*depot.Tag]*depot.Tag) error {
+	for current, archive := range tags {
+		if err := deleteIfExists(wd, archive); err != nil {
+			return errors.Wrap(err, "problem deleting archived version")
+		}
+		if !wd.Check(current) {
+			continue
+		}
+		if err := copyTag(wd, current, archive); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// restoreTags replaces the current version of each tag with its archived
+// version, removing the current version if there is no archived version, and
+// then removes the archived versions.
+func restoreTags(wd depot.Depot, tags map[*depot.Tag]*depot.Tag) error {
+	for current, archive := range tags {
+		if !wd.Check(archive) {
+			if err := deleteIfExists(wd, current); err != nil {
+				return errors.Wrap(err, "problem deleting current version")
+			}
+			continue
+		}
+		if err := copyTag(wd, archive, current); err != nil {
+			return errors.Wrap(err, "problem restoring archived version")
+		}
+		if err := wd.Delete(archive); err != nil {
+			return errors.Wrap(err, "problem deleting archived version")
+		}
+	}
+
+	return nil
+}
+
+// putArchiveTTL sets the TTL of the archived certificate with the given name
+// to its expiration in depots that are ExpirationManagers.
+func putArchiveTTL(wd depot.Depot, name string) error {
+	if _, ok := wd.(ExpirationManager); !ok {
+		return nil
+	}
+	rawCrt, err := getRawCertificate(wd, ArchiveName(name))
+	if err != nil {
+		return errors.Wrap(err, "problem getting archived certificate")
+	}
+	return errors.Wrap(putTTL(wd, ArchiveName(name), rawCrt.NotAfter), "problem saving archived certificate TTL")
+}
+
+func copyTag(wd depot.Depot, from, to *depot.Tag) error {
+	data, err := wd.Get(from)
+	if err != nil {
+		return errors.Wrap(err, "problem getting data to copy")
+	}
+	if err = deleteIfExists(wd, to); err != nil {
+		return errors.Wrap(err, "problem deleting existing data")
+	}
+	return errors.Wrap(wd.Put(to, data), "problem putting copied data")
+}
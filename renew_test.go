@@ -0,0 +1,224 @@
+package certdepot
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenew(t *testing.T) {
+	const (
+		caName     = "ca"
+		passphrase = "passphrase"
+		name       = "server"
+	)
+
+	certOpts := func() *CertificateOptions {
+		return &CertificateOptions{
+			CA:           caName,
+			CAPassphrase: passphrase,
+			CommonName:   name,
+			Host:         name,
+			Expires:      time.Hour,
+		}
+	}
+	getVersion := func(t *testing.T, d Depot, name string) map[string][]byte {
+		version := map[string][]byte{}
+		for kind, data := range map[string]func() ([]byte, error){
+			"crt": func() ([]byte, error) { return d.Get(CrtTag(name)) },
+			"key": func() ([]byte, error) { return d.Get(PrivKeyTag(name)) },
+			"csr": func() ([]byte, error) { return d.Get(CsrTag(name)) },
+		} {
+			out, err := data()
+			require.NoError(t, err)
+			version[kind] = out
+		}
+		return version
+	}
+	hasArchive := func(d Depot) bool {
+		return d.Check(CrtTag(ArchiveName(name))) ||
+			d.Check(PrivKeyTag(ArchiveName(name))) ||
+			d.Check(CsrTag(ArchiveName(name)))
+	}
+
+	for testName, testCase := range map[string]func(t *testing.T, d Depot){
+		"CreatesMissingCertificate": func(t *testing.T, d Depot) {
+			require.NoError(t, certOpts().Renew(d))
+			assert.True(t, CheckCertificate(d, name))
+			assert.True(t, d.Check(PrivKeyTag(name)))
+			assert.True(t, d.Check(CsrTag(name)))
+			assert.False(t, hasArchive(d))
+		},
+		"ReplacesAndArchivesExistingCertificate": func(t *testing.T, d Depot) {
+			require.NoError(t, certOpts().CreateCertificate(d))
+			before := getVersion(t, d, name)
+
+			require.NoError(t, certOpts().Renew(d))
+			after := getVersion(t, d, name)
+			for kind := range before {
+				assert.NotEqual(t, before[kind], after[kind], kind)
+			}
+			assert.Equal(t, before, getVersion(t, d, ArchiveName(name)))
+
+			rawCACrt, err := getRawCertificate(d, caName)
+			require.NoError(t, err)
+			rawCrt, err := getRawCertificate(d, name)
+			require.NoError(t, err)
+			assert.NoError(t, rawCrt.CheckSignatureFrom(rawCACrt))
+			_, err = GetEncryptedPrivateKey(d, caName, []byte(passphrase))
+			assert.NoError(t, err)
+		},
+		"ReplacesPreviousArchive": func(t *testing.T, d Depot) {
+			require.NoError(t, certOpts().CreateCertificate(d))
+			require.NoError(t, certOpts().Renew(d))
+			second := getVersion(t, d, name)
+
+			require.NoError(t, certOpts().Renew(d))
+			assert.Equal(t, second, getVersion(t, d, ArchiveName(name)))
+		},
+		"FailedSigningKeepsExistingCertificate": func(t *testing.T, d Depot) {
+			require.NoError(t, certOpts().CreateCertificate(d))
+			before := getVersion(t, d, name)
+
+			opts := certOpts()
+			opts.CAPassphrase = "wrong"
+			assert.Error(t, opts.Renew(d))
+			assert.Equal(t, before, getVersion(t, d, name))
+			assert.False(t, hasArchive(d))
+
+			opts = certOpts()
+			opts.CA = "nonexistent"
+			assert.Error(t, opts.Renew(d))
+			assert.Equal(t, before, getVersion(t, d, name))
+			assert.False(t, hasArchive(d))
+		},
+		"RollbackRestoresPreviousVersion": func(t *testing.T, d Depot) {
+			require.NoError(t, certOpts().CreateCertificate(d))
+			before := getVersion(t, d, name)
+			require.NoError(t, certOpts().Renew(d))
+
+			require.NoError(t, certOpts().Rollback(d))
+			assert.Equal(t, before, getVersion(t, d, name))
+			assert.False(t, hasArchive(d))
+
+			assert.Error(t, certOpts().Rollback(d))
+			assert.Equal(t, before, getVersion(t, d, name))
+		},
+		"ArchiveExpiresWithPreviousCertificate": func(t *testing.T, d Depot) {
+			require.NoError(t, certOpts().CreateCertificate(d))
+			_, notAfter, err := ValidityBounds(d, name)
+			require.NoError(t, err)
+			opts := certOpts()
+			opts.Expires = 2 * time.Hour
+			require.NoError(t, opts.Renew(d))
+
+			ttl, err := d.(ExpirationManager).GetTTL(ArchiveName(name))
+			require.NoError(t, err)
+			assert.True(t, notAfter.Equal(ttl))
+
+			require.NoError(t, d.(ExpirationManager).DeleteExpiresBefore(notAfter.Add(time.Second)))
+			assert.False(t, hasArchive(d))
+			assert.True(t, CheckCertificate(d, name))
+		},
+		"ArchiveIsNotListed": func(t *testing.T, d Depot) {
+			require.NoError(t, certOpts().CreateCertificate(d))
+			require.NoError(t, certOpts().Renew(d))
+			require.True(t, hasArchive(d))
+
+			for _, kind := range []TagKind{CrtKind, PrivKeyKind, CsrKind} {
+				names, err := ListNames(d, kind)
+				require.NoError(t, err)
+				assert.Contains(t, names, name)
+				assert.NotContains(t, names, ArchiveName(name))
+			}
+		},
+		"ReplaceCertificateArchivesPreviousVersion": func(t *testing.T, d Depot) {
+			require.NoError(t, certOpts().CreateCertificate(d))
+			before := getVersion(t, d, name)
+
+			reqOpts := &CertificateOptions{CommonName: name}
+			csr, _, err := reqOpts.CertRequestInMemory()
+			require.NoError(t, err)
+			opts := certOpts()
+			_, err = opts.SignCertificateRequestInMemory(d, csr)
+			require.NoError(t, err)
+			require.NoError(t, opts.ReplaceCertificate(d, csr))
+
+			crt, err := d.Get(CrtTag(name))
+			require.NoError(t, err)
+			assert.NotEqual(t, before["crt"], crt)
+			assert.False(t, d.Check(PrivKeyTag(name)))
+			assert.Equal(t, before, getVersion(t, d, ArchiveName(name)))
+
+			require.NoError(t, certOpts().Rollback(d))
+			assert.Equal(t, before, getVersion(t, d, name))
+		},
+		"ReplaceCertificateFailsWithoutSigning": func(t *testing.T, d Depot) {
+			require.NoError(t, certOpts().CreateCertificate(d))
+			before := getVersion(t, d, name)
+
+			reqOpts := &CertificateOptions{CommonName: name}
+			csr, _, err := reqOpts.CertRequestInMemory()
+			require.NoError(t, err)
+			assert.Error(t, certOpts().ReplaceCertificate(d, csr))
+			assert.Equal(t, before, getVersion(t, d, name))
+			assert.False(t, hasArchive(d))
+		},
+		"RollbackFailsWithoutArchive": func(t *testing.T, d Depot) {
+			require.NoError(t, certOpts().CreateCertificate(d))
+			before := getVersion(t, d, name)
+
+			assert.Error(t, certOpts().Rollback(d))
+			assert.Equal(t, before, getVersion(t, d, name))
+		},
+		"CreateCertificateOnExpirationKeepsCertificateOnFailure": func(t *testing.T, d Depot) {
+			require.NoError(t, certOpts().CreateCertificate(d))
+			before := getVersion(t, d, name)
+
+			opts := certOpts()
+			opts.CAPassphrase = "wrong"
+			created, err := opts.CreateCertificateOnExpiration(d, 2*time.Hour)
+			assert.Error(t, err)
+			assert.True(t, created)
+			assert.Equal(t, before, getVersion(t, d, name))
+
+			created, err = certOpts().CreateCertificateOnExpiration(d, 2*time.Hour)
+			require.NoError(t, err)
+			assert.True(t, created)
+			assert.Equal(t, before, getVersion(t, d, ArchiveName(name)))
+		},
+	} {
+		for depotName, makeDepot := range map[string]func(t *testing.T) (Depot, func()){
+			"Memory": func(t *testing.T) (Depot, func()) {
+				return NewMemoryDepot(DepotOptions{}), func() {}
+			},
+			"File": func(t *testing.T) (Depot, func()) {
+				tempDir, err := ioutil.TempDir(".", "renew-test")
+				require.NoError(t, err)
+				d, err := NewFileDepot(tempDir)
+				require.NoError(t, err)
+				return d, func() {
+					assert.NoError(t, os.RemoveAll(tempDir))
+				}
+			},
+		} {
+			t.Run(depotName+"/"+testName, func(t *testing.T) {
+				d, cleanup := makeDepot(t)
+				defer cleanup()
+
+				caOpts := &CertificateOptions{
+					CommonName: caName,
+					Expires:    24 * time.Hour,
+					Passphrase: passphrase,
+				}
+				require.NoError(t, caOpts.Init(d))
+
+				testCase(t, d)
+			})
+		}
+	}
+}
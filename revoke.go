@@ -0,0 +1,300 @@
+package certdepot
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+	"github.com/square/certstrap/pkix"
+)
+
+// RevokeOptions contains options for RevokeWithOptions.
+type RevokeOptions struct {
+	// Passphrase to decrypt the CA's private-key PEM block.
+	CAPassphrase string `bson:"ca_passphrase,omitempty" json:"ca_passphrase,omitempty" yaml:"ca_passphrase,omitempty"`
+	// Whether to delete the certificate, key and certificate request of the
+	// revoked credentials from the depot.
+	DeleteCredentials bool `bson:"delete_credentials,omitempty" json:"delete_credentials,omitempty" yaml:"delete_credentials,omitempty"`
+	// How long until the next CRL update. If zero, the CRL is valid until
+	// the CA certificate expires.
+	NextUpdate time.Duration `bson:"next_update,omitempty" json:"next_update,omitempty" yaml:"next_update,omitempty"`
+}
+
+// Revoke adds the certificate with the given name to the CRL of the CA. The
+// reason is a CRLReason code as defined in RFC 5280 section 5.3.1. The CA key
+// must not be encrypted; use RevokeWithOptions to provide a passphrase.
+func Revoke(d Depot, caName, certName string, reason int) error {
+	return RevokeWithOptions(d, caName, certName, reason, RevokeOptions{})
+}
+
+// RevokeWithOptions is the same as Revoke but allows the CA passphrase,
+// deletion of the revoked credentials and the CRL validity to be configured.
+func RevokeWithOptions(d Depot, caName, certName string, reason int, opts RevokeOptions) error {
+	if reason < 0 || reason > 10 || reason == 7 {
+		return errors.Errorf("invalid revocation reason %d", reason)
+	}
+	formattedCAName := strings.Replace(caName, " ", "_", -1)
+	formattedCertName := strings.Replace(certName, " ", "_", -1)
+
+	rawCACrt, err := getRawCertificate(d, formattedCAName)
+	if err != nil {
+		return errors.Wrap(err, "problem getting CA certificate")
+	}
+	rawCrt, err := getRawCertificate(d, formattedCertName)
+	if err != nil {
+		return errors.Wrapf(err, "problem getting certificate for %s", certName)
+	}
+	if err = rawCrt.CheckSignatureFrom(rawCACrt); err != nil {
+		return errors.Wrapf(err, "%s was not issued by %s", certName, caName)
+	}
+
+	caKey, err := getCAKey(d, formattedCAName, opts.CAPassphrase)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = updateRevocationList(d, formattedCAName, rawCACrt, caKey, opts.NextUpdate, func(crl *x509.RevocationList) bool {
+		if isSerialRevoked(crl, rawCrt.SerialNumber) {
+			return false
+		}
+		crl.RevokedCertificateEntries = append(crl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   rawCrt.SerialNumber,
+			RevocationTime: time.Now().UTC(),
+			ReasonCode:     reason,
+		})
+		return true
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if opts.DeleteCredentials {
+		if err = deleteIfExists(d, CrtTag(formattedCertName), PrivKeyTag(formattedCertName), CsrTag(formattedCertName)); err != nil {
+			return errors.Wrapf(err, "problem deleting credentials for %s", certName)
+		}
+	}
+
+	return nil
+}
+
+// IsRevoked returns whether the certificate appears in the CRL of the CA with
+// the given name. The CRL must be signed by the CA.
+func IsRevoked(d Depot, caName string, crt *pkix.Certificate) (bool, error) {
+	formattedCAName := strings.Replace(caName, " ", "_", -1)
+
+	rawCACrt, err := getRawCertificate(d, formattedCAName)
+	if err != nil {
+		return false, errors.Wrap(err, "problem getting CA certificate")
+	}
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return false, errors.Wrap(err, "problem getting raw certificate")
+	}
+
+	crl, err := getRevocationList(d, formattedCAName, rawCACrt)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	return isSerialRevoked(crl, rawCrt.SerialNumber), nil
+}
+
+// FindRevocation returns the entry for the serial number in the CRL of the CA
+// with the given name, or nil if the serial number has not been revoked. The
+// CRL must be signed by the CA.
+func FindRevocation(d Depot, caName string, serial *big.Int) (*x509.RevocationListEntry, error) {
+	formattedCAName := strings.Replace(caName, " ", "_", -1)
+
+	rawCACrt, err := getRawCertificate(d, formattedCAName)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem getting CA certificate")
+	}
+
+	crl, err := getRevocationList(d, formattedCAName, rawCACrt)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for i := range crl.RevokedCertificateEntries {
+		if crl.RevokedCertificateEntries[i].SerialNumber.Cmp(serial) == 0 {
+			return &crl.RevokedCertificateEntries[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// getCAKey returns the private key of the CA, decrypting it with the
+// passphrase if it is not empty.
+func getCAKey(d depot.Depot, caName, passphrase string) (*pkix.Key, error) {
+	var key *pkix.Key
+	var err error
+	if passphrase == "" {
+		key, err = GetPrivateKey(d, caName)
+	} else {
+		key, err = GetEncryptedPrivateKey(d, caName, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "problem getting CA key")
+	}
+
+	return key, nil
+}
+
+// maxRevocationListSwaps is the number of times an update of a CRL is
+// attempted before giving up because other writers keep replacing the CRL.
+const maxRevocationListSwaps = 10
+
+// revocationListLocks holds a mutex for each CA whose CRL is being updated,
+// so that updates of the same CRL within the process do not race.
+var revocationListLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: map[string]*sync.Mutex{}}
+
+// lockRevocationList locks the CRL of the CA with the given name and returns
+// the function that unlocks it.
+func lockRevocationList(caName string) func() {
+	revocationListLocks.Lock()
+	lock, ok := revocationListLocks.locks[caName]
+	if !ok {
+		lock = &sync.Mutex{}
+		revocationListLocks.locks[caName] = lock
+	}
+	revocationListLocks.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// getRevocationList returns the parsed CRL of the CA after checking that it
+// was signed by the CA. It errors if the CA has no CRL, since a missing CRL
+// cannot tell which certificates were revoked.
+func getRevocationList(d depot.Depot, caName string, rawCACrt *x509.Certificate) (*x509.RevocationList, error) {
+	_, crl, err := readRevocationList(d, caName, rawCACrt)
+	return crl, errors.WithStack(err)
+}
+
+// readRevocationList returns the stored and the parsed CRL of the CA after
+// checking that it was signed by the CA.
+func readRevocationList(d depot.Depot, caName string, rawCACrt *x509.Certificate) ([]byte, *x509.RevocationList, error) {
+	if !d.Check(CrlTag(caName)) {
+		return nil, nil, errors.Errorf("%s does not have a certificate revocation list", caName)
+	}
+
+	data, err := d.Get(CrlTag(caName))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "problem getting certificate revocation list")
+	}
+	crl, err := pkix.NewCertificateRevocationListFromPEM(data)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "problem decoding certificate revocation list")
+	}
+	rawCRL, err := x509.ParseRevocationList(crl.DERBytes())
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "problem parsing certificate revocation list")
+	}
+	if err = rawCRL.CheckSignatureFrom(rawCACrt); err != nil {
+		return nil, nil, errors.Wrap(err, "certificate revocation list was not signed by the CA")
+	}
+
+	return data, rawCRL, nil
+}
+
+// updateRevocationList applies the update to the CRL of the CA and stores a
+// new version of the CRL if the update returns true. The CA must already have
+// a CRL. Updates of the same CRL are serialized within the process and, if the
+// depot is a RevocationListSwapper, the CRL is only replaced if no other
+// writer changed it in the meantime; otherwise, the update is retried on the
+// new CRL.
+func updateRevocationList(d depot.Depot, caName string, rawCACrt *x509.Certificate, caKey *pkix.Key, nextUpdate time.Duration, update func(*x509.RevocationList) bool) error {
+	unlock := lockRevocationList(caName)
+	defer unlock()
+
+	for i := 0; i < maxRevocationListSwaps; i++ {
+		prev, crl, err := readRevocationList(d, caName, rawCACrt)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !update(crl) {
+			return nil
+		}
+
+		next, err := signRevocationList(crl, rawCACrt, caKey, nextUpdate)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		swapped, err := swapRevocationList(d, caName, prev, next)
+		if err != nil {
+			return errors.Wrap(err, "problem saving certificate revocation list")
+		}
+		if swapped {
+			return nil
+		}
+	}
+
+	return errors.Errorf("certificate revocation list of %s was modified concurrently", caName)
+}
+
+// swapRevocationList replaces the stored CRL prev of the CA with next. If the
+// depot is not a RevocationListSwapper, the CRL is overwritten with Put, which
+// the depot must support for existing data.
+func swapRevocationList(d depot.Depot, caName string, prev, next []byte) (bool, error) {
+	if swapper, ok := d.(RevocationListSwapper); ok {
+		swapped, err := swapper.SwapRevocationList(caName, prev, next)
+		return swapped, errors.WithStack(err)
+	}
+
+	return true, errors.WithStack(d.Put(CrlTag(caName), next))
+}
+
+// signRevocationList signs a new version of the CRL with an incremented CRL
+// number and returns it PEM-encoded.
+func signRevocationList(crl *x509.RevocationList, rawCACrt *x509.Certificate, caKey *pkix.Key, nextUpdate time.Duration) ([]byte, error) {
+	signer, ok := caKey.Private.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA key cannot be used for signing")
+	}
+
+	number := big.NewInt(1)
+	if crl.Number != nil {
+		number.Add(crl.Number, number)
+	}
+
+	now := time.Now()
+	template := &x509.RevocationList{
+		RevokedCertificateEntries: crl.RevokedCertificateEntries,
+		Number:                    number,
+		ThisUpdate:                now.UTC(),
+		NextUpdate:                rawCACrt.NotAfter,
+	}
+	if nextUpdate > 0 {
+		template.NextUpdate = now.Add(nextUpdate).UTC()
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, rawCACrt, signer)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem creating certificate revocation list")
+	}
+	data, err := pkix.NewCertificateRevocationListFromDER(der).Export()
+	if err != nil {
+		return nil, errors.Wrap(err, "problem encoding certificate revocation list")
+	}
+
+	return data, nil
+}
+
+func isSerialRevoked(crl *x509.RevocationList, serial *big.Int) bool {
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(serial) == 0 {
+			return true
+		}
+	}
+	return false
+}
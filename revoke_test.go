@@ -0,0 +1,269 @@
+package certdepot
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/depot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevoke(t *testing.T) {
+	const (
+		caName     = "ca"
+		passphrase = "passphrase"
+	)
+
+	createCert := func(t *testing.T, d Depot, name string) {
+		opts := &CertificateOptions{
+			CA:           caName,
+			CAPassphrase: passphrase,
+			CommonName:   name,
+			Host:         name,
+			Expires:      time.Hour,
+		}
+		require.NoError(t, opts.CreateCertificate(d))
+	}
+	isRevoked := func(t *testing.T, d Depot, name string) bool {
+		crt, err := GetCertificate(d, name)
+		require.NoError(t, err)
+		revoked, err := IsRevoked(d, caName, crt)
+		require.NoError(t, err)
+		return revoked
+	}
+	getCRL := func(t *testing.T, d Depot) *x509.RevocationList {
+		crl, err := GetCertificateRevocationList(d, caName)
+		require.NoError(t, err)
+		rawCRL, err := x509.ParseRevocationList(crl.DERBytes())
+		require.NoError(t, err)
+		return rawCRL
+	}
+	revokeOpts := RevokeOptions{CAPassphrase: passphrase}
+
+	for testName, testCase := range map[string]func(t *testing.T, d Depot){
+		"InitCreatesEmptyCRL": func(t *testing.T, d Depot) {
+			assert.Empty(t, getCRL(t, d).RevokedCertificateEntries)
+		},
+		"AddsCertificateToCRL": func(t *testing.T, d Depot) {
+			createCert(t, d, "alice")
+			createCert(t, d, "bob")
+			require.NoError(t, RevokeWithOptions(d, caName, "alice", 1, revokeOpts))
+
+			assert.True(t, isRevoked(t, d, "alice"))
+			assert.False(t, isRevoked(t, d, "bob"))
+
+			crl := getCRL(t, d)
+			require.Len(t, crl.RevokedCertificateEntries, 1)
+			assert.Equal(t, 1, crl.RevokedCertificateEntries[0].ReasonCode)
+			assert.True(t, d.Check(depot.CrtTag("alice")))
+
+			for name, revoked := range map[string]bool{"alice": true, "bob": false} {
+				crt, err := GetCertificate(d, name)
+				require.NoError(t, err)
+				rawCrt, err := crt.GetRawCertificate()
+				require.NoError(t, err)
+				entry, err := FindRevocation(d, caName, rawCrt.SerialNumber)
+				require.NoError(t, err)
+				if !revoked {
+					assert.Nil(t, entry)
+					continue
+				}
+				require.NotNil(t, entry)
+				assert.Equal(t, 1, entry.ReasonCode)
+				assert.Zero(t, entry.SerialNumber.Cmp(rawCrt.SerialNumber))
+			}
+		},
+		"IncrementsCRLNumber": func(t *testing.T, d Depot) {
+			createCert(t, d, "alice")
+			createCert(t, d, "bob")
+			require.NoError(t, RevokeWithOptions(d, caName, "alice", 0, revokeOpts))
+			first := getCRL(t, d)
+			require.NoError(t, RevokeWithOptions(d, caName, "bob", 0, revokeOpts))
+			second := getCRL(t, d)
+
+			assert.Equal(t, 1, second.Number.Cmp(first.Number))
+			assert.Len(t, second.RevokedCertificateEntries, 2)
+			assert.True(t, isRevoked(t, d, "alice"))
+			assert.True(t, isRevoked(t, d, "bob"))
+		},
+		"IsIdempotent": func(t *testing.T, d Depot) {
+			createCert(t, d, "alice")
+			require.NoError(t, RevokeWithOptions(d, caName, "alice", 0, revokeOpts))
+			require.NoError(t, RevokeWithOptions(d, caName, "alice", 0, revokeOpts))
+			assert.Len(t, getCRL(t, d).RevokedCertificateEntries, 1)
+		},
+		"SetsNextUpdate": func(t *testing.T, d Depot) {
+			createCert(t, d, "alice")
+			opts := revokeOpts
+			opts.NextUpdate = time.Hour
+			require.NoError(t, RevokeWithOptions(d, caName, "alice", 0, opts))
+			assert.WithinDuration(t, time.Now().Add(time.Hour), getCRL(t, d).NextUpdate, time.Minute)
+		},
+		"DeletesCredentials": func(t *testing.T, d Depot) {
+			createCert(t, d, "alice")
+			crt, err := GetCertificate(d, "alice")
+			require.NoError(t, err)
+
+			opts := revokeOpts
+			opts.DeleteCredentials = true
+			require.NoError(t, RevokeWithOptions(d, caName, "alice", 0, opts))
+			assert.False(t, d.Check(depot.CrtTag("alice")))
+			assert.False(t, d.Check(depot.PrivKeyTag("alice")))
+			assert.False(t, d.Check(depot.CsrTag("alice")))
+
+			revoked, err := IsRevoked(d, caName, crt)
+			require.NoError(t, err)
+			assert.True(t, revoked)
+		},
+		"FailsWithoutCAPassphrase": func(t *testing.T, d Depot) {
+			createCert(t, d, "alice")
+			assert.Error(t, Revoke(d, caName, "alice", 0))
+			assert.False(t, isRevoked(t, d, "alice"))
+		},
+		"FailsWithInvalidReason": func(t *testing.T, d Depot) {
+			createCert(t, d, "alice")
+			assert.Error(t, RevokeWithOptions(d, caName, "alice", 7, revokeOpts))
+			assert.Error(t, RevokeWithOptions(d, caName, "alice", 11, revokeOpts))
+		},
+		"FailsForNonexistentCertificate": func(t *testing.T, d Depot) {
+			assert.Error(t, RevokeWithOptions(d, caName, "nonexistent", 0, revokeOpts))
+		},
+		"FailsForCertificateFromOtherCA": func(t *testing.T, d Depot) {
+			otherCA := &CertificateOptions{
+				CommonName: "other",
+				Expires:    time.Hour,
+			}
+			require.NoError(t, otherCA.Init(d))
+			opts := &CertificateOptions{
+				CA:         "other",
+				CommonName: "alice",
+				Host:       "alice",
+				Expires:    time.Hour,
+			}
+			require.NoError(t, opts.CreateCertificate(d))
+
+			assert.Error(t, RevokeWithOptions(d, caName, "alice", 0, revokeOpts))
+		},
+		"KeepsConcurrentRevocations": func(t *testing.T, d Depot) {
+			names := []string{"alice", "bob", "carol", "dave", "erin"}
+			for _, name := range names {
+				createCert(t, d, name)
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, len(names))
+			for _, name := range names {
+				wg.Add(1)
+				go func(name string) {
+					defer wg.Done()
+					errs <- RevokeWithOptions(d, caName, name, 0, revokeOpts)
+				}(name)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				require.NoError(t, err)
+			}
+
+			assert.Len(t, getCRL(t, d).RevokedCertificateEntries, len(names))
+			for _, name := range names {
+				assert.True(t, isRevoked(t, d, name))
+			}
+		},
+		"RevokesCertificateFromIntermediate": func(t *testing.T, d Depot) {
+			intermediate := &CertificateOptions{
+				CA:           caName,
+				CAPassphrase: passphrase,
+				CommonName:   "intermediate",
+				Host:         "intermediate",
+				Expires:      time.Hour,
+				Intermediate: true,
+			}
+			require.NoError(t, intermediate.CreateCertificate(d))
+			require.True(t, d.Check(depot.CrlTag("intermediate")))
+			opts := &CertificateOptions{
+				CA:         "intermediate",
+				CommonName: "alice",
+				Host:       "alice",
+				Expires:    time.Hour,
+			}
+			require.NoError(t, opts.CreateCertificate(d))
+
+			require.NoError(t, Revoke(d, "intermediate", "alice", 0))
+			crt, err := GetCertificate(d, "alice")
+			require.NoError(t, err)
+			revoked, err := IsRevoked(d, "intermediate", crt)
+			require.NoError(t, err)
+			assert.True(t, revoked)
+		},
+		"FailsWithoutCRL": func(t *testing.T, d Depot) {
+			createCert(t, d, "alice")
+			require.NoError(t, d.Delete(depot.CrlTag(caName)))
+
+			assert.Error(t, RevokeWithOptions(d, caName, "alice", 0, revokeOpts))
+			crt, err := GetCertificate(d, "alice")
+			require.NoError(t, err)
+			_, err = IsRevoked(d, caName, crt)
+			assert.Error(t, err)
+		},
+	} {
+		for depotName, makeDepot := range map[string]func(t *testing.T) (Depot, func()){
+			"Memory": func(t *testing.T) (Depot, func()) {
+				return NewMemoryDepot(DepotOptions{}), func() {}
+			},
+			"File": func(t *testing.T) (Depot, func()) {
+				tempDir, err := ioutil.TempDir(".", "revoke-test")
+				require.NoError(t, err)
+				d, err := NewFileDepot(tempDir)
+				require.NoError(t, err)
+				return d, func() {
+					assert.NoError(t, os.RemoveAll(tempDir))
+				}
+			},
+			"Bolt": func(t *testing.T) (Depot, func()) {
+				tempDir, err := ioutil.TempDir(".", "revoke-test")
+				require.NoError(t, err)
+				d, err := NewBoltDBCertDepot(&BoltDBOptions{Path: filepath.Join(tempDir, "bolt.db")})
+				require.NoError(t, err)
+				return d, func() {
+					assert.NoError(t, d.(io.Closer).Close())
+					assert.NoError(t, os.RemoveAll(tempDir))
+				}
+			},
+			"SQL": func(t *testing.T) (Depot, func()) {
+				tempDir, err := ioutil.TempDir(".", "revoke-test")
+				require.NoError(t, err)
+				// Wait for locks held by concurrent revocations
+				// instead of failing with SQLITE_BUSY.
+				d, err := NewSQLCertDepot(context.Background(), &SQLDepotOptions{DriverName: "sqlite", DataSourceName: filepath.Join(tempDir, "sql.db") + "?_pragma=busy_timeout(10000)"})
+				require.NoError(t, err)
+				return d, func() {
+					assert.NoError(t, os.RemoveAll(tempDir))
+				}
+			},
+		} {
+			t.Run(depotName+"/"+testName, func(t *testing.T) {
+				d, cleanup := makeDepot(t)
+				defer cleanup()
+
+				caOpts := &CertificateOptions{
+					CommonName: caName,
+					Expires:    24 * time.Hour,
+					Passphrase: passphrase,
+					MaxPathLen: 1,
+				}
+				require.NoError(t, caOpts.Init(d))
+
+				testCase(t, d)
+			})
+		}
+	}
+}
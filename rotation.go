@@ -0,0 +1,148 @@
+package certdepot
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/cdr/grip"
+	"github.com/cdr/grip/message"
+	"github.com/pkg/errors"
+)
+
+// RotationEvent describes an attempt by a RotationManager to renew a
+// certificate.
+type RotationEvent struct {
+	// Name of the certificate.
+	Name string
+	// Expiration of the certificate before renewal. This is zero if the
+	// certificate did not exist.
+	PreviousExpiration time.Time
+	// Expiration of the renewed certificate. This is zero if renewal
+	// failed.
+	Expiration time.Time
+	// Error is set if renewal failed, in which case the previous
+	// certificate is left in the depot.
+	Error error
+}
+
+// RotationManagerOptions contains options for NewRotationManager.
+type RotationManagerOptions struct {
+	// Depot containing the certificates and their CA.
+	Depot Depot
+	// Certificates to keep renewed. Each must specify the CommonName,
+	// Host and CA to create the certificate.
+	Certificates []CertificateOptions
+	// How often to check the certificates for renewal.
+	Interval time.Duration
+	// Certificates that expire within this window, or that do not exist,
+	// are renewed.
+	RenewalWindow time.Duration
+	// Callback is called after every renewal attempt, successful or not,
+	// so that services can reload their credentials.
+	Callback func(RotationEvent)
+}
+
+// Validate checks that the options are set correctly.
+func (opts *RotationManagerOptions) Validate() error {
+	catcher := grip.NewBasicCatcher()
+	catcher.NewWhen(opts.Depot == nil, "must specify a depot")
+	catcher.NewWhen(len(opts.Certificates) == 0, "must specify at least one certificate")
+	catcher.NewWhen(opts.Interval <= 0, "interval must be positive")
+	catcher.NewWhen(opts.RenewalWindow <= 0, "renewal window must be positive")
+	for _, crtOpts := range opts.Certificates {
+		catcher.NewWhen(crtOpts.CommonName == "", "must specify a common name for every certificate")
+		catcher.ErrorfWhen(crtOpts.Host == "", "must specify a host for certificate %s", crtOpts.CommonName)
+		catcher.ErrorfWhen(crtOpts.CA == "", "must specify a CA for certificate %s", crtOpts.CommonName)
+	}
+	return catcher.Resolve()
+}
+
+// RotationManager periodically renews certificates in a depot before they
+// expire. Certificates are replaced using Renew, so a failed renewal leaves the
+// old certificate in place.
+type RotationManager struct {
+	opts RotationManagerOptions
+}
+
+// NewRotationManager returns a RotationManager with the given options.
+func NewRotationManager(opts RotationManagerOptions) (*RotationManager, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+
+	return &RotationManager{opts: opts}, nil
+}
+
+// Start checks the certificates immediately and then at every interval in a
+// background goroutine until the context is canceled.
+func (m *RotationManager) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(m.opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			grip.Warning(message.WrapError(m.Rotate(ctx), message.Fields{
+				"message": "problem rotating certificates",
+			}))
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Rotate checks every certificate once and renews the ones that are missing
+// or that expire within the renewal window.
+func (m *RotationManager) Rotate(ctx context.Context) error {
+	catcher := grip.NewBasicCatcher()
+	for _, crtOpts := range m.opts.Certificates {
+		if ctx.Err() != nil {
+			catcher.Add(ctx.Err())
+			break
+		}
+
+		catcher.Wrapf(m.rotate(crtOpts), "problem rotating certificate %s", crtOpts.CommonName)
+	}
+
+	return catcher.Resolve()
+}
+
+func (m *RotationManager) rotate(crtOpts CertificateOptions) error {
+	name := strings.Replace(crtOpts.Host, " ", "_", -1)
+	event := RotationEvent{Name: name}
+
+	if CheckCertificate(m.opts.Depot, name) {
+		_, notAfter, err := ValidityBounds(m.opts.Depot, name)
+		if err != nil {
+			return errors.Wrap(err, "problem getting certificate expiration")
+		}
+		if notAfter.After(time.Now().Add(m.opts.RenewalWindow)) {
+			return nil
+		}
+		event.PreviousExpiration = notAfter
+	}
+
+	event.Expiration, event.Error = renewCertificate(m.opts.Depot, &crtOpts)
+	if m.opts.Callback != nil {
+		m.opts.Callback(event)
+	}
+
+	return event.Error
+}
+
+func renewCertificate(d Depot, opts *CertificateOptions) (time.Time, error) {
+	if err := opts.Renew(d); err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+
+	rawCrt, err := opts.crt.GetRawCertificate()
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "problem getting raw certificate")
+	}
+
+	return rawCrt.NotAfter, nil
+}
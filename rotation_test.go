@@ -0,0 +1,242 @@
+package certdepot
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotationManager(t *testing.T) {
+	const caName = "ca"
+
+	certOpts := func(name string, expires time.Duration) CertificateOptions {
+		return CertificateOptions{
+			CA:         caName,
+			CommonName: name,
+			Host:       name,
+			Domain:     []string{name},
+			Expires:    expires,
+		}
+	}
+	expiration := func(t *testing.T, d Depot, name string) time.Time {
+		_, notAfter, err := ValidityBounds(d, name)
+		require.NoError(t, err)
+		return notAfter
+	}
+	type eventRecorder struct {
+		mu     sync.Mutex
+		events []RotationEvent
+	}
+	record := func(r *eventRecorder) func(RotationEvent) {
+		return func(event RotationEvent) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.events = append(r.events, event)
+		}
+	}
+
+	t.Run("ValidateOptions", func(t *testing.T) {
+		d := NewMemoryDepot(DepotOptions{})
+		for testName, opts := range map[string]RotationManagerOptions{
+			"MissingDepot": {
+				Certificates:  []CertificateOptions{certOpts("server", time.Hour)},
+				Interval:      time.Minute,
+				RenewalWindow: time.Minute,
+			},
+			"MissingCertificates": {
+				Depot:         d,
+				Interval:      time.Minute,
+				RenewalWindow: time.Minute,
+			},
+			"MissingInterval": {
+				Depot:         d,
+				Certificates:  []CertificateOptions{certOpts("server", time.Hour)},
+				RenewalWindow: time.Minute,
+			},
+			"MissingRenewalWindow": {
+				Depot:        d,
+				Certificates: []CertificateOptions{certOpts("server", time.Hour)},
+				Interval:     time.Minute,
+			},
+			"MissingCA": {
+				Depot: d,
+				Certificates: []CertificateOptions{
+					{CommonName: "server", Host: "server"},
+				},
+				Interval:      time.Minute,
+				RenewalWindow: time.Minute,
+			},
+			"MissingHost": {
+				Depot: d,
+				Certificates: []CertificateOptions{
+					{CA: caName, CommonName: "server"},
+				},
+				Interval:      time.Minute,
+				RenewalWindow: time.Minute,
+			},
+		} {
+			t.Run(testName, func(t *testing.T) {
+				_, err := NewRotationManager(opts)
+				assert.Error(t, err)
+			})
+		}
+	})
+
+	for testName, testCase := range map[string]func(t *testing.T, d Depot){
+		"CreatesMissingCertificate": func(t *testing.T, d Depot) {
+			recorder := &eventRecorder{}
+			m, err := NewRotationManager(RotationManagerOptions{
+				Depot:         d,
+				Certificates:  []CertificateOptions{certOpts("server", time.Hour)},
+				Interval:      time.Minute,
+				RenewalWindow: time.Minute,
+				Callback:      record(recorder),
+			})
+			require.NoError(t, err)
+
+			require.NoError(t, m.Rotate(context.Background()))
+			assert.True(t, CheckCertificate(d, "server"))
+			assert.True(t, d.Check(PrivKeyTag("server")))
+			assert.True(t, d.Check(CsrTag("server")))
+
+			require.Len(t, recorder.events, 1)
+			assert.Equal(t, "server", recorder.events[0].Name)
+			assert.NoError(t, recorder.events[0].Error)
+			assert.True(t, recorder.events[0].PreviousExpiration.IsZero())
+			assert.Equal(t, expiration(t, d, "server"), recorder.events[0].Expiration)
+		},
+		"SkipsCertificateOutsideRenewalWindow": func(t *testing.T, d Depot) {
+			opts := certOpts("server", 24*time.Hour)
+			require.NoError(t, opts.CreateCertificate(d))
+			before, err := d.Get(CrtTag("server"))
+			require.NoError(t, err)
+
+			recorder := &eventRecorder{}
+			m, err := NewRotationManager(RotationManagerOptions{
+				Depot:         d,
+				Certificates:  []CertificateOptions{opts},
+				Interval:      time.Minute,
+				RenewalWindow: time.Hour,
+				Callback:      record(recorder),
+			})
+			require.NoError(t, err)
+
+			require.NoError(t, m.Rotate(context.Background()))
+			after, err := d.Get(CrtTag("server"))
+			require.NoError(t, err)
+			assert.Equal(t, before, after)
+			assert.Empty(t, recorder.events)
+		},
+		"RenewsCertificateWithinRenewalWindow": func(t *testing.T, d Depot) {
+			opts := certOpts("server", time.Hour)
+			require.NoError(t, opts.CreateCertificate(d))
+			before, err := d.Get(CrtTag("server"))
+			require.NoError(t, err)
+			previousExpiration := expiration(t, d, "server")
+
+			recorder := &eventRecorder{}
+			opts.Expires = 24 * time.Hour
+			m, err := NewRotationManager(RotationManagerOptions{
+				Depot:         d,
+				Certificates:  []CertificateOptions{opts},
+				Interval:      time.Minute,
+				RenewalWindow: 2 * time.Hour,
+				Callback:      record(recorder),
+			})
+			require.NoError(t, err)
+
+			require.NoError(t, m.Rotate(context.Background()))
+			after, err := d.Get(CrtTag("server"))
+			require.NoError(t, err)
+			assert.NotEqual(t, before, after)
+
+			creds, err := d.Find("server")
+			require.NoError(t, err)
+			_, err = creds.Resolve()
+			assert.NoError(t, err)
+
+			require.Len(t, recorder.events, 1)
+			assert.NoError(t, recorder.events[0].Error)
+			assert.Equal(t, previousExpiration, recorder.events[0].PreviousExpiration)
+			assert.True(t, recorder.events[0].Expiration.After(previousExpiration))
+		},
+		"FailedRenewalKeepsPreviousCertificate": func(t *testing.T, d Depot) {
+			opts := certOpts("server", time.Hour)
+			require.NoError(t, opts.CreateCertificate(d))
+			before, err := d.Get(CrtTag("server"))
+			require.NoError(t, err)
+
+			recorder := &eventRecorder{}
+			opts.CA = "nonexistent"
+			m, err := NewRotationManager(RotationManagerOptions{
+				Depot:         d,
+				Certificates:  []CertificateOptions{opts},
+				Interval:      time.Minute,
+				RenewalWindow: 2 * time.Hour,
+				Callback:      record(recorder),
+			})
+			require.NoError(t, err)
+
+			assert.Error(t, m.Rotate(context.Background()))
+			after, err := d.Get(CrtTag("server"))
+			require.NoError(t, err)
+			assert.Equal(t, before, after)
+			assert.True(t, d.Check(PrivKeyTag("server")))
+
+			require.Len(t, recorder.events, 1)
+			assert.Error(t, recorder.events[0].Error)
+			assert.True(t, recorder.events[0].Expiration.IsZero())
+		},
+		"StartRenewsInBackground": func(t *testing.T, d Depot) {
+			recorder := &eventRecorder{}
+			m, err := NewRotationManager(RotationManagerOptions{
+				Depot:         d,
+				Certificates:  []CertificateOptions{certOpts("server", time.Hour)},
+				Interval:      10 * time.Millisecond,
+				RenewalWindow: 2 * time.Hour,
+				Callback:      record(recorder),
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			m.Start(ctx)
+
+			assert.Eventually(t, func() bool {
+				recorder.mu.Lock()
+				defer recorder.mu.Unlock()
+				return len(recorder.events) >= 2
+			}, 5*time.Second, 10*time.Millisecond)
+			assert.True(t, CheckCertificate(d, "server"))
+		},
+		"RotateFailsWithCanceledContext": func(t *testing.T, d Depot) {
+			m, err := NewRotationManager(RotationManagerOptions{
+				Depot:         d,
+				Certificates:  []CertificateOptions{certOpts("server", time.Hour)},
+				Interval:      time.Minute,
+				RenewalWindow: time.Minute,
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			assert.Error(t, m.Rotate(ctx))
+			assert.False(t, CheckCertificate(d, "server"))
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			d := NewMemoryDepot(DepotOptions{CA: caName})
+			caOpts := &CertificateOptions{
+				CommonName: caName,
+				Expires:    48 * time.Hour,
+			}
+			require.NoError(t, caOpts.Init(d))
+
+			testCase(t, d)
+		})
+	}
+}
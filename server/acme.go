@@ -0,0 +1,1184 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cdr/grip"
+	"github.com/cdr/grip/message"
+	"github.com/deciduosity/certdepot"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/pkix"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/idna"
+)
+
+// HTTP01Challenge is the type of the ACME http-01 challenge, which proves
+// control of a domain by serving a key authorization over HTTP.
+const HTTP01Challenge = "http-01"
+
+const (
+	acmeDirectoryPath  = "/directory"
+	acmeNewNoncePath   = "/new-nonce"
+	acmeNewAccountPath = "/new-account"
+	acmeNewOrderPath   = "/new-order"
+	acmeAccountPath    = "/account/"
+	acmeOrdersPath     = "/orders/"
+	acmeOrderPath      = "/order/"
+	acmeAuthzPath      = "/authz/"
+	acmeChallengePath  = "/challenge/"
+	acmeFinalizePath   = "/finalize/"
+	acmeCertPath       = "/cert/"
+
+	// acmeOrderLifetime is how long orders and authorizations remain
+	// valid.
+	acmeOrderLifetime = 24 * time.Hour
+	// acmeInvalidLifetime is how long invalid orders are kept before they
+	// are removed.
+	acmeInvalidLifetime = time.Hour
+	// acmeAccountLifetime is how long an account without orders is kept
+	// after it was last used.
+	acmeAccountLifetime = 30 * 24 * time.Hour
+	// acmeNonceLifetime is how long a nonce can be used after it is
+	// issued.
+	acmeNonceLifetime = time.Hour
+	// acmeMaxNonces is how many unused nonces are kept, after which the
+	// oldest ones are discarded.
+	acmeMaxNonces = 10000
+	// acmePruneInterval is how often expired objects are removed.
+	acmePruneInterval = time.Minute
+)
+
+// acmeIDNA converts identifiers to the ASCII form of a hostname, rejecting
+// anything that is not a valid hostname.
+var acmeIDNA = idna.New(idna.MapForLookup(), idna.VerifyDNSLength(true), idna.BidiRule())
+
+// Statuses of ACME objects as defined in RFC 8555 section 7.1.6.
+const (
+	acmeStatusPending     = "pending"
+	acmeStatusReady       = "ready"
+	acmeStatusProcessing  = "processing"
+	acmeStatusValid       = "valid"
+	acmeStatusInvalid     = "invalid"
+	acmeStatusDeactivated = "deactivated"
+)
+
+// ChallengeValidator checks that the key authorization of a challenge has been
+// provisioned for the domain, returning an error if it has not.
+type ChallengeValidator func(ctx context.Context, challengeType, domain, token, keyAuthorization string) error
+
+// NewHTTP01Validator returns a ChallengeValidator for http-01 challenges that
+// fetches the key authorization from the domain with the given client. If the
+// client is nil, a client with a 10 second timeout is used.
+func NewHTTP01Validator(client *http.Client) ChallengeValidator {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return func(ctx context.Context, challengeType, domain, token, keyAuthorization string) error {
+		if challengeType != HTTP01Challenge {
+			return errors.Errorf("unsupported challenge type '%s'", challengeType)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, "http://"+domain+"/.well-known/acme-challenge/"+token, nil)
+		if err != nil {
+			return errors.Wrap(err, "problem creating request")
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return errors.Wrapf(err, "problem fetching key authorization from %s", domain)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("%s responded with status %d", domain, resp.StatusCode)
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		if err != nil {
+			return errors.Wrapf(err, "problem reading key authorization from %s", domain)
+		}
+		if strings.TrimSpace(string(body)) != keyAuthorization {
+			return errors.Errorf("%s responded with an incorrect key authorization", domain)
+		}
+
+		return nil
+	}
+}
+
+// ACMEOptions contains options for the ACME handler.
+type ACMEOptions struct {
+	// Depot holding the CA.
+	Depot certdepot.Depot `bson:"-" json:"-" yaml:"-"`
+	// Name of the CA that issues certificates.
+	CA string `bson:"ca" json:"ca" yaml:"ca"`
+	// Passphrase to decrypt the CA's private-key PEM block.
+	CAPassphrase string `bson:"ca_passphrase,omitempty" json:"ca_passphrase,omitempty" yaml:"ca_passphrase,omitempty"`
+	// How long until issued certificates expire.
+	Expiration time.Duration `bson:"expiration" json:"expiration" yaml:"expiration"`
+	// BaseURL is the external URL at which the handler is served, such as
+	// "https://ca.example.com/acme", used to build the URLs of ACME
+	// resources. If empty, it is derived from each request, which assumes
+	// that the handler is served at the root.
+	BaseURL string `bson:"base_url,omitempty" json:"base_url,omitempty" yaml:"base_url,omitempty"`
+	// Validator checks challenges (defaults to NewHTTP01Validator(nil)).
+	Validator ChallengeValidator `bson:"-" json:"-" yaml:"-"`
+}
+
+// Validate checks that the required options are set.
+func (opts *ACMEOptions) Validate() error {
+	catcher := grip.NewBasicCatcher()
+
+	catcher.NewWhen(opts.Depot == nil, "must specify a depot")
+	catcher.NewWhen(opts.CA == "", "must specify the name of the CA")
+	catcher.NewWhen(opts.Expiration <= 0, "expiration must be positive")
+	if catcher.HasErrors() {
+		return catcher.Resolve()
+	}
+
+	if opts.Validator == nil {
+		opts.Validator = NewHTTP01Validator(nil)
+	}
+	opts.BaseURL = strings.TrimSuffix(opts.BaseURL, "/")
+
+	return nil
+}
+
+// ACMEHandler is an http.Handler that implements the server side of the ACME
+// protocol (RFC 8555), so that ACME clients can obtain certificates from a CA
+// in a depot. Each identifier in an order must be a DNS name that is
+// validated with an http-01 challenge; challenges are validated when the
+// client responds to them.
+//
+// Accounts, orders and issued certificates are held in memory, so clients
+// must register again after the handler is recreated. Orders, along with their
+// authorizations and certificates, are removed once they expire, or an hour
+// after they become invalid, and accounts without orders are removed after 30
+// days without use or once they are deactivated.
+type ACMEHandler struct {
+	opts ACMEOptions
+	mux  *http.ServeMux
+
+	mu            sync.Mutex
+	pruned        time.Time
+	nonces        *acmeNonces
+	accounts      map[string]*acmeAccount
+	accountsByKey map[string]string
+	orders        map[string]*acmeOrder
+	authzs        map[string]*acmeAuthz
+	challenges    map[string]*acmeChallenge
+	certs         map[string][]byte
+}
+
+type acmeAccount struct {
+	id         string
+	key        crypto.PublicKey
+	thumbprint string
+	status     string
+	contact    []string
+	orders     []string
+	lastUsed   time.Time
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	id          string
+	account     string
+	status      string
+	expires     time.Time
+	identifiers []acmeIdentifier
+	authzs      []string
+	cert        string
+	err         *acmeProblem
+}
+
+type acmeAuthz struct {
+	id         string
+	account    string
+	identifier acmeIdentifier
+	status     string
+	expires    time.Time
+	challenges []string
+}
+
+type acmeChallenge struct {
+	id        string
+	authz     string
+	typ       string
+	token     string
+	status    string
+	validated time.Time
+	err       *acmeProblem
+}
+
+// acmeProblem is an ACME error in the problem document format of RFC 7807.
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func newACMEProblem(status int, problemType string, err error) *acmeProblem {
+	return &acmeProblem{
+		Type:   "urn:ietf:params:acme:error:" + problemType,
+		Detail: err.Error(),
+		Status: status,
+	}
+}
+
+// acmeRequest is an authenticated request to the handler.
+type acmeRequest struct {
+	payload []byte
+	key     crypto.PublicKey
+	account *acmeAccount
+}
+
+// postAsGet returns whether the request is a POST-as-GET request, which has
+// an empty payload.
+func (r *acmeRequest) postAsGet() bool {
+	return len(r.payload) == 0
+}
+
+// NewACMEHandler returns a handler that issues certificates from the CA with
+// the given options.
+func NewACMEHandler(opts ACMEOptions) (*ACMEHandler, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+
+	h := &ACMEHandler{
+		opts:          opts,
+		mux:           http.NewServeMux(),
+		nonces:        newACMENonces(acmeMaxNonces),
+		accounts:      map[string]*acmeAccount{},
+		accountsByKey: map[string]string{},
+		orders:        map[string]*acmeOrder{},
+		authzs:        map[string]*acmeAuthz{},
+		challenges:    map[string]*acmeChallenge{},
+		certs:         map[string][]byte{},
+	}
+	h.mux.HandleFunc(acmeDirectoryPath, h.directory)
+	h.mux.HandleFunc(acmeNewNoncePath, h.newNonce)
+	h.mux.HandleFunc(acmeNewAccountPath, h.newAccount)
+	h.mux.HandleFunc(acmeNewOrderPath, h.newOrder)
+	h.mux.HandleFunc(acmeAccountPath, h.account)
+	h.mux.HandleFunc(acmeOrdersPath, h.accountOrders)
+	h.mux.HandleFunc(acmeOrderPath, h.order)
+	h.mux.HandleFunc(acmeAuthzPath, h.authz)
+	h.mux.HandleFunc(acmeChallengePath, h.challenge)
+	h.mux.HandleFunc(acmeFinalizePath, h.finalize)
+	h.mux.HandleFunc(acmeCertPath, h.cert)
+
+	return h, nil
+}
+
+// ServeHTTP adds a fresh nonce to every response and routes the request to
+// the ACME resources.
+func (h *ACMEHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	nonce, err := h.issueNonce()
+	if err != nil {
+		writeACMEProblem(w, newACMEProblem(http.StatusInternalServerError, "serverInternal", err))
+		return
+	}
+	h.prune(time.Now())
+	w.Header().Set("Replay-Nonce", nonce)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Add("Link", `<`+h.baseURL(r)+acmeDirectoryPath+`>;rel="index"`)
+
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *ACMEHandler) directory(w http.ResponseWriter, r *http.Request) {
+	base := h.baseURL(r)
+	writeACMEJSON(w, http.StatusOK, map[string]string{
+		"newNonce":   base + acmeNewNoncePath,
+		"newAccount": base + acmeNewAccountPath,
+		"newOrder":   base + acmeNewOrderPath,
+	})
+}
+
+func (h *ACMEHandler) newNonce(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *ACMEHandler) newAccount(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.readRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.account != nil {
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", errors.New("new accounts must be requested with a jwk")))
+		return
+	}
+
+	payload := struct {
+		Contact            []string `json:"contact"`
+		OnlyReturnExisting bool     `json:"onlyReturnExisting"`
+	}{}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", errors.Wrap(err, "problem decoding account")))
+		return
+	}
+	thumbprint, err := acme.JWKThumbprint(req.key)
+	if err != nil {
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "badPublicKey", err))
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if id, ok := h.accountsByKey[thumbprint]; ok {
+		account := h.accounts[id]
+		w.Header().Set("Location", h.baseURL(r)+acmeAccountPath+account.id)
+		writeACMEJSON(w, http.StatusOK, h.accountJSON(r, account))
+		return
+	}
+	if payload.OnlyReturnExisting {
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "accountDoesNotExist", errors.New("no account exists for the key")))
+		return
+	}
+
+	id, err := newACMEID()
+	if err != nil {
+		writeACMEProblem(w, newACMEProblem(http.StatusInternalServerError, "serverInternal", err))
+		return
+	}
+	account := &acmeAccount{
+		id:         id,
+		key:        req.key,
+		thumbprint: thumbprint,
+		status:     acmeStatusValid,
+		contact:    payload.Contact,
+		lastUsed:   time.Now(),
+	}
+	h.accounts[id] = account
+	h.accountsByKey[thumbprint] = id
+
+	w.Header().Set("Location", h.baseURL(r)+acmeAccountPath+id)
+	writeACMEJSON(w, http.StatusCreated, h.accountJSON(r, account))
+}
+
+func (h *ACMEHandler) account(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.readAccountRequest(w, r)
+	if !ok {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if req.account.id != strings.TrimPrefix(r.URL.Path, acmeAccountPath) {
+		writeACMEProblem(w, newACMEProblem(http.StatusForbidden, "unauthorized", errors.New("account does not match the key")))
+		return
+	}
+	if !req.postAsGet() {
+		payload := struct {
+			Contact []string `json:"contact"`
+			Status  string   `json:"status"`
+		}{}
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", errors.Wrap(err, "problem decoding account")))
+			return
+		}
+		if payload.Status != "" && payload.Status != acmeStatusDeactivated {
+			writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", errors.Errorf("cannot change account status to '%s'", payload.Status)))
+			return
+		}
+		if payload.Contact != nil {
+			req.account.contact = payload.Contact
+		}
+		if payload.Status == acmeStatusDeactivated {
+			req.account.status = acmeStatusDeactivated
+		}
+	}
+
+	writeACMEJSON(w, http.StatusOK, h.accountJSON(r, req.account))
+}
+
+func (h *ACMEHandler) accountOrders(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.readAccountRequest(w, r)
+	if !ok {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if req.account.id != strings.TrimPrefix(r.URL.Path, acmeOrdersPath) {
+		writeACMEProblem(w, newACMEProblem(http.StatusForbidden, "unauthorized", errors.New("account does not match the key")))
+		return
+	}
+	urls := []string{}
+	for _, id := range req.account.orders {
+		urls = append(urls, h.baseURL(r)+acmeOrderPath+id)
+	}
+
+	writeACMEJSON(w, http.StatusOK, map[string][]string{"orders": urls})
+}
+
+func (h *ACMEHandler) newOrder(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.readAccountRequest(w, r)
+	if !ok {
+		return
+	}
+
+	payload := struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}{}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", errors.Wrap(err, "problem decoding order")))
+		return
+	}
+	if len(payload.Identifiers) == 0 {
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", errors.New("order must have at least one identifier")))
+		return
+	}
+	for i, identifier := range payload.Identifiers {
+		if identifier.Type != "dns" {
+			writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "unsupportedIdentifier", errors.Errorf("unsupported identifier type '%s'", identifier.Type)))
+			return
+		}
+		name, err := normalizeHostname(identifier.Value)
+		if err != nil {
+			writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "rejectedIdentifier", errors.Wrapf(err, "cannot issue certificates for '%s'", identifier.Value)))
+			return
+		}
+		payload.Identifiers[i].Value = name
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	order, err := h.createOrder(req.account, payload.Identifiers)
+	if err != nil {
+		writeACMEProblem(w, newACMEProblem(http.StatusInternalServerError, "serverInternal", err))
+		return
+	}
+
+	w.Header().Set("Location", h.baseURL(r)+acmeOrderPath+order.id)
+	writeACMEJSON(w, http.StatusCreated, h.orderJSON(r, order))
+}
+
+// createOrder creates an order with a pending authorization and http-01
+// challenge for each identifier. The caller must hold the lock.
+func (h *ACMEHandler) createOrder(account *acmeAccount, identifiers []acmeIdentifier) (*acmeOrder, error) {
+	expires := time.Now().Add(acmeOrderLifetime).UTC().Truncate(time.Second)
+	orderID, err := newACMEID()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	order := &acmeOrder{
+		id:          orderID,
+		account:     account.id,
+		status:      acmeStatusPending,
+		expires:     expires,
+		identifiers: identifiers,
+	}
+
+	for _, identifier := range identifiers {
+		authzID, err := newACMEID()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		challengeID, err := newACMEID()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		token, err := newACMEID()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		h.challenges[challengeID] = &acmeChallenge{
+			id:     challengeID,
+			authz:  authzID,
+			typ:    HTTP01Challenge,
+			token:  token,
+			status: acmeStatusPending,
+		}
+		h.authzs[authzID] = &acmeAuthz{
+			id:         authzID,
+			account:    account.id,
+			identifier: identifier,
+			status:     acmeStatusPending,
+			expires:    expires,
+			challenges: []string{challengeID},
+		}
+		order.authzs = append(order.authzs, authzID)
+	}
+
+	h.orders[orderID] = order
+	account.orders = append(account.orders, orderID)
+
+	return order, nil
+}
+
+func (h *ACMEHandler) order(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.readAccountRequest(w, r)
+	if !ok {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	order, ok := h.orders[strings.TrimPrefix(r.URL.Path, acmeOrderPath)]
+	if !ok || order.account != req.account.id {
+		writeACMEProblem(w, newACMEProblem(http.StatusNotFound, "malformed", errors.New("order not found")))
+		return
+	}
+
+	w.Header().Set("Location", h.baseURL(r)+acmeOrderPath+order.id)
+	writeACMEJSON(w, http.StatusOK, h.orderJSON(r, order))
+}
+
+func (h *ACMEHandler) authz(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.readAccountRequest(w, r)
+	if !ok {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	authz, ok := h.authzs[strings.TrimPrefix(r.URL.Path, acmeAuthzPath)]
+	if !ok || authz.account != req.account.id {
+		writeACMEProblem(w, newACMEProblem(http.StatusNotFound, "malformed", errors.New("authorization not found")))
+		return
+	}
+	if !req.postAsGet() {
+		payload := struct {
+			Status string `json:"status"`
+		}{}
+		if err := json.Unmarshal(req.payload, &payload); err != nil || payload.Status != acmeStatusDeactivated {
+			writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", errors.New("authorizations can only be deactivated")))
+			return
+		}
+		authz.status = acmeStatusDeactivated
+		h.updateOrders(authz)
+	}
+
+	writeACMEJSON(w, http.StatusOK, h.authzJSON(r, authz))
+}
+
+func (h *ACMEHandler) challenge(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.readAccountRequest(w, r)
+	if !ok {
+		return
+	}
+
+	h.mu.Lock()
+	challenge, ok := h.challenges[strings.TrimPrefix(r.URL.Path, acmeChallengePath)]
+	var authz *acmeAuthz
+	if ok {
+		authz = h.authzs[challenge.authz]
+	}
+	if !ok || authz.account != req.account.id {
+		h.mu.Unlock()
+		writeACMEProblem(w, newACMEProblem(http.StatusNotFound, "malformed", errors.New("challenge not found")))
+		return
+	}
+	validate := !req.postAsGet() && challenge.status == acmeStatusPending && authz.status == acmeStatusPending
+	if validate {
+		challenge.status = acmeStatusProcessing
+	}
+	identifier, token, keyAuth := authz.identifier, challenge.token, challenge.token+"."+req.account.thumbprint
+	h.mu.Unlock()
+
+	if validate {
+		err := h.opts.Validator(r.Context(), challenge.typ, identifier.Value, token, keyAuth)
+
+		h.mu.Lock()
+		if err != nil {
+			challenge.status = acmeStatusInvalid
+			challenge.err = newACMEProblem(http.StatusForbidden, "incorrectResponse", err)
+			authz.status = acmeStatusInvalid
+		} else {
+			challenge.status = acmeStatusValid
+			challenge.validated = time.Now().UTC().Truncate(time.Second)
+			authz.status = acmeStatusValid
+		}
+		h.updateOrders(authz)
+		h.mu.Unlock()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w.Header().Add("Link", `<`+h.baseURL(r)+acmeAuthzPath+authz.id+`>;rel="up"`)
+	writeACMEJSON(w, http.StatusOK, h.challengeJSON(r, challenge))
+}
+
+// updateOrders updates the status of the pending orders that contain the
+// authorization. The caller must hold the lock.
+func (h *ACMEHandler) updateOrders(authz *acmeAuthz) {
+	for _, order := range h.orders {
+		if order.status != acmeStatusPending || order.account != authz.account {
+			continue
+		}
+
+		status := acmeStatusReady
+		contains := false
+		for _, id := range order.authzs {
+			if id == authz.id {
+				contains = true
+			}
+			switch h.authzs[id].status {
+			case acmeStatusValid:
+			case acmeStatusPending:
+				if status == acmeStatusReady {
+					status = acmeStatusPending
+				}
+			default:
+				status = acmeStatusInvalid
+			}
+		}
+		if contains {
+			order.status = status
+		}
+	}
+}
+
+func (h *ACMEHandler) finalize(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.readAccountRequest(w, r)
+	if !ok {
+		return
+	}
+
+	payload := struct {
+		CSR string `json:"csr"`
+	}{}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", errors.Wrap(err, "problem decoding finalize request")))
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "badCSR", errors.Wrap(err, "problem decoding certificate request")))
+		return
+	}
+	rawCSR, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "badCSR", errors.Wrap(err, "problem parsing certificate request")))
+		return
+	}
+
+	h.mu.Lock()
+	order, ok := h.orders[strings.TrimPrefix(r.URL.Path, acmeFinalizePath)]
+	if !ok || order.account != req.account.id {
+		h.mu.Unlock()
+		writeACMEProblem(w, newACMEProblem(http.StatusNotFound, "malformed", errors.New("order not found")))
+		return
+	}
+	if h.expireOrder(order); order.status != acmeStatusReady {
+		h.mu.Unlock()
+		writeACMEProblem(w, newACMEProblem(http.StatusForbidden, "orderNotReady", errors.Errorf("order is %s", order.status)))
+		return
+	}
+	if err = checkCSRIdentifiers(rawCSR, order.identifiers); err != nil {
+		h.mu.Unlock()
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "badCSR", err))
+		return
+	}
+	order.status = acmeStatusProcessing
+	h.mu.Unlock()
+
+	chain, err := h.sign(der)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.orders[order.id] != order {
+		writeACMEProblem(w, newACMEProblem(http.StatusNotFound, "malformed", errors.New("order expired")))
+		return
+	}
+	if err != nil {
+		order.status = acmeStatusInvalid
+		order.err = newACMEProblem(http.StatusBadRequest, "badCSR", err)
+		writeACMEProblem(w, order.err)
+		return
+	}
+	certID, err := newACMEID()
+	if err != nil {
+		order.status = acmeStatusInvalid
+		writeACMEProblem(w, newACMEProblem(http.StatusInternalServerError, "serverInternal", err))
+		return
+	}
+	h.certs[certID] = chain
+	order.cert = certID
+	order.status = acmeStatusValid
+
+	w.Header().Set("Location", h.baseURL(r)+acmeOrderPath+order.id)
+	writeACMEJSON(w, http.StatusOK, h.orderJSON(r, order))
+}
+
+// sign signs the DER-encoded certificate request with the CA and returns the
+// PEM-encoded certificate chain.
+func (h *ACMEHandler) sign(der []byte) ([]byte, error) {
+	opts := certdepot.CertificateOptions{
+		CA:           h.opts.CA,
+		CAPassphrase: h.opts.CAPassphrase,
+		Expires:      h.opts.Expiration,
+	}
+	crt, err := opts.SignCertificateRequestInMemory(h.opts.Depot, pkix.NewCertificateSigningRequestFromDER(der))
+	if err != nil {
+		return nil, errors.Wrap(err, "problem signing certificate request")
+	}
+	pemCrt, err := crt.Export()
+	if err != nil {
+		return nil, errors.Wrap(err, "problem exporting certificate")
+	}
+	pemCACrt, err := h.opts.Depot.Get(certdepot.CrtTag(strings.Replace(h.opts.CA, " ", "_", -1)))
+	if err != nil {
+		return nil, errors.Wrap(err, "problem getting CA certificate")
+	}
+
+	return append(pemCrt, pemCACrt...), nil
+}
+
+func (h *ACMEHandler) cert(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.readAccountRequest(w, r)
+	if !ok {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	id := strings.TrimPrefix(r.URL.Path, acmeCertPath)
+	chain, ok := h.certs[id]
+	if ok {
+		ok = false
+		for _, orderID := range req.account.orders {
+			if h.orders[orderID].cert == id {
+				ok = true
+			}
+		}
+	}
+	if !ok {
+		writeACMEProblem(w, newACMEProblem(http.StatusNotFound, "malformed", errors.New("certificate not found")))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	_, err := w.Write(chain)
+	grip.Warning(message.WrapError(err, "problem writing response"))
+}
+
+// readRequest verifies the JWS in the body of the POST request and returns
+// its payload along with the key that signed it and, if the JWS identifies an
+// account, the account. An error response is written if the request is
+// invalid.
+func (h *ACMEHandler) readRequest(w http.ResponseWriter, r *http.Request) (*acmeRequest, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeACMEProblem(w, newACMEProblem(http.StatusMethodNotAllowed, "malformed", errors.Errorf("method %s not allowed", r.Method)))
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", errors.Wrap(err, "problem reading request")))
+		return nil, false
+	}
+	msg, header, payload, err := parseJWS(body)
+	if err != nil {
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", err))
+		return nil, false
+	}
+	if header.URL != h.baseURL(r)+r.URL.Path {
+		writeACMEProblem(w, newACMEProblem(http.StatusUnauthorized, "unauthorized", errors.New("url in protected header does not match the request")))
+		return nil, false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.useNonce(header.Nonce) {
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "badNonce", errors.New("invalid or reused nonce")))
+		return nil, false
+	}
+
+	req := &acmeRequest{payload: payload}
+	if len(header.JWK) > 0 {
+		req.key, err = parseJWK(header.JWK)
+		if err != nil {
+			writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "badPublicKey", err))
+			return nil, false
+		}
+	} else {
+		account, ok := h.accounts[strings.TrimPrefix(header.KID, h.baseURL(r)+acmeAccountPath)]
+		if !ok || !strings.HasPrefix(header.KID, h.baseURL(r)+acmeAccountPath) {
+			writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "accountDoesNotExist", errors.New("account not found")))
+			return nil, false
+		}
+		if account.status != acmeStatusValid {
+			writeACMEProblem(w, newACMEProblem(http.StatusUnauthorized, "unauthorized", errors.Errorf("account is %s", account.status)))
+			return nil, false
+		}
+		account.lastUsed = time.Now()
+		req.account = account
+		req.key = account.key
+	}
+	if err = msg.verify(header.Alg, req.key); err != nil {
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", err))
+		return nil, false
+	}
+
+	return req, true
+}
+
+// readAccountRequest is the same as readRequest but requires the JWS to
+// identify an account.
+func (h *ACMEHandler) readAccountRequest(w http.ResponseWriter, r *http.Request) (*acmeRequest, bool) {
+	req, ok := h.readRequest(w, r)
+	if !ok {
+		return nil, false
+	}
+	if req.account == nil {
+		writeACMEProblem(w, newACMEProblem(http.StatusBadRequest, "malformed", errors.New("request must identify an account with a kid")))
+		return nil, false
+	}
+
+	return req, true
+}
+
+func (h *ACMEHandler) issueNonce() (string, error) {
+	nonce, err := newACMEID()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nonces.add(nonce, time.Now().Add(acmeNonceLifetime))
+
+	return nonce, nil
+}
+
+// useNonce returns whether the nonce was issued and has not been used or
+// expired. The caller must hold the lock.
+func (h *ACMEHandler) useNonce(nonce string) bool {
+	return h.nonces.use(nonce, time.Now())
+}
+
+// acmeNonces holds the unused nonces in the order they were issued, up to a
+// maximum number of nonces, after which the oldest nonce is discarded. Since
+// every nonce has the same lifetime, the oldest nonces expire first.
+type acmeNonces struct {
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type acmeNonce struct {
+	nonce   string
+	expires time.Time
+}
+
+func newACMENonces(size int) *acmeNonces {
+	return &acmeNonces{
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// add adds the nonce, discarding the oldest nonces if there are too many.
+func (n *acmeNonces) add(nonce string, expires time.Time) {
+	n.entries[nonce] = n.order.PushBack(&acmeNonce{nonce: nonce, expires: expires})
+	for n.order.Len() > n.size {
+		n.remove(n.order.Front())
+	}
+}
+
+// use removes the nonce and returns whether it had not expired.
+func (n *acmeNonces) use(nonce string, now time.Time) bool {
+	elem, ok := n.entries[nonce]
+	if !ok {
+		return false
+	}
+	n.remove(elem)
+
+	return now.Before(elem.Value.(*acmeNonce).expires)
+}
+
+// prune removes the expired nonces.
+func (n *acmeNonces) prune(now time.Time) {
+	for elem := n.order.Front(); elem != nil && !now.Before(elem.Value.(*acmeNonce).expires); elem = n.order.Front() {
+		n.remove(elem)
+	}
+}
+
+func (n *acmeNonces) remove(elem *list.Element) {
+	delete(n.entries, elem.Value.(*acmeNonce).nonce)
+	n.order.Remove(elem)
+}
+
+// prune removes expired nonces, expired and invalid orders, along with their
+// authorizations, challenges and certificates, and unused accounts. It does nothing if it ran
+// less than acmePruneInterval ago.
+func (h *ACMEHandler) prune(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if now.Sub(h.pruned) < acmePruneInterval {
+		return
+	}
+	h.pruned = now
+
+	h.nonces.prune(now)
+	for id, order := range h.orders {
+		h.expireOrder(order)
+		if order.status == acmeStatusInvalid && order.expires.After(now.Add(acmeInvalidLifetime)) {
+			order.expires = now.Add(acmeInvalidLifetime).UTC().Truncate(time.Second)
+		}
+		if !now.After(order.expires) {
+			continue
+		}
+
+		for _, authzID := range order.authzs {
+			if authz, ok := h.authzs[authzID]; ok {
+				for _, challengeID := range authz.challenges {
+					delete(h.challenges, challengeID)
+				}
+			}
+			delete(h.authzs, authzID)
+		}
+		if order.cert != "" {
+			delete(h.certs, order.cert)
+		}
+		delete(h.orders, id)
+
+		if account, ok := h.accounts[order.account]; ok {
+			orders := account.orders[:0]
+			for _, orderID := range account.orders {
+				if orderID != id {
+					orders = append(orders, orderID)
+				}
+			}
+			account.orders = orders
+		}
+	}
+
+	for id, account := range h.accounts {
+		if len(account.orders) > 0 {
+			continue
+		}
+		if account.status == acmeStatusValid && now.Sub(account.lastUsed) < acmeAccountLifetime {
+			continue
+		}
+		delete(h.accountsByKey, account.thumbprint)
+		delete(h.accounts, id)
+	}
+}
+
+// expireOrder invalidates the order if it expired before being issued. The
+// caller must hold the lock.
+func (h *ACMEHandler) expireOrder(order *acmeOrder) {
+	if order.status != acmeStatusValid && order.status != acmeStatusInvalid && time.Now().After(order.expires) {
+		order.status = acmeStatusInvalid
+	}
+}
+
+func (h *ACMEHandler) baseURL(r *http.Request) string {
+	if h.opts.BaseURL != "" {
+		return h.opts.BaseURL
+	}
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+func (h *ACMEHandler) accountJSON(r *http.Request, account *acmeAccount) interface{} {
+	return struct {
+		Status  string   `json:"status"`
+		Contact []string `json:"contact,omitempty"`
+		Orders  string   `json:"orders"`
+	}{
+		Status:  account.status,
+		Contact: account.contact,
+		Orders:  h.baseURL(r) + acmeOrdersPath + account.id,
+	}
+}
+
+func (h *ACMEHandler) orderJSON(r *http.Request, order *acmeOrder) interface{} {
+	h.expireOrder(order)
+
+	out := struct {
+		Status         string           `json:"status"`
+		Expires        time.Time        `json:"expires"`
+		Identifiers    []acmeIdentifier `json:"identifiers"`
+		Authorizations []string         `json:"authorizations"`
+		Finalize       string           `json:"finalize"`
+		Certificate    string           `json:"certificate,omitempty"`
+		Error          *acmeProblem     `json:"error,omitempty"`
+	}{
+		Status:      order.status,
+		Expires:     order.expires,
+		Identifiers: order.identifiers,
+		Finalize:    h.baseURL(r) + acmeFinalizePath + order.id,
+		Error:       order.err,
+	}
+	for _, id := range order.authzs {
+		out.Authorizations = append(out.Authorizations, h.baseURL(r)+acmeAuthzPath+id)
+	}
+	if order.cert != "" {
+		out.Certificate = h.baseURL(r) + acmeCertPath + order.cert
+	}
+
+	return out
+}
+
+func (h *ACMEHandler) authzJSON(r *http.Request, authz *acmeAuthz) interface{} {
+	out := struct {
+		Status     string         `json:"status"`
+		Expires    time.Time      `json:"expires"`
+		Identifier acmeIdentifier `json:"identifier"`
+		Challenges []interface{}  `json:"challenges"`
+	}{
+		Status:     authz.status,
+		Expires:    authz.expires,
+		Identifier: authz.identifier,
+	}
+	for _, id := range authz.challenges {
+		out.Challenges = append(out.Challenges, h.challengeJSON(r, h.challenges[id]))
+	}
+
+	return out
+}
+
+func (h *ACMEHandler) challengeJSON(r *http.Request, challenge *acmeChallenge) interface{} {
+	out := struct {
+		Type      string       `json:"type"`
+		URL       string       `json:"url"`
+		Token     string       `json:"token"`
+		Status    string       `json:"status"`
+		Validated *time.Time   `json:"validated,omitempty"`
+		Error     *acmeProblem `json:"error,omitempty"`
+	}{
+		Type:   challenge.typ,
+		URL:    h.baseURL(r) + acmeChallengePath + challenge.id,
+		Token:  challenge.token,
+		Status: challenge.status,
+		Error:  challenge.err,
+	}
+	if !challenge.validated.IsZero() {
+		out.Validated = &challenge.validated
+	}
+
+	return out
+}
+
+// checkCSRIdentifiers checks that the certificate request is for exactly the
+// DNS names of the order's identifiers.
+func checkCSRIdentifiers(csr *x509.CertificateRequest, identifiers []acmeIdentifier) error {
+	if len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return errors.New("certificate request can only contain DNS names")
+	}
+
+	requested := map[string]bool{}
+	for _, name := range csr.DNSNames {
+		requested[strings.ToLower(name)] = true
+	}
+	if csr.Subject.CommonName != "" {
+		requested[strings.ToLower(csr.Subject.CommonName)] = true
+	}
+	ordered := map[string]bool{}
+	for _, identifier := range identifiers {
+		ordered[strings.ToLower(identifier.Value)] = true
+	}
+
+	var unordered []string
+	for name := range requested {
+		if !ordered[name] {
+			unordered = append(unordered, name)
+		}
+	}
+	if len(unordered) > 0 {
+		sort.Strings(unordered)
+		return errors.Errorf("certificate request contains names that are not in the order: %s", strings.Join(unordered, ", "))
+	}
+	if len(requested) != len(ordered) {
+		return errors.New("certificate request does not contain all names in the order")
+	}
+
+	return nil
+}
+
+// normalizeHostname returns the lowercase ASCII form of the hostname, or an
+// error if the name is not a valid hostname. Wildcards, IP addresses and names
+// with ports, user information or paths are rejected.
+func normalizeHostname(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("name is empty")
+	}
+	if net.ParseIP(name) != nil {
+		return "", errors.New("IP addresses are not supported")
+	}
+
+	ascii, err := acmeIDNA.ToASCII(name)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid hostname")
+	}
+	labels := strings.Split(ascii, ".")
+	for _, label := range labels {
+		if label == "" {
+			return "", errors.New("hostname contains an empty label")
+		}
+		if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return "", errors.Errorf("label '%s' cannot start or end with a hyphen", label)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return "", errors.Errorf("label '%s' contains invalid character '%c'", label, c)
+			}
+		}
+	}
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return "", errors.New("top-level domain cannot be numeric")
+	}
+
+	return ascii, nil
+}
+
+func newACMEID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "problem generating random identifier")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func writeACMEJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	grip.Warning(message.WrapError(json.NewEncoder(w).Encode(data), "problem writing response"))
+}
+
+func writeACMEProblem(w http.ResponseWriter, problem *acmeProblem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	grip.Warning(message.WrapError(json.NewEncoder(w).Encode(problem), "problem writing response"))
+}
@@ -0,0 +1,388 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deciduosity/certdepot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+)
+
+// challengeResponder serves http-01 key authorizations for any domain.
+type challengeResponder struct {
+	mu        sync.Mutex
+	responses map[string]string
+}
+
+func (c *challengeResponder) set(path, response string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.responses[path] = response
+}
+
+func (c *challengeResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	response, ok := c.responses[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	_, _ = w.Write([]byte(response))
+}
+
+func TestACMEHandler(t *testing.T) {
+	newClient := func(t *testing.T, srv *httptest.Server) *acme.Client {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		return &acme.Client{
+			Key:          key,
+			HTTPClient:   srv.Client(),
+			DirectoryURL: srv.URL + acmeDirectoryPath,
+		}
+	}
+	newCSR := func(t *testing.T, names ...string) []byte {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject:  pkix.Name{CommonName: names[0]},
+			DNSNames: names,
+		}, key)
+		require.NoError(t, err)
+		return csr
+	}
+	// authorize creates an order for the domains and responds to its
+	// challenges, using the wrong key authorization if valid is false.
+	authorize := func(ctx context.Context, t *testing.T, client *acme.Client, responder *challengeResponder, valid bool, domains ...string) *acme.Order {
+		_, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+		if err != acme.ErrAccountAlreadyExists {
+			require.NoError(t, err)
+		}
+		order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+		require.NoError(t, err)
+		assert.Equal(t, acme.StatusPending, order.Status)
+		require.Len(t, order.AuthzURLs, len(domains))
+
+		for _, authzURL := range order.AuthzURLs {
+			authz, err := client.GetAuthorization(ctx, authzURL)
+			require.NoError(t, err)
+			require.Len(t, authz.Challenges, 1)
+			challenge := authz.Challenges[0]
+			require.Equal(t, HTTP01Challenge, challenge.Type)
+
+			response, err := client.HTTP01ChallengeResponse(challenge.Token)
+			require.NoError(t, err)
+			if !valid {
+				response = "invalid"
+			}
+			responder.set(client.HTTP01ChallengePath(challenge.Token), response)
+
+			_, err = client.Accept(ctx, challenge)
+			require.NoError(t, err)
+		}
+
+		return order
+	}
+
+	for testName, testCase := range map[string]func(ctx context.Context, t *testing.T, opts ACMEOptions, srv *httptest.Server, responder *challengeResponder){
+		"IssuesCertificate": func(ctx context.Context, t *testing.T, opts ACMEOptions, srv *httptest.Server, responder *challengeResponder) {
+			client := newClient(t, srv)
+			order := authorize(ctx, t, client, responder, true, "example.com", "www.example.com")
+			for _, authzURL := range order.AuthzURLs {
+				authz, err := client.WaitAuthorization(ctx, authzURL)
+				require.NoError(t, err)
+				assert.Equal(t, acme.StatusValid, authz.Status)
+			}
+			order, err := client.WaitOrder(ctx, order.URI)
+			require.NoError(t, err)
+			assert.Equal(t, acme.StatusReady, order.Status)
+
+			chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, newCSR(t, "example.com", "www.example.com"), true)
+			require.NoError(t, err)
+			require.Len(t, chain, 2)
+			crt, err := x509.ParseCertificate(chain[0])
+			require.NoError(t, err)
+			caCrt, err := x509.ParseCertificate(chain[1])
+			require.NoError(t, err)
+			assert.Equal(t, caName, caCrt.Subject.CommonName)
+			assert.NoError(t, crt.CheckSignatureFrom(caCrt))
+			assert.ElementsMatch(t, []string{"example.com", "www.example.com"}, crt.DNSNames)
+			assert.True(t, crt.NotAfter.Before(time.Now().Add(opts.Expiration+time.Minute)))
+
+			order, err = client.GetOrder(ctx, order.URI)
+			require.NoError(t, err)
+			assert.Equal(t, acme.StatusValid, order.Status)
+		},
+		"ReturnsExistingAccount": func(ctx context.Context, t *testing.T, _ ACMEOptions, srv *httptest.Server, _ *challengeResponder) {
+			client := newClient(t, srv)
+			account, err := client.Register(ctx, &acme.Account{Contact: []string{"mailto:admin@example.com"}}, acme.AcceptTOS)
+			require.NoError(t, err)
+			assert.Equal(t, acme.StatusValid, account.Status)
+			assert.NotEmpty(t, account.URI)
+
+			_, err = client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+			assert.Equal(t, acme.ErrAccountAlreadyExists, err)
+
+			existing, err := client.GetReg(ctx, "")
+			require.NoError(t, err)
+			assert.Equal(t, account.URI, existing.URI)
+			assert.Equal(t, account.Contact, existing.Contact)
+
+			_, err = newClient(t, srv).GetReg(ctx, "")
+			assert.Equal(t, acme.ErrNoAccount, err)
+		},
+		"InvalidatesOrderWithIncorrectResponse": func(ctx context.Context, t *testing.T, _ ACMEOptions, srv *httptest.Server, responder *challengeResponder) {
+			client := newClient(t, srv)
+			order := authorize(ctx, t, client, responder, false, "example.com")
+
+			_, err := client.WaitAuthorization(ctx, order.AuthzURLs[0])
+			assert.Error(t, err)
+			_, err = client.WaitOrder(ctx, order.URI)
+			assert.Error(t, err)
+
+			_, _, err = client.CreateOrderCert(ctx, order.FinalizeURL, newCSR(t, "example.com"), true)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "orderNotReady")
+		},
+		"FinalizeFailsBeforeAuthorization": func(ctx context.Context, t *testing.T, _ ACMEOptions, srv *httptest.Server, _ *challengeResponder) {
+			client := newClient(t, srv)
+			_, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+			require.NoError(t, err)
+			order, err := client.AuthorizeOrder(ctx, acme.DomainIDs("example.com"))
+			require.NoError(t, err)
+
+			_, _, err = client.CreateOrderCert(ctx, order.FinalizeURL, newCSR(t, "example.com"), true)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "orderNotReady")
+		},
+		"FinalizeFailsWithMismatchedCSR": func(ctx context.Context, t *testing.T, _ ACMEOptions, srv *httptest.Server, responder *challengeResponder) {
+			client := newClient(t, srv)
+			order := authorize(ctx, t, client, responder, true, "example.com")
+			_, err := client.WaitOrder(ctx, order.URI)
+			require.NoError(t, err)
+
+			for _, names := range [][]string{{"example.com", "other.com"}, {"other.com"}} {
+				_, _, err = client.CreateOrderCert(ctx, order.FinalizeURL, newCSR(t, names...), true)
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "badCSR")
+			}
+
+			_, _, err = client.CreateOrderCert(ctx, order.FinalizeURL, newCSR(t, "example.com"), true)
+			assert.NoError(t, err)
+		},
+		"RejectsWildcardIdentifiers": func(ctx context.Context, t *testing.T, _ ACMEOptions, srv *httptest.Server, _ *challengeResponder) {
+			client := newClient(t, srv)
+			_, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+			require.NoError(t, err)
+			_, err = client.AuthorizeOrder(ctx, acme.DomainIDs("*.example.com"))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "rejectedIdentifier")
+		},
+		"RejectsInvalidIdentifiers": func(ctx context.Context, t *testing.T, _ ACMEOptions, srv *httptest.Server, _ *challengeResponder) {
+			client := newClient(t, srv)
+			_, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+			require.NoError(t, err)
+			for _, name := range []string{
+				"example.com:8080",
+				"user@example.com",
+				"example.com/path",
+				"example.com?query",
+				"127.0.0.1",
+				"[::1]",
+				"::1",
+				"1.2.3",
+				"example..com",
+				"-example.com",
+				"exa_mple.com",
+				strings.Repeat("a", 64) + ".com",
+			} {
+				_, err = client.AuthorizeOrder(ctx, acme.DomainIDs(name))
+				require.Error(t, err, name)
+				assert.Contains(t, err.Error(), "rejectedIdentifier", name)
+			}
+		},
+		"NormalizesIdentifiers": func(ctx context.Context, t *testing.T, _ ACMEOptions, srv *httptest.Server, _ *challengeResponder) {
+			client := newClient(t, srv)
+			_, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+			require.NoError(t, err)
+			order, err := client.AuthorizeOrder(ctx, acme.DomainIDs("WWW.Example.com", "bücher.example"))
+			require.NoError(t, err)
+			assert.Equal(t, acme.DomainIDs("www.example.com", "xn--bcher-kva.example"), order.Identifiers)
+		},
+		"PrunesExpiredObjects": func(ctx context.Context, t *testing.T, _ ACMEOptions, srv *httptest.Server, responder *challengeResponder) {
+			h := srv.Config.Handler.(*ACMEHandler)
+			client := newClient(t, srv)
+			order := authorize(ctx, t, client, responder, true, "example.com")
+			_, err := client.WaitOrder(ctx, order.URI)
+			require.NoError(t, err)
+			_, _, err = client.CreateOrderCert(ctx, order.FinalizeURL, newCSR(t, "example.com"), true)
+			require.NoError(t, err)
+
+			invalid := newClient(t, srv)
+			invalidOrder := authorize(ctx, t, invalid, responder, false, "other.com")
+			_, err = invalid.WaitOrder(ctx, invalidOrder.URI)
+			require.Error(t, err)
+
+			deactivated := newClient(t, srv)
+			_, err = deactivated.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+			require.NoError(t, err)
+			require.NoError(t, deactivated.DeactivateReg(ctx))
+
+			h.prune(time.Now().Add(acmePruneInterval))
+			h.mu.Lock()
+			assert.Len(t, h.orders, 2)
+			assert.Len(t, h.accounts, 2)
+			h.mu.Unlock()
+
+			h.prune(time.Now().Add(acmePruneInterval + acmeInvalidLifetime + time.Minute))
+			h.mu.Lock()
+			assert.Len(t, h.orders, 1)
+			assert.Len(t, h.authzs, 1)
+			assert.Len(t, h.challenges, 1)
+			assert.Len(t, h.accounts, 2)
+			h.mu.Unlock()
+
+			h.prune(time.Now().Add(acmeOrderLifetime + 2*acmePruneInterval))
+			h.mu.Lock()
+			assert.Empty(t, h.orders)
+			assert.Empty(t, h.authzs)
+			assert.Empty(t, h.challenges)
+			assert.Empty(t, h.certs)
+			assert.Len(t, h.accounts, 2)
+			h.mu.Unlock()
+
+			h.prune(time.Now().Add(acmeAccountLifetime + 3*acmePruneInterval))
+			h.mu.Lock()
+			assert.Empty(t, h.accounts)
+			assert.Empty(t, h.accountsByKey)
+			h.mu.Unlock()
+		},
+		"OtherAccountsCannotAccessOrders": func(ctx context.Context, t *testing.T, _ ACMEOptions, srv *httptest.Server, _ *challengeResponder) {
+			client := newClient(t, srv)
+			_, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+			require.NoError(t, err)
+			order, err := client.AuthorizeOrder(ctx, acme.DomainIDs("example.com"))
+			require.NoError(t, err)
+
+			other := newClient(t, srv)
+			_, err = other.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+			require.NoError(t, err)
+			_, err = other.GetOrder(ctx, order.URI)
+			assert.Error(t, err)
+			_, err = other.GetAuthorization(ctx, order.AuthzURLs[0])
+			assert.Error(t, err)
+		},
+		"DeactivatedAccountsCannotOrder": func(ctx context.Context, t *testing.T, _ ACMEOptions, srv *httptest.Server, _ *challengeResponder) {
+			client := newClient(t, srv)
+			_, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+			require.NoError(t, err)
+			require.NoError(t, client.DeactivateReg(ctx))
+
+			_, err = client.AuthorizeOrder(ctx, acme.DomainIDs("example.com"))
+			assert.Error(t, err)
+		},
+		"RejectsReusedNonces": func(ctx context.Context, t *testing.T, _ ACMEOptions, srv *httptest.Server, _ *challengeResponder) {
+			h := srv.Config.Handler.(*ACMEHandler)
+			nonce, err := h.issueNonce()
+			require.NoError(t, err)
+
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			assert.True(t, h.useNonce(nonce))
+			assert.False(t, h.useNonce(nonce))
+			assert.False(t, h.useNonce("nonexistent"))
+		},
+		"BoundsAndPrunesNonces": func(ctx context.Context, t *testing.T, _ ACMEOptions, srv *httptest.Server, _ *challengeResponder) {
+			h := srv.Config.Handler.(*ACMEHandler)
+			first, err := h.issueNonce()
+			require.NoError(t, err)
+			for i := 0; i < acmeMaxNonces; i++ {
+				_, err = h.issueNonce()
+				require.NoError(t, err)
+			}
+
+			h.mu.Lock()
+			assert.Equal(t, acmeMaxNonces, h.nonces.order.Len())
+			assert.Len(t, h.nonces.entries, acmeMaxNonces)
+			assert.False(t, h.useNonce(first))
+			h.mu.Unlock()
+
+			h.prune(time.Now().Add(acmeNonceLifetime + acmePruneInterval))
+			h.mu.Lock()
+			assert.Zero(t, h.nonces.order.Len())
+			assert.Empty(t, h.nonces.entries)
+			h.mu.Unlock()
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			d := certdepot.NewMemoryDepot(certdepot.DepotOptions{CA: caName, DefaultExpiration: time.Hour})
+			require.NoError(t, (&certdepot.CertificateOptions{
+				CommonName: caName,
+				Expires:    24 * time.Hour,
+			}).Init(d))
+
+			responder := &challengeResponder{responses: map[string]string{}}
+			challengeSrv := httptest.NewServer(responder)
+			defer challengeSrv.Close()
+			// Resolve every domain to the challenge server.
+			validatorClient := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, network, strings.TrimPrefix(challengeSrv.URL, "http://"))
+				},
+			}}
+
+			opts := ACMEOptions{
+				Depot:      d,
+				CA:         caName,
+				Expiration: time.Hour,
+				Validator:  NewHTTP01Validator(validatorClient),
+			}
+			h, err := NewACMEHandler(opts)
+			require.NoError(t, err)
+			srv := httptest.NewTLSServer(h)
+			defer srv.Close()
+
+			testCase(ctx, t, opts, srv, responder)
+		})
+	}
+	t.Run("NewACMEHandlerFailsWithInvalidOptions", func(t *testing.T) {
+		for optsName, opts := range map[string]ACMEOptions{
+			"MissingDepot":      {CA: caName, Expiration: time.Hour},
+			"MissingCA":         {Depot: certdepot.NewMemoryDepot(certdepot.DepotOptions{}), Expiration: time.Hour},
+			"MissingExpiration": {Depot: certdepot.NewMemoryDepot(certdepot.DepotOptions{}), CA: caName},
+		} {
+			_, err := NewACMEHandler(opts)
+			assert.Error(t, err, optsName)
+		}
+	})
+}
+
+func TestHTTP01Validator(t *testing.T) {
+	responder := &challengeResponder{responses: map[string]string{"/.well-known/acme-challenge/token": "token.thumbprint\n"}}
+	srv := httptest.NewServer(responder)
+	defer srv.Close()
+	domain := strings.TrimPrefix(srv.URL, "http://")
+	validate := NewHTTP01Validator(srv.Client())
+	ctx := context.Background()
+
+	assert.NoError(t, validate(ctx, HTTP01Challenge, domain, "token", "token.thumbprint"))
+	assert.Error(t, validate(ctx, HTTP01Challenge, domain, "token", "token.other"))
+	assert.Error(t, validate(ctx, HTTP01Challenge, domain, "other", "other.thumbprint"))
+	assert.Error(t, validate(ctx, "dns-01", domain, "token", "token.thumbprint"))
+}
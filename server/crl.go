@@ -0,0 +1,126 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cdr/grip"
+	"github.com/cdr/grip/message"
+	"github.com/deciduosity/certdepot"
+	"github.com/pkg/errors"
+)
+
+// CRLDistributionOptions contains options for the CRL distribution handler.
+type CRLDistributionOptions struct {
+	// Depot holding the CAs.
+	Depot certdepot.Depot `bson:"-" json:"-" yaml:"-"`
+	// Names of the CAs whose CRLs are served.
+	CAs []string `bson:"cas" json:"cas" yaml:"cas"`
+}
+
+// Validate checks that the required options are set.
+func (opts *CRLDistributionOptions) Validate() error {
+	catcher := grip.NewBasicCatcher()
+
+	catcher.NewWhen(opts.Depot == nil, "must specify a depot")
+	catcher.NewWhen(len(opts.CAs) == 0, "must specify at least one CA")
+	for _, ca := range opts.CAs {
+		catcher.NewWhen(ca == "", "must specify the name of every CA")
+	}
+
+	return catcher.Resolve()
+}
+
+// CRLDistributionHandler is an http.Handler that serves the CRLs of CAs in a
+// depot, which can be used as the CRL distribution point of the certificates
+// they issue. The CRL of a CA is served DER-encoded at "<ca>.crl" and
+// PEM-encoded at "<ca>.pem" as the last element of the path, where spaces in
+// the CA name are replaced by underscores.
+//
+// CRLs are read from the depot on every request, so CRLs refreshed with
+// certdepot.RefreshCRL or a certdepot.CRLManager are served as soon as they
+// are stored. Responses can be cached until the next update of the CRL.
+type CRLDistributionHandler struct {
+	opts CRLDistributionOptions
+	cas  map[string]string
+}
+
+// NewCRLDistributionHandler returns a handler that serves the CRLs of the CAs
+// with the given options.
+func NewCRLDistributionHandler(opts CRLDistributionOptions) (*CRLDistributionHandler, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+
+	h := &CRLDistributionHandler{
+		opts: opts,
+		cas:  map[string]string{},
+	}
+	for _, ca := range opts.CAs {
+		h.cas[strings.Replace(ca, " ", "_", -1)] = ca
+	}
+
+	return h, nil
+}
+
+// ServeHTTP responds with the requested CRL.
+func (h *CRLDistributionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", strings.Join([]string{http.MethodGet, http.MethodHead}, ", "))
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	file := path.Base(r.URL.Path)
+	ext := path.Ext(file)
+	name := strings.TrimSuffix(file, ext)
+	ca, ok := h.cas[name]
+	if !ok || (ext != ".crl" && ext != ".pem") {
+		http.NotFound(w, r)
+		return
+	}
+
+	crl, err := certdepot.GetCertificateRevocationList(h.opts.Depot, name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("CRL for %s not found", ca), http.StatusNotFound)
+		return
+	}
+	der := crl.DERBytes()
+	rawCRL, err := x509.ParseRevocationList(der)
+	if err != nil {
+		grip.Warning(message.WrapError(err, message.Fields{
+			"message": "problem parsing CRL",
+			"ca":      ca,
+		}))
+		http.Error(w, "invalid CRL", http.StatusInternalServerError)
+		return
+	}
+
+	data := der
+	contentType := "application/pkix-crl"
+	if ext == ".pem" {
+		data = pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+		contentType = "application/x-pem-file"
+	}
+
+	if !rawCRL.NextUpdate.IsZero() {
+		maxAge := int(time.Until(rawCRL.NextUpdate).Seconds())
+		if maxAge < 0 {
+			maxAge = 0
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, public, no-transform, must-revalidate", maxAge))
+		w.Header().Set("Expires", rawCRL.NextUpdate.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Last-Modified", rawCRL.ThisUpdate.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Type", contentType)
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, err = w.Write(data)
+	grip.Warning(message.WrapError(err, "problem writing response"))
+}
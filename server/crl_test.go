@@ -0,0 +1,146 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/deciduosity/certdepot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCRLDistributionHandler(t *testing.T) {
+	get := func(t *testing.T, srv *httptest.Server, path string) (*http.Response, []byte) {
+		resp, err := http.Get(srv.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, data
+	}
+	caCertificate := func(t *testing.T, d certdepot.Depot, name string) *x509.Certificate {
+		crt, err := certdepot.GetCertificate(d, name)
+		require.NoError(t, err)
+		rawCrt, err := crt.GetRawCertificate()
+		require.NoError(t, err)
+		return rawCrt
+	}
+
+	for testName, testCase := range map[string]func(t *testing.T, d certdepot.Depot, srv *httptest.Server){
+		"ServesDERCRL": func(t *testing.T, d certdepot.Depot, srv *httptest.Server) {
+			resp, data := get(t, srv, "/crl/"+caName+".crl")
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "application/pkix-crl", resp.Header.Get("Content-Type"))
+			crl, err := x509.ParseRevocationList(data)
+			require.NoError(t, err)
+			assert.NoError(t, crl.CheckSignatureFrom(caCertificate(t, d, caName)))
+			assert.Equal(t, crl.ThisUpdate.UTC().Format(http.TimeFormat), resp.Header.Get("Last-Modified"))
+			assert.Equal(t, crl.NextUpdate.UTC().Format(http.TimeFormat), resp.Header.Get("Expires"))
+			assert.Contains(t, resp.Header.Get("Cache-Control"), "max-age=")
+		},
+		"ServesPEMCRL": func(t *testing.T, d certdepot.Depot, srv *httptest.Server) {
+			resp, data := get(t, srv, "/"+caName+".pem")
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			block, _ := pem.Decode(data)
+			require.NotNil(t, block)
+			assert.Equal(t, "X509 CRL", block.Type)
+			crl, err := x509.ParseRevocationList(block.Bytes)
+			require.NoError(t, err)
+			assert.NoError(t, crl.CheckSignatureFrom(caCertificate(t, d, caName)))
+		},
+		"ServesRefreshedCRL": func(t *testing.T, d certdepot.Depot, srv *httptest.Server) {
+			require.NoError(t, (&certdepot.CertificateOptions{
+				CA:         caName,
+				CommonName: "server",
+				Host:       "server",
+				Expires:    time.Hour,
+			}).CreateCertificate(d))
+			require.NoError(t, certdepot.Revoke(d, caName, "server", 0))
+			require.NoError(t, certdepot.RefreshCRL(d, certdepot.CRLOptions{CA: caName, NextUpdate: time.Minute}))
+
+			resp, data := get(t, srv, "/"+caName+".crl")
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			crl, err := x509.ParseRevocationList(data)
+			require.NoError(t, err)
+			assert.Len(t, crl.RevokedCertificateEntries, 1)
+			assert.Equal(t, time.Minute, crl.NextUpdate.Sub(crl.ThisUpdate))
+		},
+		"ServesCAWithSpacesInName": func(t *testing.T, _ certdepot.Depot, srv *httptest.Server) {
+			resp, data := get(t, srv, "/other_ca.crl")
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			_, err := x509.ParseRevocationList(data)
+			assert.NoError(t, err)
+
+			tempDir, err := ioutil.TempDir(".", "crl-test")
+			require.NoError(t, err)
+			defer func() {
+				assert.NoError(t, os.RemoveAll(tempDir))
+			}()
+			fd, err := certdepot.NewFileDepot(tempDir)
+			require.NoError(t, err)
+			require.NoError(t, (&certdepot.CertificateOptions{CommonName: "other ca", Expires: time.Hour}).Init(fd))
+			h, err := NewCRLDistributionHandler(CRLDistributionOptions{Depot: fd, CAs: []string{"other ca"}})
+			require.NoError(t, err)
+			fileSrv := httptest.NewServer(h)
+			defer fileSrv.Close()
+
+			resp, data = get(t, fileSrv, "/other_ca.crl")
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			_, err = x509.ParseRevocationList(data)
+			assert.NoError(t, err)
+		},
+		"SupportsHEADRequests": func(t *testing.T, _ certdepot.Depot, srv *httptest.Server) {
+			resp, err := http.Head(srv.URL + "/" + caName + ".crl")
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "application/pkix-crl", resp.Header.Get("Content-Type"))
+		},
+		"FailsForUnknownCRL": func(t *testing.T, d certdepot.Depot, srv *httptest.Server) {
+			require.NoError(t, (&certdepot.CertificateOptions{CommonName: "unlisted", Expires: time.Hour}).Init(d))
+			for _, path := range []string{"/unlisted.crl", "/" + caName + ".der", "/" + caName, "/"} {
+				resp, _ := get(t, srv, path)
+				assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+			}
+		},
+		"FailsWithInvalidMethod": func(t *testing.T, _ certdepot.Depot, srv *httptest.Server) {
+			resp, err := http.Post(srv.URL+"/"+caName+".crl", "text/plain", nil)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			d := certdepot.NewMemoryDepot(certdepot.DepotOptions{CA: caName, DefaultExpiration: time.Hour})
+			for _, name := range []string{caName, "other ca"} {
+				require.NoError(t, (&certdepot.CertificateOptions{
+					CommonName: name,
+					Expires:    24 * time.Hour,
+				}).Init(d))
+			}
+
+			h, err := NewCRLDistributionHandler(CRLDistributionOptions{Depot: d, CAs: []string{caName, "other ca"}})
+			require.NoError(t, err)
+			srv := httptest.NewServer(h)
+			defer srv.Close()
+
+			testCase(t, d, srv)
+		})
+	}
+	t.Run("NewCRLDistributionHandlerFailsWithInvalidOptions", func(t *testing.T) {
+		for optsName, opts := range map[string]CRLDistributionOptions{
+			"MissingDepot": {CAs: []string{caName}},
+			"MissingCAs":   {Depot: certdepot.NewMemoryDepot(certdepot.DepotOptions{})},
+			"EmptyCAName":  {Depot: certdepot.NewMemoryDepot(certdepot.DepotOptions{}), CAs: []string{""}},
+		} {
+			_, err := NewCRLDistributionHandler(opts)
+			assert.Error(t, err, optsName)
+		}
+	})
+}
@@ -0,0 +1,421 @@
+package server
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cdr/grip"
+	"github.com/cdr/grip/message"
+	"github.com/deciduosity/certdepot"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/pkix"
+)
+
+// ESTPath is the path prefix of the EST endpoints.
+const ESTPath = "/.well-known/est/"
+
+const (
+	// EnrollEndpoint enrolls clients that do not have a certificate for
+	// the requested name.
+	EnrollEndpoint Endpoint = "enroll"
+	// ReenrollEndpoint renews the certificate of a client.
+	ReenrollEndpoint Endpoint = "reenroll"
+)
+
+var (
+	oidPKCS7Data       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+)
+
+// ESTOptions contains options for the EST handler.
+type ESTOptions struct {
+	// Depot holding the CA, where issued certificates are stored.
+	Depot certdepot.Depot `bson:"-" json:"-" yaml:"-"`
+	// Name of the CA that issues certificates.
+	CA string `bson:"ca" json:"ca" yaml:"ca"`
+	// Passphrase to decrypt the CA's private-key PEM block.
+	CAPassphrase string `bson:"ca_passphrase,omitempty" json:"ca_passphrase,omitempty" yaml:"ca_passphrase,omitempty"`
+	// How long until issued certificates expire.
+	Expiration time.Duration `bson:"expiration" json:"expiration" yaml:"expiration"`
+	// Authorize decides whether a client may enroll or re-enroll each
+	// name in its certificate request. The client certificate is nil if
+	// the client enrolls without one. If nil, clients cannot enroll and
+	// may only re-enroll the names in their current certificate.
+	Authorize Authorizer `bson:"-" json:"-" yaml:"-"`
+}
+
+// Validate checks that the required options are set.
+func (opts *ESTOptions) Validate() error {
+	catcher := grip.NewBasicCatcher()
+
+	catcher.NewWhen(opts.Depot == nil, "must specify a depot")
+	catcher.NewWhen(opts.CA == "", "must specify the name of the CA")
+	catcher.NewWhen(opts.Expiration <= 0, "expiration must be positive")
+
+	return catcher.Resolve()
+}
+
+// ESTHandler is an http.Handler that implements Enrollment over Secure
+// Transport (RFC 7030) for a CA in a depot. It serves the cacerts,
+// simpleenroll, simplereenroll and csrattrs operations under ESTPath.
+//
+// Enrollment issues a certificate for a name, taken from the common name of
+// the certificate request, that does not yet have one in the depot.
+// Re-enrollment replaces the certificate of a client that authenticates with
+// its current certificate from the depot, and the certificate request must
+// have the same names as the current certificate. Issued certificates and
+// their requests are stored in the depot with the certificate's expiration as
+// the TTL, and the previous certificate is archived as with
+// certdepot.CertificateOptions.Renew.
+//
+// The handler should be served with a TLS configuration that verifies, but
+// does not require, client certificates signed by the CA, such as the one
+// returned by TLSConfig with ClientAuth set to tls.VerifyClientCertIfGiven.
+type ESTHandler struct {
+	opts ESTOptions
+	mux  *http.ServeMux
+
+	// mu serializes checking and replacing certificates in the depot.
+	mu sync.Mutex
+}
+
+// NewESTHandler returns a handler that enrolls clients with the CA with the
+// given options.
+func NewESTHandler(opts ESTOptions) (*ESTHandler, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+
+	h := &ESTHandler{
+		opts: opts,
+		mux:  http.NewServeMux(),
+	}
+	h.mux.HandleFunc(ESTPath+"cacerts", h.caCerts)
+	h.mux.HandleFunc(ESTPath+"simpleenroll", h.enroll)
+	h.mux.HandleFunc(ESTPath+"simplereenroll", h.reenroll)
+	h.mux.HandleFunc(ESTPath+"csrattrs", h.csrAttrs)
+
+	return h, nil
+}
+
+// ServeHTTP routes the request to the EST operations.
+func (h *ESTHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *ESTHandler) caCerts(w http.ResponseWriter, r *http.Request) {
+	if !checkESTMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	crt, err := certdepot.GetCertificate(h.opts.Depot, strings.Replace(h.opts.CA, " ", "_", -1))
+	if err != nil {
+		writeESTError(w, http.StatusInternalServerError, errors.Wrap(err, "problem getting CA certificate"))
+		return
+	}
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		writeESTError(w, http.StatusInternalServerError, errors.Wrap(err, "problem getting raw CA certificate"))
+		return
+	}
+
+	writePKCS7Certificates(w, rawCrt)
+}
+
+func (h *ESTHandler) csrAttrs(w http.ResponseWriter, r *http.Request) {
+	if !checkESTMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	// There are no attributes that clients are required to include.
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *ESTHandler) enroll(w http.ResponseWriter, r *http.Request) {
+	if !checkESTMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	csr, rawCSR, ok := h.readCertificateRequest(w, r)
+	if !ok {
+		return
+	}
+	name := rawCSR.Subject.CommonName
+	client := clientCertificate(r)
+	if !h.authorize(w, client, EnrollEndpoint, requestNames(rawCSR)) {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if certdepot.CheckCertificate(h.opts.Depot, strings.Replace(name, " ", "_", -1)) {
+		writeESTError(w, http.StatusConflict, errors.Errorf("certificate for %s already exists and must be re-enrolled", name))
+		return
+	}
+
+	h.issue(w, csr, name)
+}
+
+func (h *ESTHandler) reenroll(w http.ResponseWriter, r *http.Request) {
+	if !checkESTMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	client := clientCertificate(r)
+	if client == nil {
+		writeESTError(w, http.StatusUnauthorized, errors.New("must authenticate with the current certificate"))
+		return
+	}
+	csr, rawCSR, ok := h.readCertificateRequest(w, r)
+	if !ok {
+		return
+	}
+	name := rawCSR.Subject.CommonName
+	if client.Subject.CommonName != name {
+		writeESTError(w, http.StatusForbidden, errors.Errorf("client certificate is not for %s", name))
+		return
+	}
+	if err := checkSameNames(requestNames(rawCSR), certificateNames(client)); err != nil {
+		writeESTError(w, http.StatusForbidden, err)
+		return
+	}
+	if !h.authorize(w, client, ReenrollEndpoint, requestNames(rawCSR)) {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.checkCurrentCertificate(client, name); err != nil {
+		writeESTError(w, http.StatusForbidden, err)
+		return
+	}
+
+	h.issue(w, csr, name)
+}
+
+// readCertificateRequest reads the base64-encoded certificate request in the
+// body of the request and returns it along with its parsed form, whose common
+// name is the name to issue it under. An error response is written if the
+// certificate request is invalid.
+func (h *ESTHandler) readCertificateRequest(w http.ResponseWriter, r *http.Request) (*pkix.CertificateSigningRequest, *x509.CertificateRequest, bool) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		writeESTError(w, http.StatusBadRequest, errors.Wrap(err, "problem reading request"))
+		return nil, nil, false
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+	if err != nil {
+		writeESTError(w, http.StatusBadRequest, errors.Wrap(err, "problem decoding certificate request"))
+		return nil, nil, false
+	}
+	csr := pkix.NewCertificateSigningRequestFromDER(der)
+	rawCSR, err := csr.GetRawCertificateSigningRequest()
+	if err != nil {
+		writeESTError(w, http.StatusBadRequest, errors.Wrap(err, "problem parsing certificate request"))
+		return nil, nil, false
+	}
+
+	name := rawCSR.Subject.CommonName
+	if name == "" || strings.Replace(name, " ", "_", -1) == strings.Replace(h.opts.CA, " ", "_", -1) {
+		writeESTError(w, http.StatusBadRequest, errors.Errorf("cannot enroll certificate request with common name '%s'", name))
+		return nil, nil, false
+	}
+
+	return csr, rawCSR, true
+}
+
+// checkCurrentCertificate checks that the client certificate is the
+// certificate for the name in the depot and that it has not been revoked.
+func (h *ESTHandler) checkCurrentCertificate(client *x509.Certificate, name string) error {
+	crt, err := certdepot.GetCertificate(h.opts.Depot, strings.Replace(name, " ", "_", -1))
+	if err != nil {
+		return errors.Wrapf(err, "problem getting certificate for %s", name)
+	}
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return errors.Wrapf(err, "problem getting raw certificate for %s", name)
+	}
+	if !bytes.Equal(rawCrt.Raw, client.Raw) {
+		return errors.Errorf("client certificate is not the current certificate for %s", name)
+	}
+
+	revoked, err := certdepot.IsRevoked(h.opts.Depot, h.opts.CA, crt)
+	if err != nil {
+		return errors.Wrap(err, "problem checking revocation")
+	}
+	if revoked {
+		return errors.Errorf("certificate for %s has been revoked", name)
+	}
+
+	return nil
+}
+
+// issue signs the certificate request, replaces any existing certificate,
+// request and private key for the name in the depot, and writes the issued
+// certificate. The caller must hold the lock.
+func (h *ESTHandler) issue(w http.ResponseWriter, csr *pkix.CertificateSigningRequest, name string) {
+	opts := certdepot.CertificateOptions{
+		CA:           h.opts.CA,
+		CAPassphrase: h.opts.CAPassphrase,
+		Host:         name,
+		Expires:      h.opts.Expiration,
+	}
+	crt, err := opts.SignCertificateRequestInMemory(h.opts.Depot, csr)
+	if err != nil {
+		writeESTError(w, http.StatusBadRequest, errors.Wrap(err, "problem signing certificate request"))
+		return
+	}
+
+	if err = opts.ReplaceCertificate(h.opts.Depot, csr); err != nil {
+		writeESTError(w, http.StatusInternalServerError, errors.Wrapf(err, "problem storing certificate for %s", name))
+		return
+	}
+
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		writeESTError(w, http.StatusInternalServerError, errors.Wrap(err, "problem getting raw certificate"))
+		return
+	}
+
+	writePKCS7Certificates(w, rawCrt)
+}
+
+// authorize checks that the client may use the endpoint for every name in its
+// certificate request. An error response is written if any name is not
+// authorized.
+func (h *ESTHandler) authorize(w http.ResponseWriter, client *x509.Certificate, endpoint Endpoint, names []string) bool {
+	authorize := h.opts.Authorize
+	if authorize == nil {
+		authorize = defaultAuthorize
+	}
+
+	for _, name := range names {
+		if err := authorize(client, endpoint, name); err != nil {
+			writeESTError(w, http.StatusForbidden, errors.Wrapf(err, "not authorized to enroll %s", name))
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkSameNames checks that the certificate request asks for exactly the
+// names of the current certificate.
+func checkSameNames(requested, current []string) error {
+	currentNames := map[string]bool{}
+	for _, name := range current {
+		currentNames[name] = true
+	}
+
+	var added []string
+	for _, name := range requested {
+		if !currentNames[name] {
+			added = append(added, name)
+		}
+		delete(currentNames, name)
+	}
+	var removed []string
+	for name := range currentNames {
+		removed = append(removed, name)
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	catcher := grip.NewBasicCatcher()
+	catcher.ErrorfWhen(len(added) > 0, "certificate request contains names that are not in the current certificate: %s", strings.Join(added, ", "))
+	catcher.ErrorfWhen(len(removed) > 0, "certificate request does not contain names in the current certificate: %s", strings.Join(removed, ", "))
+
+	return catcher.Resolve()
+}
+
+// clientCertificate returns the verified client certificate of the request,
+// or nil if the client did not present one.
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// pkcs7SignedData is a degenerate PKCS #7 SignedData structure, which only
+// contains certificates, as used by EST responses.
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []asn1.RawValue `asn1:"set"`
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	SignerInfos      []asn1.RawValue `asn1:"set"`
+}
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional"`
+}
+
+// marshalPKCS7Certificates returns the DER encoding of a certs-only PKCS #7
+// message containing the certificates.
+func marshalPKCS7Certificates(crts ...*x509.Certificate) ([]byte, error) {
+	var raw []byte
+	for _, crt := range crts {
+		raw = append(raw, crt.Raw...)
+	}
+
+	signedData, err := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []asn1.RawValue{},
+		ContentInfo:      pkcs7ContentInfo{ContentType: oidPKCS7Data},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw},
+		SignerInfos:      []asn1.RawValue{},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "problem encoding signed data")
+	}
+
+	data, err := asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidPKCS7SignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "problem encoding content info")
+	}
+
+	return data, nil
+}
+
+func writePKCS7Certificates(w http.ResponseWriter, crts ...*x509.Certificate) {
+	data, err := marshalPKCS7Certificates(crts...)
+	if err != nil {
+		writeESTError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pkcs7-mime; smime-type=certs-only")
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	_, err = w.Write([]byte(base64.StdEncoding.EncodeToString(data)))
+	grip.Warning(message.WrapError(err, "problem writing response"))
+}
+
+func checkESTMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeESTError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return false
+	}
+	return true
+}
+
+// writeESTError writes the error as plain text, which EST clients can show to
+// users.
+func writeESTError(w http.ResponseWriter, status int, err error) {
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deciduosity/certdepot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// parsePKCS7Certificates returns the certificates in the body of a certs-only
+// EST response.
+func parsePKCS7Certificates(t *testing.T, resp *http.Response) []*x509.Certificate {
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/pkcs7-mime; smime-type=certs-only", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	der, err := base64.StdEncoding.DecodeString(string(body))
+	require.NoError(t, err)
+
+	contentInfo := pkcs7ContentInfo{}
+	_, err = asn1.Unmarshal(der, &contentInfo)
+	require.NoError(t, err)
+	require.True(t, contentInfo.ContentType.Equal(oidPKCS7SignedData))
+	signedData := pkcs7SignedData{}
+	_, err = asn1.Unmarshal(contentInfo.Content.Bytes, &signedData)
+	require.NoError(t, err)
+	crts, err := x509.ParseCertificates(signedData.Certificates.Bytes)
+	require.NoError(t, err)
+
+	return crts
+}
+
+func TestESTHandler(t *testing.T) {
+	newCSR := func(t *testing.T, name string, domains ...string) (string, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: name}, DNSNames: domains}, key)
+		require.NoError(t, err)
+		return base64.StdEncoding.EncodeToString(csr), key
+	}
+	// newClient returns a client that trusts the same server as the base
+	// client and authenticates with the given certificates, if any.
+	newClient := func(base *http.Client, crts ...tls.Certificate) *http.Client {
+		conf := base.Transport.(*http.Transport).TLSClientConfig.Clone()
+		conf.Certificates = crts
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+	}
+	enroll := func(t *testing.T, client *http.Client, srv *httptest.Server, operation, csr string) *http.Response {
+		resp, err := client.Post(srv.URL+ESTPath+operation, "application/pkcs10", strings.NewReader(csr))
+		require.NoError(t, err)
+		return resp
+	}
+	// enrollDevice enrolls "device" with the bootstrap client and returns
+	// a client that authenticates with the new certificate.
+	enrollDevice := func(t *testing.T, srv *httptest.Server, bootstrap *http.Client, domains ...string) (*http.Client, *x509.Certificate) {
+		csr, key := newCSR(t, "device", domains...)
+		crts := parsePKCS7Certificates(t, enroll(t, bootstrap, srv, "simpleenroll", csr))
+		require.Len(t, crts, 1)
+		return newClient(bootstrap, tls.Certificate{Certificate: [][]byte{crts[0].Raw}, PrivateKey: key}), crts[0]
+	}
+
+	for testName, testCase := range map[string]func(t *testing.T, opts ESTOptions, srv *httptest.Server, bootstrap *http.Client){
+		"GetsCACertificates": func(t *testing.T, opts ESTOptions, srv *httptest.Server, bootstrap *http.Client) {
+			resp, err := newClient(bootstrap).Get(srv.URL + ESTPath + "cacerts")
+			require.NoError(t, err)
+			crts := parsePKCS7Certificates(t, resp)
+			require.Len(t, crts, 1)
+
+			expected, err := certdepot.GetCertificate(opts.Depot, caName)
+			require.NoError(t, err)
+			rawExpected, err := expected.GetRawCertificate()
+			require.NoError(t, err)
+			assert.Equal(t, rawExpected.Raw, crts[0].Raw)
+		},
+		"GetsCSRAttributes": func(t *testing.T, _ ESTOptions, srv *httptest.Server, bootstrap *http.Client) {
+			resp, err := newClient(bootstrap).Get(srv.URL + ESTPath + "csrattrs")
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		},
+		"EnrollsClient": func(t *testing.T, opts ESTOptions, srv *httptest.Server, bootstrap *http.Client) {
+			_, crt := enrollDevice(t, srv, bootstrap)
+			assert.Equal(t, "device", crt.Subject.CommonName)
+			caCrt, err := certdepot.GetCertificate(opts.Depot, caName)
+			require.NoError(t, err)
+			rawCACrt, err := caCrt.GetRawCertificate()
+			require.NoError(t, err)
+			assert.NoError(t, crt.CheckSignatureFrom(rawCACrt))
+
+			assert.True(t, opts.Depot.Check(certdepot.CrtTag("device")))
+			assert.True(t, opts.Depot.Check(certdepot.CsrTag("device")))
+			assert.False(t, opts.Depot.Check(certdepot.PrivKeyTag("device")))
+			ttl, err := opts.Depot.(certdepot.ExpirationManager).GetTTL("device")
+			require.NoError(t, err)
+			assert.True(t, ttl.Equal(crt.NotAfter))
+		},
+		"EnrollFailsWithoutClientCertificate": func(t *testing.T, opts ESTOptions, srv *httptest.Server, bootstrap *http.Client) {
+			csr, _ := newCSR(t, "device")
+			resp := enroll(t, newClient(bootstrap), srv, "simpleenroll", csr)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+			assert.False(t, opts.Depot.Check(certdepot.CrtTag("device")))
+		},
+		"EnrollFailsForExistingCertificate": func(t *testing.T, _ ESTOptions, srv *httptest.Server, bootstrap *http.Client) {
+			csr, _ := newCSR(t, "server")
+			resp := enroll(t, bootstrap, srv, "simpleenroll", csr)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusConflict, resp.StatusCode)
+		},
+		"EnrollFailsWithInvalidRequest": func(t *testing.T, _ ESTOptions, srv *httptest.Server, bootstrap *http.Client) {
+			caCSR, _ := newCSR(t, caName)
+			for reqName, csr := range map[string]string{
+				"InvalidBase64": "invalid!",
+				"InvalidCSR":    base64.StdEncoding.EncodeToString([]byte("invalid")),
+				"CAName":        caCSR,
+			} {
+				resp := enroll(t, bootstrap, srv, "simpleenroll", csr)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode, reqName)
+			}
+
+			resp, err := bootstrap.Get(srv.URL + ESTPath + "simpleenroll")
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+		},
+		"AuthorizerAllowsEnrollmentWithoutClientCertificate": func(t *testing.T, _ ESTOptions, srv *httptest.Server, bootstrap *http.Client) {
+			client := newClient(bootstrap)
+			csr, _ := newCSR(t, "device")
+			crts := parsePKCS7Certificates(t, enroll(t, client, srv, "simpleenroll", csr))
+			require.Len(t, crts, 1)
+			assert.Equal(t, "device", crts[0].Subject.CommonName)
+
+			csr, _ = newCSR(t, "other")
+			resp := enroll(t, client, srv, "simpleenroll", csr)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+			csr, _ = newCSR(t, "device", "other")
+			resp = enroll(t, client, srv, "simpleenroll", csr)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		},
+		"DefaultAuthorizerOnlyReenrolls": func(t *testing.T, opts ESTOptions, srv *httptest.Server, bootstrap *http.Client) {
+			csr, _ := newCSR(t, "device")
+			resp := enroll(t, bootstrap, srv, "simpleenroll", csr)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+			assert.False(t, opts.Depot.Check(certdepot.CrtTag("device")))
+
+			require.NoError(t, (&certdepot.CertificateOptions{
+				CA:         caName,
+				CommonName: "device",
+				Host:       "device",
+				Expires:    time.Hour,
+			}).CreateCertificate(opts.Depot))
+			before, err := opts.Depot.Get(certdepot.CrtTag("device"))
+			require.NoError(t, err)
+			creds, err := opts.Depot.Find("device")
+			require.NoError(t, err)
+			creds.ServerName = "server"
+			conf, err := creds.Resolve()
+			require.NoError(t, err)
+			device := &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+
+			crts := parsePKCS7Certificates(t, enroll(t, device, srv, "simplereenroll", csr))
+			require.Len(t, crts, 1)
+			assert.Equal(t, "device", crts[0].Subject.CommonName)
+			assert.False(t, opts.Depot.Check(certdepot.PrivKeyTag("device")))
+			archived, err := opts.Depot.Get(certdepot.CrtTag(certdepot.ArchiveName("device")))
+			require.NoError(t, err)
+			assert.Equal(t, before, archived)
+			assert.True(t, opts.Depot.Check(certdepot.PrivKeyTag(certdepot.ArchiveName("device"))))
+		},
+		"ConcurrentEnrollmentsIssueOneCertificate": func(t *testing.T, _ ESTOptions, srv *httptest.Server, bootstrap *http.Client) {
+			const enrollments = 10
+			statuses := make(chan int, enrollments)
+			wg := sync.WaitGroup{}
+			for i := 0; i < enrollments; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					csr, _ := newCSR(t, "device")
+					resp := enroll(t, bootstrap, srv, "simpleenroll", csr)
+					resp.Body.Close()
+					statuses <- resp.StatusCode
+				}()
+			}
+			wg.Wait()
+			close(statuses)
+
+			counts := map[int]int{}
+			for status := range statuses {
+				counts[status]++
+			}
+			assert.Equal(t, map[int]int{http.StatusOK: 1, http.StatusConflict: enrollments - 1}, counts)
+		},
+		"ReenrollsWithCurrentCertificate": func(t *testing.T, opts ESTOptions, srv *httptest.Server, bootstrap *http.Client) {
+			device, crt := enrollDevice(t, srv, bootstrap)
+			csr, _ := newCSR(t, "device")
+			crts := parsePKCS7Certificates(t, enroll(t, device, srv, "simplereenroll", csr))
+			require.Len(t, crts, 1)
+			assert.Equal(t, "device", crts[0].Subject.CommonName)
+			assert.NotEqual(t, crt.SerialNumber, crts[0].SerialNumber)
+
+			stored, err := certdepot.GetCertificate(opts.Depot, "device")
+			require.NoError(t, err)
+			rawStored, err := stored.GetRawCertificate()
+			require.NoError(t, err)
+			assert.Equal(t, crts[0].Raw, rawStored.Raw)
+
+			resp := enroll(t, device, srv, "simplereenroll", csr)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		},
+		"ReenrollMustKeepNames": func(t *testing.T, opts ESTOptions, srv *httptest.Server, bootstrap *http.Client) {
+			device, crt := enrollDevice(t, srv, bootstrap, "device.example.com")
+			for _, domains := range [][]string{nil, {"device.example.com", "other.example.com"}, {"other.example.com"}} {
+				csr, _ := newCSR(t, "device", domains...)
+				resp := enroll(t, device, srv, "simplereenroll", csr)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusForbidden, resp.StatusCode, domains)
+			}
+			stored, err := certdepot.GetCertificate(opts.Depot, "device")
+			require.NoError(t, err)
+			rawStored, err := stored.GetRawCertificate()
+			require.NoError(t, err)
+			assert.Equal(t, crt.Raw, rawStored.Raw)
+
+			csr, _ := newCSR(t, "device", "device.example.com")
+			crts := parsePKCS7Certificates(t, enroll(t, device, srv, "simplereenroll", csr))
+			require.Len(t, crts, 1)
+			assert.Equal(t, []string{"device.example.com"}, crts[0].DNSNames)
+		},
+		"ReenrollFailsWithoutCurrentCertificate": func(t *testing.T, opts ESTOptions, srv *httptest.Server, bootstrap *http.Client) {
+			device, _ := enrollDevice(t, srv, bootstrap)
+			csr, _ := newCSR(t, "device")
+
+			resp := enroll(t, newClient(bootstrap), srv, "simplereenroll", csr)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+			resp = enroll(t, bootstrap, srv, "simplereenroll", csr)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+			require.NoError(t, certdepot.Revoke(opts.Depot, caName, "device", 0))
+			resp = enroll(t, device, srv, "simplereenroll", csr)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			d := certdepot.NewMemoryDepot(certdepot.DepotOptions{CA: caName, DefaultExpiration: time.Hour})
+			require.NoError(t, (&certdepot.CertificateOptions{
+				CommonName: caName,
+				Expires:    24 * time.Hour,
+			}).Init(d))
+			for _, name := range []string{"server", "bootstrap"} {
+				require.NoError(t, (&certdepot.CertificateOptions{
+					CA:         caName,
+					CommonName: name,
+					Host:       name,
+					Domain:     []string{"server"},
+					Expires:    time.Hour,
+				}).CreateCertificate(d))
+			}
+
+			opts := ESTOptions{
+				Depot:      d,
+				CA:         caName,
+				Expiration: time.Hour,
+			}
+			switch testName {
+			case "AuthorizerAllowsEnrollmentWithoutClientCertificate":
+				opts.Authorize = func(client *x509.Certificate, endpoint Endpoint, name string) error {
+					if endpoint == EnrollEndpoint && name == "device" {
+						return nil
+					}
+					return assert.AnError
+				}
+			case "DefaultAuthorizerOnlyReenrolls":
+			default:
+				// Allow clients with a certificate from the CA to
+				// enroll any name.
+				opts.Authorize = func(client *x509.Certificate, endpoint Endpoint, name string) error {
+					if endpoint == EnrollEndpoint && client != nil {
+						return nil
+					}
+					return defaultAuthorize(client, endpoint, name)
+				}
+			}
+			h, err := NewESTHandler(opts)
+			require.NoError(t, err)
+
+			serverCreds, err := d.Find("server")
+			require.NoError(t, err)
+			srv := httptest.NewUnstartedServer(h)
+			srv.TLS, err = TLSConfig(serverCreds)
+			require.NoError(t, err)
+			srv.TLS.ClientAuth = tls.VerifyClientCertIfGiven
+			srv.StartTLS()
+			defer srv.Close()
+
+			bootstrapCreds, err := d.Find("bootstrap")
+			require.NoError(t, err)
+			bootstrapCreds.ServerName = "server"
+			bootstrapConf, err := bootstrapCreds.Resolve()
+			require.NoError(t, err)
+			bootstrap := &http.Client{Transport: &http.Transport{TLSClientConfig: bootstrapConf}}
+
+			testCase(t, opts, srv, bootstrap)
+		})
+	}
+	t.Run("NewESTHandlerFailsWithInvalidOptions", func(t *testing.T) {
+		for optsName, opts := range map[string]ESTOptions{
+			"MissingDepot":      {CA: caName, Expiration: time.Hour},
+			"MissingCA":         {Depot: certdepot.NewMemoryDepot(certdepot.DepotOptions{}), Expiration: time.Hour},
+			"MissingExpiration": {Depot: certdepot.NewMemoryDepot(certdepot.DepotOptions{}), CA: caName},
+		} {
+			_, err := NewESTHandler(opts)
+			assert.Error(t, err, optsName)
+		}
+	})
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha512" // needed for ES384 and ES512
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+// jwsMessage is a JWS in the flattened JSON serialization, which is the only
+// serialization that ACME allows.
+type jwsMessage struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// jwsHeader is the protected header of an ACME request. Exactly one of JWK and
+// KID is set.
+type jwsHeader struct {
+	Alg   string          `json:"alg"`
+	JWK   json.RawMessage `json:"jwk,omitempty"`
+	KID   string          `json:"kid,omitempty"`
+	Nonce string          `json:"nonce"`
+	URL   string          `json:"url"`
+}
+
+// jwk is a public key in the JSON Web Key format. Only RSA and EC keys are
+// supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// parseJWS decodes the protected header and payload of the message without
+// verifying the signature.
+func parseJWS(data []byte) (*jwsMessage, *jwsHeader, []byte, error) {
+	msg := &jwsMessage{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, nil, nil, errors.Wrap(err, "problem decoding JWS")
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(msg.Protected)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "problem decoding protected header")
+	}
+	header := &jwsHeader{}
+	if err = json.Unmarshal(rawHeader, header); err != nil {
+		return nil, nil, nil, errors.Wrap(err, "problem decoding protected header")
+	}
+	if (len(header.JWK) == 0) == (header.KID == "") {
+		return nil, nil, nil, errors.New("protected header must contain exactly one of jwk and kid")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(msg.Payload)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "problem decoding payload")
+	}
+
+	return msg, header, payload, nil
+}
+
+// verify checks the signature of the message with the public key.
+func (msg *jwsMessage) verify(alg string, key crypto.PublicKey) error {
+	sig, err := base64.RawURLEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return errors.Wrap(err, "problem decoding signature")
+	}
+
+	hash, err := jwsHash(alg, key)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	h := hash.New()
+	_, _ = h.Write([]byte(msg.Protected + "." + msg.Payload))
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		return errors.Wrap(rsa.VerifyPKCS1v15(pub, hash, digest, sig), "invalid signature")
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return errors.New("unsupported key type")
+	}
+}
+
+// jwsHash returns the hash for the algorithm after checking that the
+// algorithm can be used with the key.
+func jwsHash(alg string, key crypto.PublicKey) (crypto.Hash, error) {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if alg == "RS256" {
+			return crypto.SHA256, nil
+		}
+	case *ecdsa.PublicKey:
+		switch {
+		case alg == "ES256" && pub.Curve == elliptic.P256():
+			return crypto.SHA256, nil
+		case alg == "ES384" && pub.Curve == elliptic.P384():
+			return crypto.SHA384, nil
+		case alg == "ES512" && pub.Curve == elliptic.P521():
+			return crypto.SHA512, nil
+		}
+	}
+
+	return 0, errors.Errorf("unsupported algorithm '%s' for key", alg)
+}
+
+// parseJWK returns the public key in the JSON Web Key.
+func parseJWK(data []byte) (crypto.PublicKey, error) {
+	key := jwk{}
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, errors.Wrap(err, "problem decoding JWK")
+	}
+
+	decode := func(field, value string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(b) == 0 {
+			return nil, errors.Errorf("invalid JWK field '%s'", field)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch key.Kty {
+	case "RSA":
+		n, err := decode("n", key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode("e", key.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 || n.BitLen() < 2048 {
+			return nil, errors.New("unsupported RSA key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported curve '%s'", key.Crv)
+		}
+		x, err := decode("x", key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode("y", key.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, errors.Errorf("unsupported key type '%s'", key.Kty)
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+)
+
+func TestJWS(t *testing.T) {
+	encode := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecJWK := jwk{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   encode(ecKey.X.Bytes()),
+		Y:   encode(ecKey.Y.Bytes()),
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaJWK := jwk{
+		Kty: "RSA",
+		N:   encode(rsaKey.N.Bytes()),
+		E:   encode(big.NewInt(int64(rsaKey.E)).Bytes()),
+	}
+	// sign returns a JWS for the payload signed with the P-256 key.
+	sign := func(t *testing.T, header jwsHeader, payload string) []byte {
+		protected, err := json.Marshal(header)
+		require.NoError(t, err)
+		msg := jwsMessage{Protected: encode(protected), Payload: encode([]byte(payload))}
+		digest := sha256.Sum256([]byte(msg.Protected + "." + msg.Payload))
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		require.NoError(t, err)
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		msg.Signature = encode(sig)
+		data, err := json.Marshal(msg)
+		require.NoError(t, err)
+		return data
+	}
+
+	t.Run("ParsesKeys", func(t *testing.T) {
+		for keyName, testCase := range map[string]struct {
+			jwk jwk
+			key crypto.PublicKey
+		}{
+			"EC":  {jwk: ecJWK, key: ecKey.Public()},
+			"RSA": {jwk: rsaJWK, key: rsaKey.Public()},
+		} {
+			data, err := json.Marshal(testCase.jwk)
+			require.NoError(t, err)
+			key, err := parseJWK(data)
+			require.NoError(t, err, keyName)
+
+			thumbprint, err := acme.JWKThumbprint(key)
+			require.NoError(t, err)
+			expected, err := acme.JWKThumbprint(testCase.key)
+			require.NoError(t, err)
+			assert.Equal(t, expected, thumbprint, keyName)
+		}
+	})
+	t.Run("RejectsInvalidKeys", func(t *testing.T) {
+		smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+		require.NoError(t, err)
+		offCurve := ecJWK
+		offCurve.Y = encode(new(big.Int).Add(ecKey.Y, big.NewInt(1)).Bytes())
+		otherCurve := ecJWK
+		otherCurve.Crv = "P-224"
+
+		for keyName, key := range map[string]jwk{
+			"SmallRSA":   {Kty: "RSA", N: encode(smallKey.N.Bytes()), E: rsaJWK.E},
+			"OffCurve":   offCurve,
+			"OtherCurve": otherCurve,
+			"MissingX":   {Kty: "EC", Crv: "P-256", Y: ecJWK.Y},
+			"Symmetric":  {Kty: "oct"},
+		} {
+			data, err := json.Marshal(key)
+			require.NoError(t, err)
+			_, err = parseJWK(data)
+			assert.Error(t, err, keyName)
+		}
+	})
+	t.Run("VerifiesSignature", func(t *testing.T) {
+		jwkData, err := json.Marshal(ecJWK)
+		require.NoError(t, err)
+		msg, header, payload, err := parseJWS(sign(t, jwsHeader{Alg: "ES256", JWK: jwkData, Nonce: "nonce", URL: "url"}, "{}"))
+		require.NoError(t, err)
+		assert.Equal(t, "nonce", header.Nonce)
+		assert.Equal(t, "url", header.URL)
+		assert.Equal(t, []byte("{}"), payload)
+
+		key, err := parseJWK(header.JWK)
+		require.NoError(t, err)
+		assert.NoError(t, msg.verify(header.Alg, key))
+		assert.Error(t, msg.verify("ES384", key))
+		assert.Error(t, msg.verify("RS256", rsaKey.Public()))
+
+		otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		assert.Error(t, msg.verify(header.Alg, otherKey.Public()))
+
+		msg.Payload = encode([]byte("tampered"))
+		assert.Error(t, msg.verify(header.Alg, key))
+	})
+	t.Run("RejectsHeaderWithoutExactlyOneKey", func(t *testing.T) {
+		jwkData, err := json.Marshal(ecJWK)
+		require.NoError(t, err)
+
+		_, _, _, err = parseJWS(sign(t, jwsHeader{Alg: "ES256", Nonce: "nonce", URL: "url"}, "{}"))
+		assert.Error(t, err)
+		_, _, _, err = parseJWS(sign(t, jwsHeader{Alg: "ES256", JWK: jwkData, KID: "kid", Nonce: "nonce", URL: "url"}, "{}"))
+		assert.Error(t, err)
+		_, _, _, err = parseJWS([]byte("invalid"))
+		assert.Error(t, err)
+	})
+}
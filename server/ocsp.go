@@ -0,0 +1,632 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cdr/grip"
+	"github.com/cdr/grip/message"
+	"github.com/deciduosity/certdepot"
+	"github.com/pkg/errors"
+	cpkix "github.com/square/certstrap/pkix"
+	"golang.org/x/crypto/ocsp"
+)
+
+// oidOCSPNonce is the id-pkix-ocsp-nonce extension defined in RFC 8954.
+var oidOCSPNonce = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}
+
+const (
+	// maxOCSPNonceSize is the maximum length of a nonce defined in RFC
+	// 8954.
+	maxOCSPNonceSize = 32
+	// ocspIndexInterval is the shortest time between searches of the depot
+	// for the certificates issued by the CA.
+	ocspIndexInterval = 10 * time.Second
+	// ocspPruneInterval is the shortest time between removals of expired
+	// responses from the cache.
+	ocspPruneInterval = time.Minute
+)
+
+// OCSPOptions contains options for the OCSP handler.
+type OCSPOptions struct {
+	// Depot holding the CA.
+	Depot certdepot.Depot `bson:"-" json:"-" yaml:"-"`
+	// Name of the CA whose certificates the responder reports on.
+	CA string `bson:"ca" json:"ca" yaml:"ca"`
+	// Passphrase to decrypt the CA's private-key PEM block.
+	CAPassphrase string `bson:"ca_passphrase,omitempty" json:"ca_passphrase,omitempty" yaml:"ca_passphrase,omitempty"`
+	// Name of the credentials in the depot to sign responses with, which
+	// must be a delegated OCSP signer issued by the CA, such as one created
+	// with CertificateOptions.OCSPSigner. If empty, responses are signed
+	// with the CA key.
+	Signer string `bson:"signer,omitempty" json:"signer,omitempty" yaml:"signer,omitempty"`
+	// Passphrase to decrypt the signer's private-key PEM block.
+	SignerPassphrase string `bson:"signer_passphrase,omitempty" json:"signer_passphrase,omitempty" yaml:"signer_passphrase,omitempty"`
+	// How long responses are valid, which is also how long they are
+	// cached (defaults to one hour).
+	ValidFor time.Duration `bson:"valid_for,omitempty" json:"valid_for,omitempty" yaml:"valid_for,omitempty"`
+	// The maximum number of responses to cache (defaults to 10000).
+	CacheSize int `bson:"cache_size,omitempty" json:"cache_size,omitempty" yaml:"cache_size,omitempty"`
+}
+
+// Validate checks that the required options are set.
+func (opts *OCSPOptions) Validate() error {
+	catcher := grip.NewBasicCatcher()
+
+	catcher.NewWhen(opts.Depot == nil, "must specify a depot")
+	catcher.NewWhen(opts.CA == "", "must specify the name of the CA")
+	catcher.NewWhen(opts.ValidFor < 0, "validity cannot be negative")
+	catcher.NewWhen(opts.CacheSize < 0, "cache size cannot be negative")
+	if catcher.HasErrors() {
+		return catcher.Resolve()
+	}
+
+	if opts.ValidFor == 0 {
+		opts.ValidFor = time.Hour
+	}
+	if opts.CacheSize == 0 {
+		opts.CacheSize = 10000
+	}
+
+	return nil
+}
+
+// OCSPHandler is an http.Handler that implements an OCSP responder (RFC 6960)
+// for the certificates issued by a CA in a depot. It accepts requests by POST
+// or, as described in RFC 5019, by GET with the base64-encoded request as the
+// last element of the path.
+//
+// A certificate is reported as revoked if its serial number is in the CA's
+// CRL, as good if a certificate with its serial number issued by the CA is in
+// the depot, and as unknown otherwise. The depot must implement
+// certdepot.Lister so that the certificates issued by the CA can be found,
+// which is done at most every ten seconds, so a certificate may be reported
+// as unknown for a few seconds after it is issued. Responses for known
+// certificates are cached until they expire or the CRL changes, with the least
+// recently used responses evicted once the cache is full, except for
+// responses to requests with a nonce, which are signed for every request and
+// include the nonce.
+type OCSPHandler struct {
+	opts      OCSPOptions
+	lister    certdepot.Lister
+	caCrt     *x509.Certificate
+	signerCrt *x509.Certificate
+	signer    crypto.Signer
+	sigAlg    x509.SignatureAlgorithm
+
+	mu        sync.Mutex
+	crlDigest [sha256.Size]byte
+	cache     *ocspCache
+
+	// indexMu serializes searches of the depot for issued certificates.
+	indexMu sync.Mutex
+	issued  map[string]bool
+	indexed time.Time
+}
+
+type cachedOCSPResponse struct {
+	data       []byte
+	thisUpdate time.Time
+	nextUpdate time.Time
+}
+
+// NewOCSPHandler returns a handler that reports the revocation status of
+// certificates issued by the CA with the given options.
+func NewOCSPHandler(opts OCSPOptions) (*OCSPHandler, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+
+	lister, ok := opts.Depot.(certdepot.Lister)
+	if !ok {
+		return nil, errors.New("depot must support listing to find issued certificates")
+	}
+	caCrt, caKey, err := getCredentials(opts.Depot, opts.CA, opts.CAPassphrase)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem getting CA credentials")
+	}
+	h := &OCSPHandler{
+		opts:   opts,
+		lister: lister,
+		caCrt:  caCrt,
+		cache:  newOCSPCache(opts.CacheSize),
+		issued: map[string]bool{},
+	}
+
+	key := caKey
+	if opts.Signer != "" {
+		var signerCrt *x509.Certificate
+		signerCrt, key, err = getCredentials(opts.Depot, opts.Signer, opts.SignerPassphrase)
+		if err != nil {
+			return nil, errors.Wrap(err, "problem getting signer credentials")
+		}
+		if err = signerCrt.CheckSignatureFrom(caCrt); err != nil {
+			return nil, errors.Wrapf(err, "signer %s was not issued by %s", opts.Signer, opts.CA)
+		}
+		if !hasExtKeyUsage(signerCrt, x509.ExtKeyUsageOCSPSigning) {
+			return nil, errors.Errorf("signer %s is not allowed to sign OCSP responses", opts.Signer)
+		}
+		h.signerCrt = signerCrt
+	}
+
+	if h.signer, ok = key.Private.(crypto.Signer); !ok {
+		return nil, errors.New("signing key does not support signing")
+	}
+	switch h.signer.Public().(type) {
+	case *rsa.PublicKey:
+		h.sigAlg = x509.SHA256WithRSA
+	case *ecdsa.PublicKey:
+		h.sigAlg = x509.ECDSAWithSHA256
+	default:
+		return nil, errors.New("unsupported signing key type")
+	}
+
+	return h, nil
+}
+
+// ServeHTTP responds to the OCSP request.
+func (h *OCSPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var der []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		path := r.URL.EscapedPath()
+		var encoded string
+		if encoded, err = url.PathUnescape(path[strings.LastIndex(path, "/")+1:]); err == nil {
+			der, err = base64.StdEncoding.DecodeString(encoded)
+		}
+	case http.MethodPost:
+		der, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	default:
+		w.Header().Set("Allow", strings.Join([]string{http.MethodGet, http.MethodPost}, ", "))
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		writeOCSPResponse(w, ocsp.MalformedRequestErrorResponse)
+		return
+	}
+
+	req, err := ocsp.ParseRequest(der)
+	if err != nil {
+		writeOCSPResponse(w, ocsp.MalformedRequestErrorResponse)
+		return
+	}
+	nonce, err := parseOCSPNonce(der)
+	if err != nil {
+		writeOCSPResponse(w, ocsp.MalformedRequestErrorResponse)
+		return
+	}
+	if !h.isIssuer(req) {
+		writeOCSPResponse(w, ocsp.UnauthorizedErrorResponse)
+		return
+	}
+
+	resp, err := h.respond(req, nonce)
+	if err != nil {
+		grip.Warning(message.WrapError(err, message.Fields{
+			"message": "problem creating OCSP response",
+			"ca":      h.opts.CA,
+			"serial":  req.SerialNumber.String(),
+		}))
+		writeOCSPResponse(w, ocsp.InternalErrorErrorResponse)
+		return
+	}
+
+	if nonce == nil && r.Method == http.MethodGet && !resp.nextUpdate.IsZero() {
+		maxAge := int(time.Until(resp.nextUpdate).Seconds())
+		if maxAge < 0 {
+			maxAge = 0
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, public, no-transform, must-revalidate", maxAge))
+		w.Header().Set("Last-Modified", resp.thisUpdate.UTC().Format(http.TimeFormat))
+		w.Header().Set("Expires", resp.nextUpdate.UTC().Format(http.TimeFormat))
+	}
+	writeOCSPResponse(w, resp.data)
+}
+
+// respond returns the response for the request, from the cache if possible.
+// Responses for unknown certificates are not cached, and do not have a next
+// update, since the certificate may have been issued since the depot was last
+// searched.
+func (h *OCSPHandler) respond(req *ocsp.Request, nonce *pkix.Extension) (*cachedOCSPResponse, error) {
+	crlDigest, err := h.checkCRL()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	key := fmt.Sprintf("%d/%s", req.HashAlgorithm, req.SerialNumber.Text(16))
+	if nonce == nil {
+		h.mu.Lock()
+		cached, ok := h.cache.get(key, time.Now())
+		h.mu.Unlock()
+		if ok {
+			return cached, nil
+		}
+	}
+
+	entry, err := certdepot.FindRevocation(h.opts.Depot, h.opts.CA, req.SerialNumber)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem checking revocation")
+	}
+	known := entry != nil
+	if !known {
+		if known, err = h.isIssued(req.SerialNumber); err != nil {
+			return nil, errors.Wrap(err, "problem finding issued certificate")
+		}
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	template := ocsp.Response{
+		Status:             ocsp.Good,
+		SerialNumber:       req.SerialNumber,
+		ThisUpdate:         now,
+		NextUpdate:         now.Add(h.opts.ValidFor),
+		IssuerHash:         req.HashAlgorithm,
+		Certificate:        h.signerCrt,
+		SignatureAlgorithm: h.sigAlg,
+	}
+	switch {
+	case entry != nil:
+		template.Status = ocsp.Revoked
+		template.RevokedAt = entry.RevocationTime
+		template.RevocationReason = entry.ReasonCode
+	case !known:
+		template.Status = ocsp.Unknown
+		template.NextUpdate = time.Time{}
+	}
+	responderCrt := h.caCrt
+	if h.signerCrt != nil {
+		responderCrt = h.signerCrt
+	}
+
+	data, err := ocsp.CreateResponse(h.caCrt, responderCrt, template, h.signer)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem creating response")
+	}
+	resp := &cachedOCSPResponse{data: data, thisUpdate: template.ThisUpdate, nextUpdate: template.NextUpdate}
+
+	if nonce != nil {
+		if resp.data, err = addOCSPResponseExtension(data, *nonce, h.signer); err != nil {
+			return nil, errors.Wrap(err, "problem adding nonce to response")
+		}
+		return resp, nil
+	}
+	if !known {
+		return resp, nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Do not cache the response if the CRL changed while it was created.
+	if h.crlDigest == crlDigest {
+		h.cache.put(key, resp, time.Now())
+	}
+
+	return resp, nil
+}
+
+// isIssued returns whether a certificate with the serial number issued by the
+// CA is in the depot, including certificates archived by renewal. If the
+// serial number is not among those found by the last search, the depot is
+// searched again, unless it was searched less than ocspIndexInterval ago.
+func (h *OCSPHandler) isIssued(serial *big.Int) (bool, error) {
+	h.indexMu.Lock()
+	defer h.indexMu.Unlock()
+
+	if h.issued[serial.Text(16)] {
+		return true, nil
+	}
+	if time.Since(h.indexed) < ocspIndexInterval {
+		return false, nil
+	}
+
+	names, err := h.lister.List(certdepot.CrtKind)
+	if err != nil {
+		return false, errors.Wrap(err, "problem listing certificates")
+	}
+	issued := map[string]bool{}
+	for _, name := range names {
+		crt, err := certdepot.GetCertificate(h.opts.Depot, name)
+		if err != nil {
+			// The certificate may have been deleted since it was
+			// listed.
+			continue
+		}
+		rawCrt, err := crt.GetRawCertificate()
+		if err != nil || !bytes.Equal(rawCrt.RawIssuer, h.caCrt.RawSubject) {
+			continue
+		}
+		if rawCrt.CheckSignatureFrom(h.caCrt) == nil {
+			issued[rawCrt.SerialNumber.Text(16)] = true
+		}
+	}
+	h.issued = issued
+	h.indexed = time.Now()
+
+	return issued[serial.Text(16)], nil
+}
+
+// checkCRL clears the cache if the CA's CRL has changed since it was last
+// checked and returns the digest of the current CRL. It errors if the CA does
+// not have a CRL, since the revocation status of certificates is then unknown.
+func (h *OCSPHandler) checkCRL() ([sha256.Size]byte, error) {
+	crl, err := h.opts.Depot.Get(certdepot.CrlTag(h.opts.CA))
+	if err != nil {
+		return [sha256.Size]byte{}, errors.Wrap(err, "problem getting CRL")
+	}
+	digest := sha256.Sum256(crl)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if digest != h.crlDigest {
+		h.crlDigest = digest
+		h.cache.clear()
+	}
+
+	return digest, nil
+}
+
+// ocspCache holds responses by key, up to a maximum number of responses, after
+// which the least recently used response is evicted. Expired responses are
+// removed when they are looked up and periodically when responses are added.
+type ocspCache struct {
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+	pruned  time.Time
+}
+
+type ocspCacheEntry struct {
+	key  string
+	resp *cachedOCSPResponse
+}
+
+func newOCSPCache(size int) *ocspCache {
+	return &ocspCache{
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// get returns the unexpired response with the key, if any.
+func (c *ocspCache) get(key string, now time.Time) (*cachedOCSPResponse, bool) {
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*ocspCacheEntry)
+	if !now.Before(entry.resp.nextUpdate) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+
+	return entry.resp, true
+}
+
+// put adds or replaces the response with the key, evicting responses if the
+// cache is full.
+func (c *ocspCache) put(key string, resp *cachedOCSPResponse, now time.Time) {
+	if now.Sub(c.pruned) >= ocspPruneInterval {
+		c.prune(now)
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*ocspCacheEntry).resp = resp
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&ocspCacheEntry{key: key, resp: resp})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// prune removes the expired responses.
+func (c *ocspCache) prune(now time.Time) {
+	c.pruned = now
+	for elem := c.order.Front(); elem != nil; {
+		next := elem.Next()
+		if !now.Before(elem.Value.(*ocspCacheEntry).resp.nextUpdate) {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
+
+func (c *ocspCache) remove(elem *list.Element) {
+	delete(c.entries, elem.Value.(*ocspCacheEntry).key)
+	c.order.Remove(elem)
+}
+
+func (c *ocspCache) clear() {
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
+
+// isIssuer returns whether the request is for a certificate issued by the CA.
+func (h *OCSPHandler) isIssuer(req *ocsp.Request) bool {
+	if !req.HashAlgorithm.Available() {
+		return false
+	}
+
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(h.caCrt.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return false
+	}
+
+	hash := req.HashAlgorithm.New()
+	_, _ = hash.Write(h.caCrt.RawSubject)
+	nameHash := hash.Sum(nil)
+	hash.Reset()
+	_, _ = hash.Write(publicKeyInfo.PublicKey.RightAlign())
+	keyHash := hash.Sum(nil)
+
+	return string(nameHash) == string(req.IssuerNameHash) && string(keyHash) == string(req.IssuerKeyHash)
+}
+
+// The following types mirror the ASN.1 structures of OCSP requests and
+// responses in RFC 6960, which the ocsp package does not expose. They only
+// decode as much as is needed to handle request and response extensions.
+
+type ocspRequestASN1 struct {
+	TBSRequest ocspTBSRequest
+	Signature  asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspTBSRequest struct {
+	Version           int           `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName     asn1.RawValue `asn1:"explicit,tag:1,optional"`
+	RequestList       []asn1.RawValue
+	RequestExtensions []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+type ocspResponseASN1 struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    ocspResponseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version            int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID     asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []asn1.RawValue
+	ResponseExtensions []pkix.Extension `asn1:"optional,explicit,tag:1"`
+}
+
+// parseOCSPNonce returns the nonce extension of the DER-encoded request, or
+// nil if it does not have one.
+func parseOCSPNonce(der []byte) (*pkix.Extension, error) {
+	req := ocspRequestASN1{}
+	if _, err := asn1.Unmarshal(der, &req); err != nil {
+		return nil, errors.Wrap(err, "problem decoding request")
+	}
+
+	for _, ext := range req.TBSRequest.RequestExtensions {
+		if !ext.Id.Equal(oidOCSPNonce) {
+			continue
+		}
+		var nonce []byte
+		if _, err := asn1.Unmarshal(ext.Value, &nonce); err != nil {
+			return nil, errors.Wrap(err, "problem decoding nonce")
+		}
+		if len(nonce) == 0 || len(nonce) > maxOCSPNonceSize {
+			return nil, errors.Errorf("nonce must be between 1 and %d bytes", maxOCSPNonceSize)
+		}
+		return &pkix.Extension{Id: ext.Id, Value: ext.Value}, nil
+	}
+
+	return nil, nil
+}
+
+// addOCSPResponseExtension adds the extension to the response data of the
+// DER-encoded response, which must have been signed with the key using
+// SHA-256, and signs it again.
+func addOCSPResponseExtension(der []byte, ext pkix.Extension, key crypto.Signer) ([]byte, error) {
+	resp := ocspResponseASN1{}
+	if _, err := asn1.Unmarshal(der, &resp); err != nil {
+		return nil, errors.Wrap(err, "problem decoding response")
+	}
+	basic := ocspBasicResponse{}
+	if _, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil {
+		return nil, errors.Wrap(err, "problem decoding basic response")
+	}
+	basic.TBSResponseData.ResponseExtensions = append(basic.TBSResponseData.ResponseExtensions, ext)
+
+	tbs, err := asn1.Marshal(basic.TBSResponseData)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem encoding response data")
+	}
+	digest := sha256.Sum256(tbs)
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem signing response data")
+	}
+	basic.Signature = asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)}
+
+	if resp.Response.Response, err = asn1.Marshal(basic); err != nil {
+		return nil, errors.Wrap(err, "problem encoding basic response")
+	}
+	data, err := asn1.Marshal(resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem encoding response")
+	}
+
+	return data, nil
+}
+
+// getCredentials returns the certificate and key with the given name from the
+// depot.
+func getCredentials(d certdepot.Depot, name, passphrase string) (*x509.Certificate, *cpkix.Key, error) {
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	crt, err := certdepot.GetCertificate(d, formattedName)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "problem getting certificate for %s", name)
+	}
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "problem getting raw certificate for %s", name)
+	}
+
+	var key *cpkix.Key
+	if passphrase == "" {
+		key, err = certdepot.GetPrivateKey(d, formattedName)
+	} else {
+		key, err = certdepot.GetEncryptedPrivateKey(d, formattedName, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "problem getting key for %s", name)
+	}
+
+	return rawCrt, key, nil
+}
+
+func hasExtKeyUsage(crt *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range crt.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
+
+func writeOCSPResponse(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	_, err := w.Write(data)
+	grip.Warning(message.WrapError(err, "problem writing response"))
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/deciduosity/certdepot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestOCSPHandler(t *testing.T) {
+	getCertificate := func(t *testing.T, d certdepot.Depot, name string) *x509.Certificate {
+		crt, err := certdepot.GetCertificate(d, name)
+		require.NoError(t, err)
+		rawCrt, err := crt.GetRawCertificate()
+		require.NoError(t, err)
+		return rawCrt
+	}
+	newRequest := func(t *testing.T, d certdepot.Depot, name string) []byte {
+		req, err := ocsp.CreateRequest(getCertificate(t, d, name), getCertificate(t, d, caName), nil)
+		require.NoError(t, err)
+		return req
+	}
+	// addNonce adds a nonce extension to the request.
+	addNonce := func(t *testing.T, der []byte, nonce []byte) []byte {
+		req := ocspRequestASN1{}
+		_, err := asn1.Unmarshal(der, &req)
+		require.NoError(t, err)
+		value, err := asn1.Marshal(nonce)
+		require.NoError(t, err)
+		req.TBSRequest.RequestExtensions = append(req.TBSRequest.RequestExtensions, pkix.Extension{Id: oidOCSPNonce, Value: value})
+		data, err := asn1.Marshal(req)
+		require.NoError(t, err)
+		return data
+	}
+	post := func(t *testing.T, srv *httptest.Server, req []byte) []byte {
+		resp, err := http.Post(srv.URL, "application/ocsp-request", bytes.NewReader(req))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/ocsp-response", resp.Header.Get("Content-Type"))
+		data, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return data
+	}
+	parse := func(t *testing.T, d certdepot.Depot, data []byte) *ocsp.Response {
+		resp, err := ocsp.ParseResponse(data, getCertificate(t, d, caName))
+		require.NoError(t, err)
+		return resp
+	}
+
+	for testName, testCase := range map[string]func(t *testing.T, d certdepot.Depot, srv *httptest.Server){
+		"ReportsGoodCertificate": func(t *testing.T, d certdepot.Depot, srv *httptest.Server) {
+			resp := parse(t, d, post(t, srv, newRequest(t, d, "server")))
+			assert.Equal(t, ocsp.Good, resp.Status)
+			assert.Zero(t, resp.SerialNumber.Cmp(getCertificate(t, d, "server").SerialNumber))
+			assert.Nil(t, resp.Certificate)
+			assert.Equal(t, time.Hour, resp.NextUpdate.Sub(resp.ThisUpdate))
+		},
+		"ReportsRevokedCertificate": func(t *testing.T, d certdepot.Depot, srv *httptest.Server) {
+			req := newRequest(t, d, "server")
+			assert.Equal(t, ocsp.Good, parse(t, d, post(t, srv, req)).Status)
+
+			require.NoError(t, certdepot.Revoke(d, caName, "server", ocsp.KeyCompromise))
+			resp := parse(t, d, post(t, srv, req))
+			assert.Equal(t, ocsp.Revoked, resp.Status)
+			assert.Equal(t, ocsp.KeyCompromise, resp.RevocationReason)
+			assert.False(t, resp.RevokedAt.IsZero())
+
+			assert.Equal(t, ocsp.Good, parse(t, d, post(t, srv, newRequest(t, d, "client"))).Status)
+		},
+		"ReportsUnknownCertificate": func(t *testing.T, d certdepot.Depot, srv *httptest.Server) {
+			crt := *getCertificate(t, d, "server")
+			crt.SerialNumber = new(big.Int).Add(crt.SerialNumber, big.NewInt(1))
+			req, err := ocsp.CreateRequest(&crt, getCertificate(t, d, caName), nil)
+			require.NoError(t, err)
+			resp := parse(t, d, post(t, srv, req))
+			assert.Equal(t, ocsp.Unknown, resp.Status)
+			assert.True(t, resp.NextUpdate.IsZero())
+
+			h := srv.Config.Handler.(*OCSPHandler)
+			h.mu.Lock()
+			assert.Zero(t, h.cache.order.Len())
+			h.mu.Unlock()
+
+			encoded := url.PathEscape(base64.StdEncoding.EncodeToString(req))
+			httpResp, err := http.Get(srv.URL + "/" + encoded)
+			require.NoError(t, err)
+			defer httpResp.Body.Close()
+			assert.Empty(t, httpResp.Header.Get("Expires"))
+		},
+		"ReportsNewlyIssuedCertificate": func(t *testing.T, d certdepot.Depot, srv *httptest.Server) {
+			assert.Equal(t, ocsp.Good, parse(t, d, post(t, srv, newRequest(t, d, "server"))).Status)
+			require.NoError(t, (&certdepot.CertificateOptions{
+				CA:         caName,
+				CommonName: "new",
+				Host:       "new",
+				Expires:    time.Hour,
+			}).CreateCertificate(d))
+			req := newRequest(t, d, "new")
+			assert.Equal(t, ocsp.Unknown, parse(t, d, post(t, srv, req)).Status)
+
+			h := srv.Config.Handler.(*OCSPHandler)
+			h.indexMu.Lock()
+			h.indexed = time.Time{}
+			h.indexMu.Unlock()
+			assert.Equal(t, ocsp.Good, parse(t, d, post(t, srv, req)).Status)
+		},
+		"ReportsArchivedCertificate": func(t *testing.T, d certdepot.Depot, srv *httptest.Server) {
+			req := newRequest(t, d, "server")
+			require.NoError(t, (&certdepot.CertificateOptions{
+				CA:         caName,
+				CommonName: "server",
+				Host:       "server",
+				Expires:    time.Hour,
+			}).Renew(d))
+			assert.Equal(t, ocsp.Good, parse(t, d, post(t, srv, req)).Status)
+		},
+		"ReportsRevokedCertificateAfterDeletion": func(t *testing.T, d certdepot.Depot, srv *httptest.Server) {
+			req := newRequest(t, d, "server")
+			require.NoError(t, certdepot.Revoke(d, caName, "server", ocsp.KeyCompromise))
+			require.NoError(t, certdepot.DeleteCertificate(d, "server"))
+			assert.Equal(t, ocsp.Revoked, parse(t, d, post(t, srv, req)).Status)
+		},
+		"BoundsCache": func(t *testing.T, d certdepot.Depot, _ *httptest.Server) {
+			h, err := NewOCSPHandler(OCSPOptions{Depot: d, CA: caName, CacheSize: 1})
+			require.NoError(t, err)
+			srv := httptest.NewServer(h)
+			defer srv.Close()
+
+			first := post(t, srv, newRequest(t, d, "server"))
+			post(t, srv, newRequest(t, d, "client"))
+			h.mu.Lock()
+			assert.Equal(t, 1, h.cache.order.Len())
+			assert.Len(t, h.cache.entries, 1)
+			h.mu.Unlock()
+			time.Sleep(1100 * time.Millisecond)
+			assert.NotEqual(t, first, post(t, srv, newRequest(t, d, "server")))
+
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			h.cache.prune(time.Now().Add(2 * time.Hour))
+			assert.Zero(t, h.cache.order.Len())
+			assert.Empty(t, h.cache.entries)
+		},
+		"FailsWithoutCRL": func(t *testing.T, d certdepot.Depot, srv *httptest.Server) {
+			require.NoError(t, d.Delete(certdepot.CrlTag(caName)))
+			_, err := ocsp.ParseResponse(post(t, srv, newRequest(t, d, "server")), nil)
+			assert.Equal(t, ocsp.ResponseError{Status: ocsp.InternalError}, err)
+		},
+		"SupportsGETRequests": func(t *testing.T, d certdepot.Depot, srv *httptest.Server) {
+			encoded := url.PathEscape(base64.StdEncoding.EncodeToString(newRequest(t, d, "server")))
+			resp, err := http.Get(srv.URL + "/ocsp/" + encoded)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Contains(t, resp.Header.Get("Cache-Control"), "max-age=")
+			assert.NotEmpty(t, resp.Header.Get("Expires"))
+			data, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, ocsp.Good, parse(t, d, data).Status)
+		},
+		"CachesResponses": func(t *testing.T, d certdepot.Depot, srv *httptest.Server) {
+			req := newRequest(t, d, "server")
+			first := post(t, srv, req)
+			time.Sleep(1100 * time.Millisecond)
+			assert.Equal(t, first, post(t, srv, req))
+
+			require.NoError(t, certdepot.Revoke(d, caName, "client", 0))
+			assert.NotEqual(t, first, post(t, srv, req))
+		},
+		"EchoesNonce": func(t *testing.T, d certdepot.Depot, srv *httptest.Server) {
+			nonce := []byte("0123456789abcdef")
+			req := addNonce(t, newRequest(t, d, "server"), nonce)
+			data := post(t, srv, req)
+			assert.Equal(t, ocsp.Good, parse(t, d, data).Status)
+
+			outer := ocspResponseASN1{}
+			_, err := asn1.Unmarshal(data, &outer)
+			require.NoError(t, err)
+			basic := ocspBasicResponse{}
+			_, err = asn1.Unmarshal(outer.Response.Response, &basic)
+			require.NoError(t, err)
+			require.Len(t, basic.TBSResponseData.ResponseExtensions, 1)
+			ext := basic.TBSResponseData.ResponseExtensions[0]
+			assert.True(t, ext.Id.Equal(oidOCSPNonce))
+			var echoed []byte
+			_, err = asn1.Unmarshal(ext.Value, &echoed)
+			require.NoError(t, err)
+			assert.Equal(t, nonce, echoed)
+
+			time.Sleep(1100 * time.Millisecond)
+			assert.NotEqual(t, data, post(t, srv, req))
+
+			resp, err := ocsp.ParseResponse(post(t, srv, addNonce(t, newRequest(t, d, "server"), bytes.Repeat([]byte("a"), 33))), nil)
+			assert.Equal(t, ocsp.ResponseError{Status: ocsp.Malformed}, err)
+			assert.Nil(t, resp)
+		},
+		"SignsWithDelegatedSigner": func(t *testing.T, d certdepot.Depot, _ *httptest.Server) {
+			require.NoError(t, (&certdepot.CertificateOptions{
+				CA:         caName,
+				CommonName: "ocsp",
+				Host:       "ocsp",
+				Expires:    time.Hour,
+				OCSPSigner: true,
+			}).CreateCertificate(d))
+			h, err := NewOCSPHandler(OCSPOptions{Depot: d, CA: caName, Signer: "ocsp"})
+			require.NoError(t, err)
+			srv := httptest.NewServer(h)
+			defer srv.Close()
+
+			resp := parse(t, d, post(t, srv, newRequest(t, d, "server")))
+			assert.Equal(t, ocsp.Good, resp.Status)
+			require.NotNil(t, resp.Certificate)
+			assert.Equal(t, getCertificate(t, d, "ocsp").Raw, resp.Certificate.Raw)
+
+			resp = parse(t, d, post(t, srv, addNonce(t, newRequest(t, d, "server"), []byte("nonce"))))
+			assert.Equal(t, ocsp.Good, resp.Status)
+		},
+		"RejectsRequestsForOtherIssuer": func(t *testing.T, d certdepot.Depot, srv *httptest.Server) {
+			require.NoError(t, (&certdepot.CertificateOptions{CommonName: "other", Expires: time.Hour}).Init(d))
+			require.NoError(t, (&certdepot.CertificateOptions{
+				CA:         "other",
+				CommonName: "foreign",
+				Host:       "foreign",
+				Expires:    time.Hour,
+			}).CreateCertificate(d))
+			req, err := ocsp.CreateRequest(getCertificate(t, d, "foreign"), getCertificate(t, d, "other"), nil)
+			require.NoError(t, err)
+
+			_, err = ocsp.ParseResponse(post(t, srv, req), nil)
+			assert.Equal(t, ocsp.ResponseError{Status: ocsp.Unauthorized}, err)
+		},
+		"RejectsMalformedRequests": func(t *testing.T, _ certdepot.Depot, srv *httptest.Server) {
+			_, err := ocsp.ParseResponse(post(t, srv, []byte("invalid")), nil)
+			assert.Equal(t, ocsp.ResponseError{Status: ocsp.Malformed}, err)
+
+			resp, err := http.Get(srv.URL + "/invalid!")
+			require.NoError(t, err)
+			data, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+			_, err = ocsp.ParseResponse(data, nil)
+			assert.Equal(t, ocsp.ResponseError{Status: ocsp.Malformed}, err)
+
+			req, err := http.NewRequest(http.MethodDelete, srv.URL, nil)
+			require.NoError(t, err)
+			resp, err = http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			d := certdepot.NewMemoryDepot(certdepot.DepotOptions{CA: caName, DefaultExpiration: time.Hour})
+			require.NoError(t, (&certdepot.CertificateOptions{
+				CommonName: caName,
+				Expires:    24 * time.Hour,
+			}).Init(d))
+			for _, name := range []string{"server", "client"} {
+				require.NoError(t, (&certdepot.CertificateOptions{
+					CA:         caName,
+					CommonName: name,
+					Host:       name,
+					Expires:    time.Hour,
+				}).CreateCertificate(d))
+			}
+
+			h, err := NewOCSPHandler(OCSPOptions{Depot: d, CA: caName})
+			require.NoError(t, err)
+			srv := httptest.NewServer(h)
+			defer srv.Close()
+
+			testCase(t, d, srv)
+		})
+	}
+	t.Run("NewOCSPHandlerFailsWithInvalidOptions", func(t *testing.T) {
+		d := certdepot.NewMemoryDepot(certdepot.DepotOptions{CA: caName, DefaultExpiration: time.Hour})
+		require.NoError(t, (&certdepot.CertificateOptions{
+			CommonName: caName,
+			Expires:    24 * time.Hour,
+		}).Init(d))
+		require.NoError(t, (&certdepot.CertificateOptions{
+			CA:         caName,
+			CommonName: "server",
+			Host:       "server",
+			Expires:    time.Hour,
+		}).CreateCertificate(d))
+
+		for optsName, opts := range map[string]OCSPOptions{
+			"MissingDepot":       {CA: caName},
+			"MissingCA":          {Depot: d},
+			"NonexistentCA":      {Depot: d, CA: "nonexistent"},
+			"NegativeValidity":   {Depot: d, CA: caName, ValidFor: -time.Hour},
+			"NegativeCacheSize":  {Depot: d, CA: caName, CacheSize: -1},
+			"NonexistentSigner":  {Depot: d, CA: caName, Signer: "nonexistent"},
+			"SignerWithoutUsage": {Depot: d, CA: caName, Signer: "server"},
+		} {
+			_, err := NewOCSPHandler(opts)
+			assert.Error(t, err, optsName)
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/deciduosity/certdepot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteDepot(t *testing.T) {
+	for testName, testCase := range map[string]func(t *testing.T, local certdepot.Depot, remote certdepot.Depot, conf *certdepot.RemoteDepotOptions){
+		"PutCheckGetAndDelete": func(t *testing.T, local certdepot.Depot, remote certdepot.Depot, _ *certdepot.RemoteDepotOptions) {
+			tag := certdepot.CsrTag("test name")
+			assert.False(t, remote.Check(tag))
+			_, err := remote.Get(tag)
+			assert.Error(t, err)
+
+			require.NoError(t, remote.Put(tag, []byte("data")))
+			assert.True(t, remote.Check(tag))
+			assert.True(t, local.Check(tag))
+			data, err := remote.Get(tag)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("data"), data)
+
+			require.NoError(t, remote.Delete(tag))
+			assert.False(t, remote.Check(tag))
+			assert.False(t, local.Check(tag))
+			assert.Error(t, remote.Delete(tag))
+		},
+		"CannotAccessCAKey": func(t *testing.T, local certdepot.Depot, remote certdepot.Depot, _ *certdepot.RemoteDepotOptions) {
+			assert.True(t, remote.Check(certdepot.CrtTag(caName)))
+			assert.False(t, remote.Check(certdepot.PrivKeyTag(caName)))
+			_, err := remote.Get(certdepot.PrivKeyTag(caName))
+			assert.Error(t, err)
+			assert.Error(t, remote.Put(certdepot.CrtTag(caName), []byte("data")))
+			assert.Error(t, remote.Delete(certdepot.PrivKeyTag(caName)))
+			_, err = remote.Find(caName)
+			assert.Error(t, err)
+			assert.True(t, local.Check(certdepot.PrivKeyTag(caName)))
+		},
+		"SaveFindAndGenerate": func(t *testing.T, local certdepot.Depot, remote certdepot.Depot, _ *certdepot.RemoteDepotOptions) {
+			creds, err := remote.Generate("generated")
+			require.NoError(t, err)
+			require.NoError(t, remote.Save("generated", creds))
+			assert.True(t, local.Check(certdepot.CrtTag("generated")))
+
+			found, err := remote.Find("generated")
+			require.NoError(t, err)
+			assert.Equal(t, creds, found)
+
+			_, err = remote.Find("nonexistent")
+			assert.Error(t, err)
+		},
+		"CreatesAndRenewsCertificates": func(t *testing.T, local certdepot.Depot, remote certdepot.Depot, _ *certdepot.RemoteDepotOptions) {
+			opts := certdepot.CertificateOptions{
+				CA:         caName,
+				CommonName: "remote",
+				Host:       "remote",
+				Expires:    time.Hour,
+			}
+			require.NoError(t, opts.CreateCertificate(remote))
+			assert.True(t, local.Check(certdepot.CrtTag("remote")))
+			assert.True(t, local.Check(certdepot.PrivKeyTag("remote")))
+			_, err := remote.Find("remote")
+			require.NoError(t, err)
+
+			_, notAfter, err := certdepot.ValidityBounds(local, "remote")
+			require.NoError(t, err)
+			opts.Expires = 2 * time.Hour
+			created, err := opts.CreateCertificateOnExpiration(remote, 2*time.Hour)
+			require.NoError(t, err)
+			assert.True(t, created)
+			_, renewedNotAfter, err := certdepot.ValidityBounds(local, "remote")
+			require.NoError(t, err)
+			assert.True(t, renewedNotAfter.After(notAfter))
+
+			intermediate := certdepot.CertificateOptions{
+				CA:           caName,
+				CommonName:   "intermediate",
+				Host:         "intermediate",
+				Expires:      time.Hour,
+				Intermediate: true,
+			}
+			assert.Error(t, intermediate.CreateCertificate(remote))
+		},
+		"BootstrapsServiceCertificate": func(t *testing.T, local certdepot.Depot, _ certdepot.Depot, conf *certdepot.RemoteDepotOptions) {
+			d, err := certdepot.BootstrapDepot(context.Background(), certdepot.BootstrapDepotConfig{
+				RemoteDepot: conf,
+				CAName:      caName,
+				ServiceName: "service",
+				ServiceOpts: &certdepot.CertificateOptions{
+					CA:         caName,
+					CommonName: "service",
+					Host:       "service",
+					Expires:    time.Hour,
+				},
+			})
+			require.NoError(t, err)
+			assert.True(t, local.Check(certdepot.CrtTag("service")))
+			creds, err := d.Find("service")
+			require.NoError(t, err)
+			_, err = creds.Resolve()
+			assert.NoError(t, err)
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			local := certdepot.NewMemoryDepot(certdepot.DepotOptions{CA: caName, DefaultExpiration: time.Hour})
+			srv, creds := newTestServer(t, Options{
+				Depot:             local,
+				CA:                caName,
+				DefaultExpiration: time.Hour,
+				Authorize:         allowAll,
+			})
+			defer srv.Close()
+
+			conf := &certdepot.RemoteDepotOptions{URL: srv.URL, Credentials: creds}
+			remote, err := certdepot.NewRemoteDepot(conf)
+			require.NoError(t, err)
+
+			testCase(t, local, remote, conf)
+		})
+	}
+	t.Run("NewRemoteDepotFailsWithInvalidOptions", func(t *testing.T) {
+		_, err := certdepot.NewRemoteDepot(&certdepot.RemoteDepotOptions{})
+		assert.Error(t, err)
+		_, err = certdepot.NewRemoteDepot(&certdepot.RemoteDepotOptions{URL: "https://localhost"})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,525 @@
+// Package server provides an HTTP service that signs certificate requests and
+// distributes credentials from a certdepot.Depot, so that clients that cannot
+// link against certdepot can obtain certificates from its CA.
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cdr/grip"
+	"github.com/cdr/grip/message"
+	"github.com/deciduosity/certdepot"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+	"github.com/square/certstrap/pkix"
+)
+
+// maxRequestSize is the largest request body that the handler reads.
+const maxRequestSize = 1 << 20
+
+// Endpoint identifies an endpoint of the service for authorization.
+type Endpoint string
+
+const (
+	// SignEndpoint signs certificate requests.
+	SignEndpoint Endpoint = "sign"
+	// CAEndpoint serves the CA certificate.
+	CAEndpoint Endpoint = "ca"
+	// CRLEndpoint serves the CRL of the CA.
+	CRLEndpoint Endpoint = "crl"
+	// FindEndpoint serves existing credentials from the depot.
+	FindEndpoint Endpoint = "find"
+	// GenerateEndpoint generates new credentials.
+	GenerateEndpoint Endpoint = "generate"
+	// SaveEndpoint saves credentials in the depot.
+	SaveEndpoint Endpoint = "save"
+	// GetEntryEndpoint checks for and serves raw depot entries.
+	GetEntryEndpoint Endpoint = "get-entry"
+	// PutEntryEndpoint puts raw depot entries.
+	PutEntryEndpoint Endpoint = "put-entry"
+	// DeleteEntryEndpoint deletes raw depot entries.
+	DeleteEntryEndpoint Endpoint = "delete-entry"
+)
+
+// Authorizer decides whether a client may use an endpoint. The client is the
+// verified certificate the client presented, which is only nil for
+// EnrollEndpoint. The name is the name of the credentials or entry for the
+// credentials and entry endpoints, with spaces replaced by underscores as in
+// the depot, and empty for the CA and CRL endpoints. For
+// SignEndpoint, EnrollEndpoint and ReenrollEndpoint, the authorizer is called
+// once for each name that the certificate request asks for, which are its
+// common name and its DNS, IP address, email address and URI subject
+// alternative names, and the request is only signed if every name is
+// authorized. Returning an error rejects the request.
+type Authorizer func(client *x509.Certificate, endpoint Endpoint, name string) error
+
+// defaultAuthorize is used when no Authorizer is set. It allows any client to
+// get the CA certificate and CRL and to have certificate requests for its own
+// names signed or re-enrolled, and rejects every other request, including
+// every request to the credentials and entry endpoints and every enrollment.
+func defaultAuthorize(client *x509.Certificate, endpoint Endpoint, name string) error {
+	switch endpoint {
+	case CAEndpoint, CRLEndpoint:
+		return nil
+	case SignEndpoint, ReenrollEndpoint:
+		for _, clientName := range certificateNames(client) {
+			if name == clientName {
+				return nil
+			}
+		}
+		return errors.Errorf("certificate does not include %s", name)
+	default:
+		return errors.Errorf("%s requires an authorizer", endpoint)
+	}
+}
+
+// certificateNames returns the common name and the subject alternative names
+// of the certificate.
+func certificateNames(crt *x509.Certificate) []string {
+	if crt == nil {
+		return nil
+	}
+	return collectNames(crt.Subject.CommonName, crt.DNSNames, crt.IPAddresses, crt.EmailAddresses, crt.URIs)
+}
+
+// requestNames returns the names that the certificate request asks for: its
+// common name and its subject alternative names.
+func requestNames(csr *x509.CertificateRequest) []string {
+	return collectNames(csr.Subject.CommonName, csr.DNSNames, csr.IPAddresses, csr.EmailAddresses, csr.URIs)
+}
+
+func collectNames(commonName string, dnsNames []string, ips []net.IP, emails []string, uris []*url.URL) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	add(commonName)
+	for _, name := range dnsNames {
+		add(name)
+	}
+	for _, ip := range ips {
+		add(ip.String())
+	}
+	for _, email := range emails {
+		add(email)
+	}
+	for _, uri := range uris {
+		add(uri.String())
+	}
+
+	return names
+}
+
+// Options contains options for the service.
+type Options struct {
+	// Depot holding the CA and the credentials to serve.
+	Depot certdepot.Depot `bson:"-" json:"-" yaml:"-"`
+	// Name of the CA that signs certificate requests.
+	CA string `bson:"ca" json:"ca" yaml:"ca"`
+	// Passphrase to decrypt the CA's private-key PEM block.
+	CAPassphrase string `bson:"ca_passphrase,omitempty" json:"ca_passphrase,omitempty" yaml:"ca_passphrase,omitempty"`
+	// How long until signed certificates expire if the request does not
+	// specify an expiration.
+	DefaultExpiration time.Duration `bson:"default_expiration" json:"default_expiration" yaml:"default_expiration"`
+	// The longest expiration a request may specify. If zero, any
+	// expiration is allowed.
+	MaxExpiration time.Duration `bson:"max_expiration,omitempty" json:"max_expiration,omitempty" yaml:"max_expiration,omitempty"`
+	// Authorize is called for every authenticated request. If nil, clients
+	// with a certificate signed by the CA may only get the CA certificate
+	// and CRL and have certificate requests for their own names signed.
+	Authorize Authorizer `bson:"-" json:"-" yaml:"-"`
+}
+
+// Validate checks that the required options are set.
+func (opts *Options) Validate() error {
+	catcher := grip.NewBasicCatcher()
+
+	catcher.NewWhen(opts.Depot == nil, "must specify a depot")
+	catcher.NewWhen(opts.CA == "", "must specify the name of the CA")
+	catcher.NewWhen(opts.DefaultExpiration <= 0, "default expiration must be positive")
+	catcher.NewWhen(opts.MaxExpiration < 0, "max expiration cannot be negative")
+	catcher.NewWhen(opts.MaxExpiration > 0 && opts.DefaultExpiration > opts.MaxExpiration, "default expiration cannot exceed the max expiration")
+
+	return catcher.Resolve()
+}
+
+// Handler is an http.Handler that serves the depot. Clients are
+// authenticated by the certificate they present over TLS, so the handler
+// must be served with a TLS configuration that verifies client certificates,
+// such as the one returned by TLSConfig.
+type Handler struct {
+	opts Options
+	mux  *http.ServeMux
+}
+
+// NewHandler returns a handler that serves the depot with the given options.
+func NewHandler(opts Options) (*Handler, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+
+	h := &Handler{opts: opts, mux: http.NewServeMux()}
+	h.mux.HandleFunc(certdepot.ServiceSignPath, h.sign)
+	h.mux.HandleFunc(certdepot.ServiceCAPath, h.ca)
+	h.mux.HandleFunc(certdepot.ServiceCRLPath, h.crl)
+	h.mux.HandleFunc(certdepot.ServiceCredentialsPath, h.credentials)
+	h.mux.HandleFunc(certdepot.ServiceEntriesPath, h.entries)
+
+	return h, nil
+}
+
+// TLSConfig returns a TLS configuration for serving the handler with the
+// given credentials. Clients must present a certificate signed by the CA in
+// the credentials.
+func TLSConfig(creds *certdepot.Credentials) (*tls.Config, error) {
+	conf, err := creds.ResolveServer()
+	if err != nil {
+		return nil, errors.Wrap(err, "problem resolving credentials")
+	}
+	conf.MinVersion = tls.VersionTLS12
+
+	return conf, nil
+}
+
+// ServeHTTP rejects requests from clients without a verified certificate and
+// routes the rest to the endpoints.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		writeError(w, http.StatusUnauthorized, errors.New("must authenticate with a client certificate"))
+		return
+	}
+
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) sign(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	req := certdepot.SignRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "problem reading request"))
+		return
+	}
+	csr, err := pkix.NewCertificateSigningRequestFromPEM(req.CSR)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "problem parsing certificate request"))
+		return
+	}
+	rawCSR, err := csr.GetRawCertificateSigningRequest()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "problem parsing certificate request"))
+		return
+	}
+
+	if req.CA != "" && formatName(req.CA) != formatName(h.opts.CA) {
+		writeError(w, http.StatusBadRequest, errors.Errorf("service does not sign with CA %s", req.CA))
+		return
+	}
+
+	expires := req.Expires
+	if expires == 0 {
+		expires = h.opts.DefaultExpiration
+	}
+	if expires < 0 || (h.opts.MaxExpiration > 0 && expires > h.opts.MaxExpiration) {
+		writeError(w, http.StatusBadRequest, errors.Errorf("invalid expiration %s", expires))
+		return
+	}
+
+	names := requestNames(rawCSR)
+	if len(names) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("certificate request does not include any names"))
+		return
+	}
+	for _, name := range names {
+		if !h.authorize(w, r, SignEndpoint, name) {
+			return
+		}
+	}
+
+	opts := certdepot.CertificateOptions{
+		CA:           h.opts.CA,
+		CAPassphrase: h.opts.CAPassphrase,
+		Expires:      expires,
+	}
+	crt, err := opts.SignCertificateRequestInMemory(h.opts.Depot, csr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "problem signing certificate request"))
+		return
+	}
+	pemCrt, err := crt.Export()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "problem exporting certificate"))
+		return
+	}
+	pemCACrt, err := h.opts.Depot.Get(certdepot.CrtTag(h.opts.CA))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrap(err, "problem getting CA certificate"))
+		return
+	}
+
+	writeJSON(w, certdepot.SignResponse{Cert: pemCrt, CACert: pemCACrt})
+}
+
+func (h *Handler) ca(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) || !h.authorize(w, r, CAEndpoint, "") {
+		return
+	}
+
+	h.writeEntry(w, certdepot.CrtTag(h.opts.CA), "CA certificate")
+}
+
+func (h *Handler) crl(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, http.MethodGet) || !h.authorize(w, r, CRLEndpoint, "") {
+		return
+	}
+
+	h.writeEntry(w, certdepot.CrlTag(h.opts.CA), "CRL")
+}
+
+func (h *Handler) credentials(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, certdepot.ServiceCredentialsPath)
+	if name == "" || strings.Contains(name, "/") {
+		writeError(w, http.StatusNotFound, errors.New("must specify the name of the credentials"))
+		return
+	}
+	name = formatName(name)
+
+	var creds *certdepot.Credentials
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		if !h.authorize(w, r, FindEndpoint, name) {
+			return
+		}
+		// the CA credentials would include its private key.
+		if !h.checkNotCA(w, name, "cannot get the credentials of a CA") {
+			return
+		}
+		if !h.opts.Depot.Check(certdepot.CrtTag(name)) || !h.opts.Depot.Check(certdepot.PrivKeyTag(name)) {
+			writeError(w, http.StatusNotFound, errors.Errorf("credentials for %s not found", name))
+			return
+		}
+		creds, err = h.opts.Depot.Find(name)
+		err = errors.Wrapf(err, "problem finding credentials for %s", name)
+	case http.MethodPost:
+		if !h.authorize(w, r, GenerateEndpoint, name) || !h.checkNotCA(w, name, "cannot generate credentials for a CA") {
+			return
+		}
+		creds, err = h.opts.Depot.Generate(name)
+		err = errors.Wrapf(err, "problem generating credentials for %s", name)
+	case http.MethodPut:
+		if !h.authorize(w, r, SaveEndpoint, name) || !h.checkNotCA(w, name, "cannot replace the credentials of a CA") {
+			return
+		}
+		creds = &certdepot.Credentials{}
+		if err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(creds); err != nil {
+			writeError(w, http.StatusBadRequest, errors.Wrap(err, "problem reading credentials"))
+			return
+		}
+		if err = creds.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid credentials"))
+			return
+		}
+		if err = h.opts.Depot.Save(name, creds); err != nil {
+			writeError(w, http.StatusInternalServerError, errors.Wrapf(err, "problem saving credentials for %s", name))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", strings.Join([]string{http.MethodGet, http.MethodPost, http.MethodPut}, ", "))
+		writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, creds)
+}
+
+func (h *Handler) entries(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, certdepot.ServiceEntriesPath), "/")
+	if len(parts) != 2 || parts[1] == "" {
+		writeError(w, http.StatusNotFound, errors.New("must specify the kind and name of the entry"))
+		return
+	}
+	kind, name := certdepot.TagKind(parts[0]), formatName(parts[1])
+	if err := kind.Validate(); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	tag := certdepot.KindTag(kind, name)
+
+	var endpoint Endpoint
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		endpoint = GetEntryEndpoint
+	case http.MethodPut:
+		endpoint = PutEntryEndpoint
+	case http.MethodDelete:
+		endpoint = DeleteEntryEndpoint
+	default:
+		w.Header().Set("Allow", strings.Join([]string{http.MethodHead, http.MethodGet, http.MethodPut, http.MethodDelete}, ", "))
+		writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	if !h.authorize(w, r, endpoint, name) {
+		return
+	}
+	// CA keys never leave the service and only the service modifies CAs.
+	if (kind == certdepot.PrivKeyKind || endpoint != GetEntryEndpoint) && !h.checkNotCA(w, name, fmt.Sprintf("cannot access %s entry of a CA", kind)) {
+		return
+	}
+
+	switch endpoint {
+	case GetEntryEndpoint:
+		h.writeEntry(w, tag, string(kind)+" entry")
+	case PutEntryEndpoint:
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.Wrap(err, "problem reading entry"))
+			return
+		}
+		if err = h.opts.Depot.Put(tag, data); err != nil {
+			writeError(w, http.StatusInternalServerError, errors.Wrapf(err, "problem putting %s entry", kind))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case DeleteEntryEndpoint:
+		if !h.opts.Depot.Check(tag) {
+			writeError(w, http.StatusNotFound, errors.Errorf("%s entry not found", kind))
+			return
+		}
+		if err := h.opts.Depot.Delete(tag); err != nil {
+			writeError(w, http.StatusInternalServerError, errors.Wrapf(err, "problem deleting %s entry", kind))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// authorize calls the authorizer with the client certificate and writes an
+// error response if the client is not authorized.
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request, endpoint Endpoint, name string) bool {
+	authorize := h.opts.Authorize
+	if authorize == nil {
+		authorize = defaultAuthorize
+	}
+
+	client := r.TLS.VerifiedChains[0][0]
+	if err := authorize(client, endpoint, name); err != nil {
+		writeError(w, http.StatusForbidden, errors.Wrapf(err, "%s is not authorized", client.Subject.CommonName))
+		return false
+	}
+
+	return true
+}
+
+// checkNotCA writes an error response with the message if the name is a CA
+// and returns whether it is not. Besides the service's CA, every certificate
+// that can sign certificates or OCSP responses, and every name recorded as the
+// issuer of another certificate, is considered a CA.
+func (h *Handler) checkNotCA(w http.ResponseWriter, name, msg string) bool {
+	isCA, err := h.isCA(name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrapf(err, "problem checking whether %s is a CA", name))
+		return false
+	}
+	if isCA {
+		writeError(w, http.StatusForbidden, errors.New(msg))
+		return false
+	}
+
+	return true
+}
+
+func (h *Handler) isCA(name string) (bool, error) {
+	if name == formatName(h.opts.CA) {
+		return true, nil
+	}
+
+	if certdepot.CheckCertificate(h.opts.Depot, name) {
+		crt, err := certdepot.GetCertificate(h.opts.Depot, name)
+		if err != nil {
+			return false, errors.Wrap(err, "problem getting certificate")
+		}
+		rawCrt, err := crt.GetRawCertificate()
+		if err != nil {
+			return false, errors.Wrap(err, "problem parsing certificate")
+		}
+		if rawCrt.IsCA {
+			return true, nil
+		}
+		for _, usage := range rawCrt.ExtKeyUsage {
+			if usage == x509.ExtKeyUsageOCSPSigning {
+				return true, nil
+			}
+		}
+	}
+
+	// the certificate of a CA may be missing while the certificates that
+	// it issued remain.
+	hasChildren, err := certdepot.HasChildren(h.opts.Depot, name)
+	return hasChildren, errors.WithStack(err)
+}
+
+// formatName replaces spaces in the name with underscores, as depots do.
+func formatName(name string) string {
+	return strings.Replace(name, " ", "_", -1)
+}
+
+// writeEntry writes the PEM-encoded depot entry with the given tag.
+func (h *Handler) writeEntry(w http.ResponseWriter, tag *depot.Tag, description string) {
+	if !h.opts.Depot.Check(tag) {
+		writeError(w, http.StatusNotFound, errors.Errorf("%s not found", description))
+		return
+	}
+	data, err := h.opts.Depot.Get(tag)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Wrapf(err, "problem getting %s", description))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	_, err = w.Write(data)
+	grip.Warning(message.WrapError(err, "problem writing response"))
+}
+
+func checkMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	grip.Warning(message.WrapError(json.NewEncoder(w).Encode(data), "problem writing response"))
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	grip.Warning(message.WrapError(json.NewEncoder(w).Encode(certdepot.ErrorResponse{Error: err.Error()}), "problem writing response"))
+}
@@ -0,0 +1,354 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/deciduosity/certdepot"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/pkix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const caName = "ca"
+
+// newTestServer initializes a CA in the depot and starts a TLS server for the
+// handler. It returns the server and credentials that clients can use to
+// authenticate with it.
+func newTestServer(t *testing.T, opts Options) (*httptest.Server, *certdepot.Credentials) {
+	require.NoError(t, (&certdepot.CertificateOptions{
+		CommonName: caName,
+		Expires:    24 * time.Hour,
+		MaxPathLen: 1,
+	}).Init(opts.Depot))
+	for _, name := range []string{"server", "client"} {
+		require.NoError(t, (&certdepot.CertificateOptions{
+			CA:         caName,
+			CommonName: name,
+			Host:       name,
+			Domain:     []string{"server"},
+			Expires:    time.Hour,
+		}).CreateCertificate(opts.Depot))
+	}
+
+	h, err := NewHandler(opts)
+	require.NoError(t, err)
+	serverCreds, err := opts.Depot.Find("server")
+	require.NoError(t, err)
+	srv := httptest.NewUnstartedServer(h)
+	srv.TLS, err = TLSConfig(serverCreds)
+	require.NoError(t, err)
+	srv.StartTLS()
+
+	clientCreds, err := opts.Depot.Find("client")
+	require.NoError(t, err)
+	clientCreds.ServerName = "server"
+
+	return srv, clientCreds
+}
+
+// allowAll is an Authorizer that authorizes every request.
+func allowAll(*x509.Certificate, Endpoint, string) error { return nil }
+
+func TestHandler(t *testing.T) {
+	do := func(t *testing.T, client *http.Client, method, url string, body interface{}) *http.Response {
+		var payload []byte
+		if body != nil {
+			var err error
+			payload, err = json.Marshal(body)
+			require.NoError(t, err)
+		}
+		req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+	decode := func(t *testing.T, resp *http.Response, out interface{}) {
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+	}
+	newCSR := func(t *testing.T, name string, domains ...string) []byte {
+		csr, _, err := (&certdepot.CertificateOptions{CommonName: name, Domain: domains}).CertRequestInMemory()
+		require.NoError(t, err)
+		pemCSR, err := csr.Export()
+		require.NoError(t, err)
+		return pemCSR
+	}
+
+	for testName, testCase := range map[string]func(t *testing.T, opts Options, srv *httptest.Server, client *http.Client){
+		"SignsCertificateRequest": func(t *testing.T, opts Options, srv *httptest.Server, client *http.Client) {
+			resp := do(t, client, http.MethodPost, srv.URL+certdepot.ServiceSignPath, certdepot.SignRequest{
+				CSR:     newCSR(t, "external"),
+				Expires: 30 * time.Minute,
+			})
+			out := certdepot.SignResponse{}
+			decode(t, resp, &out)
+
+			crt, err := pkix.NewCertificateFromPEM(out.Cert)
+			require.NoError(t, err)
+			rawCrt, err := crt.GetRawCertificate()
+			require.NoError(t, err)
+			assert.Equal(t, "external", rawCrt.Subject.CommonName)
+			assert.True(t, rawCrt.NotAfter.Before(time.Now().Add(time.Hour)))
+
+			caCrt, err := pkix.NewCertificateFromPEM(out.CACert)
+			require.NoError(t, err)
+			rawCACrt, err := caCrt.GetRawCertificate()
+			require.NoError(t, err)
+			assert.NoError(t, rawCrt.CheckSignatureFrom(rawCACrt))
+			assert.False(t, certdepot.CheckCertificate(opts.Depot, "external"))
+		},
+		"SignFailsWithInvalidRequest": func(t *testing.T, _ Options, srv *httptest.Server, client *http.Client) {
+			for reqName, req := range map[string]certdepot.SignRequest{
+				"InvalidCSR":        {CSR: []byte("invalid")},
+				"ExceedsMaxExpires": {CSR: newCSR(t, "external"), Expires: 48 * time.Hour},
+				"OtherCA":           {CSR: newCSR(t, "external"), CA: "other"},
+			} {
+				resp := do(t, client, http.MethodPost, srv.URL+certdepot.ServiceSignPath, req)
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode, reqName)
+				out := certdepot.ErrorResponse{}
+				assert.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+				assert.NotEmpty(t, out.Error)
+				resp.Body.Close()
+			}
+
+			resp := do(t, client, http.MethodGet, srv.URL+certdepot.ServiceSignPath, nil)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+		},
+		"GetsCACertificate": func(t *testing.T, opts Options, srv *httptest.Server, client *http.Client) {
+			resp := do(t, client, http.MethodGet, srv.URL+certdepot.ServiceCAPath, nil)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			expected, err := opts.Depot.Get(certdepot.CrtTag(caName))
+			require.NoError(t, err)
+			assert.Equal(t, expected, body)
+		},
+		"GetsCRL": func(t *testing.T, opts Options, srv *httptest.Server, client *http.Client) {
+			require.NoError(t, certdepot.Revoke(opts.Depot, caName, "server", 0))
+
+			resp := do(t, client, http.MethodGet, srv.URL+certdepot.ServiceCRLPath, nil)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			crl, err := pkix.NewCertificateRevocationListFromPEM(body)
+			require.NoError(t, err)
+			rawCRL, err := x509.ParseRevocationList(crl.DERBytes())
+			require.NoError(t, err)
+			assert.Len(t, rawCRL.RevokedCertificateEntries, 1)
+		},
+		"FindsCredentials": func(t *testing.T, opts Options, srv *httptest.Server, client *http.Client) {
+			creds := certdepot.Credentials{}
+			decode(t, do(t, client, http.MethodGet, srv.URL+certdepot.ServiceCredentialsPath+"server", nil), &creds)
+
+			expected, err := opts.Depot.Find("server")
+			require.NoError(t, err)
+			assert.Equal(t, *expected, creds)
+		},
+		"FindFailsForMissingOrCACredentials": func(t *testing.T, _ Options, srv *httptest.Server, client *http.Client) {
+			resp := do(t, client, http.MethodGet, srv.URL+certdepot.ServiceCredentialsPath+"nonexistent", nil)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+			resp = do(t, client, http.MethodGet, srv.URL+certdepot.ServiceCredentialsPath+caName, nil)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		},
+		"GeneratesCredentials": func(t *testing.T, _ Options, srv *httptest.Server, client *http.Client) {
+			creds := certdepot.Credentials{}
+			decode(t, do(t, client, http.MethodPost, srv.URL+certdepot.ServiceCredentialsPath+"generated", nil), &creds)
+
+			assert.Equal(t, "generated", creds.ServerName)
+			_, err := creds.Resolve()
+			assert.NoError(t, err)
+		},
+		"AuthorizerRejectsRequests": func(t *testing.T, opts Options, srv *httptest.Server, client *http.Client) {
+			resp := do(t, client, http.MethodGet, srv.URL+certdepot.ServiceCAPath, nil)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			resp = do(t, client, http.MethodGet, srv.URL+certdepot.ServiceCredentialsPath+"server", nil)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+			resp = do(t, client, http.MethodPost, srv.URL+certdepot.ServiceSignPath, certdepot.SignRequest{CSR: newCSR(t, "other")})
+			resp.Body.Close()
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+			resp = do(t, client, http.MethodPost, srv.URL+certdepot.ServiceSignPath, certdepot.SignRequest{CSR: newCSR(t, "client", "other")})
+			resp.Body.Close()
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+			resp = do(t, client, http.MethodPost, srv.URL+certdepot.ServiceSignPath, certdepot.SignRequest{CSR: newCSR(t, "client")})
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		},
+		"ProtectsEveryCA": func(t *testing.T, opts Options, srv *httptest.Server, client *http.Client) {
+			require.NoError(t, (&certdepot.CertificateOptions{
+				CA:           caName,
+				CommonName:   "intermediate ca",
+				Host:         "intermediate ca",
+				Expires:      time.Hour,
+				Intermediate: true,
+			}).CreateCertificate(opts.Depot))
+			require.NoError(t, (&certdepot.CertificateOptions{
+				CA:         caName,
+				CommonName: "ocsp",
+				Host:       "ocsp",
+				Expires:    time.Hour,
+				OCSPSigner: true,
+			}).CreateCertificate(opts.Depot))
+			require.NoError(t, (&certdepot.CertificateOptions{
+				CA:         "intermediate ca",
+				CommonName: "leaf",
+				Host:       "leaf",
+				Expires:    time.Hour,
+			}).CreateCertificate(opts.Depot))
+
+			check := func(t *testing.T, names ...string) {
+				for _, name := range names {
+					for _, req := range []struct {
+						method string
+						path   string
+					}{
+						{http.MethodGet, certdepot.ServiceCredentialsPath + name},
+						{http.MethodPost, certdepot.ServiceCredentialsPath + name},
+						{http.MethodPut, certdepot.ServiceCredentialsPath + name},
+						{http.MethodGet, certdepot.ServiceEntriesPath + "key/" + name},
+						{http.MethodPut, certdepot.ServiceEntriesPath + "crt/" + name},
+						{http.MethodDelete, certdepot.ServiceEntriesPath + "crl/" + name},
+					} {
+						resp := do(t, client, req.method, srv.URL+req.path, certdepot.Credentials{})
+						resp.Body.Close()
+						assert.Equal(t, http.StatusForbidden, resp.StatusCode, "%s %s", req.method, req.path)
+					}
+				}
+			}
+			check(t, caName, "intermediate%20ca", "intermediate_ca", "ocsp")
+
+			// a CA remains protected while it has issued certificates
+			require.NoError(t, opts.Depot.Delete(certdepot.CrtTag("intermediate ca")))
+			check(t, "intermediate%20ca")
+			assert.True(t, opts.Depot.Check(certdepot.PrivKeyTag("intermediate ca")))
+
+			resp := do(t, client, http.MethodGet, srv.URL+certdepot.ServiceEntriesPath+"crt/"+caName, nil)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		},
+		"DefaultAuthorizerOnlySignsOwnNames": func(t *testing.T, _ Options, srv *httptest.Server, client *http.Client) {
+			for _, path := range []string{certdepot.ServiceCAPath, certdepot.ServiceCRLPath} {
+				resp := do(t, client, http.MethodGet, srv.URL+path, nil)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+			}
+
+			for csrName, csr := range map[string][]byte{
+				"CommonName":  newCSR(t, "client"),
+				"OwnSANs":     newCSR(t, "client", "server"),
+				"SANOnlyName": newCSR(t, "", "server"),
+			} {
+				resp := do(t, client, http.MethodPost, srv.URL+certdepot.ServiceSignPath, certdepot.SignRequest{CSR: csr})
+				resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode, csrName)
+			}
+			for csrName, csr := range map[string][]byte{
+				"OtherCommonName": newCSR(t, "other"),
+				"OtherSAN":        newCSR(t, "client", "other"),
+			} {
+				resp := do(t, client, http.MethodPost, srv.URL+certdepot.ServiceSignPath, certdepot.SignRequest{CSR: csr})
+				resp.Body.Close()
+				assert.Equal(t, http.StatusForbidden, resp.StatusCode, csrName)
+			}
+
+			for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut} {
+				resp := do(t, client, method, srv.URL+certdepot.ServiceCredentialsPath+"client", certdepot.Credentials{})
+				resp.Body.Close()
+				assert.Equal(t, http.StatusForbidden, resp.StatusCode, method)
+			}
+			for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+				resp := do(t, client, method, srv.URL+certdepot.ServiceEntriesPath+"crt/client", nil)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusForbidden, resp.StatusCode, method)
+			}
+		},
+		"RejectsClientsWithoutCertificate": func(t *testing.T, _ Options, srv *httptest.Server, client *http.Client) {
+			conf := client.Transport.(*http.Transport).TLSClientConfig.Clone()
+			conf.Certificates = nil
+			noCertClient := &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+			_, err := noCertClient.Get(srv.URL + certdepot.ServiceCAPath)
+			assert.Error(t, err)
+
+			rec := httptest.NewRecorder()
+			srv.Config.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, certdepot.ServiceCAPath, nil))
+			assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		},
+		"RejectsClientsFromOtherCA": func(t *testing.T, _ Options, srv *httptest.Server, client *http.Client) {
+			other := certdepot.NewMemoryDepot(certdepot.DepotOptions{CA: "other", DefaultExpiration: time.Hour})
+			require.NoError(t, (&certdepot.CertificateOptions{CommonName: "other", Expires: time.Hour}).Init(other))
+			otherCreds, err := other.Generate("client")
+			require.NoError(t, err)
+			otherCert, err := tls.X509KeyPair(otherCreds.Cert, otherCreds.Key)
+			require.NoError(t, err)
+
+			conf := client.Transport.(*http.Transport).TLSClientConfig.Clone()
+			conf.Certificates = []tls.Certificate{otherCert}
+			otherClient := &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+			_, err = otherClient.Get(srv.URL + certdepot.ServiceCAPath)
+			assert.Error(t, err)
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			opts := Options{
+				Depot:             certdepot.NewMemoryDepot(certdepot.DepotOptions{CA: caName, DefaultExpiration: time.Hour}),
+				CA:                caName,
+				DefaultExpiration: time.Hour,
+				MaxExpiration:     24 * time.Hour,
+			}
+			switch testName {
+			case "AuthorizerRejectsRequests":
+				opts.Authorize = func(client *x509.Certificate, endpoint Endpoint, name string) error {
+					if endpoint == CAEndpoint || name == client.Subject.CommonName {
+						return nil
+					}
+					return errors.Errorf("%s cannot access %s", client.Subject.CommonName, name)
+				}
+			case "DefaultAuthorizerOnlySignsOwnNames":
+			default:
+				opts.Authorize = allowAll
+			}
+			srv, clientCreds := newTestServer(t, opts)
+			defer srv.Close()
+			clientConf, err := clientCreds.Resolve()
+			require.NoError(t, err)
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConf}}
+
+			testCase(t, opts, srv, client)
+		})
+	}
+	t.Run("NewHandlerFailsWithInvalidOptions", func(t *testing.T) {
+		for optsName, opts := range map[string]Options{
+			"MissingDepot":    {CA: caName, DefaultExpiration: time.Hour},
+			"MissingCA":       {Depot: certdepot.NewMemoryDepot(certdepot.DepotOptions{}), DefaultExpiration: time.Hour},
+			"MissingDuration": {Depot: certdepot.NewMemoryDepot(certdepot.DepotOptions{}), CA: caName},
+			"ExceedsMax":      {Depot: certdepot.NewMemoryDepot(certdepot.DepotOptions{}), CA: caName, DefaultExpiration: time.Hour, MaxExpiration: time.Minute},
+		} {
+			_, err := NewHandler(opts)
+			assert.Error(t, err, optsName)
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package certdepot
+
+import "time"
+
+// Paths of the endpoints served by the depot service in the server package.
+const (
+	// ServiceSignPath accepts a POST with a SignRequest and responds with a
+	// SignResponse.
+	ServiceSignPath = "/v1/sign"
+	// ServiceCAPath responds to a GET with the PEM-encoded CA certificate.
+	ServiceCAPath = "/v1/ca"
+	// ServiceCRLPath responds to a GET with the PEM-encoded CRL of the CA.
+	ServiceCRLPath = "/v1/crl"
+	// ServiceCredentialsPath is the prefix of the credentials endpoints,
+	// which are followed by the name of the credentials. A GET responds
+	// with the Credentials found in the depot, a PUT saves the Credentials
+	// in the body and a POST responds with newly generated Credentials.
+	ServiceCredentialsPath = "/v1/credentials/"
+	// ServiceEntriesPath is the prefix of the endpoints for the raw depot
+	// entries, which are followed by the TagKind and the name of the
+	// entry. A HEAD checks whether the entry exists, a GET responds with
+	// its data, a PUT puts the body in the depot and a DELETE removes it.
+	ServiceEntriesPath = "/v1/entries/"
+)
+
+// SignRequest is the body of a request to the depot service to sign a
+// certificate request.
+type SignRequest struct {
+	// CSR is the PEM-encoded certificate request.
+	CSR []byte `bson:"csr" json:"csr" yaml:"csr"`
+	// Name of the CA that should sign the request. If set, it must match
+	// the CA of the service.
+	CA string `bson:"ca,omitempty" json:"ca,omitempty" yaml:"ca,omitempty"`
+	// How long until the certificate expires. If zero, the default
+	// expiration of the service is used.
+	Expires time.Duration `bson:"expires,omitempty" json:"expires,omitempty" yaml:"expires,omitempty"`
+}
+
+// SignResponse is the body of a response from the depot service to a
+// SignRequest.
+type SignResponse struct {
+	// Cert is the PEM-encoded signed certificate.
+	Cert []byte `bson:"cert" json:"cert" yaml:"cert"`
+	// CACert is the PEM-encoded certificate of the CA that signed it.
+	CACert []byte `bson:"ca_cert" json:"ca_cert" yaml:"ca_cert"`
+}
+
+// ErrorResponse is the body of a response from the depot service when a
+// request fails.
+type ErrorResponse struct {
+	Error string `bson:"error" json:"error" yaml:"error"`
+}
@@ -0,0 +1,739 @@
+package certdepot
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cdr/grip"
+	"github.com/pkg/errors"
+	"github.com/square/certstrap/depot"
+	"github.com/square/certstrap/pkix"
+)
+
+// SQLDialect identifies the flavor of SQL spoken by the database backing a
+// SQL depot.
+type SQLDialect string
+
+const (
+	// SQLiteDialect is the dialect for SQLite databases.
+	SQLiteDialect SQLDialect = "sqlite"
+	// PostgresDialect is the dialect for PostgreSQL databases.
+	PostgresDialect SQLDialect = "postgres"
+)
+
+// sqlTableNamePattern matches the table names that SQL depots accept. Table
+// names are formatted into queries, so they are restricted to unquoted
+// identifiers that are valid in every dialect.
+var sqlTableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SQLDepotOptions contains options for NewSQLCertDepot and
+// NewSQLCertDepotWithDB. The database/sql driver named by DriverName must be
+// registered by the caller.
+type SQLDepotOptions struct {
+	DriverName     string `bson:"driver_name" json:"driver_name" yaml:"driver_name"`
+	DataSourceName string `bson:"data_source_name" json:"data_source_name" yaml:"data_source_name"`
+	// Dialect of the database. If empty, it is inferred from the driver
+	// name.
+	Dialect SQLDialect `bson:"dialect,omitempty" json:"dialect,omitempty" yaml:"dialect,omitempty"`
+	// TableName is the name of the table holding the certificates, which
+	// may only contain letters, digits and underscores and may not start
+	// with a digit. Defaults to "certs".
+	TableName    string       `bson:"table_name" json:"table_name" yaml:"table_name"`
+	DepotOptions DepotOptions `bson:"depot_options" json:"depot_options" yaml:"depot_options"`
+}
+
+// IsZero returns whether the given SQLDepotOptions struct holds the "zero"
+// value of the struct.
+func (opts *SQLDepotOptions) IsZero() bool {
+	return opts.DriverName == "" && opts.DataSourceName == ""
+}
+
+func (opts *SQLDepotOptions) validate() error {
+	if opts.TableName == "" {
+		opts.TableName = "certs"
+	}
+	if !sqlTableNamePattern.MatchString(opts.TableName) {
+		return errors.Errorf("invalid table name '%s'", opts.TableName)
+	}
+
+	if opts.Dialect == "" {
+		switch opts.DriverName {
+		case "sqlite", "sqlite3":
+			opts.Dialect = SQLiteDialect
+		case "postgres", "pgx":
+			opts.Dialect = PostgresDialect
+		default:
+			return errors.Errorf("cannot infer SQL dialect for driver '%s'", opts.DriverName)
+		}
+	}
+
+	switch opts.Dialect {
+	case SQLiteDialect, PostgresDialect:
+	default:
+		return errors.Errorf("unsupported SQL dialect '%s'", opts.Dialect)
+	}
+
+	return nil
+}
+
+type sqlDepot struct {
+	ctx       context.Context
+	db        *sql.DB
+	dialect   SQLDialect
+	tableName string
+	opts      DepotOptions
+	// ownsDB is whether the depot opened the database and closes it in
+	// Close.
+	ownsDB bool
+}
+
+// NewSQLCertDepot returns a new cert depot backed by a SQL database using
+// database/sql. The table holding the certificates is created or migrated
+// to the latest schema if necessary. The database stays open until the depot
+// is closed with its Close method, which the depot implements as io.Closer.
+func NewSQLCertDepot(ctx context.Context, opts *SQLDepotOptions) (Depot, error) {
+	if opts.DriverName == "" || opts.DataSourceName == "" {
+		return nil, errors.New("must specify a driver name and data source name")
+	}
+
+	db, err := sql.Open(opts.DriverName, opts.DataSourceName)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem opening database")
+	}
+	if err = db.PingContext(ctx); err != nil {
+		catcher := grip.NewBasicCatcher()
+		catcher.Wrap(err, "problem connecting to database")
+		catcher.Wrap(db.Close(), "problem closing database")
+		return nil, catcher.Resolve()
+	}
+
+	d, err := NewSQLCertDepotWithDB(ctx, db, opts)
+	if err != nil {
+		catcher := grip.NewBasicCatcher()
+		catcher.Add(err)
+		catcher.Wrap(db.Close(), "problem closing database")
+		return nil, catcher.Resolve()
+	}
+	d.(*sqlDepot).ownsDB = true
+
+	return d, nil
+}
+
+// NewSQLCertDepotWithDB returns a new cert depot backed by the provided SQL
+// database. The table holding the certificates is created or migrated to the
+// latest schema if necessary. The caller owns the database: closing the depot
+// does not close it, and the caller must close it once the depot is no longer
+// used.
+func NewSQLCertDepotWithDB(ctx context.Context, db *sql.DB, opts *SQLDepotOptions) (Depot, error) {
+	if db == nil {
+		return nil, errors.New("must specify a non-nil database")
+	}
+
+	if err := opts.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+
+	s := &sqlDepot{
+		ctx:       ctx,
+		db:        db,
+		dialect:   opts.Dialect,
+		tableName: opts.TableName,
+		opts:      opts.DepotOptions,
+	}
+	if err := s.migrate(); err != nil {
+		return nil, errors.Wrap(err, "problem migrating database schema")
+	}
+
+	return s, nil
+}
+
+// Close closes the database if the depot opened it. The depot cannot be used
+// after it is closed.
+func (s *sqlDepot) Close() error {
+	if !s.ownsDB {
+		return nil
+	}
+	return errors.Wrap(s.db.Close(), "problem closing database")
+}
+
+// sqlMigrations are the schema changes applied, in order, to a SQL depot.
+// Each statement is formatted with the table name. Never modify an existing
+// entry; append a new one instead.
+var sqlMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS %[1]s (
+		id TEXT PRIMARY KEY,
+		cert TEXT NOT NULL DEFAULT '',
+		private_key TEXT NOT NULL DEFAULT '',
+		cert_req TEXT NOT NULL DEFAULT '',
+		cert_revoc_list TEXT NOT NULL DEFAULT '',
+		ttl BIGINT
+	)`,
+	`CREATE INDEX IF NOT EXISTS %[1]s_ttl ON %[1]s (ttl)`,
+	`ALTER TABLE %[1]s ADD COLUMN parent TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE %[1]s ADD COLUMN policy TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE IF NOT EXISTS %[1]s_profiles (
+		id TEXT PRIMARY KEY,
+		profile TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS %[1]s_requests (
+		id TEXT PRIMARY KEY,
+		request TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS %[1]s_parent ON %[1]s (parent)`,
+}
+
+func (s *sqlDepot) migrationsTable() string { return s.tableName + "_migrations" }
+
+func (s *sqlDepot) migrate() error {
+	if _, err := s.db.ExecContext(s.ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (version INTEGER PRIMARY KEY)", s.migrationsTable())); err != nil {
+		return errors.Wrap(err, "problem creating migrations table")
+	}
+
+	var current sql.NullInt64
+	if err := s.db.QueryRowContext(s.ctx, fmt.Sprintf(
+		"SELECT MAX(version) FROM %s", s.migrationsTable())).Scan(&current); err != nil {
+		return errors.Wrap(err, "problem finding current schema version")
+	}
+
+	for version := int(current.Int64) + 1; version <= len(sqlMigrations); version++ {
+		if err := s.withTx(func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(s.ctx, fmt.Sprintf(sqlMigrations[version-1], s.tableName)); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(s.ctx, s.rebind(fmt.Sprintf(
+				"INSERT INTO %s (version) VALUES (?)", s.migrationsTable())), version)
+			return err
+		}); err != nil {
+			return errors.Wrapf(err, "problem applying migration %d", version)
+		}
+	}
+
+	return nil
+}
+
+// rebind replaces the '?' placeholders in the query with the placeholders
+// expected by the dialect.
+func (s *sqlDepot) rebind(query string) string {
+	if s.dialect != PostgresDialect {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *sqlDepot) withTx(fn func(*sql.Tx) error) error {
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "problem starting transaction")
+	}
+
+	if err = fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return errors.Wrap(tx.Commit(), "problem committing transaction")
+}
+
+// Put inserts the data into the row specified by the tag, creating the row if
+// it does not exist.
+func (s *sqlDepot) Put(tag *depot.Tag, data []byte) error {
+	if data == nil {
+		return errors.New("data is nil")
+	}
+
+	name, key, err := getNameAndKey(tag)
+	if err != nil {
+		return errors.Wrapf(err, "could not format name %s", name)
+	}
+	if key == "" {
+		return errors.Errorf("unrecognized tag for %s", name)
+	}
+
+	query := fmt.Sprintf("INSERT INTO %[1]s (id, %[2]s) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET %[2]s = excluded.%[2]s", s.tableName, key)
+	if _, err = s.db.ExecContext(s.ctx, s.rebind(query), name, string(data)); err != nil {
+		return errors.Wrap(err, "problem adding data to the database")
+	}
+
+	return nil
+}
+
+// Check returns whether the row and data specified by the tag exists.
+func (s *sqlDepot) Check(tag *depot.Tag) bool {
+	data, err := s.Get(tag)
+	return err == nil && len(data) != 0
+}
+
+// Get reads the data for the row specified by tag. Returns an error if the
+// row does not exist or if the data is empty.
+func (s *sqlDepot) Get(tag *depot.Tag) ([]byte, error) {
+	name, key, err := getNameAndKey(tag)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not format name %s", name)
+	}
+	if key == "" {
+		return nil, errors.Errorf("unrecognized tag for %s", name)
+	}
+
+	var data string
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", key, s.tableName)
+	if err = s.db.QueryRowContext(s.ctx, s.rebind(query), name).Scan(&data); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf("could not find %s in the database", name)
+		}
+		return nil, errors.Wrapf(err, "problem looking up %s in the database", name)
+	}
+
+	if len(data) == 0 {
+		return nil, errors.New("no data available")
+	}
+	return []byte(data), nil
+}
+
+// Delete removes the data from a row specified by the tag.
+func (s *sqlDepot) Delete(tag *depot.Tag) error {
+	name, key, err := getNameAndKey(tag)
+	if err != nil {
+		return errors.Wrapf(err, "could not format name %s", name)
+	}
+	if key == "" {
+		return errors.Errorf("unrecognized tag for %s", name)
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET %s = '' WHERE id = ?", s.tableName, key)
+	if _, err = s.db.ExecContext(s.ctx, s.rebind(query), name); err != nil {
+		return errors.Wrapf(err, "problem deleting %s.%s from the database", name, key)
+	}
+
+	return nil
+}
+
+// Save writes the credentials and their expiration for the given name in a
+// single transaction, replacing any existing credentials and certificate
+// request.
+func (s *sqlDepot) Save(name string, creds *Credentials) error {
+	crt, err := pkix.NewCertificateFromPEM(creds.Cert)
+	if err != nil {
+		return errors.Wrap(err, "could not get certificate from PEM bytes")
+	}
+	rawCrt, err := crt.GetRawCertificate()
+	if err != nil {
+		return errors.Wrap(err, "could not get x509 certificate")
+	}
+
+	formattedName := strings.Replace(name, " ", "_", -1)
+	query := fmt.Sprintf(`INSERT INTO %s (id, cert, private_key, cert_req, ttl) VALUES (?, ?, ?, '', ?)
+		ON CONFLICT (id) DO UPDATE SET cert = excluded.cert, private_key = excluded.private_key, cert_req = excluded.cert_req, ttl = excluded.ttl`, s.tableName)
+
+	return errors.Wrap(s.withTx(func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(s.ctx, s.rebind(query), formattedName, string(creds.Cert), string(creds.Key), rawCrt.NotAfter.UTC().UnixNano())
+		return err
+	}), "problem saving credentials")
+}
+
+func (s *sqlDepot) Find(name string) (*Credentials, error) { return depotFind(s, name, s.opts) }
+func (s *sqlDepot) Generate(name string) (*Credentials, error) {
+	return depotGenerate(s, name, s.opts)
+}
+
+// List returns the names of all rows that hold data of the given kind.
+func (s *sqlDepot) List(kind TagKind) ([]string, error) {
+	key, err := kind.userKey()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	query := fmt.Sprintf("SELECT id FROM %s WHERE %s != ''", s.tableName, key)
+	rows, err := s.db.QueryContext(s.ctx, query)
+	if err != nil {
+		return nil, errors.Wrapf(err, "problem listing %s entries", kind)
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, errors.Wrap(err, "problem decoding results")
+		}
+		names = append(names, name)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "problem decoding results")
+	}
+
+	return names, nil
+}
+
+// PutTTL sets the TTL to the given expiration time for the name. If the name is
+// not found in the database, this will error. The expiration must be within
+// the validity bounds of the certificate for the given name.
+func (s *sqlDepot) PutTTL(name string, expiration time.Time) error {
+	expiration = expiration.UTC()
+
+	minExpiration, maxExpiration, err := ValidityBounds(s, name)
+	if err != nil {
+		return errors.Wrap(err, "could not get certificate validity bounds")
+	}
+	if expiration.Before(minExpiration) || expiration.After(maxExpiration) {
+		return errors.Errorf("cannot set expiration to %s because it must be between %s and %s", expiration, minExpiration, maxExpiration)
+	}
+
+	formattedName := strings.Replace(name, " ", "_", -1)
+	query := fmt.Sprintf("UPDATE %s SET ttl = ? WHERE id = ?", s.tableName)
+	res, err := s.db.ExecContext(s.ctx, s.rebind(query), expiration.UnixNano(), formattedName)
+	if err != nil {
+		return errors.Wrap(err, "problem updating TTL in the database")
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errors.Errorf("update did not change TTL for user %s", name)
+	}
+
+	return nil
+}
+
+// GetTTL returns the TTL for the given name.
+func (s *sqlDepot) GetTTL(name string) (time.Time, error) {
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	var ttl sql.NullInt64
+	query := fmt.Sprintf("SELECT ttl FROM %s WHERE id = ?", s.tableName)
+	if err := s.db.QueryRowContext(s.ctx, s.rebind(query), formattedName).Scan(&ttl); err != nil {
+		return time.Time{}, errors.Wrap(err, "could not get TTL from database")
+	}
+
+	return nullTTL(ttl), nil
+}
+
+// PutParent records the name of the CA that issued the certificate with the
+// given name. If the name is not found in the database, this will error.
+func (s *sqlDepot) PutParent(name, parent string) error {
+	formattedName := strings.Replace(name, " ", "_", -1)
+	query := fmt.Sprintf("UPDATE %s SET parent = ? WHERE id = ?", s.tableName)
+	res, err := s.db.ExecContext(s.ctx, s.rebind(query), strings.Replace(parent, " ", "_", -1), formattedName)
+	if err != nil {
+		return errors.Wrap(err, "problem updating parent in the database")
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errors.Errorf("could not find %s in the database", name)
+	}
+
+	return nil
+}
+
+// GetParent returns the name of the CA that issued the certificate with the
+// given name.
+func (s *sqlDepot) GetParent(name string) (string, error) {
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	var parent string
+	query := fmt.Sprintf("SELECT parent FROM %s WHERE id = ?", s.tableName)
+	if err := s.db.QueryRowContext(s.ctx, s.rebind(query), formattedName).Scan(&parent); err != nil {
+		return "", errors.Wrap(err, "could not get parent from database")
+	}
+
+	return parent, nil
+}
+
+// HasChildren returns whether any certificate records the CA with the given
+// name as its parent.
+func (s *sqlDepot) HasChildren(name string) (bool, error) {
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	var id string
+	query := fmt.Sprintf("SELECT id FROM %s WHERE parent = ? LIMIT 1", s.tableName)
+	err := s.db.QueryRowContext(s.ctx, s.rebind(query), formattedName).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "could not find children in database")
+	}
+
+	return true, nil
+}
+
+// SwapRevocationList replaces the CRL of the CA with the given name if the
+// stored CRL is equal to prev.
+func (s *sqlDepot) SwapRevocationList(name string, prev, next []byte) (bool, error) {
+	if next == nil {
+		return false, errors.New("data is nil")
+	}
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	query := fmt.Sprintf("UPDATE %[1]s SET %[2]s = ? WHERE id = ? AND %[2]s = ?", s.tableName, userCertRevocListKey)
+	res, err := s.db.ExecContext(s.ctx, s.rebind(query), string(next), formattedName, string(prev))
+	if err != nil {
+		return false, errors.Wrap(err, "problem updating certificate revocation list in the database")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "problem checking updated certificate revocation list")
+	}
+
+	return n == 1, nil
+}
+
+// PutPolicy attaches the policy to the CA with the given name, which is stored
+// as JSON. If the name is not found in the database, this will error.
+func (s *sqlDepot) PutPolicy(name string, policy *Policy) error {
+	formattedName := strings.Replace(name, " ", "_", -1)
+	var data []byte
+	if policy != nil {
+		var err error
+		if data, err = json.Marshal(policy); err != nil {
+			return errors.Wrap(err, "problem encoding policy")
+		}
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET policy = ? WHERE id = ?", s.tableName)
+	res, err := s.db.ExecContext(s.ctx, s.rebind(query), string(data), formattedName)
+	if err != nil {
+		return errors.Wrap(err, "problem updating policy in the database")
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errors.Errorf("could not find %s in the database", name)
+	}
+
+	return nil
+}
+
+// GetPolicy returns the policy of the CA with the given name.
+func (s *sqlDepot) GetPolicy(name string) (*Policy, error) {
+	formattedName := strings.Replace(name, " ", "_", -1)
+
+	var data string
+	query := fmt.Sprintf("SELECT policy FROM %s WHERE id = ?", s.tableName)
+	if err := s.db.QueryRowContext(s.ctx, s.rebind(query), formattedName).Scan(&data); err != nil {
+		return nil, errors.Wrap(err, "could not get policy from database")
+	}
+
+	if data == "" {
+		return nil, nil
+	}
+	policy := &Policy{}
+	if err := json.Unmarshal([]byte(data), policy); err != nil {
+		return nil, errors.Wrapf(err, "problem decoding policy for %s", name)
+	}
+
+	return policy, nil
+}
+
+func (s *sqlDepot) profilesTable() string { return s.tableName + "_profiles" }
+
+// PutProfile stores the profile under the given name, encoded as JSON, in the
+// profiles table.
+func (s *sqlDepot) PutProfile(name string, profile *Profile) error {
+	if profile == nil {
+		query := fmt.Sprintf("DELETE FROM %s WHERE id = ?", s.profilesTable())
+		_, err := s.db.ExecContext(s.ctx, s.rebind(query), name)
+		return errors.Wrap(err, "problem deleting profile from the database")
+	}
+
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return errors.Wrap(err, "problem encoding profile")
+	}
+	query := fmt.Sprintf("INSERT INTO %s (id, profile) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET profile = excluded.profile", s.profilesTable())
+	_, err = s.db.ExecContext(s.ctx, s.rebind(query), name, string(data))
+	return errors.Wrap(err, "problem updating profile in the database")
+}
+
+// GetProfile returns the profile with the given name.
+func (s *sqlDepot) GetProfile(name string) (*Profile, error) {
+	var data string
+	query := fmt.Sprintf("SELECT profile FROM %s WHERE id = ?", s.profilesTable())
+	err := s.db.QueryRowContext(s.ctx, s.rebind(query), name).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get profile from database")
+	}
+
+	profile := &Profile{}
+	if err = json.Unmarshal([]byte(data), profile); err != nil {
+		return nil, errors.Wrapf(err, "problem decoding profile %s", name)
+	}
+
+	return profile, nil
+}
+
+// ListProfiles returns all profiles by name.
+func (s *sqlDepot) ListProfiles() (map[string]*Profile, error) {
+	rows, err := s.db.QueryContext(s.ctx, fmt.Sprintf("SELECT id, profile FROM %s", s.profilesTable()))
+	if err != nil {
+		return nil, errors.Wrap(err, "problem finding profiles")
+	}
+	defer rows.Close()
+
+	profiles := map[string]*Profile{}
+	for rows.Next() {
+		var name, data string
+		if err = rows.Scan(&name, &data); err != nil {
+			return nil, errors.Wrap(err, "problem reading profile")
+		}
+		profile := &Profile{}
+		if err = json.Unmarshal([]byte(data), profile); err != nil {
+			return nil, errors.Wrapf(err, "problem decoding profile %s", name)
+		}
+		profiles[name] = profile
+	}
+
+	return profiles, errors.Wrap(rows.Err(), "problem iterating profiles")
+}
+
+func (s *sqlDepot) requestsTable() string { return s.tableName + "_requests" }
+
+// PutPendingRequest inserts or replaces the pending request, encoded as JSON,
+// in the requests table.
+func (s *sqlDepot) PutPendingRequest(req *PendingRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrapf(err, "problem encoding pending request %s", req.ID)
+	}
+	query := fmt.Sprintf("INSERT INTO %s (id, request) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET request = excluded.request", s.requestsTable())
+	_, err = s.db.ExecContext(s.ctx, s.rebind(query), req.ID, string(data))
+	return errors.Wrap(err, "problem updating pending request in the database")
+}
+
+// SwapPendingRequest replaces the pending request if the stored request has
+// the given status. The request is only replaced if it is unchanged since it
+// was read, so concurrent swaps cannot both succeed.
+func (s *sqlDepot) SwapPendingRequest(req *PendingRequest, prev PendingRequestStatus) (bool, error) {
+	var currentData string
+	query := fmt.Sprintf("SELECT request FROM %s WHERE id = ?", s.requestsTable())
+	err := s.db.QueryRowContext(s.ctx, s.rebind(query), req.ID).Scan(&currentData)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "could not get pending request from database")
+	}
+	current := PendingRequest{}
+	if err = json.Unmarshal([]byte(currentData), &current); err != nil {
+		return false, errors.Wrapf(err, "problem decoding pending request %s", req.ID)
+	}
+	if current.Status != prev {
+		return false, nil
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return false, errors.Wrapf(err, "problem encoding pending request %s", req.ID)
+	}
+	query = fmt.Sprintf("UPDATE %s SET request = ? WHERE id = ? AND request = ?", s.requestsTable())
+	res, err := s.db.ExecContext(s.ctx, s.rebind(query), string(data), req.ID, currentData)
+	if err != nil {
+		return false, errors.Wrap(err, "problem updating pending request in the database")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "problem checking updated pending request")
+	}
+
+	return n == 1, nil
+}
+
+// GetPendingRequest returns the pending request with the given ID.
+func (s *sqlDepot) GetPendingRequest(id string) (*PendingRequest, error) {
+	var data string
+	query := fmt.Sprintf("SELECT request FROM %s WHERE id = ?", s.requestsTable())
+	err := s.db.QueryRowContext(s.ctx, s.rebind(query), id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get pending request from database")
+	}
+
+	req := &PendingRequest{}
+	if err = json.Unmarshal([]byte(data), req); err != nil {
+		return nil, errors.Wrapf(err, "problem decoding pending request %s", id)
+	}
+
+	return req, nil
+}
+
+// ListPendingRequests returns all pending requests.
+func (s *sqlDepot) ListPendingRequests() ([]PendingRequest, error) {
+	rows, err := s.db.QueryContext(s.ctx, fmt.Sprintf("SELECT id, request FROM %s", s.requestsTable()))
+	if err != nil {
+		return nil, errors.Wrap(err, "problem finding pending requests")
+	}
+	defer rows.Close()
+
+	reqs := []PendingRequest{}
+	for rows.Next() {
+		var id, data string
+		if err = rows.Scan(&id, &data); err != nil {
+			return nil, errors.Wrap(err, "problem reading pending request")
+		}
+		req := PendingRequest{}
+		if err = json.Unmarshal([]byte(data), &req); err != nil {
+			return nil, errors.Wrapf(err, "problem decoding pending request %s", id)
+		}
+		reqs = append(reqs, req)
+	}
+
+	return reqs, errors.Wrap(rows.Err(), "problem iterating pending requests")
+}
+
+// FindExpiresBefore finds all Users that expire before the given cutoff time.
+func (s *sqlDepot) FindExpiresBefore(cutoff time.Time) ([]User, error) {
+	query := fmt.Sprintf("SELECT id, cert, private_key, cert_req, cert_revoc_list, ttl, parent FROM %s WHERE ttl IS NOT NULL AND ttl <= ?", s.tableName)
+	rows, err := s.db.QueryContext(s.ctx, s.rebind(query), cutoff.UTC().UnixNano())
+	if err != nil {
+		return nil, errors.Wrap(err, "problem finding expired users")
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var u User
+		var ttl sql.NullInt64
+		if err = rows.Scan(&u.ID, &u.Cert, &u.PrivateKey, &u.CertReq, &u.CertRevocList, &ttl, &u.Parent); err != nil {
+			return nil, errors.Wrap(err, "problem decoding results")
+		}
+		u.TTL = nullTTL(ttl)
+		users = append(users, u)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "problem decoding results")
+	}
+
+	return users, nil
+}
+
+// DeleteExpiresBefore removes all Users that expire before the given cutoff
+// time.
+func (s *sqlDepot) DeleteExpiresBefore(cutoff time.Time) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE ttl IS NOT NULL AND ttl <= ?", s.tableName)
+	if _, err := s.db.ExecContext(s.ctx, s.rebind(query), cutoff.UTC().UnixNano()); err != nil {
+		return errors.Wrap(err, "problem removing expired users")
+	}
+	return nil
+}
+
+func nullTTL(ttl sql.NullInt64) time.Time {
+	if !ttl.Valid {
+		return time.Time{}
+	}
+	return time.Unix(0, ttl.Int64).UTC()
+}
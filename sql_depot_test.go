@@ -0,0 +1,259 @@
+package certdepot
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/square/certstrap/depot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func TestSQLDepot(t *testing.T) {
+	const (
+		caName      = "ca"
+		serviceName = "localhost"
+	)
+
+	insertUser := func(t *testing.T, sd *sqlDepot, u *User) {
+		var ttl sql.NullInt64
+		if !u.TTL.IsZero() {
+			ttl = sql.NullInt64{Int64: u.TTL.UnixNano(), Valid: true}
+		}
+		_, err := sd.db.Exec(fmt.Sprintf("INSERT INTO %s (id, cert, ttl) VALUES (?, ?, ?)", sd.tableName), u.ID, u.Cert, ttl)
+		require.NoError(t, err)
+	}
+
+	for testName, testCase := range map[string]func(t *testing.T, path string, sd *sqlDepot){
+		"PutTTLSetsValueOnExistingUser": func(t *testing.T, _ string, sd *sqlDepot) {
+			const name = "foo"
+			opts := &CertificateOptions{
+				CA:         caName,
+				CommonName: name,
+				Host:       name,
+				Expires:    24 * time.Hour,
+			}
+			require.NoError(t, opts.CreateCertificate(sd))
+
+			ttl, err := sd.GetTTL(name)
+			require.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(opts.Expires), ttl, time.Minute)
+		},
+		"PutTTLDoesNotInsert": func(t *testing.T, _ string, sd *sqlDepot) {
+			const name = "user"
+			require.Error(t, sd.PutTTL(name, time.Now()))
+			_, err := sd.GetTTL(name)
+			assert.Error(t, err)
+		},
+		"PutParentSetsValueOnExistingUser": func(t *testing.T, _ string, sd *sqlDepot) {
+			const name = "foo"
+			require.NoError(t, (&CertificateOptions{
+				CA:         caName,
+				CommonName: name,
+				Host:       name,
+				Expires:    24 * time.Hour,
+			}).CreateCertificate(sd))
+
+			parent, err := sd.GetParent(name)
+			require.NoError(t, err)
+			assert.Equal(t, caName, parent)
+
+			require.NoError(t, sd.PutParent(name, ""))
+			parent, err = sd.GetParent(name)
+			require.NoError(t, err)
+			assert.Empty(t, parent)
+		},
+		"HasChildrenFindsRecordedParent": func(t *testing.T, _ string, sd *sqlDepot) {
+			hasChildren, err := sd.HasChildren(caName)
+			require.NoError(t, err)
+			assert.True(t, hasChildren)
+			hasChildren, err = sd.HasChildren(serviceName)
+			require.NoError(t, err)
+			assert.False(t, hasChildren)
+
+			require.NoError(t, sd.PutParent(serviceName, ""))
+			hasChildren, err = sd.HasChildren(caName)
+			require.NoError(t, err)
+			assert.False(t, hasChildren)
+		},
+		"PutParentDoesNotInsert": func(t *testing.T, _ string, sd *sqlDepot) {
+			const name = "user"
+			require.Error(t, sd.PutParent(name, caName))
+			_, err := sd.GetParent(name)
+			assert.Error(t, err)
+		},
+		"PutPolicySetsValueOnExistingUser": func(t *testing.T, _ string, sd *sqlDepot) {
+			policy, err := sd.GetPolicy(caName)
+			require.NoError(t, err)
+			assert.Nil(t, policy)
+
+			expected := &Policy{AllowedNames: []string{"*.example.com"}, MaxLifetime: time.Hour}
+			require.NoError(t, sd.PutPolicy(caName, expected))
+			policy, err = sd.GetPolicy(caName)
+			require.NoError(t, err)
+			assert.Equal(t, expected, policy)
+
+			require.NoError(t, sd.PutPolicy(caName, nil))
+			policy, err = sd.GetPolicy(caName)
+			require.NoError(t, err)
+			assert.Nil(t, policy)
+		},
+		"PutPolicyDoesNotInsert": func(t *testing.T, _ string, sd *sqlDepot) {
+			const name = "user"
+			require.Error(t, sd.PutPolicy(name, &Policy{}))
+			_, err := sd.GetPolicy(name)
+			assert.Error(t, err)
+		},
+		"GetTTLFailsForNonexistentUser": func(t *testing.T, _ string, sd *sqlDepot) {
+			_, err := sd.GetTTL("nonexistent")
+			assert.Error(t, err)
+		},
+		"FindExpiresBeforeMatchesExpired": func(t *testing.T, _ string, sd *sqlDepot) {
+			ttl := time.Now()
+			expiration := ttl.Add(time.Hour)
+			insertUser(t, sd, &User{ID: "user1", TTL: ttl})
+			insertUser(t, sd, &User{ID: "user2", TTL: expiration.Add(time.Hour)})
+			insertUser(t, sd, &User{ID: "user3", Cert: "cert"})
+
+			users, err := sd.FindExpiresBefore(expiration)
+			require.NoError(t, err)
+			require.Len(t, users, 1)
+			assert.Equal(t, "user1", users[0].ID)
+			assert.True(t, ttl.Equal(users[0].TTL))
+		},
+		"DeleteExpiresBeforeRemovesExpired": func(t *testing.T, _ string, sd *sqlDepot) {
+			ttl := time.Now()
+			expiration := ttl.Add(time.Hour)
+			insertUser(t, sd, &User{ID: "user1", Cert: "cert", TTL: ttl})
+			insertUser(t, sd, &User{ID: "user2", Cert: "cert", TTL: expiration.Add(time.Hour)})
+			insertUser(t, sd, &User{ID: "user3", Cert: "cert"})
+
+			require.NoError(t, sd.DeleteExpiresBefore(expiration))
+			assert.False(t, sd.Check(depot.CrtTag("user1")))
+			assert.True(t, sd.Check(depot.CrtTag("user2")))
+			assert.True(t, sd.Check(depot.CrtTag("user3")))
+		},
+		"SaveReplacesCertificateRequest": func(t *testing.T, _ string, sd *sqlDepot) {
+			const name = "saved"
+			sd.opts = DepotOptions{CA: caName, DefaultExpiration: time.Hour}
+			require.NoError(t, sd.Put(depot.CsrTag(name), []byte("csr")))
+
+			creds, err := sd.Generate(name)
+			require.NoError(t, err)
+			require.NoError(t, sd.Save(name, creds))
+			assert.False(t, sd.Check(depot.CsrTag(name)))
+
+			found, err := sd.Find(name)
+			require.NoError(t, err)
+			assert.Equal(t, creds.Cert, found.Cert)
+			assert.Equal(t, creds.Key, found.Key)
+		},
+		"SavePersistsAcrossReopen": func(t *testing.T, path string, sd *sqlDepot) {
+			const name = "saved"
+			sd.opts = DepotOptions{CA: caName, DefaultExpiration: time.Hour}
+			creds, err := sd.Generate(name)
+			require.NoError(t, err)
+			require.NoError(t, sd.Save(name, creds))
+			require.NoError(t, sd.Close())
+
+			d, err := NewSQLCertDepot(context.Background(), &SQLDepotOptions{
+				DriverName:     "sqlite",
+				DataSourceName: path,
+				DepotOptions:   DepotOptions{CA: caName},
+			})
+			require.NoError(t, err)
+			reopened := d.(*sqlDepot)
+			defer func() {
+				assert.NoError(t, reopened.Close())
+			}()
+
+			found, err := reopened.Find(name)
+			require.NoError(t, err)
+			assert.Equal(t, creds.Cert, found.Cert)
+			assert.Equal(t, creds.Key, found.Key)
+
+			ttl, err := reopened.GetTTL(name)
+			require.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(time.Hour), ttl, time.Minute)
+
+			var version int
+			require.NoError(t, reopened.db.QueryRow(fmt.Sprintf("SELECT MAX(version) FROM %s", reopened.migrationsTable())).Scan(&version))
+			assert.Equal(t, len(sqlMigrations), version)
+		},
+		"CloseDoesNotCloseProvidedDatabase": func(t *testing.T, path string, sd *sqlDepot) {
+			require.NoError(t, sd.Close())
+			db, err := sql.Open("sqlite", path)
+			require.NoError(t, err)
+			defer func() {
+				assert.NoError(t, db.Close())
+			}()
+
+			d, err := NewSQLCertDepotWithDB(context.Background(), db, &SQLDepotOptions{Dialect: SQLiteDialect})
+			require.NoError(t, err)
+			require.NoError(t, d.(*sqlDepot).Close())
+			assert.True(t, d.Check(depot.CrtTag(caName)))
+		},
+		"RebindUsesDialectPlaceholders": func(t *testing.T, _ string, sd *sqlDepot) {
+			query := "SELECT id FROM certs WHERE id = ? AND ttl <= ?"
+			assert.Equal(t, query, sd.rebind(query))
+
+			pg := &sqlDepot{dialect: PostgresDialect}
+			assert.Equal(t, "SELECT id FROM certs WHERE id = $1 AND ttl <= $2", pg.rebind(query))
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			tempDir, err := ioutil.TempDir(".", "sql-test")
+			require.NoError(t, err)
+			defer func() {
+				assert.NoError(t, os.RemoveAll(tempDir))
+			}()
+			path := filepath.Join(tempDir, "certs.db")
+
+			d, err := BootstrapDepot(context.Background(), BootstrapDepotConfig{
+				SQLDepot: &SQLDepotOptions{
+					DriverName:     "sqlite",
+					DataSourceName: path,
+				},
+				CAName:      caName,
+				ServiceName: serviceName,
+				CAOpts: &CertificateOptions{
+					CommonName: caName,
+					Expires:    24 * time.Hour,
+				},
+				ServiceOpts: &CertificateOptions{
+					CA:         caName,
+					CommonName: serviceName,
+					Host:       serviceName,
+					Expires:    24 * time.Hour,
+				},
+			})
+			require.NoError(t, err)
+			sd, ok := d.(*sqlDepot)
+			require.True(t, ok)
+			defer sd.Close()
+
+			testCase(t, path, sd)
+		})
+	}
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		for name, opts := range map[string]SQLDepotOptions{
+			"UnknownDriver":  {DriverName: "unknown", DataSourceName: "db"},
+			"UnknownDialect": {DriverName: "sqlite", DataSourceName: "db", Dialect: "oracle"},
+			"InjectedTable":  {DriverName: "sqlite", DataSourceName: "db", TableName: "certs; DROP TABLE certs"},
+			"QuotedTable":    {DriverName: "sqlite", DataSourceName: "db", TableName: `"certs"`},
+			"NumericTable":   {DriverName: "sqlite", DataSourceName: "db", TableName: "1certs"},
+		} {
+			t.Run(name, func(t *testing.T) {
+				assert.Error(t, opts.validate())
+			})
+		}
+	})
+}
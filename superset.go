@@ -1,7 +1,10 @@
 package certdepot
 
 import (
+	"sort"
+
 	"github.com/cdr/grip"
+	"github.com/cdr/grip/message"
 	"github.com/pkg/errors"
 	"github.com/square/certstrap/depot"
 	"github.com/square/certstrap/pkix"
@@ -51,11 +54,11 @@ func depotGenerate(dpt Depot, name string, do DepotOptions) (*Credentials, error
 		CommonName: name,
 		Host:       name,
 		Expires:    do.DefaultExpiration,
+		KeyType:    do.KeyType,
+		Profile:    do.Profile,
 	}
-
-	pemCACrt, err := dpt.Get(CrtTag(do.CA))
-	if err != nil {
-		return nil, errors.Wrap(err, "problem getting CA certificate")
+	if err := opts.ApplyProfile(dpt); err != nil {
+		return nil, errors.Wrap(err, "problem applying profile")
 	}
 
 	_, key, err := opts.CertRequestInMemory()
@@ -63,7 +66,7 @@ func depotGenerate(dpt Depot, name string, do DepotOptions) (*Credentials, error
 		return nil, errors.Wrap(err, "problem making certificate request and key")
 	}
 
-	pemKey, err := key.ExportPrivate()
+	pemKey, err := exportPrivateKey(key)
 	if err != nil {
 		return nil, errors.Wrap(err, "problem exporting key")
 	}
@@ -78,24 +81,48 @@ func depotGenerate(dpt Depot, name string, do DepotOptions) (*Credentials, error
 		return nil, errors.Wrap(err, "problem exporting certificate")
 	}
 
-	creds, err := NewCredentials(pemCACrt, pemCrt, pemKey)
+	chain, root, err := depotChain(dpt, pemCrt, opts.CA)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem building certificate chain")
+	}
+
+	creds, err := NewCredentials(root, pemCrt, pemKey)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create credentials")
 	}
+	creds.Chain = chain
 	creds.ServerName = name
 
 	return creds, nil
 }
 
 func depotFind(dpt depot.Depot, name string, do DepotOptions) (*Credentials, error) {
-	caCrt, err := dpt.Get(CrtTag(do.CA))
+	crt, err := dpt.Get(CrtTag(name))
 	if err != nil {
-		return nil, errors.Wrap(err, "problem getting CA certificate")
+		return nil, errors.Wrap(err, "problem getting certificate")
 	}
 
-	crt, err := dpt.Get(CrtTag(name))
+	issuer, err := getParent(dpt, name)
 	if err != nil {
-		return nil, errors.Wrap(err, "problem getting certificate")
+		return nil, errors.Wrap(err, "problem getting issuer of certificate")
+	}
+	if issuer == "" {
+		issuer = do.CA
+	}
+	chain, root, err := depotChain(dpt, crt, issuer)
+	if err != nil {
+		// The recorded issuer may be wrong while the default CA did issue
+		// the certificate, so fall back to it, but only if it verifies.
+		var fallbackErr error
+		chain, root, fallbackErr = defaultCAChain(dpt, crt, do.CA)
+		if fallbackErr != nil {
+			return nil, errors.Wrap(err, "problem building certificate chain")
+		}
+		grip.Warning(message.WrapError(err, message.Fields{
+			"message": "problem building certificate chain, falling back to the default CA",
+			"name":    name,
+			"ca":      do.CA,
+		}))
 	}
 
 	key, err := dpt.Get(PrivKeyTag(name))
@@ -103,11 +130,55 @@ func depotFind(dpt depot.Depot, name string, do DepotOptions) (*Credentials, err
 		return nil, errors.Wrap(err, "problem getting key")
 	}
 
-	creds, err := NewCredentials(caCrt, crt, key)
+	creds, err := NewCredentials(root, crt, key)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create credentials")
 	}
+	creds.Chain = chain
 	creds.ServerName = name
 
 	return creds, nil
 }
+
+// ListNames returns the sorted names of all entries of the given kind in the
+// depot. The depot must implement Lister. Versions archived by Renew under
+// ArchiveName are skipped, so they are not listed, copied or backed up.
+func ListNames(dpt depot.Depot, kind TagKind) ([]string, error) {
+	if err := kind.Validate(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	lister, ok := dpt.(Lister)
+	if !ok {
+		return nil, errors.New("depot does not support listing")
+	}
+
+	all, err := lister.List(kind)
+	if err != nil {
+		return nil, errors.Wrapf(err, "problem listing %s entries", kind)
+	}
+	names := make([]string, 0, len(all))
+	for _, name := range all {
+		if !isArchiveName(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func userHasKind(u *User, key string) bool {
+	switch key {
+	case userCertKey:
+		return u.Cert != ""
+	case userPrivateKeyKey:
+		return u.PrivateKey != ""
+	case userCertReqKey:
+		return u.CertReq != ""
+	case userCertRevocListKey:
+		return u.CertRevocList != ""
+	default:
+		return false
+	}
+}
@@ -0,0 +1,176 @@
+package certdepot
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+
+	"github.com/cdr/grip"
+	"github.com/pkg/errors"
+)
+
+// ExtKeyUsage is a purpose for which a certificate may be used, which is set
+// in the extended key usage extension of the certificate.
+type ExtKeyUsage string
+
+const (
+	// ExtKeyUsageServerAuth allows the certificate to authenticate a TLS
+	// server.
+	ExtKeyUsageServerAuth ExtKeyUsage = "serverAuth"
+	// ExtKeyUsageClientAuth allows the certificate to authenticate a TLS
+	// client.
+	ExtKeyUsageClientAuth ExtKeyUsage = "clientAuth"
+	// ExtKeyUsageCodeSigning allows the certificate to sign code.
+	ExtKeyUsageCodeSigning ExtKeyUsage = "codeSigning"
+	// ExtKeyUsageEmailProtection allows the certificate to sign and encrypt
+	// email.
+	ExtKeyUsageEmailProtection ExtKeyUsage = "emailProtection"
+	// ExtKeyUsageOCSPSigning allows the certificate to sign OCSP responses
+	// on behalf of its issuer.
+	ExtKeyUsageOCSPSigning ExtKeyUsage = "OCSPSigning"
+)
+
+// Validate checks that the extended key usage is supported.
+func (u ExtKeyUsage) Validate() error {
+	if _, ok := extKeyUsages[u]; !ok {
+		return errors.Errorf("unsupported extended key usage '%s'", u)
+	}
+	return nil
+}
+
+var extKeyUsages = map[ExtKeyUsage]x509.ExtKeyUsage{
+	ExtKeyUsageServerAuth:      x509.ExtKeyUsageServerAuth,
+	ExtKeyUsageClientAuth:      x509.ExtKeyUsageClientAuth,
+	ExtKeyUsageCodeSigning:     x509.ExtKeyUsageCodeSigning,
+	ExtKeyUsageEmailProtection: x509.ExtKeyUsageEmailProtection,
+	ExtKeyUsageOCSPSigning:     x509.ExtKeyUsageOCSPSigning,
+}
+
+// KeyUsage is an operation that the key of a certificate may be used for,
+// which is set in the key usage extension of the certificate. Usages that are
+// reserved for CAs cannot be requested.
+type KeyUsage string
+
+const (
+	// KeyUsageDigitalSignature allows the key to verify digital signatures,
+	// such as those made during a TLS handshake.
+	KeyUsageDigitalSignature KeyUsage = "digitalSignature"
+	// KeyUsageContentCommitment allows the key to verify signatures that
+	// protect against the signer denying an action.
+	KeyUsageContentCommitment KeyUsage = "contentCommitment"
+	// KeyUsageKeyEncipherment allows the key to encrypt other keys, as in
+	// TLS RSA key exchange. It is only valid for RSA keys.
+	KeyUsageKeyEncipherment KeyUsage = "keyEncipherment"
+	// KeyUsageDataEncipherment allows the key to encrypt data directly. It
+	// is only valid for RSA keys.
+	KeyUsageDataEncipherment KeyUsage = "dataEncipherment"
+	// KeyUsageKeyAgreement allows the key to be used for key agreement.
+	KeyUsageKeyAgreement KeyUsage = "keyAgreement"
+)
+
+// Validate checks that the key usage is supported.
+func (u KeyUsage) Validate() error {
+	if _, ok := keyUsages[u]; !ok {
+		return errors.Errorf("unsupported key usage '%s'", u)
+	}
+	return nil
+}
+
+var keyUsages = map[KeyUsage]x509.KeyUsage{
+	KeyUsageDigitalSignature:  x509.KeyUsageDigitalSignature,
+	KeyUsageContentCommitment: x509.KeyUsageContentCommitment,
+	KeyUsageKeyEncipherment:   x509.KeyUsageKeyEncipherment,
+	KeyUsageDataEncipherment:  x509.KeyUsageDataEncipherment,
+	KeyUsageKeyAgreement:      x509.KeyUsageKeyAgreement,
+}
+
+// compatibleKeyUsages are the key usages that are consistent with each
+// extended key usage, as described in RFC 5280. At least one of them must be
+// set if the key usages are given explicitly.
+var compatibleKeyUsages = map[x509.ExtKeyUsage]x509.KeyUsage{
+	x509.ExtKeyUsageServerAuth:      x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement,
+	x509.ExtKeyUsageClientAuth:      x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement,
+	x509.ExtKeyUsageCodeSigning:     x509.KeyUsageDigitalSignature,
+	x509.ExtKeyUsageEmailProtection: x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment | x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement,
+	x509.ExtKeyUsageOCSPSigning:     x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment,
+}
+
+// defaultHostKeyUsage and defaultHostExtKeyUsage are used for certificates
+// that do not specify their usages, which may be used both as a TLS server and
+// as a TLS client.
+var (
+	defaultHostKeyUsage    = x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement
+	defaultHostExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+)
+
+// resolveUsages returns the key usage and extended key usages of a certificate
+// for the public key, defaulting to those of a certificate that can be used
+// both as a TLS server and as a TLS client. It returns an error if the usages
+// are not supported or are inconsistent with each other or with the key.
+func resolveUsages(keyUsage []KeyUsage, extKeyUsage []ExtKeyUsage, pub interface{}) (x509.KeyUsage, []x509.ExtKeyUsage, error) {
+	catcher := grip.NewBasicCatcher()
+
+	var usage x509.KeyUsage
+	for _, u := range keyUsage {
+		if err := u.Validate(); err != nil {
+			catcher.Add(err)
+			continue
+		}
+		usage |= keyUsages[u]
+	}
+	var extUsage []x509.ExtKeyUsage
+	for _, u := range extKeyUsage {
+		if err := u.Validate(); err != nil {
+			catcher.Add(err)
+			continue
+		}
+		extUsage = append(extUsage, extKeyUsages[u])
+	}
+	if catcher.HasErrors() {
+		return 0, nil, catcher.Resolve()
+	}
+
+	if len(extUsage) == 0 {
+		extUsage = defaultHostExtKeyUsage
+	}
+	if usage == 0 {
+		return defaultHostKeyUsage, extUsage, nil
+	}
+
+	if _, isRSA := pub.(*rsa.PublicKey); !isRSA {
+		catcher.NewWhen(usage&x509.KeyUsageKeyEncipherment != 0, "key encipherment requires an RSA key")
+		catcher.NewWhen(usage&x509.KeyUsageDataEncipherment != 0, "data encipherment requires an RSA key")
+	}
+	for _, u := range extUsage {
+		catcher.ErrorfWhen(usage&compatibleKeyUsages[u] == 0, "key usages are not compatible with extended key usage '%s'", extKeyUsageName(u))
+	}
+	if catcher.HasErrors() {
+		return 0, nil, catcher.Resolve()
+	}
+
+	return usage, extUsage, nil
+}
+
+// hasExtKeyUsage returns whether the certificate may be used for the given
+// purpose. As in crypto/x509, a certificate without extended key usages may
+// be used for any purpose.
+func hasExtKeyUsage(crt *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	if len(crt.ExtKeyUsage) == 0 {
+		return true
+	}
+	for _, u := range crt.ExtKeyUsage {
+		if u == usage || u == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+// extKeyUsageName returns the name of the extended key usage.
+func extKeyUsageName(usage x509.ExtKeyUsage) string {
+	for name, u := range extKeyUsages {
+		if u == usage {
+			return string(name)
+		}
+	}
+	return "unknown purpose"
+}
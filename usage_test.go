@@ -0,0 +1,104 @@
+package certdepot
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsages(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	t.Run("Validate", func(t *testing.T) {
+		for _, u := range []ExtKeyUsage{ExtKeyUsageServerAuth, ExtKeyUsageClientAuth, ExtKeyUsageCodeSigning, ExtKeyUsageEmailProtection, ExtKeyUsageOCSPSigning} {
+			assert.NoError(t, u.Validate())
+		}
+		assert.Error(t, ExtKeyUsage("").Validate())
+		assert.Error(t, ExtKeyUsage("any").Validate())
+		for _, u := range []KeyUsage{KeyUsageDigitalSignature, KeyUsageContentCommitment, KeyUsageKeyEncipherment, KeyUsageDataEncipherment, KeyUsageKeyAgreement} {
+			assert.NoError(t, u.Validate())
+		}
+		assert.Error(t, KeyUsage("").Validate())
+		assert.Error(t, KeyUsage("crlSign").Validate())
+	})
+	t.Run("Resolve", func(t *testing.T) {
+		for testName, testCase := range map[string]struct {
+			keyUsage            []KeyUsage
+			extKeyUsage         []ExtKeyUsage
+			pub                 interface{}
+			expectedKeyUsage    x509.KeyUsage
+			expectedExtKeyUsage []x509.ExtKeyUsage
+			hasErr              bool
+		}{
+			"DefaultsToServerAndClient": {
+				pub:                 ecdsaKey.Public(),
+				expectedKeyUsage:    defaultHostKeyUsage,
+				expectedExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			},
+			"DualUse": {
+				keyUsage:            []KeyUsage{KeyUsageDigitalSignature},
+				extKeyUsage:         []ExtKeyUsage{ExtKeyUsageServerAuth, ExtKeyUsageClientAuth},
+				pub:                 ecdsaKey.Public(),
+				expectedKeyUsage:    x509.KeyUsageDigitalSignature,
+				expectedExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			},
+			"KeyEnciphermentWithRSAKey": {
+				keyUsage:            []KeyUsage{KeyUsageKeyEncipherment},
+				extKeyUsage:         []ExtKeyUsage{ExtKeyUsageServerAuth},
+				pub:                 rsaKey.Public(),
+				expectedKeyUsage:    x509.KeyUsageKeyEncipherment,
+				expectedExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			},
+			"KeyEnciphermentWithECDSAKey": {
+				keyUsage:    []KeyUsage{KeyUsageDigitalSignature, KeyUsageKeyEncipherment},
+				extKeyUsage: []ExtKeyUsage{ExtKeyUsageServerAuth},
+				pub:         ecdsaKey.Public(),
+				hasErr:      true,
+			},
+			"KeyUsageIncompatibleWithClientAuth": {
+				keyUsage:    []KeyUsage{KeyUsageKeyEncipherment},
+				extKeyUsage: []ExtKeyUsage{ExtKeyUsageClientAuth},
+				pub:         rsaKey.Public(),
+				hasErr:      true,
+			},
+			"KeyUsageIncompatibleWithDefaultExtKeyUsage": {
+				keyUsage: []KeyUsage{KeyUsageContentCommitment},
+				pub:      rsaKey.Public(),
+				hasErr:   true,
+			},
+			"UnsupportedUsages": {
+				keyUsage:    []KeyUsage{"certSign"},
+				extKeyUsage: []ExtKeyUsage{"any"},
+				pub:         rsaKey.Public(),
+				hasErr:      true,
+			},
+		} {
+			t.Run(testName, func(t *testing.T) {
+				keyUsage, extKeyUsage, err := resolveUsages(testCase.keyUsage, testCase.extKeyUsage, testCase.pub)
+				if testCase.hasErr {
+					assert.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+				assert.Equal(t, testCase.expectedKeyUsage, keyUsage)
+				assert.Equal(t, testCase.expectedExtKeyUsage, extKeyUsage)
+			})
+		}
+	})
+	t.Run("HasExtKeyUsage", func(t *testing.T) {
+		assert.True(t, hasExtKeyUsage(&x509.Certificate{}, x509.ExtKeyUsageServerAuth))
+		assert.True(t, hasExtKeyUsage(&x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}, x509.ExtKeyUsageClientAuth))
+		serverOnly := &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+		assert.True(t, hasExtKeyUsage(serverOnly, x509.ExtKeyUsageServerAuth))
+		assert.False(t, hasExtKeyUsage(serverOnly, x509.ExtKeyUsageClientAuth))
+	})
+}